@@ -7,6 +7,7 @@ package daemon
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 )
@@ -47,17 +48,162 @@ type Config struct {
 		Acme  bool   `envconfig:"DRONE_SERVER_ACME"`
 	}
 
+	API struct {
+		CACert string `envconfig:"DRONE_API_CA_CERT"`
+	}
+
 	Keypair struct {
-		Public  string `envconfig:"DRONE_PUBLIC_KEY_FILE"`
-		Private string `envconfig:"DRONE_PRIVATE_KEY_FILE"`
+		Public  string        `envconfig:"DRONE_PUBLIC_KEY_FILE"`
+		Private string        `envconfig:"DRONE_PRIVATE_KEY_FILE"`
+		Lookup  bool          `envconfig:"DRONE_PUBLIC_KEY_LOOKUP"`
+		Skip    bool          `envconfig:"DRONE_PUBLIC_KEY_SKIP_REGISTRATION"`
+		TTL     time.Duration `envconfig:"DRONE_PUBLIC_KEY_CACHE_TTL"`
+		Origin  bool          `envconfig:"DRONE_PUBLIC_KEY_ORIGIN"`
 	}
 
 	Runner struct {
-		Name     string            `envconfig:"DRONE_RUNNER_NAME"`
-		Capacity int               `envconfig:"DRONE_RUNNER_CAPACITY" default:"10"`
-		Procs    int64             `envconfig:"DRONE_RUNNER_MAX_PROCS"`
-		Labels   map[string]string `envconfig:"DRONE_RUNNER_LABELS"`
-		Environ  map[string]string `envconfig:"DRONE_RUNNER_ENVIRON"`
+		Name       string            `envconfig:"DRONE_RUNNER_NAME"`
+		Capacity   int               `envconfig:"DRONE_RUNNER_CAPACITY" default:"10"`
+		Procs      int64             `envconfig:"DRONE_RUNNER_MAX_PROCS"`
+		Provisions int               `envconfig:"DRONE_RUNNER_MAX_PROVISIONS"`
+		Labels     map[string]string `envconfig:"DRONE_RUNNER_LABELS"`
+		Environ    map[string]string `envconfig:"DRONE_RUNNER_ENVIRON"`
+	}
+
+	Image struct {
+		Users map[string]string `envconfig:"DRONE_IMAGE_USERS"`
+	}
+
+	Output struct {
+		Limit      int64             `envconfig:"DRONE_OUTPUT_LIMIT"`
+		LimitFail  bool              `envconfig:"DRONE_OUTPUT_LIMIT_FAIL"`
+		Script     bool              `envconfig:"DRONE_OUTPUT_SCRIPT"`
+		Tail       int               `envconfig:"DRONE_OUTPUT_TAIL_LINES"`
+		Newlines   bool              `envconfig:"DRONE_OUTPUT_NORMALIZE_NEWLINES"`
+		Sanitize   bool              `envconfig:"DRONE_OUTPUT_SANITIZE_UTF8"`
+		Prefix     bool              `envconfig:"DRONE_OUTPUT_PREFIX"`
+		Trailer    string            `envconfig:"DRONE_OUTPUT_STEP_TRAILER"`
+		Scan       bool              `envconfig:"DRONE_OUTPUT_SCAN"`
+		Signatures map[string]string `envconfig:"DRONE_OUTPUT_SIGNATURES"`
+		Buffer     int               `envconfig:"DRONE_OUTPUT_BUFFER_SIZE"`
+		Flush      time.Duration     `envconfig:"DRONE_OUTPUT_FLUSH_INTERVAL"`
+		Redact     string            `envconfig:"DRONE_OUTPUT_REDACT_FILE"`
+	}
+
+	SSH struct {
+		MaxSessions int           `envconfig:"DRONE_SSH_MAX_SESSIONS"`
+		NoRetry     []string      `envconfig:"DRONE_SSH_NO_RETRY"`
+		Handshake   time.Duration `envconfig:"DRONE_SSH_HANDSHAKE_TIMEOUT"`
+		Rekey       uint64        `envconfig:"DRONE_SSH_REKEY_THRESHOLD"`
+		RouteProbe  bool          `envconfig:"DRONE_SSH_ROUTE_PROBE"`
+		Fallback    bool          `envconfig:"DRONE_SSH_PRIVATE_FALLBACK"`
+		Prefer      string        `envconfig:"DRONE_SSH_PREFER_ADDRESS"`
+		ExitCode    int           `envconfig:"DRONE_SSH_TRANSPORT_EXIT_CODE"`
+		HostKey     string        `envconfig:"DRONE_SSH_HOST_KEY_COMMAND"`
+		Insecure    bool          `envconfig:"DRONE_SSH_INSECURE_IGNORE_HOST_KEY"`
+		HostKeyAlgs []string      `envconfig:"DRONE_SSH_HOST_KEY_ALGORITHMS"`
+		BackupKeys  []string      `envconfig:"DRONE_SSH_BACKUP_KEY_FILES"`
+		Identities  bool          `envconfig:"DRONE_SSH_IDENTITIES_ONLY"`
+		SendEnv     []string      `envconfig:"DRONE_SSH_SEND_ENV"`
+		Reuse       bool          `envconfig:"DRONE_SSH_REUSE_CONNECTIONS"`
+		Liveness    time.Duration `envconfig:"DRONE_SSH_LIVENESS_TIMEOUT"`
+	}
+
+	Upload struct {
+		Rate     int64 `envconfig:"DRONE_UPLOAD_RATE"`
+		Compress bool  `envconfig:"DRONE_UPLOAD_COMPRESS"`
+		SCP      bool  `envconfig:"DRONE_UPLOAD_SCP"`
+		Packet   int   `envconfig:"DRONE_UPLOAD_SFTP_MAX_PACKET"`
+		Requests int   `envconfig:"DRONE_UPLOAD_SFTP_CONCURRENCY"`
+		Retries  int   `envconfig:"DRONE_UPLOAD_RETRIES"`
+		Verify   bool  `envconfig:"DRONE_UPLOAD_VERIFY_MODE"`
+	}
+
+	Environ struct {
+		Allow []string `envconfig:"DRONE_ENV_ALLOW"`
+		Deny  []string `envconfig:"DRONE_ENV_DENY"`
+	}
+
+	Monitoring struct {
+		AlertTag string `envconfig:"DRONE_MONITORING_ALERT_TAG"`
+	}
+
+	Setup struct {
+		Retries int      `envconfig:"DRONE_SETUP_RETRIES"`
+		Phases  []string `envconfig:"DRONE_SETUP_PHASES"`
+	}
+
+	CloudInit struct {
+		Timeout time.Duration `envconfig:"DRONE_CLOUD_INIT_TIMEOUT"`
+		Dump    bool          `envconfig:"DRONE_CLOUD_INIT_DUMP"`
+	}
+
+	Secrets struct {
+		File string `envconfig:"DRONE_SECRETS_FILE"`
+	}
+
+	Step struct {
+		Timeout   time.Duration `envconfig:"DRONE_STEP_TIMEOUT"`
+		Isolation string        `envconfig:"DRONE_STEP_ISOLATION"`
+		Shebang   string        `envconfig:"DRONE_STEP_SHEBANG" default:"wrap"`
+	}
+
+	Pull struct {
+		Images      []string `envconfig:"DRONE_PULL_IMAGES"`
+		Concurrency int      `envconfig:"DRONE_PULL_CONCURRENCY"`
+		Required    bool     `envconfig:"DRONE_PULL_REQUIRED"`
+	}
+
+	Locale struct {
+		Locale      string `envconfig:"DRONE_LOCALE"`
+		Timezone    string `envconfig:"DRONE_TIMEZONE"`
+		SetTimezone bool   `envconfig:"DRONE_TIMEZONE_SET"`
+	}
+
+	Swap struct {
+		Size int `envconfig:"DRONE_SWAP_SIZE"`
+	}
+
+	Ready struct {
+		Port    int           `envconfig:"DRONE_READY_PORT"`
+		Path    string        `envconfig:"DRONE_READY_PATH"`
+		Timeout time.Duration `envconfig:"DRONE_READY_TIMEOUT"`
+	}
+
+	Teardown struct {
+		Script   string        `envconfig:"DRONE_TEARDOWN_SCRIPT"`
+		Timeout  time.Duration `envconfig:"DRONE_TEARDOWN_TIMEOUT"`
+		Required bool          `envconfig:"DRONE_TEARDOWN_REQUIRED"`
+	}
+
+	Destroy struct {
+		Force     bool          `envconfig:"DRONE_DESTROY_FORCE"`
+		Timeout   time.Duration `envconfig:"DRONE_DESTROY_FORCE_TIMEOUT"`
+		Confirm   bool          `envconfig:"DRONE_DESTROY_CONFIRM"`
+		DryRun    bool          `envconfig:"DRONE_DESTROY_DRY_RUN"`
+		Resources bool          `envconfig:"DRONE_DESTROY_RESOURCES"`
+	}
+
+	Reaper struct {
+		Enabled   bool          `envconfig:"DRONE_REAPER_ENABLED"`
+		Interval  time.Duration `envconfig:"DRONE_REAPER_INTERVAL" default:"1h"`
+		OlderThan time.Duration `envconfig:"DRONE_REAPER_OLDER_THAN"`
+		Token     string        `envconfig:"DRONE_REAPER_TOKEN"`
+	}
+
+	Provision struct {
+		NamePolicy     string        `envconfig:"DRONE_PROVISION_NAME_POLICY" default:"suffix"`
+		Lifetime       time.Duration `envconfig:"DRONE_PROVISION_MAX_LIFETIME"`
+		LifetimePolicy string        `envconfig:"DRONE_PROVISION_LIFETIME_POLICY" default:"timer"`
+	}
+
+	Park struct {
+		TTL time.Duration `envconfig:"DRONE_PARK_TTL"`
+	}
+
+	Workspace struct {
+		Policy     string `envconfig:"DRONE_WORKSPACE_POLICY" default:"reuse"`
+		ModePolicy string `envconfig:"DRONE_WORKSPACE_MODE_POLICY" default:"warn"`
 	}
 
 	Limit struct {
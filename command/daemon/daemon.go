@@ -6,11 +6,16 @@ package daemon
 
 import (
 	"context"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/drone-runners/drone-runner-digitalocean/engine"
 	"github.com/drone-runners/drone-runner-digitalocean/engine/resource"
 	"github.com/drone-runners/drone-runner-digitalocean/internal/match"
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
 	"github.com/drone-runners/drone-runner-digitalocean/runtime"
 
 	"github.com/drone/runner-go/client"
@@ -65,7 +70,126 @@ func (c *daemonCommand) run(*kingpin.ParseContext) error {
 		),
 	)
 
-	engine, err := engine.New(config.Keypair.Public, config.Keypair.Private)
+	cacert, err := readCACert(config.API.CACert)
+	if err != nil {
+		logrus.WithError(err).
+			Errorln("cannot read the api ca certificate")
+		return err
+	}
+
+	backupKeys, err := readKeys(config.SSH.BackupKeys)
+	if err != nil {
+		logrus.WithError(err).
+			Errorln("cannot read the backup ssh keys")
+		return err
+	}
+
+	// the server instance lifetime is not enforced by the
+	// tag policy unless the reaper removes expired server
+	// instances.
+	if engine.LifetimePolicy(config.Provision.LifetimePolicy) == engine.LifetimeTag && !config.Reaper.Enabled {
+		logrus.Errorln("the tag lifetime policy requires the reaper, set DRONE_REAPER_ENABLED")
+		return errors.New("the tag lifetime policy requires the reaper")
+	}
+
+	// the reaper requires an account token to list and remove
+	// server instances in the account.
+	if config.Reaper.Enabled && config.Reaper.Token == "" {
+		logrus.Errorln("the reaper requires an account token, set DRONE_REAPER_TOKEN")
+		return errors.New("the reaper requires an account token")
+	}
+
+	redact, err := readPatterns(config.Output.Redact)
+	if err != nil {
+		logrus.WithError(err).
+			Errorln("cannot read the output redaction patterns")
+		return err
+	}
+
+	engine, err := engine.New(
+		config.Keypair.Public,
+		config.Keypair.Private,
+		engine.Opts{
+			MaxOutput:           config.Output.Limit,
+			MaxOutputFail:       config.Output.LimitFail,
+			UploadRate:          config.Upload.Rate,
+			CompressUploads:     config.Upload.Compress,
+			SCP:                 config.Upload.SCP,
+			SFTPMaxPacket:       config.Upload.Packet,
+			SFTPConcurrency:     config.Upload.Requests,
+			UploadRetries:       config.Upload.Retries,
+			VerifyUploads:       config.Upload.Verify,
+			DumpScript:          config.Output.Script,
+			TailLines:           config.Output.Tail,
+			NormalizeNewlines:   config.Output.Newlines,
+			SanitizeOutput:      config.Output.Sanitize,
+			PrefixOutput:        config.Output.Prefix,
+			StepTrailer:         config.Output.Trailer,
+			ScanOutput:          config.Output.Scan,
+			Signatures:          signatures(config.Output.Signatures),
+			OutputBufferSize:    config.Output.Buffer,
+			OutputFlushInterval: config.Output.Flush,
+			SetupRetries:        config.Setup.Retries,
+			SetupPhases:         setupPhases(config.Setup.Phases),
+			CloudInitTimeout:    config.CloudInit.Timeout,
+			DumpCloudInit:       config.CloudInit.Dump,
+			ReadyPort:           config.Ready.Port,
+			ReadyPath:           config.Ready.Path,
+			ReadyTimeout:        config.Ready.Timeout,
+			SwapSize:            config.Swap.Size,
+			EnvAllow:            config.Environ.Allow,
+			EnvDeny:             config.Environ.Deny,
+			KeyLookup:           config.Keypair.Lookup,
+			KeyCacheTTL:         config.Keypair.TTL,
+			KeyOrigin:           config.Keypair.Origin,
+			RunnerName:          config.Runner.Name,
+			SkipKeyRegistration: config.Keypair.Skip,
+			RootPolicy:          engine.RootPolicy(config.Workspace.Policy),
+			ModePolicy:          engine.ModePolicy(config.Workspace.ModePolicy),
+			CACert:              cacert,
+			AlertTag:            config.Monitoring.AlertTag,
+			TeardownScript:      config.Teardown.Script,
+			TeardownTimeout:     config.Teardown.Timeout,
+			TeardownRequired:    config.Teardown.Required,
+			ForceDestroy:        config.Destroy.Force,
+			ForceDestroyTimeout: config.Destroy.Timeout,
+			ConfirmDestroy:      config.Destroy.Confirm,
+			DestroyDryRun:       config.Destroy.DryRun,
+			DestroyResources:    config.Destroy.Resources,
+			DefaultStepTimeout:  config.Step.Timeout,
+			Isolation:           config.Step.Isolation,
+			Shebang:             engine.ShebangPolicy(config.Step.Shebang),
+			Locale:              config.Locale.Locale,
+			Timezone:            config.Locale.Timezone,
+			SetTimezone:         config.Locale.SetTimezone,
+			PullImages:          config.Pull.Images,
+			PullConcurrency:     config.Pull.Concurrency,
+			PullRequired:        config.Pull.Required,
+			Redact:              redact,
+			ParkTTL:             config.Park.TTL,
+			MaxSessions:         config.SSH.MaxSessions,
+			MaxProvisions:       config.Runner.Provisions,
+			NamePolicy:          engine.NamePolicy(config.Provision.NamePolicy),
+			MaxLifetime:         config.Provision.Lifetime,
+			LifetimePolicy:      engine.LifetimePolicy(config.Provision.LifetimePolicy),
+			Retryable:           retryable(config.SSH.NoRetry),
+			ReuseConnections:    config.SSH.Reuse,
+			LivenessTimeout:     config.SSH.Liveness,
+			HandshakeTimeout:    config.SSH.Handshake,
+			RekeyThreshold:      config.SSH.Rekey,
+			RouteProbe:          config.SSH.RouteProbe,
+			RouteFallback:       config.SSH.Fallback,
+			PreferAddress:       engine.AddressFamily(config.SSH.Prefer),
+			TransportExitCode:   config.SSH.ExitCode,
+			HostKeyCommand:      config.SSH.HostKey,
+			InsecureHostKey:     config.SSH.Insecure,
+			HostKeyAlgorithms:   config.SSH.HostKeyAlgs,
+			SecretProvider:      secretsFile(config.Secrets.File),
+			BackupKeys:          backupKeys,
+			IdentitiesOnly:      config.SSH.Identities,
+			SendEnv:             config.SSH.SendEnv,
+		},
+	)
 	if err != nil {
 		return err
 	}
@@ -81,6 +205,7 @@ func (c *daemonCommand) run(*kingpin.ParseContext) error {
 			Client:   cli,
 			Environ:  config.Runner.Environ,
 			Machine:  config.Runner.Name,
+			Users:    config.Image.Users,
 			Reporter: tracer,
 			Match: match.Func(
 				config.Limit.Repos,
@@ -133,6 +258,33 @@ func (c *daemonCommand) run(*kingpin.ParseContext) error {
 		return server.ListenAndServe(ctx)
 	})
 
+	// optionally remove expired server instances, and server
+	// instances older than the configured age, on an interval.
+	if config.Reaper.Enabled {
+		reapctx := ctx
+		if len(cacert) != 0 {
+			httpClient, err := platform.NewHTTPClient(cacert)
+			if err != nil {
+				return err
+			}
+			reapctx = platform.WithHTTPClient(ctx, httpClient)
+		}
+		args := platform.ReapArgs{
+			OlderThan: config.Reaper.OlderThan,
+			Token:     config.Reaper.Token,
+			DryRun:    config.Destroy.DryRun,
+		}
+		logrus.WithField("interval", config.Reaper.Interval).
+			WithField("older_than", config.Reaper.OlderThan).
+			WithField("dry_run", args.DryRun).
+			Infoln("starting the reaper")
+
+		g.Go(func() error {
+			reap(reapctx, args, config.Reaper.Interval)
+			return nil
+		})
+	}
+
 	// Ping the server and block until a successful connection
 	// to the server has been established.
 	for {
@@ -174,6 +326,155 @@ func (c *daemonCommand) run(*kingpin.ParseContext) error {
 	return err
 }
 
+// helper function removes expired server instances, and
+// server instances older than the configured age, on the
+// interval until the context is cancelled.
+func reap(ctx context.Context, args platform.ReapArgs, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		targets, err := platform.ReapOlderThan(ctx, args)
+		if err != nil {
+			logrus.WithError(err).
+				Errorln("cannot reap server instances")
+		} else if len(targets) != 0 {
+			logrus.WithField("count", len(targets)).
+				WithField("dry_run", args.DryRun).
+				Infoln("reaped server instances")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// helper function returns the PEM encoded certificate
+// authority bundle. The value is either the PEM encoded
+// bundle or the path to the bundle file.
+func readCACert(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN") {
+		return []byte(s), nil
+	}
+	return ioutil.ReadFile(s)
+}
+
+// helper function reads and returns the PEM encoded private
+// keys from the key files.
+func readKeys(paths []string) ([]string, error) {
+	var keys []string
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, string(b))
+	}
+	return keys, nil
+}
+
+// helper function reads and returns the patterns from the
+// patterns file, one pattern per line. Empty lines and lines
+// beginning with # are ignored.
+func readPatterns(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
+// helper function returns a function that reports whether an
+// ssh connection error is retryable. Errors that contain any
+// of the patterns are not retried. A nil function is returned
+// if no patterns are configured.
+func retryable(patterns []string) func(error) bool {
+	if len(patterns) == 0 {
+		return nil
+	}
+	return func(err error) bool {
+		for _, pattern := range patterns {
+			if strings.Contains(err.Error(), pattern) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// helper function returns the output signatures from the map
+// of patterns to diagnoses, sorted by pattern. A nil value is
+// returned if no patterns are configured, in which case the
+// default signatures are used.
+func signatures(patterns map[string]string) []engine.Signature {
+	if len(patterns) == 0 {
+		return nil
+	}
+	var keys []string
+	for pattern := range patterns {
+		keys = append(keys, pattern)
+	}
+	sort.Strings(keys)
+	var list []engine.Signature
+	for _, pattern := range keys {
+		list = append(list, engine.Signature{
+			Pattern:   pattern,
+			Diagnosis: patterns[pattern],
+		})
+	}
+	return list
+}
+
+// helper function converts the setup phase names to setup
+// phases.
+func setupPhases(names []string) []engine.SetupPhase {
+	var phases []engine.SetupPhase
+	for _, name := range names {
+		phases = append(phases, engine.SetupPhase(name))
+	}
+	return phases
+}
+
+// helper function returns a secrets provider that reads the
+// secrets from the env file. The file is read every time the
+// server instance is configured, so that rotated secrets are
+// used without restarting the runner. A nil value is returned
+// if the path is empty.
+func secretsFile(path string) engine.SecretProvider {
+	if path == "" {
+		return nil
+	}
+	return func(context.Context) (map[string][]byte, error) {
+		envs, err := godotenv.Read(path)
+		if err != nil {
+			return nil, err
+		}
+		secrets := map[string][]byte{}
+		for k, v := range envs {
+			secrets[k] = []byte(v)
+		}
+		return secrets, nil
+	}
+}
+
 // helper function configures the global logger from
 // the loaded configuration.
 func setupLogger(config Config) {
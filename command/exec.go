@@ -44,6 +44,8 @@ type execCommand struct {
 	Debug      bool
 	Trace      bool
 	Dump       bool
+	DumpScript bool
+	SetupOnly  time.Duration
 	PublicKey  string
 	PrivateKey string
 }
@@ -156,11 +158,24 @@ func (c *execCommand) run(*kingpin.ParseContext) error {
 		),
 	)
 
-	engine, err := engine.New(c.PublicKey, c.PrivateKey)
+	engine, err := engine.New(c.PublicKey, c.PrivateKey, engine.Opts{
+		DumpScript: c.DumpScript,
+	})
 	if err != nil {
 		return err
 	}
 
+	// optionally provision and configure the server instance
+	// for interactive use, without executing the pipeline.
+	if c.SetupOnly > 0 {
+		conn, err := engine.SetupOnly(ctx, spec, c.SetupOnly)
+		if err != nil {
+			return err
+		}
+		dump(conn)
+		return nil
+	}
+
 	err = runtime.NewExecer(
 		pipeline.NopReporter(),
 		console.New(c.Pretty),
@@ -220,6 +235,12 @@ func registerExec(app *kingpin.Application) {
 	cmd.Flag("dump", "dump the pipeline state to stdout").
 		BoolVar(&c.Dump)
 
+	cmd.Flag("dump-script", "dump the generated step scripts to the log").
+		BoolVar(&c.DumpScript)
+
+	cmd.Flag("setup-only", "setup the server for interactive use and remove after the ttl").
+		DurationVar(&c.SetupOnly)
+
 	cmd.Flag("pretty", "pretty print the output").
 		Default(
 			fmt.Sprint(
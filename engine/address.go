@@ -0,0 +1,61 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+	"github.com/drone/runner-go/logger"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// helper function returns an error if the address family is
+// not known.
+func checkFamily(family AddressFamily) error {
+	switch family {
+	case "", AddressIPv4, AddressIPv6:
+		return nil
+	default:
+		return fmt.Errorf("unknown address family: %s", family)
+	}
+}
+
+// helper function returns the preferred address of the server
+// instance, and the address of the other family that is dialed
+// if the preferred address is not reachable.
+func preferAddress(family AddressFamily, instance platform.Instance) (string, string) {
+	switch {
+	case family == AddressIPv6 && instance.IPv6 != "":
+		return instance.IPv6, instance.IP
+	case family != "":
+		return instance.IP, instance.IPv6
+	default:
+		return instance.IP, ""
+	}
+}
+
+// helper function dials the fallback address of the server
+// instance. If the fallback address is reachable, the addresses
+// are swapped so that subsequent steps dial the fallback
+// address.
+func (e *engine) dialFallback(ctx context.Context, spec *Spec, username string, timeout time.Duration) (*ssh.Client, error) {
+	log := logger.FromContext(ctx).
+		WithField("ip", spec.ip).
+		WithField("fallback_ip", spec.fallbackIP)
+
+	client, err := e.connect(spec.fallbackIP, username, timeout, e.hostKeyCallback(spec))
+	if err != nil {
+		log.WithError(err).
+			Trace("failed to dial vm fallback address")
+		return nil, err
+	}
+	log.Debug("preferred address is not reachable, using the fallback address")
+	spec.ip, spec.fallbackIP = spec.fallbackIP, spec.ip
+	return client, nil
+}
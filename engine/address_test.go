@@ -0,0 +1,95 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+func TestPreferAddress(t *testing.T) {
+	instance := platform.Instance{IP: "1.2.3.4", IPv6: "2001:db8::1"}
+	tests := []struct {
+		family   AddressFamily
+		instance platform.Instance
+		ip       string
+		fallback string
+	}{
+		{family: "", instance: instance, ip: "1.2.3.4"},
+		{family: AddressIPv4, instance: instance, ip: "1.2.3.4", fallback: "2001:db8::1"},
+		{family: AddressIPv6, instance: instance, ip: "2001:db8::1", fallback: "1.2.3.4"},
+		{family: AddressIPv6, instance: platform.Instance{IP: "1.2.3.4"}, ip: "1.2.3.4"},
+	}
+	for _, test := range tests {
+		ip, fallback := preferAddress(test.family, test.instance)
+		if ip != test.ip || fallback != test.fallback {
+			t.Errorf("Want addresses %q and %q for family %q, got %q and %q",
+				test.ip, test.fallback, test.family, ip, fallback)
+		}
+	}
+	if err := checkFamily("ipx"); err == nil {
+		t.Errorf("Expect unknown address family error")
+	}
+}
+
+func TestProvision_PreferAddress(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	var enabled bool
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		enabled = args.IPv6
+		return platform.Instance{ID: 1, IP: "1.2.3.4", IPv6: "2001:db8::1"}, nil
+	}
+
+	engine := &engine{opts: Opts{PreferAddress: AddressIPv6}}
+	spec := &Spec{Token: "token"}
+	if err := engine.Provision(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	if !enabled {
+		t.Errorf("Expect ipv6 enabled")
+	}
+	if spec.ip != "2001:db8::1" || spec.fallbackIP != "1.2.3.4" {
+		t.Errorf("Want ipv6 address preferred, got %q and %q", spec.ip, spec.fallbackIP)
+	}
+}
+
+func TestDialRetry_Fallback(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+
+	// the preferred address refuses the connection, and the
+	// fallback address is reachable.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := listener.Addr().String()
+	listener.Close()
+
+	spec.ip = unreachable
+	spec.fallbackIP = server.addr
+	client, err := engine.dialRetry(context.Background(), spec)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	client.Close()
+
+	// the address used is recorded so that subsequent steps
+	// dial the reachable address.
+	if spec.ip != server.addr || spec.fallbackIP != unreachable {
+		t.Errorf("Want fallback address recorded, got %q and %q", spec.ip, spec.fallbackIP)
+	}
+	if _, err := engine.Run(context.Background(), spec, &Step{Name: "build", Command: "true"}, new(syncBuffer)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/drone/runner-go/logger"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// bootFinished is the file written by cloud-init when the
+// boot process is complete. It is used when the cloud-init
+// status command is not available.
+const bootFinished = "/var/lib/cloud/instance/boot-finished"
+
+// cloudInitLog is the cloud-init output log, which includes
+// the output of the user data script. It is declared as a
+// variable so that it can be overridden in unit tests.
+var cloudInitLog = "/var/log/cloud-init-output.log"
+
+// cloudInitLogLines is the number of lines of the cloud-init
+// output log that are logged when configuration fails.
+const cloudInitLogLines = 50
+
+// cloudInitInterval is the interval at which the cloud-init
+// status is polled. It is declared as a variable so that it
+// can be overridden in unit tests.
+var cloudInitInterval = time.Second * 5
+
+// ErrCloudInitTimeout is returned when cloud-init does not
+// complete before the timeout.
+var ErrCloudInitTimeout = errors.New("timeout waiting for cloud-init")
+
+// cloudInitError is returned when cloud-init fails. The error
+// includes the cloud-init status output.
+type cloudInitError struct {
+	output string
+}
+
+func (e *cloudInitError) Error() string {
+	return "cloud-init failed: " + e.output
+}
+
+// WaitForCloudInit blocks until cloud-init completes on the
+// server instance, or returns an error if cloud-init fails or
+// does not complete before the timeout.
+func (e *engine) WaitForCloudInit(ctx context.Context, spec *Spec, timeout time.Duration) error {
+	if spec.Platform.OS == "windows" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, err := e.dialRetry(ctx, spec)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrCloudInitTimeout
+		}
+		return err
+	}
+	defer client.Close()
+
+	log := logger.FromContext(ctx).
+		WithField("hostname", spec.Server.Name).
+		WithField("ip", spec.ip).
+		WithField("id", spec.id)
+
+	for {
+		done, err := cloudInitStatus(client)
+		if err != nil {
+			log.WithError(err).Error("cloud-init failed")
+			return err
+		}
+		if done {
+			log.Debug("cloud-init complete")
+			return nil
+		}
+		log.Trace("waiting for cloud-init")
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return ErrCloudInitTimeout
+			}
+			return ctx.Err()
+		case <-time.After(cloudInitInterval):
+		}
+	}
+}
+
+// helper function logs the tail of the cloud-init output log.
+// Errors reading the log are logged, but are not returned.
+func dumpCloudInitLog(ctx context.Context, spec *Spec, fs filesystem) {
+	if spec.Platform.OS == "windows" {
+		return
+	}
+	log := logger.FromContext(ctx).
+		WithField("hostname", spec.Server.Name).
+		WithField("ip", spec.ip).
+		WithField("id", spec.id).
+		WithField("path", cloudInitLog)
+
+	data, err := fs.ReadFile(cloudInitLog)
+	if err != nil {
+		log.WithError(err).Debug("cannot read cloud-init output log")
+		return
+	}
+	tail := newTailWriter(cloudInitLogLines)
+	tail.Write(data)
+	log.WithField("tail", strings.Join(tail.Lines(), "\n")).
+		Error("server configuration failed, cloud-init output log")
+}
+
+// helper function returns true if cloud-init is complete on
+// the server instance. If the cloud-init status command is
+// not available, the boot-finished file is checked instead.
+func cloudInitStatus(client *ssh.Client) (bool, error) {
+	out, err := execute(client, "cloud-init status --long")
+	if exiterr, ok := err.(*ssh.ExitError); ok && exiterr.ExitStatus() == 127 {
+		_, err = execute(client, "test -f "+bootFinished)
+		return err == nil, nil
+	}
+	// the status command exits with a non-zero exit code
+	// when cloud-init fails, in which case the output is
+	// parsed to surface the error.
+	if _, ok := err.(*ssh.ExitError); err != nil && !ok {
+		return false, err
+	}
+	return parseCloudInitStatus(out)
+}
+
+// helper function parses the cloud-init status output and
+// returns true if cloud-init is complete, or an error if
+// cloud-init failed.
+func parseCloudInitStatus(out []byte) (bool, error) {
+	var status string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "status:") {
+			status = strings.TrimSpace(strings.TrimPrefix(line, "status:"))
+			break
+		}
+	}
+	switch status {
+	case "done", "disabled", "degraded done":
+		return true, nil
+	case "error", "degraded error":
+		return false, &cloudInitError{output: strings.TrimSpace(string(out))}
+	default:
+		// running, not run or an unknown status indicates
+		// cloud-init is not yet complete.
+		return false, nil
+	}
+}
+
+// helper function executes the command on the remote server
+// and returns the combined output.
+func execute(client *ssh.Client, cmd string) ([]byte, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	return session.CombinedOutput(cmd)
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone/runner-go/logger"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestParseCloudInitStatus(t *testing.T) {
+	tests := []struct {
+		output string
+		done   bool
+		err    bool
+	}{
+		{output: "status: done\n", done: true},
+		{output: "status: disabled\n", done: true},
+		{output: "status: degraded done\nboot_status_code: enabled-by-generator\n", done: true},
+		{output: "status: running\n"},
+		{output: "status: not run\n"},
+		{output: ""},
+		{output: "\nstatus: error\ntime: Mon, 14 Oct 2019 10:00:00 +0000\ndetail:\n('scripts-user', RuntimeError('Runparts: 1 failures in 1 attempted commands'))\n", err: true},
+	}
+	for _, test := range tests {
+		done, err := parseCloudInitStatus([]byte(test.output))
+		if done != test.done {
+			t.Errorf("Want done %v for output %q, got %v", test.done, test.output, done)
+		}
+		if (err != nil) != test.err {
+			t.Errorf("Want error %v for output %q, got %v", test.err, test.output, err)
+		}
+	}
+}
+
+func TestParseCloudInitStatus_Error(t *testing.T) {
+	_, err := parseCloudInitStatus([]byte("status: error\ndetail:\nscripts-user failed\n"))
+	if err == nil {
+		t.Errorf("Expect error when cloud-init failed")
+		return
+	}
+	if !strings.Contains(err.Error(), "scripts-user failed") {
+		t.Errorf("Expect error includes cloud-init output, got %q", err)
+	}
+}
+
+func TestWaitForCloudInit_Timeout(t *testing.T) {
+	cloudInitInterval = time.Millisecond * 10
+	defer func() {
+		cloudInitInterval = time.Second * 5
+	}()
+
+	// the mock server does not have cloud-init installed and
+	// the boot-finished file does not exist.
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	err := engine.WaitForCloudInit(context.Background(), spec, time.Millisecond*200)
+	if err != ErrCloudInitTimeout {
+		t.Errorf("Want timeout error, got %v", err)
+	}
+}
+
+func TestConfigure_DumpCloudInit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(path string) {
+		cloudInitLog = path
+	}(cloudInitLog)
+	cloudInitLog = filepath.Join(dir, "cloud-init-output.log")
+	ioutil.WriteFile(cloudInitLog, []byte("Cloud-init v. 19.1 running\nuser data script failed\n"), 0600)
+
+	for _, dump := range []bool{true, false} {
+		log, hook := test.NewNullLogger()
+		ctx := logger.WithContext(context.Background(), logger.Logrus(logrus.NewEntry(log)))
+
+		// the configuration fails after the ssh connection is
+		// established, because the file mode is rejected.
+		engine, spec, closer := mockEngine(t, Opts{ModePolicy: ModeReject, DumpCloudInit: dump})
+		spec.Root = filepath.Join(dir, "drone-random")
+		spec.Files = []*File{{Path: filepath.Join(dir, "setuid"), Mode: 04755}}
+		err := engine.Configure(ctx, spec)
+		closer()
+		if err == nil {
+			t.Errorf("Expect configuration error")
+			return
+		}
+
+		var tail interface{}
+		for _, entry := range hook.AllEntries() {
+			if v, ok := entry.Data["tail"]; ok {
+				tail = v
+			}
+		}
+		if !dump {
+			if tail != nil {
+				t.Errorf("Expect cloud-init output log not logged when disabled")
+			}
+			continue
+		}
+		if got, want := tail, "Cloud-init v. 19.1 running\nuser data script failed"; got != want {
+			t.Errorf("Want cloud-init output log tail %q, got %q", want, got)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+	"github.com/drone/runner-go/logger"
+
+	"github.com/dchest/uniuri"
+)
+
+// nameSuffix returns the unique suffix appended to a server
+// instance name that is already used. It is declared as a
+// variable so that it can be replaced in unit tests.
+var nameSuffix = func() string {
+	return uniuri.NewLenChars(8, []byte("abcdefghijklmnopqrstuvwxyz0123456789"))
+}
+
+// helper function searches the account for a server instance
+// with the same name, and handles an existing server instance
+// according to the name policy. If the existing server instance
+// is reused, the server instance is returned. Only server
+// instances provisioned by the runner are reused.
+func (e *engine) resolveName(ctx context.Context, spec *Spec) (*platform.Instance, error) {
+	policy := e.opts.NamePolicy
+	switch policy {
+	case "":
+		return nil, nil
+	case NameSuffix, NameFail, NameReuse:
+	default:
+		return nil, fmt.Errorf("unknown name policy: %s", policy)
+	}
+
+	log := logger.FromContext(ctx).
+		WithField("name", spec.Server.Name).
+		WithField("policy", policy)
+
+	instance, err := findByName(ctx, spec.Server.Name, spec.Token)
+	if err == platform.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil && err != platform.ErrDuplicateName {
+		log.WithError(err).
+			Error("cannot search for server instance name")
+		return nil, err
+	}
+
+	switch policy {
+	case NameFail:
+		log.Error("server instance name already exists")
+		return nil, ErrNameExists
+	case NameReuse:
+		// the server instance to reuse is ambiguous if more
+		// than one server instance matches the name.
+		if err != nil {
+			log.WithError(err).
+				Error("cannot reuse server instance")
+			return nil, err
+		}
+		// never attach the pipeline to a server instance that
+		// was not provisioned by the runner.
+		if !instance.Owned {
+			log.WithField("id", instance.ID).
+				Error("server instance name already exists and is not owned by the runner")
+			return nil, ErrNameExists
+		}
+		log.WithField("id", instance.ID).
+			Info("reusing existing server instance")
+		return instance, nil
+	default:
+		name := platform.SanitizeName(spec.Server.Name + "-" + nameSuffix())
+		log.WithField("suffixed", name).
+			Debug("server instance name already exists, appending suffix")
+		spec.Server.Name = name
+		return nil, nil
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+// helper function mocks an account that includes a server
+// instance with the given name. The returned function restores
+// the mocked functions, and the returned counter reports the
+// number of server instances provisioned.
+func mockExistingInstance(name string) (func(), *int) {
+	var provisioned int
+	suffix := nameSuffix
+	restore := stubPlatform()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	findByName = func(ctx context.Context, got, token string) (*platform.Instance, error) {
+		if got != name {
+			return nil, platform.ErrNotFound
+		}
+		return &platform.Instance{ID: 7, IP: "1.2.3.7", PrivateIP: "10.0.0.7", Owned: true}, nil
+	}
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		provisioned++
+		return platform.Instance{ID: 1, IP: "1.2.3.4"}, nil
+	}
+	nameSuffix = func() string {
+		return "unique"
+	}
+	return func() {
+		restore()
+		nameSuffix = suffix
+	}, &provisioned
+}
+
+func TestProvision_NameSuffix(t *testing.T) {
+	restore, provisioned := mockExistingInstance("drone-temp-foo")
+	defer restore()
+
+	engine := &engine{opts: Opts{NamePolicy: NameSuffix}}
+	spec := &Spec{Token: "token", Server: Server{Name: "drone-temp-foo"}}
+	if err := engine.Provision(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := spec.Server.Name, "drone-temp-foo-unique"; got != want {
+		t.Errorf("Want server name %q, got %q", want, got)
+	}
+	if *provisioned != 1 || spec.id != 1 {
+		t.Errorf("Want new server instance provisioned")
+	}
+}
+
+func TestProvision_NameSuffixNotFound(t *testing.T) {
+	restore, _ := mockExistingInstance("drone-temp-bar")
+	defer restore()
+
+	engine := &engine{opts: Opts{NamePolicy: NameSuffix}}
+	spec := &Spec{Token: "token", Server: Server{Name: "drone-temp-foo"}}
+	if err := engine.Provision(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := spec.Server.Name, "drone-temp-foo"; got != want {
+		t.Errorf("Want server name %q, got %q", want, got)
+	}
+}
+
+func TestProvision_NameFail(t *testing.T) {
+	restore, provisioned := mockExistingInstance("drone-temp-foo")
+	defer restore()
+
+	engine := &engine{opts: Opts{NamePolicy: NameFail}}
+	spec := &Spec{Token: "token", Server: Server{Name: "drone-temp-foo"}}
+	if err := engine.Provision(context.Background(), spec); err != ErrNameExists {
+		t.Errorf("Want ErrNameExists, got %v", err)
+	}
+	if *provisioned != 0 {
+		t.Errorf("Expect server instance not provisioned")
+	}
+}
+
+func TestProvision_NameReuse(t *testing.T) {
+	restore, provisioned := mockExistingInstance("drone-temp-foo")
+	defer restore()
+
+	engine := &engine{opts: Opts{NamePolicy: NameReuse}}
+	spec := &Spec{Token: "token", Server: Server{Name: "drone-temp-foo"}}
+	if err := engine.Provision(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	if *provisioned != 0 {
+		t.Errorf("Expect existing server instance reused")
+	}
+	if spec.id != 7 || spec.ip != "1.2.3.7" || spec.privateIP != "10.0.0.7" {
+		t.Errorf("Want existing server instance attached, got id %d, ip %s", spec.id, spec.ip)
+	}
+}
+
+func TestProvision_NameReuseNotOwned(t *testing.T) {
+	restore, provisioned := mockExistingInstance("drone-temp-foo")
+	defer restore()
+	findByName = func(context.Context, string, string) (*platform.Instance, error) {
+		return &platform.Instance{ID: 7, IP: "1.2.3.7"}, nil
+	}
+
+	engine := &engine{opts: Opts{NamePolicy: NameReuse}}
+	spec := &Spec{Token: "token", Server: Server{Name: "drone-temp-foo"}}
+	if err := engine.Provision(context.Background(), spec); err != ErrNameExists {
+		t.Errorf("Want ErrNameExists, got %v", err)
+	}
+	if *provisioned != 0 || spec.id != 0 {
+		t.Errorf("Expect server instance neither provisioned nor reused")
+	}
+}
+
+func TestProvision_NameReuseDuplicate(t *testing.T) {
+	restore, provisioned := mockExistingInstance("drone-temp-foo")
+	defer restore()
+	findByName = func(context.Context, string, string) (*platform.Instance, error) {
+		return nil, platform.ErrDuplicateName
+	}
+
+	engine := &engine{opts: Opts{NamePolicy: NameReuse}}
+	spec := &Spec{Token: "token", Server: Server{Name: "drone-temp-foo"}}
+	if err := engine.Provision(context.Background(), spec); err != platform.ErrDuplicateName {
+		t.Errorf("Want ErrDuplicateName, got %v", err)
+	}
+	if *provisioned != 0 {
+		t.Errorf("Expect server instance not provisioned")
+	}
+}
+
+func TestProvision_NamePolicyUnknown(t *testing.T) {
+	restore, _ := mockExistingInstance("drone-temp-foo")
+	defer restore()
+
+	engine := &engine{opts: Opts{NamePolicy: "rename"}}
+	spec := &Spec{Token: "token", Server: Server{Name: "drone-temp-foo"}}
+	if err := engine.Provision(context.Background(), spec); err == nil {
+		t.Errorf("Expect unknown name policy error")
+	}
+}
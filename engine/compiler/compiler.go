@@ -69,6 +69,13 @@ type Compiler struct {
 	// Secret returns a named secret value that can be injected
 	// into the pipeline step.
 	Secret secret.Provider
+
+	// Users provides the default ssh user for server images,
+	// keyed by image slug, which is used if the pipeline does
+	// not define the user. This is intended for marketplace
+	// images that disable root login. A slug ending with an
+	// asterisk matches by prefix.
+	Users map[string]string
 }
 
 // Compile compiles the configuration file.
@@ -84,19 +91,29 @@ func (c *Compiler) Compile(ctx context.Context) *engine.Spec {
 			Version: c.Pipeline.Platform.Version,
 		},
 		Server: engine.Server{
-			Name:   fmt.Sprintf("drone-temp-%s", random()),
-			Image:  c.Pipeline.Server.Image,
-			Region: c.Pipeline.Server.Region,
-			Size:   c.Pipeline.Server.Size,
-			User:   c.Pipeline.Server.User,
+			Name:     fmt.Sprintf("drone-temp-%s", random()),
+			Hostname: c.Pipeline.Server.Hostname,
+			Image:    c.Pipeline.Server.Image,
+			Region:   c.Pipeline.Server.Region,
+			Size:     c.Pipeline.Server.Size,
+			User:     c.Pipeline.Server.User,
+			Keypair:  c.Pipeline.Server.Keypair,
+			Labels:   c.Pipeline.Server.Labels,
+			Images:   c.Pipeline.Server.Images,
+			Sizes:    c.Pipeline.Server.Sizes,
 		},
 	}
 
-	switch {
-	case spec.Server.User == "" && spec.Platform.OS == "windows":
-		spec.Server.User = "Administrator"
-	case spec.Server.User == "":
-		spec.Server.User = "root"
+	// the server name may be prefixed with build metadata
+	// (e.g. the repository name) using string substitution.
+	// The random suffix is always appended to ensure the
+	// server name is unique.
+	if c.Pipeline.Server.Name != "" {
+		spec.Server.Name = fmt.Sprintf("%s-%s", c.Pipeline.Server.Name, random())
+	}
+
+	if spec.Server.User == "" {
+		spec.Server.User = getUser(os, spec.Server.Image, c.Users)
 	}
 
 	// maybe load the digital ocean api token from secret
@@ -104,8 +121,14 @@ func (c *Compiler) Compile(ctx context.Context) *engine.Spec {
 		spec.Token = s
 	}
 
-	// create the root directory
+	// create the root directory. The root directory may be
+	// overridden, and may reference the home directory of the
+	// ssh user (e.g. $HOME/drone), which is resolved when the
+	// server instance is configured.
 	spec.Root = tempdir(os)
+	if root := c.Pipeline.Server.Root; root != "" {
+		spec.Root = root
+	}
 
 	// creates a home directory in the root.
 	// note: mkdirall fails on windows so we need to create all
@@ -230,7 +253,22 @@ func (c *Compiler) Compile(ctx context.Context) *engine.Spec {
 		buildpath := join(os, spec.Root, "opt", getExt(os, buildslug))
 		buildfile := genScript(os, src.Commands)
 
-		cmd, args := getCommand(os, buildpath)
+		// optionally fetch the step script from the url on
+		// the server instance, instead of uploading the step
+		// script. The environment is exported before the
+		// fetched script is executed.
+		if src.Script.URL != "" {
+			buildfile = genFetchScript(src.Script.URL, src.Script.SHA256)
+		}
+
+		// optionally invoke the script with a login shell so
+		// that profile scripts are loaded.
+		shell := getCommand
+		if src.LoginShell {
+			shell = getLoginCommand
+		}
+
+		cmd, args := shell(os, buildpath)
 		dst := &engine.Step{
 			Name:      src.Name,
 			Args:      args,
@@ -254,10 +292,59 @@ func (c *Compiler) Compile(ctx context.Context) *engine.Spec {
 				},
 			},
 			Secrets:    convertSecretEnv(src.Environment),
+			StdinFrom:  src.StdinFrom,
+			Nice:       src.Priority.Nice,
+			IONice:     src.Priority.IONice,
+			Isolation:  src.Isolation,
 			WorkingDir: sourcedir,
 		}
 		spec.Steps = append(spec.Steps, dst)
 
+		// optionally isolate the step from the pipeline
+		// environment, in which case only the variables
+		// defined by the step are exported, for example, to
+		// reduce secret exposure to untrusted code.
+		if src.ClearEnv {
+			dst.ClearEnv = true
+			dst.Envs = environ.Expand(
+				convertStaticEnv(src.Environment),
+			)
+		}
+
+		// optionally execute the entrypoint binary directly
+		// instead of a step script, to avoid shell escaping.
+		// The step environment is passed to the binary by the
+		// engine, and the binary runs in the home directory of
+		// the ssh user.
+		if len(src.Entrypoint) != 0 {
+			dst.Direct = true
+			dst.Command = src.Entrypoint[0]
+			dst.Args = src.Entrypoint[1:]
+			dst.Files = nil
+		}
+
+		// optionally execute each command in a separate ssh
+		// session to report which command failed. Note that
+		// shell state, such as the working directory, is not
+		// shared between commands.
+		if src.Separate {
+			dst.Files = nil
+			for i, command := range src.Commands {
+				path := join(os, spec.Root, "opt", getExt(os, fmt.Sprintf("%s-%d", buildslug, i)))
+				cmd, args := shell(os, path)
+				dst.Execs = append(dst.Execs, &engine.Exec{
+					Name:    command,
+					Command: cmd,
+					Args:    args,
+				})
+				dst.Files = append(dst.Files, &engine.File{
+					Path: path,
+					Mode: 0700,
+					Data: []byte(genScript(os, []string{command})),
+				})
+			}
+		}
+
 		// set the pipeline step run policy. steps run on
 		// success by default, but may be optionally configured
 		// to run on failure.
@@ -291,6 +378,30 @@ func (c *Compiler) Compile(ctx context.Context) *engine.Spec {
 		removeCloneDeps(spec)
 	}
 
+	// a step that reads the stdout of a previous step must
+	// not start before the previous step completes.
+	configureStdinDeps(spec)
+
+	// spaces buckets are mounted on the server instance
+	// before pipeline execution begins. The credentials may
+	// be loaded from secrets.
+	for _, src := range c.Pipeline.Spaces {
+		mount := &engine.Mount{
+			Bucket:    src.Bucket,
+			Endpoint:  src.Endpoint,
+			Path:      src.Path,
+			AccessKey: src.AccessKey.Value,
+			SecretKey: src.SecretKey.Value,
+		}
+		if s, ok := c.findSecret(ctx, src.AccessKey.Secret); ok {
+			mount.AccessKey = s
+		}
+		if s, ok := c.findSecret(ctx, src.SecretKey.Secret); ok {
+			mount.SecretKey = s
+		}
+		spec.Mounts = append(spec.Mounts, mount)
+	}
+
 	for _, step := range spec.Steps {
 		for _, s := range step.Secrets {
 			secret, ok := c.findSecret(ctx, s.Name)
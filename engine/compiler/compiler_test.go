@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/dchest/uniuri"
@@ -133,6 +134,302 @@ func TestCompile_Secrets(t *testing.T) {
 	}
 }
 
+// This test verifies that the server name is prefixed with
+// the user-defined name, if provided.
+func TestCompile_ServerName(t *testing.T) {
+	random = notRandom
+	defer func() {
+		random = uniuri.New
+	}()
+
+	compiler := Compiler{}
+	compiler.Build = &drone.Build{}
+	compiler.Repo = &drone.Repo{}
+	compiler.Stage = &drone.Stage{}
+	compiler.System = &drone.System{}
+	compiler.Pipeline = &resource.Pipeline{}
+	compiler.Pipeline.Clone.Disable = true
+
+	ir := compiler.Compile(nocontext)
+	if got, want := ir.Server.Name, "drone-temp-random"; got != want {
+		t.Errorf("Want server name %q, got %q", want, got)
+	}
+
+	compiler.Pipeline.Server.Name = "octocat-hello-world"
+	ir = compiler.Compile(nocontext)
+	if got, want := ir.Server.Name, "octocat-hello-world-random"; got != want {
+		t.Errorf("Want server name %q, got %q", want, got)
+	}
+}
+
+// This test verifies that step commands are compiled to
+// separate scripts if configured.
+func TestCompile_SeparateCommands(t *testing.T) {
+	random = notRandom
+	defer func() {
+		random = uniuri.New
+	}()
+
+	compiler := Compiler{}
+	compiler.Build = &drone.Build{}
+	compiler.Repo = &drone.Repo{}
+	compiler.Stage = &drone.Stage{}
+	compiler.System = &drone.System{}
+	compiler.Pipeline = &resource.Pipeline{}
+	compiler.Pipeline.Clone.Disable = true
+	compiler.Pipeline.Steps = []*resource.Step{
+		{
+			Name:     "build",
+			Commands: []string{"go build", "go test"},
+			Separate: true,
+		},
+	}
+
+	ir := compiler.Compile(nocontext)
+	step := ir.Steps[0]
+	if got, want := len(step.Execs), 2; got != want {
+		t.Errorf("Want %d commands, got %d", want, got)
+		return
+	}
+	if got, want := len(step.Files), 2; got != want {
+		t.Errorf("Want %d scripts, got %d", want, got)
+		return
+	}
+	for i, command := range []string{"go build", "go test"} {
+		if got := step.Execs[i].Name; got != command {
+			t.Errorf("Want command name %q, got %q", command, got)
+		}
+		if got, want := step.Execs[i].Args[len(step.Execs[i].Args)-1], step.Files[i].Path; got != want {
+			t.Errorf("Want command executes script %q, got %q", want, got)
+		}
+	}
+}
+
+func TestCompile_Root(t *testing.T) {
+	compiler := Compiler{}
+	compiler.Build = &drone.Build{}
+	compiler.Repo = &drone.Repo{}
+	compiler.Stage = &drone.Stage{}
+	compiler.System = &drone.System{}
+	compiler.Pipeline = &resource.Pipeline{}
+	compiler.Pipeline.Server.Root = "$HOME/drone"
+	compiler.Pipeline.Steps = []*resource.Step{
+		{Name: "build", Commands: []string{"go build"}},
+	}
+
+	ir := compiler.Compile(nocontext)
+	if got, want := ir.Root, "$HOME/drone"; got != want {
+		t.Errorf("Want root directory %q, got %q", want, got)
+	}
+	if got, want := ir.Steps[0].WorkingDir, "$HOME/drone/drone/src"; got != want {
+		t.Errorf("Want working directory %q, got %q", want, got)
+	}
+}
+
+func TestCompile_ClearEnv(t *testing.T) {
+	compiler := Compiler{}
+	compiler.Build = &drone.Build{}
+	compiler.Repo = &drone.Repo{}
+	compiler.Stage = &drone.Stage{}
+	compiler.System = &drone.System{}
+	compiler.Environ = map[string]string{"GLOBAL": "true"}
+	compiler.Pipeline = &resource.Pipeline{}
+	compiler.Pipeline.Clone.Disable = true
+	compiler.Pipeline.Steps = []*resource.Step{
+		{
+			Name:     "untrusted",
+			Commands: []string{"make test"},
+			ClearEnv: true,
+			Environment: map[string]*manifest.Variable{
+				"GOOS": {Value: "linux"},
+			},
+		},
+		{
+			Name:     "build",
+			Commands: []string{"make"},
+		},
+	}
+
+	ir := compiler.Compile(nocontext)
+	isolated := ir.Steps[0]
+	if !isolated.ClearEnv {
+		t.Errorf("Want step isolated from the pipeline environment")
+	}
+	if diff := cmp.Diff(isolated.Envs, map[string]string{"GOOS": "linux"}); diff != "" {
+		t.Errorf("Want only the step environment for isolated steps")
+		t.Log(diff)
+	}
+	if _, ok := ir.Steps[1].Envs["GLOBAL"]; !ok {
+		t.Errorf("Want pipeline environment for steps that are not isolated")
+	}
+}
+
+func TestCompile_Entrypoint(t *testing.T) {
+	compiler := Compiler{}
+	compiler.Build = &drone.Build{}
+	compiler.Repo = &drone.Repo{}
+	compiler.Stage = &drone.Stage{}
+	compiler.System = &drone.System{}
+	compiler.Pipeline = &resource.Pipeline{}
+	compiler.Pipeline.Clone.Disable = true
+	compiler.Pipeline.Steps = []*resource.Step{
+		{
+			Name:       "test",
+			Entrypoint: []string{"/usr/local/bin/test-runner", "-run", "Test*"},
+		},
+	}
+
+	ir := compiler.Compile(nocontext)
+	step := ir.Steps[0]
+	if !step.Direct {
+		t.Errorf("Want step executed directly")
+	}
+	if got, want := step.Command, "/usr/local/bin/test-runner"; got != want {
+		t.Errorf("Want command %q, got %q", want, got)
+	}
+	if diff := cmp.Diff(step.Args, []string{"-run", "Test*"}); diff != "" {
+		t.Errorf("Unexpected step arguments")
+		t.Log(diff)
+	}
+	if len(step.Files) != 0 {
+		t.Errorf("Want no step script for direct steps")
+	}
+}
+
+func TestCompile_Script(t *testing.T) {
+	compiler := Compiler{}
+	compiler.Build = &drone.Build{}
+	compiler.Repo = &drone.Repo{}
+	compiler.Stage = &drone.Stage{}
+	compiler.System = &drone.System{}
+	compiler.Pipeline = &resource.Pipeline{}
+	compiler.Pipeline.Clone.Disable = true
+	compiler.Pipeline.Steps = []*resource.Step{
+		{
+			Name: "test",
+			Script: resource.Script{
+				URL:    "https://example.com/test.sh",
+				SHA256: strings.Repeat("a", 64),
+			},
+		},
+	}
+
+	ir := compiler.Compile(nocontext)
+	step := ir.Steps[0]
+	if len(step.Files) != 1 {
+		t.Fatalf("Want step script file")
+	}
+	if got, want := string(step.Files[0].Data), genFetchScript("https://example.com/test.sh", strings.Repeat("a", 64)); got != want {
+		t.Errorf("Want fetch script, got %q", got)
+	}
+}
+
+func TestCompile_ImageUser(t *testing.T) {
+	compiler := Compiler{}
+	compiler.Build = &drone.Build{}
+	compiler.Repo = &drone.Repo{}
+	compiler.Stage = &drone.Stage{}
+	compiler.System = &drone.System{}
+	compiler.Pipeline = &resource.Pipeline{}
+	compiler.Pipeline.Server.Image = "gitlab-20-04"
+	compiler.Users = map[string]string{"gitlab-*": "gitlab"}
+
+	ir := compiler.Compile(nocontext)
+	if got, want := ir.Server.User, "gitlab"; got != want {
+		t.Errorf("Want default user %s, got %s", want, got)
+	}
+
+	// the user defined by the pipeline takes precedence.
+	compiler.Pipeline.Server.User = "builder"
+	ir = compiler.Compile(nocontext)
+	if got, want := ir.Server.User, "builder"; got != want {
+		t.Errorf("Want user %s, got %s", want, got)
+	}
+}
+
+func TestCompile_LoginShell(t *testing.T) {
+	random = notRandom
+	defer func() {
+		random = uniuri.New
+	}()
+
+	compiler := Compiler{}
+	compiler.Build = &drone.Build{}
+	compiler.Repo = &drone.Repo{}
+	compiler.Stage = &drone.Stage{}
+	compiler.System = &drone.System{}
+	compiler.Pipeline = &resource.Pipeline{}
+	compiler.Pipeline.Clone.Disable = true
+	compiler.Pipeline.Steps = []*resource.Step{
+		{
+			Name:       "build",
+			Commands:   []string{"go build"},
+			LoginShell: true,
+		},
+		{
+			Name:     "test",
+			Commands: []string{"go test"},
+		},
+	}
+
+	ir := compiler.Compile(nocontext)
+	if got, want := ir.Steps[0].Command, "/bin/bash"; got != want {
+		t.Errorf("Want login shell %q, got %q", want, got)
+	}
+	if got, want := ir.Steps[0].Args[0], "-l"; got != want {
+		t.Errorf("Want login flag %q, got %q", want, got)
+	}
+	if got, want := ir.Steps[1].Command, "/bin/sh"; got != want {
+		t.Errorf("Want default shell %q, got %q", want, got)
+	}
+
+	// the environment prelude is prepended to the script at
+	// runtime, and is unaffected by the login shell.
+	if got, want := ir.Steps[0].Args[2], ir.Steps[0].Files[0].Path; got != want {
+		t.Errorf("Want command executes script %q, got %q", want, got)
+	}
+}
+
+func TestCompile_Spaces(t *testing.T) {
+	random = notRandom
+	defer func() {
+		random = uniuri.New
+	}()
+
+	compiler := Compiler{}
+	compiler.Build = &drone.Build{}
+	compiler.Repo = &drone.Repo{}
+	compiler.Stage = &drone.Stage{}
+	compiler.System = &drone.System{}
+	compiler.Pipeline = &resource.Pipeline{}
+	compiler.Pipeline.Clone.Disable = true
+	compiler.Pipeline.Spaces = []*resource.Spaces{
+		{
+			Bucket:    "datasets",
+			Path:      "/mnt/datasets",
+			AccessKey: manifest.Variable{Value: "access"},
+			SecretKey: manifest.Variable{Secret: "spaces_secret"},
+		},
+	}
+	compiler.Secret = secret.StaticVars(map[string]string{
+		"spaces_secret": "correct-horse-battery-staple",
+	})
+
+	ir := compiler.Compile(nocontext)
+	want := []*engine.Mount{
+		{
+			Bucket:    "datasets",
+			Path:      "/mnt/datasets",
+			AccessKey: "access",
+			SecretKey: "correct-horse-battery-staple",
+		},
+	}
+	if diff := cmp.Diff(ir.Mounts, want); diff != "" {
+		t.Errorf("Unexpected mounts")
+		t.Log(diff)
+	}
+}
+
 // helper function parses and compiles the source file and then
 // compares to a golden json file.
 func testCompile(t *testing.T, source, golden string) *engine.Spec {
@@ -187,3 +484,50 @@ func dump(v interface{}) {
 	enc.SetIndent("", "  ")
 	enc.Encode(v)
 }
+
+func TestCompile_Priority(t *testing.T) {
+	compiler := Compiler{}
+	compiler.Build = &drone.Build{}
+	compiler.Repo = &drone.Repo{}
+	compiler.Stage = &drone.Stage{}
+	compiler.System = &drone.System{}
+	compiler.Pipeline = &resource.Pipeline{}
+	compiler.Pipeline.Clone.Disable = true
+	compiler.Pipeline.Steps = []*resource.Step{
+		{
+			Name:     "build",
+			Commands: []string{"go build"},
+			Priority: resource.Priority{Nice: 10, IONice: "idle"},
+		},
+	}
+
+	ir := compiler.Compile(nocontext)
+	if got, want := ir.Steps[0].Nice, 10; got != want {
+		t.Errorf("Want nice %d, got %d", want, got)
+	}
+	if got, want := ir.Steps[0].IONice, "idle"; got != want {
+		t.Errorf("Want ionice class %q, got %q", want, got)
+	}
+}
+
+func TestCompile_Isolation(t *testing.T) {
+	compiler := Compiler{}
+	compiler.Build = &drone.Build{}
+	compiler.Repo = &drone.Repo{}
+	compiler.Stage = &drone.Stage{}
+	compiler.System = &drone.System{}
+	compiler.Pipeline = &resource.Pipeline{}
+	compiler.Pipeline.Clone.Disable = true
+	compiler.Pipeline.Steps = []*resource.Step{
+		{
+			Name:      "build",
+			Commands:  []string{"go build"},
+			Isolation: "process",
+		},
+	}
+
+	ir := compiler.Compile(nocontext)
+	if got, want := ir.Steps[0].Isolation, "process"; got != want {
+		t.Errorf("Want isolation %q, got %q", want, got)
+	}
+}
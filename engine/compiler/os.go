@@ -56,6 +56,18 @@ func getCommand(os, script string) (string, []string) {
 	return cmd, append(args, script)
 }
 
+// helper function returns the login shell command and
+// arguments based on the target platform to invoke the script.
+// The login shell loads the system and user profile scripts.
+func getLoginCommand(os, script string) (string, []string) {
+	switch os {
+	case "windows":
+		return "powershell", []string{"-noninteractive", "-command", script}
+	default:
+		return "/bin/bash", []string{"-l", "-e", script}
+	}
+}
+
 // helper function returns the netrc file name based on the
 // target platform.
 func getNetrc(os string) string {
@@ -67,6 +79,73 @@ func getNetrc(os string) string {
 	}
 }
 
+// helper function returns the default ssh user for the server
+// image. The image slug is matched against the user mapping,
+// for example, for marketplace images that disable root login,
+// in which case a slug ending with an asterisk matches by
+// prefix. The platform default user is returned if the image
+// slug does not match.
+func getUser(os, image string, users map[string]string) string {
+	if user, ok := users[image]; ok {
+		return user
+	}
+	var match string
+	for pattern := range users {
+		prefix := strings.TrimSuffix(pattern, "*")
+		if prefix != pattern && strings.HasPrefix(image, prefix) && len(pattern) > len(match) {
+			match = pattern
+		}
+	}
+	if match != "" {
+		return users[match]
+	}
+	switch os {
+	case "windows":
+		return "Administrator"
+	default:
+		return "root"
+	}
+}
+
+// helper function generates and returns a posix shell script
+// that fetches the script from the url, verifies the sha256
+// checksum, and executes the script. The script is not
+// executed if the checksum does not match.
+func genFetchScript(url, sum string) string {
+	return fmt.Sprintf(fetchScript, quote(url), quote(strings.ToLower(sum)))
+}
+
+// helper function quotes the string for the posix shell.
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// fetchScript is a posix shell script that fetches, verifies
+// and executes the step script.
+const fetchScript = `
+set -e
+
+url=%s
+want=%s
+script=$(mktemp)
+trap 'rm -f "$script"' EXIT
+
+if command -v curl >/dev/null 2>&1; then
+	curl -fsSL -o "$script" "$url"
+else
+	wget -q -O "$script" "$url"
+fi
+
+got=$(sha256sum "$script" 2>/dev/null || shasum -a 256 "$script")
+got=${got%%%% *}
+if [ "$got" != "$want" ]; then
+	echo "checksum mismatch for $url: want $want, got $got" >&2
+	exit 1
+fi
+
+sh -e "$script"
+`
+
 // helper function generates and returns a shell script to
 // execute the provided shell commands. The shell scripting
 // language (bash vs pwoershell) is determined by the operating
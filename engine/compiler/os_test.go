@@ -5,7 +5,14 @@
 package compiler
 
 import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/drone/runner-go/shell/bash"
@@ -93,6 +100,24 @@ func Test_getCommand(t *testing.T) {
 	}
 }
 
+func Test_getLoginCommand(t *testing.T) {
+	cmd, args := getLoginCommand("linux", "build.sh")
+	if got, want := cmd, "/bin/bash"; got != want {
+		t.Errorf("Want command %s, got %s", want, got)
+	}
+	if !reflect.DeepEqual(args, []string{"-l", "-e", "build.sh"}) {
+		t.Errorf("Unexpected args %v", args)
+	}
+
+	cmd, args = getLoginCommand("windows", "build.ps1")
+	if got, want := cmd, "powershell"; got != want {
+		t.Errorf("Want command %s, got %s", want, got)
+	}
+	if !reflect.DeepEqual(args, []string{"-noninteractive", "-command", "build.ps1"}) {
+		t.Errorf("Unexpected args %v", args)
+	}
+}
+
 func Test_getNetrc(t *testing.T) {
 	tests := []struct {
 		os   string
@@ -111,6 +136,28 @@ func Test_getNetrc(t *testing.T) {
 	}
 }
 
+func Test_getUser(t *testing.T) {
+	users := map[string]string{
+		"gitlab-20-04": "gitlab",
+		"docker-*":     "docker",
+		"docker-cu*":   "cuda",
+	}
+	tests := []struct {
+		os, image, user string
+	}{
+		{"linux", "gitlab-20-04", "gitlab"},
+		{"linux", "docker-20-04", "docker"},
+		{"linux", "docker-cuda-20-04", "cuda"},
+		{"linux", "ubuntu-20-04-x64", "root"},
+		{"windows", "windows-2019", "Administrator"},
+	}
+	for _, test := range tests {
+		if got, want := getUser(test.os, test.image, users), test.user; got != want {
+			t.Errorf("Want user %s for image %s, got %s", want, test.image, got)
+		}
+	}
+}
+
 func Test_getScript(t *testing.T) {
 	commands := []string{"go build"}
 
@@ -126,3 +173,54 @@ func Test_getScript(t *testing.T) {
 		t.Errorf("Generated invalid linux script")
 	}
 }
+
+func Test_genFetchScript(t *testing.T) {
+	script := genFetchScript("https://example.com/it's.sh", "ABCDEF")
+	if !strings.Contains(script, `url='https://example.com/it'\''s.sh'`) {
+		t.Errorf("Want quoted script url")
+	}
+	if !strings.Contains(script, "want='abcdef'") {
+		t.Errorf("Want lowercase script checksum")
+	}
+	if !strings.Contains(script, "${got%% *}") {
+		t.Errorf("Want checksum trimmed of the file name")
+	}
+}
+
+func Test_genFetchScript_Exec(t *testing.T) {
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("curl not available")
+	}
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		t.Skip("sha256sum not available")
+	}
+
+	dir, err := ioutil.TempDir("", "drone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("echo hello")
+	path := filepath.Join(dir, "script.sh")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	out, err := exec.Command("sh", "-c", genFetchScript("file://"+path, sum)).CombinedOutput()
+	if err != nil {
+		t.Errorf("Want script executed, got error %s: %s", err, out)
+	}
+	if got, want := strings.TrimSpace(string(out)), "hello"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+
+	out, err = exec.Command("sh", "-c", genFetchScript("file://"+path, strings.Repeat("0", 64))).CombinedOutput()
+	if err == nil {
+		t.Errorf("Want error when checksum does not match")
+	}
+	if strings.Contains(string(out), "hello") {
+		t.Errorf("Want script not executed when checksum does not match")
+	}
+}
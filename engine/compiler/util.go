@@ -115,3 +115,24 @@ func removeCloneDeps(spec *engine.Spec) {
 		}
 	}
 }
+
+// helper function modifies the pipeline dependency graph so that
+// a step depends on the step from which its stdin is piped.
+func configureStdinDeps(spec *engine.Spec) {
+	for _, step := range spec.Steps {
+		if step.StdinFrom == "" {
+			continue
+		}
+		var found bool
+		for _, dep := range step.DependsOn {
+			if dep == step.StdinFrom {
+				found = true
+			}
+		}
+		if !found {
+			deps := make([]string, 0, len(step.DependsOn)+1)
+			deps = append(deps, step.DependsOn...)
+			step.DependsOn = append(deps, step.StdinFrom)
+		}
+	}
+}
@@ -90,6 +90,31 @@ func Test_configureSerial(t *testing.T) {
 	}
 }
 
+func Test_configureStdinDeps(t *testing.T) {
+	before := new(engine.Spec)
+	before.Steps = []*engine.Step{
+		{Name: "build"},
+		{Name: "test", DependsOn: []string{"clone"}},
+		{Name: "package", DependsOn: []string{"test"}, StdinFrom: "build"},
+		{Name: "deploy", DependsOn: []string{"build"}, StdinFrom: "build"},
+	}
+
+	after := new(engine.Spec)
+	after.Steps = []*engine.Step{
+		{Name: "build"},
+		{Name: "test", DependsOn: []string{"clone"}},
+		{Name: "package", DependsOn: []string{"test", "build"}, StdinFrom: "build"},
+		{Name: "deploy", DependsOn: []string{"build"}, StdinFrom: "build"},
+	}
+	configureStdinDeps(before)
+
+	opts := cmpopts.IgnoreUnexported(engine.Spec{})
+	if diff := cmp.Diff(before, after, opts); diff != "" {
+		t.Errorf("Unexpected stdin dependency configuration")
+		t.Log(diff)
+	}
+}
+
 func Test_convertStaticEnv(t *testing.T) {
 	vars := map[string]*manifest.Variable{
 		"username": &manifest.Variable{Value: "octocat"},
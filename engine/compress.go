@@ -0,0 +1,96 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// compressMinSize is the minimum size of a file, in bytes,
+// that is compressed before it is uploaded. Smaller files are
+// uploaded uncompressed, since the time to decompress the file
+// on the remote server exceeds the transfer time saved.
+const compressMinSize = 32 * 1024
+
+// uploadFunc writes the file to the remote server and then
+// configures the file permissions.
+type uploadFunc func(path string, data []byte, mode uint32) error
+
+// helper function returns an upload function that writes files
+// to the remote server uncompressed.
+func rawUploader(fs filesystem, rate int64) uploadFunc {
+	return func(path string, data []byte, mode uint32) error {
+		return fs.WriteFile(path, data, mode, rate)
+	}
+}
+
+// helper function returns an upload function that writes files
+// to the remote server. If enabled, large files are compressed
+// before they are uploaded and decompressed on the remote
+// server. Files are uploaded uncompressed if gzip is not
+// installed on the remote server.
+func (e *engine) uploader(spec *Spec, client *ssh.Client, fs filesystem) uploadFunc {
+	raw := rawUploader(fs, e.opts.UploadRate)
+	if !e.opts.CompressUploads || spec.Platform.OS == "windows" {
+		return raw
+	}
+	return func(path string, data []byte, mode uint32) error {
+		if len(data) < compressMinSize || !spec.hasGzip(client) {
+			return raw(path, data, mode)
+		}
+		err := uploadCompressed(client, fs, path, data, mode, e.opts.UploadRate)
+		if err != nil {
+			return raw(path, data, mode)
+		}
+		return nil
+	}
+}
+
+// helper function compresses the file, writes the compressed
+// file to the remote server, and then decompresses the file to
+// the target path.
+func uploadCompressed(client *ssh.Client, fs filesystem, path string, data []byte, mode uint32, rate int64) error {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	err := fs.WriteFile(path+".gz", buf.Bytes(), 0600, rate)
+	if err != nil {
+		return err
+	}
+	// gzip decompresses the file to the target path, and
+	// removes the compressed file.
+	if _, err := execute(client, fmt.Sprintf("gzip -d -f %s.gz", path)); err != nil {
+		fs.Remove(path + ".gz")
+		return err
+	}
+	return fs.Chmod(path, mode)
+}
+
+// helper function returns true if gzip is installed on the
+// remote server. The result is cached for the lifetime of
+// the spec.
+func (s *Spec) hasGzip(client *ssh.Client) bool {
+	s.mu.Lock()
+	cached := s.gzip
+	s.mu.Unlock()
+	if cached != nil {
+		return *cached
+	}
+	_, err := execute(client, "command -v gzip")
+	ok := err == nil
+	s.mu.Lock()
+	s.gzip = &ok
+	s.mu.Unlock()
+	return ok
+}
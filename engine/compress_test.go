@@ -0,0 +1,135 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestUploadCompressed(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{CompressUploads: true})
+	defer closer()
+
+	client, err := engine.connect(spec.ip, spec.Server.User, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	clientftp, err := sftp.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientftp.Close()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	data := bytes.Repeat([]byte(`{"hello":"world"}`), compressMinSize)
+
+	// the compressed upload falls back to an uncompressed
+	// upload on error, and is therefore invoked directly.
+	if err := uploadCompressed(client, &sftpFS{client: clientftp}, path, data, 0640, 0); err != nil {
+		t.Error(err)
+		return
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Expect decompressed content matches the file")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+		t.Errorf("Want file mode 0640, got %s", info.Mode())
+	}
+	if _, err := os.Stat(path + ".gz"); !os.IsNotExist(err) {
+		t.Errorf("Expect compressed file removed")
+	}
+}
+
+func TestUploader(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{CompressUploads: true})
+	defer closer()
+
+	client, err := engine.connect(spec.ip, spec.Server.User, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	clientftp, err := sftp.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientftp.Close()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	data := bytes.Repeat([]byte("hello world\n"), compressMinSize)
+	if err := engine.uploader(spec, client, &sftpFS{client: clientftp})(path, data, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	if !spec.hasGzip(client) {
+		t.Errorf("Expect gzip detected on the remote server")
+	}
+	got, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(got, data) {
+		t.Errorf("Expect uploaded content matches the file")
+	}
+}
+
+func TestUploader_NoGzip(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{CompressUploads: true})
+	defer closer()
+
+	client, err := engine.connect(spec.ip, spec.Server.User, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	clientftp, err := sftp.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientftp.Close()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the file is uploaded uncompressed if gzip is not
+	// installed on the remote server.
+	gzip := false
+	spec.gzip = &gzip
+
+	path := filepath.Join(dir, "config.json")
+	data := bytes.Repeat([]byte("hello world\n"), compressMinSize)
+	if err := engine.uploader(spec, client, &sftpFS{client: clientftp})(path, data, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	got, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(got, data) {
+		t.Errorf("Expect uploaded content matches the file")
+	}
+}
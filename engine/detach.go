@@ -0,0 +1,148 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/drone/runner-go/logger"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrDetachUnsupported is returned when a detached step is
+// executed on a platform that does not support detached
+// steps.
+var ErrDetachUnsupported = errors.New("detached steps are not supported on windows")
+
+// A detached step runs in the background on the server
+// instance and survives the ssh session closing, for example,
+// to run a database used by subsequent pipeline steps. The
+// step is started by the Run method, which returns once the
+// step is started. The step output is written to a log file
+// that can be read with the Logs method, and the step is
+// stopped with the Stop method, or when the server instance
+// is destroyed.
+
+// Logs writes the output of the detached pipeline step to the
+// writer.
+func (e *engine) Logs(ctx context.Context, spec *Spec, step *Step, output io.Writer) error {
+	if spec.Platform.OS == "windows" {
+		return ErrDetachUnsupported
+	}
+	client, err := e.connect(spec.ip, spec.Server.User, e.opts.HandshakeTimeout, e.hostKeyCallback(spec))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdout = output
+	session.Stderr = output
+	logfile, _ := detachedPaths(spec.Root, step.Name)
+	return session.Run(fmt.Sprintf("cat %s", logfile))
+}
+
+// Stop stops the detached pipeline step. Stopping a step that
+// is not running is not an error.
+func (e *engine) Stop(ctx context.Context, spec *Spec, step *Step) error {
+	if spec.Platform.OS == "windows" {
+		return ErrDetachUnsupported
+	}
+	client, err := e.connect(spec.ip, spec.Server.User, e.opts.HandshakeTimeout, e.hostKeyCallback(spec))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	_, pidfile := detachedPaths(spec.Root, step.Name)
+	out, err := execute(client, stopCommand(pidfile))
+	if err != nil {
+		logger.FromContext(ctx).
+			WithError(err).
+			WithField("step", step.Name).
+			WithField("output", string(out)).
+			Debug("cannot stop detached step")
+		return err
+	}
+	return nil
+}
+
+// helper function starts the command in the background. The
+// command is started in a new session so that it is not
+// terminated when the ssh session closes.
+func runDetached(ctx context.Context, spec *Spec, client *ssh.Client, step *Step, cmd string) error {
+	if spec.Platform.OS == "windows" {
+		return ErrDetachUnsupported
+	}
+	logfile, pidfile := detachedPaths(spec.Root, step.Name)
+	out, err := execute(client, detachCommand(cmd, logfile, pidfile))
+	if err != nil {
+		logger.FromContext(ctx).
+			WithError(err).
+			WithField("step", step.Name).
+			WithField("output", string(out)).
+			Error("cannot start detached step")
+		return err
+	}
+	logger.FromContext(ctx).
+		WithField("step", step.Name).
+		WithField("log", logfile).
+		Debug("started detached step")
+	return nil
+}
+
+// helper function returns the paths of the log file and the
+// pid file of the detached pipeline step.
+func detachedPaths(root, name string) (logfile, pidfile string) {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '-'
+		}
+	}, name)
+	base := root + "/detached/" + name
+	return base + ".log", base + ".pid"
+}
+
+// helper function returns the command that starts the step
+// command in the background. The pid of the process group is
+// written to the pid file.
+func detachCommand(cmd, logfile, pidfile string) string {
+	return fmt.Sprintf(
+		"mkdir -p %s; setsid nohup sh -c %s > %s 2>&1 < /dev/null & echo $! > %s",
+		logfile[:strings.LastIndex(logfile, "/")],
+		shellQuote(cmd),
+		logfile,
+		pidfile,
+	)
+}
+
+// helper function returns the command that stops the process
+// group of the detached step.
+func stopCommand(pidfile string) string {
+	return fmt.Sprintf(
+		"test -f %s || exit 0; kill -TERM -$(cat %s) 2>/dev/null || kill -TERM $(cat %s) 2>/dev/null; rm -f %s",
+		pidfile,
+		pidfile,
+		pidfile,
+		pidfile,
+	)
+}
+
+// helper function quotes the string for the posix shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetachCommand(t *testing.T) {
+	logfile, pidfile := detachedPaths("/tmp/drone-random", "my database")
+	if got, want := logfile, "/tmp/drone-random/detached/my-database.log"; got != want {
+		t.Errorf("Want log file %q, got %q", want, got)
+	}
+	if got, want := pidfile, "/tmp/drone-random/detached/my-database.pid"; got != want {
+		t.Errorf("Want pid file %q, got %q", want, got)
+	}
+
+	got := detachCommand("/bin/sh -c 'echo hello'", logfile, pidfile)
+	want := `mkdir -p /tmp/drone-random/detached; setsid nohup sh -c '/bin/sh -c '\''echo hello'\''' > /tmp/drone-random/detached/my-database.log 2>&1 < /dev/null & echo $! > /tmp/drone-random/detached/my-database.pid`
+	if got != want {
+		t.Errorf("Want detach command %q, got %q", want, got)
+	}
+}
+
+func TestDetach_Windows(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+	spec.Platform.OS = "windows"
+
+	step := &Step{Name: "database"}
+	if err := engine.Logs(context.Background(), spec, step, new(syncBuffer)); err != ErrDetachUnsupported {
+		t.Errorf("Want error %v, got %v", ErrDetachUnsupported, err)
+	}
+	if err := engine.Stop(context.Background(), spec, step); err != ErrDetachUnsupported {
+		t.Errorf("Want error %v, got %v", ErrDetachUnsupported, err)
+	}
+}
+
+func TestRun_Detach(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spec.Root = dir
+
+	script := filepath.Join(dir, "database.sh")
+	step := &Step{
+		Name:       "database",
+		Command:    "sh",
+		Args:       []string{script},
+		Detach:     true,
+		WorkingDir: dir,
+		Files: []*File{
+			{Path: script, Mode: 0700, Data: []byte("trap 'echo stopped; exit' TERM\necho ready\nsleep 60\n")},
+		},
+	}
+
+	// the detached step must outlive the ssh session used
+	// to start the step.
+	buf := new(syncBuffer)
+	state, err := engine.Run(context.Background(), spec, step, buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if state.ExitCode != 0 {
+		t.Errorf("Want exit code 0, got %d", state.ExitCode)
+	}
+
+	logs := new(syncBuffer)
+	for i := 0; i < 50 && !strings.Contains(logs.String(), "ready"); i++ {
+		time.Sleep(time.Millisecond * 20)
+		logs = new(syncBuffer)
+		engine.Logs(context.Background(), spec, step, logs)
+	}
+	if got, want := logs.String(), "ready\n"; got != want {
+		t.Errorf("Want detached output %q, got %q", want, got)
+	}
+
+	_, pidfile := detachedPaths(dir, step.Name)
+	if _, err := os.Stat(pidfile); err != nil {
+		t.Errorf("Want pid file written for detached step")
+	}
+	if err := engine.Stop(context.Background(), spec, step); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(pidfile); !os.IsNotExist(err) {
+		t.Errorf("Want pid file removed when detached step stopped")
+	}
+
+	// the detached step traps the termination signal and
+	// writes to the log file before exiting.
+	for i := 0; i < 50 && !strings.Contains(logs.String(), "stopped"); i++ {
+		time.Sleep(time.Millisecond * 20)
+		logs = new(syncBuffer)
+		engine.Logs(context.Background(), spec, step, logs)
+	}
+	if !strings.HasSuffix(logs.String(), "stopped\n") {
+		t.Errorf("Want detached step terminated, got output %q", logs.String())
+	}
+
+	// stopping a step that is not running is not an error.
+	if err := engine.Stop(context.Background(), spec, step); err != nil {
+		t.Error(err)
+	}
+}
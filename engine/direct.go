@@ -0,0 +1,66 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrDirectSecrets is returned when a direct step defines
+// secrets, and the secrets cannot be sent with the ssh protocol.
+// The secrets are never passed on the command line, where they
+// are visible in the process list of the server instance.
+var ErrDirectSecrets = errors.New("cannot send direct step secrets: the server instance does not accept environment variables")
+
+// helper function returns the environment of a direct step,
+// including the step secrets, since there is no step script to
+// export the secrets. Only variables permitted by the allow and
+// deny lists are included.
+func directEnv(step *Step, envs map[string]string, allow, deny []string) map[string]string {
+	out := map[string]string{}
+	for k, v := range envs {
+		if permitEnv(k, allow, deny) {
+			out[k] = v
+		}
+	}
+	for _, s := range step.Secrets {
+		out[s.Env] = string(s.Data)
+	}
+	return out
+}
+
+// helper function returns the command line that executes the
+// step command. Direct step commands and arguments are quoted
+// so that they are passed to the binary without shell
+// expansion, and the environment variables that are not sent
+// with the ssh protocol are passed using the env utility. Note
+// that variables passed using the env utility are visible in
+// the process list of the server instance, and the engine fails
+// a direct step with secrets instead of passing the secrets
+// using the env utility.
+func commandLine(step *Step, command string, args []string, envs map[string]string) string {
+	if !step.Direct {
+		return command + " " + strings.Join(args, " ")
+	}
+	var parts []string
+	if len(envs) != 0 {
+		var keys []string
+		for k := range envs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts = append(parts, "env")
+		for _, k := range keys {
+			parts = append(parts, shellQuote(k+"="+envs[k]))
+		}
+	}
+	parts = append(parts, shellQuote(command))
+	for _, arg := range args {
+		parts = append(parts, shellQuote(arg))
+	}
+	return strings.Join(parts, " ")
+}
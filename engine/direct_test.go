@@ -0,0 +1,106 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCommandLine(t *testing.T) {
+	step := &Step{Direct: true}
+	envs := map[string]string{"GOOS": "linux", "QUOTE": "it's"}
+	got := commandLine(step, "printf", []string{"%s\\n", "$HOME"}, envs)
+	want := `env 'GOOS=linux' 'QUOTE=it'\''s' 'printf' '%s\n' '$HOME'`
+	if got != want {
+		t.Errorf("Want command line %s, got %s", want, got)
+	}
+
+	// the command line of a step script is not quoted.
+	got = commandLine(&Step{}, "/bin/sh", []string{"-e", "/opt/build"}, envs)
+	if want := "/bin/sh -e /opt/build"; got != want {
+		t.Errorf("Want command line %s, got %s", want, got)
+	}
+}
+
+func TestDirectEnv(t *testing.T) {
+	step := &Step{
+		Secrets: []*Secret{{Env: "PASSWORD", Data: []byte("correct-horse")}},
+	}
+	envs := map[string]string{"GOOS": "linux", "DRONE_NETRC": "secret"}
+	got := directEnv(step, envs, nil, []string{"DRONE_NETRC"})
+	if len(got) != 2 || got["GOOS"] != "linux" || got["PASSWORD"] != "correct-horse" {
+		t.Errorf("Unexpected direct step environment %v", got)
+	}
+}
+
+func TestRun_Direct(t *testing.T) {
+	for _, noenv := range []bool{false, true} {
+		engine, spec, server := newMockEngine(t, Opts{})
+		server.update(func() { server.noenv = noenv })
+
+		// the arguments are passed to the binary without shell
+		// expansion, and the environment is passed to the
+		// binary with or without the ssh protocol.
+		step := &Step{
+			Name:    "test",
+			Direct:  true,
+			Command: "sh",
+			Args:    []string{"-c", `echo "$GREETING" "$PASSWORD" "$0"`, "$NOT_EXPANDED"},
+			Envs:    map[string]string{"GREETING": "hello"},
+			Secrets: []*Secret{{Env: "PASSWORD", Data: []byte("it's")}},
+		}
+		buf := new(syncBuffer)
+		state, err := engine.Run(context.Background(), spec, step, buf)
+		server.Close()
+		// the secrets are not passed on the command line if the
+		// server instance does not accept the variables.
+		if noenv {
+			if err != ErrDirectSecrets {
+				t.Errorf("Want ErrDirectSecrets, got %v", err)
+			}
+			if strings.Contains(buf.String(), "it's") {
+				t.Errorf("Want secret not passed to the step")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if state.ExitCode != 0 {
+			t.Errorf("Want exit code 0, got %d", state.ExitCode)
+		}
+		if got, want := buf.String(), "hello it's $NOT_EXPANDED\n"; got != want {
+			t.Errorf("Want output %q with noenv %v, got %q", want, noenv, got)
+		}
+	}
+}
+
+func TestRun_DirectNoSetenv(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	server.update(func() { server.noenv = true })
+	defer server.Close()
+
+	// the environment of a direct step without secrets is
+	// passed using the env utility if the server instance
+	// does not accept the variables.
+	step := &Step{
+		Name:    "test",
+		Direct:  true,
+		Command: "sh",
+		Args:    []string{"-c", `echo "$GREETING"`},
+		Envs:    map[string]string{"GREETING": "hello"},
+	}
+	buf := new(syncBuffer)
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := buf.String(), "hello\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+}
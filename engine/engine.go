@@ -7,17 +7,688 @@ package engine
 import (
 	"context"
 	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 // Engine is the interface that must be implemented by a
 // pipeline execution engine.
 type Engine interface {
-	// Setup the pipeline environment.
+	// Setup the pipeline environment. Setup provisions and
+	// then configures the server instance.
 	Setup(context.Context, *Spec) error
 
-	// Destroy the pipeline environment.
-	Destroy(context.Context, *Spec) error
+	// Provision provisions the server instance.
+	Provision(context.Context, *Spec) error
+
+	// Configure configures a provisioned server instance. It
+	// can be invoked more than once, for example, to retry a
+	// failed configuration without re-provisioning.
+	Configure(context.Context, *Spec) error
+
+	// WaitForCloudInit blocks until cloud-init completes on
+	// a provisioned server instance, or returns an error if
+	// cloud-init fails or does not complete before the
+	// timeout.
+	WaitForCloudInit(context.Context, *Spec, time.Duration) error
+
+	// SetupOnly provisions and configures the server instance
+	// and returns the connection details for interactive use.
+	// The server instance is not destroyed, and is labeled for
+	// removal once the ttl has elapsed.
+	SetupOnly(context.Context, *Spec, time.Duration) (*Connection, error)
+
+	// Park parks the server instance for reuse by subsequent
+	// pipelines with the same cache key, instead of destroying
+	// the server instance, and returns the handle of the
+	// parked server instance.
+	Park(context.Context, *Spec, string) (*Handle, error)
+
+	// Resume claims the parked server instance and configures
+	// the server instance for the pipeline, instead of
+	// provisioning a new server instance.
+	Resume(context.Context, *Spec, *Handle) error
+
+	// FindParked returns the handle of a parked server
+	// instance with the cache key that has not expired.
+	FindParked(ctx context.Context, token, key string) (*Handle, error)
+
+	// Evict destroys the expired parked server instances.
+	Evict(ctx context.Context, token string) ([]*Handle, error)
 
-	// Run runs the pipeine step.
+	// Destroy the pipeline environment. The result indicates
+	// whether the server instance was deleted.
+	Destroy(context.Context, *Spec) (*DestroyResult, error)
+
+	// Status returns the health of the pipeline environment,
+	// combining the server instance status reported by the
+	// api with the ssh and workspace readiness.
+	Status(context.Context, *Spec) (*HealthStatus, error)
+
+	// Run runs the pipeine step. Step output is written to
+	// the writer as it is received. If the writer implements
+	// a Flush method, it is flushed after every write. If the
+	// step is killed because the context is cancelled, the
+	// state is returned with the context error.
 	Run(context.Context, *Spec, *Step, io.Writer) (*State, error)
+
+	// Logs writes the output of a detached pipeline step,
+	// started by the Run method, to the writer.
+	Logs(context.Context, *Spec, *Step, io.Writer) error
+
+	// Stop stops a detached pipeline step started by the Run
+	// method.
+	Stop(context.Context, *Spec, *Step) error
+}
+
+// Opts configures the Engine.
+type Opts struct {
+	// MaxOutput limits the number of bytes of output a
+	// pipeline step can write to the log. Output that exceeds
+	// the limit is discarded. A zero value means no limit.
+	MaxOutput int64
+
+	// MaxOutputFail fails the pipeline step if its output
+	// exceeds the configured limit.
+	MaxOutputFail bool
+
+	// OutputBufferSize buffers up to the configured number of
+	// bytes of step output, to reduce the number of small
+	// writes to the log for chatty steps. The buffered output
+	// is flushed on the flush interval, which bounds the delay
+	// before output appears in the live log. A zero value
+	// disables buffering, and a zero interval uses the default
+	// interval of one second.
+	OutputBufferSize    int
+	OutputFlushInterval time.Duration
+
+	// DumpScript writes the generated step script to the
+	// log before it is uploaded, with secrets masked. This is
+	// intended for debugging script generation.
+	DumpScript bool
+
+	// TailLines configures the engine to retain the last
+	// lines of step output, which are logged if the step
+	// fails. A zero value disables retaining output.
+	TailLines int
+
+	// UploadRate limits the rate, in bytes per second, at
+	// which files are uploaded to the server instance. A zero
+	// value means no limit.
+	UploadRate int64
+
+	// KeyLookup resolves the runner public key from the list
+	// of keys registered with the account, and only registers
+	// the key if it cannot be found.
+	KeyLookup bool
+
+	// KeyCacheTTL limits how long the registered runner key
+	// ID is cached before the key is registered again. A zero
+	// value caches the key ID until provisioning fails with a
+	// key error.
+	KeyCacheTTL time.Duration
+
+	// KeyOrigin embeds the runner name and the registration
+	// time in the name of the registered runner key, so that
+	// the key can be traced back to the runner that registered
+	// the key.
+	KeyOrigin bool
+
+	// RunnerName is the name of the runner embedded in the
+	// name of the registered runner key.
+	RunnerName string
+
+	// SkipKeyRegistration disables registration of the runner
+	// public key with the account. This is useful when the
+	// public key is baked into the server image.
+	SkipKeyRegistration bool
+
+	// SetupPhases configures the setup phases, in order. The
+	// phases can be reordered or skipped, for example, to
+	// configure an existing server instance without
+	// provisioning. A nil value runs the key, provision, ready
+	// and configure phases, in order.
+	SetupPhases []SetupPhase
+
+	// SetupRetries configures the number of times Setup is
+	// retried if provisioning or configuring the server
+	// instance fails with a transient error. A zero value
+	// disables retries.
+	SetupRetries int
+
+	// CloudInitTimeout configures Setup to wait for cloud-init
+	// to complete before the server instance is configured.
+	// A zero value disables waiting.
+	CloudInitTimeout time.Duration
+
+	// DumpCloudInit logs the tail of the cloud-init output log
+	// if the server instance cannot be configured, to surface
+	// user data script failures. This is intended for
+	// debugging.
+	DumpCloudInit bool
+
+	// ReadyPort configures Setup to wait for the tcp port to
+	// accept connections before the server instance is
+	// configured, for images that signal readiness on a port
+	// other than the ssh port. A zero value disables waiting.
+	ReadyPort int
+
+	// ReadyPath configures Setup to wait for the http path on
+	// the ready port to return a 200 status code, instead of
+	// waiting for the port to accept connections.
+	ReadyPath string
+
+	// ReadyTimeout limits the time Setup waits for the server
+	// instance to signal readiness. A zero value uses the
+	// default timeout.
+	ReadyTimeout time.Duration
+
+	// SwapSize configures Configure to create and enable a
+	// swapfile of the given size, in megabytes, on the server
+	// instance, so that small server instances do not kill
+	// build steps with spiky memory usage. The swapfile is
+	// allocated on the server instance disk, which reduces the
+	// disk space available to the pipeline by the same amount,
+	// and swapping is considerably slower than memory. The
+	// swapfile requires root privileges. A zero value disables
+	// the swapfile.
+	SwapSize int
+
+	// ParkTTL limits how long a parked server instance can be
+	// reused. Expired server instances are not reused, and are
+	// destroyed by Evict. A zero value uses the default ttl of
+	// 24 hours.
+	ParkTTL time.Duration
+
+	// DestroyDryRun logs the server instance that would be
+	// deleted by Destroy, without deleting the server instance.
+	// The teardown script is not run, the build keypair is not
+	// removed and setup is not retried in dry-run mode.
+	DestroyDryRun bool
+
+	// TeardownScript is executed on the server instance
+	// before it is destroyed, for example, to flush logs or
+	// deregister the instance from service discovery.
+	TeardownScript string
+
+	// TeardownTimeout limits the time to execute the teardown
+	// script. A zero value uses the default timeout.
+	TeardownTimeout time.Duration
+
+	// TeardownRequired prevents the server instance from being
+	// destroyed if the teardown script fails. By default the
+	// failure is logged and the server instance is destroyed.
+	TeardownRequired bool
+
+	// EnvAllow limits the environment variables exported to
+	// the server instance to the listed names. A name ending
+	// with an asterisk matches by prefix. An empty list
+	// exports all variables.
+	EnvAllow []string
+
+	// EnvDeny prevents the listed environment variables from
+	// being exported to the server instance. A name ending
+	// with an asterisk matches by prefix. The deny list takes
+	// precedence over the allow list.
+	EnvDeny []string
+
+	// InstanceFailed is invoked when the server instance stops
+	// responding during pipeline execution and its status
+	// indicates it has failed. It can be used, for example, to
+	// trigger re-provisioning.
+	InstanceFailed func(context.Context, *Spec, error)
+
+	// CACert is a PEM encoded certificate authority bundle
+	// trusted by the api client, in addition to the system
+	// certificate authorities.
+	CACert []byte
+
+	// AlertTag is applied to every server instance so that
+	// monitoring alert policies that target the tag apply to
+	// the server instance automatically.
+	AlertTag string
+
+	// ForceDestroy retries deleting a server instance that is
+	// locked by an in-flight action, such as a resize or
+	// snapshot, until the action completes or the timeout is
+	// reached. A zero timeout uses the default timeout.
+	ForceDestroy        bool
+	ForceDestroyTimeout time.Duration
+
+	// ConfirmDestroy verifies the server instance bears the
+	// runner tag and name before it is deleted, and refuses
+	// to delete a server instance that does not match. This
+	// is recommended for accounts shared with other services.
+	ConfirmDestroy bool
+
+	// DestroyResources destroys the volumes and volume
+	// snapshots associated with the server instance that bear
+	// the runner tag, together with the server instance, so
+	// that resources created by the pipeline do not leak.
+	// Untagged resources, droplet snapshots and reserved ips
+	// are not destroyed.
+	DestroyResources bool
+
+	// RootPolicy defines how the engine handles a pipeline
+	// root directory that already exists on the server
+	// instance, for example, when a droplet is reused.
+	RootPolicy RootPolicy
+
+	// ModePolicy defines how the engine handles files with
+	// suspicious permissions, such as setuid scripts or files
+	// without permissions, before the files are uploaded.
+	// The zero value does not validate file permissions.
+	ModePolicy ModePolicy
+
+	// DefaultStepTimeout limits the execution time of a
+	// pipeline step that does not specify a timeout, so that a
+	// runaway step is eventually killed even if the pipeline
+	// context does not set a deadline. A zero value means no
+	// limit.
+	DefaultStepTimeout time.Duration
+
+	// TransportExitCode is the exit code reported when the ssh
+	// session fails before the exit status of the step is
+	// received, to distinguish transport errors from commands
+	// that exit with status 255. A zero value uses the default
+	// exit code of 255.
+	TransportExitCode int
+
+	// MaxSessions limits the number of concurrent ssh
+	// sessions opened with a server instance. Steps wait for
+	// an available session instead of failing when the sshd
+	// limit is exceeded. Each step holds a session for every
+	// channel it opens concurrently. A zero value uses the
+	// default limit.
+	MaxSessions int
+
+	// MaxProvisions limits the number of server instances
+	// provisioned concurrently with an account token, to
+	// avoid exceeding the account droplet limit. Provision
+	// waits for an available slot, which is released when
+	// the server instance is destroyed. A zero value means
+	// no limit.
+	MaxProvisions int
+
+	// NamePolicy defines how the engine handles a server
+	// instance name that is already used by a server instance
+	// in the account, for example, a leftover or warm pool
+	// droplet. The zero value does not search the account for
+	// an existing server instance.
+	NamePolicy NamePolicy
+
+	// MaxLifetime limits the lifetime of a provisioned server
+	// instance, as a safety net in case the server instance is
+	// never destroyed. The server instance is destroyed once
+	// the lifetime elapses, according to the lifetime policy.
+	// A zero value means no limit.
+	MaxLifetime time.Duration
+
+	// LifetimePolicy defines how the maximum lifetime is
+	// enforced. The zero value uses an in-process timer.
+	LifetimePolicy LifetimePolicy
+
+	// NormalizeNewlines replaces CRLF line endings with LF in
+	// the output of windows pipeline steps.
+	NormalizeNewlines bool
+
+	// SanitizeOutput replaces invalid UTF-8 sequences in the
+	// step output with the unicode replacement character. This
+	// is disabled by default to preserve the exact bytes
+	// written by the step.
+	SanitizeOutput bool
+
+	// SendEnv sends the matching step environment variables
+	// with the ssh protocol instead of exporting the variables
+	// in the step script, if the server instance accepts the
+	// variables (see the sshd AcceptEnv option). A name ending
+	// with an asterisk matches by prefix. Secrets are always
+	// exported in the step script.
+	SendEnv []string
+
+	// ScanOutput scans the output of failed steps for common
+	// disk-full and out of memory signatures, so that the step
+	// state includes a diagnosis of the failure.
+	ScanOutput bool
+
+	// Signatures configures the output signatures that are
+	// scanned if output scanning is enabled. A nil value uses
+	// the default signatures.
+	Signatures []Signature
+
+	// StepTrailer configures the format of a trailer line that
+	// is written to the step output once the step completes,
+	// for example, "##[step-complete exit={exit}]", so that log
+	// processors can delimit step boundaries. The {step} and
+	// {exit} placeholders are replaced with the step name and
+	// exit code. An empty value disables the trailer.
+	StepTrailer string
+
+	// PrefixOutput prefixes every line of the step output with
+	// the step name.
+	PrefixOutput bool
+
+	// Retryable reports whether an error connecting to the
+	// server instance is transient and should be retried. A
+	// nil value retries all errors.
+	Retryable func(error) bool
+
+	// ReuseConnections caches the ssh connection with the
+	// server instance, which is reused by subsequent steps
+	// instead of dialing the server instance for every step.
+	// The connection is closed when the server instance is
+	// destroyed.
+	ReuseConnections bool
+
+	// LivenessTimeout limits the time to wait for a reused ssh
+	// connection to respond to a keepalive request before each
+	// step. A connection that does not respond is closed and
+	// the server instance is dialed again. A zero value uses
+	// the default timeout.
+	LivenessTimeout time.Duration
+
+	// RekeyThreshold configures the number of bytes sent or
+	// received after which the ssh transport is rekeyed, to
+	// reduce the rekey overhead of large uploads. Raising the
+	// threshold increases the amount of data encrypted with
+	// the same session key, which weakens the forward secrecy
+	// of long lived connections. A zero value uses the default
+	// threshold of the ssh package, which depends on the
+	// negotiated cipher.
+	RekeyThreshold uint64
+
+	// Dialer establishes the tcp connection with the server
+	// instance before the ssh handshake, for example, to
+	// connect through a socks proxy or to use a custom
+	// resolver. A nil value uses the default network dialer.
+	Dialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// HandshakeTimeout limits the time to complete the ssh
+	// handshake, including the login banner, once the tcp
+	// connection is established. A zero value uses the
+	// default timeout.
+	HandshakeTimeout time.Duration
+
+	// CompressUploads compresses large files before they are
+	// uploaded to the server instance, and decompresses the
+	// files on the server instance, if gzip is installed.
+	CompressUploads bool
+
+	// SCP uploads files to the server instance using scp
+	// instead of the sftp subsystem. Scp is used automatically
+	// if the sftp subsystem is not available.
+	SCP bool
+
+	// UploadRetries configures the number of times a file
+	// upload is retried if the sftp connection is lost during
+	// the upload. The sftp client is re-established and the
+	// upload resumes from the last chunk written. A zero value
+	// disables retries.
+	UploadRetries int
+
+	// VerifyUploads verifies the file permissions of uploaded
+	// files match the requested file permissions, since some
+	// sftp servers silently ignore chmod requests. A ChmodError
+	// is returned on mismatch. The file permissions are not
+	// verified when files are uploaded with scp, or on windows.
+	VerifyUploads bool
+
+	// SFTPMaxPacket configures the maximum size, in bytes, of
+	// the sftp packet payload. Larger packets reduce the number
+	// of round trips, which improves upload throughput on high
+	// latency links, but may not be supported by all servers.
+	// A zero value uses the default size of 32768 bytes.
+	SFTPMaxPacket int
+
+	// SFTPConcurrency configures the maximum number of
+	// concurrent sftp requests per file. File uploads are
+	// split into packets that are written concurrently, which
+	// overlaps the round trip time. A zero value uses the
+	// default of 64 concurrent requests.
+	SFTPConcurrency int
+
+	// RouteProbe probes the ssh port of the server instance
+	// before it is dialed, to distinguish a server instance
+	// that is not yet routable from a server instance that
+	// refuses the connection.
+	RouteProbe bool
+
+	// RouteFallback dials the private address of the server
+	// instance if the public address is not routable. This
+	// requires route probing.
+	RouteFallback bool
+
+	// PreferAddress enables the public IPv6 address of the
+	// server instance, and defines the address family that is
+	// dialed first. The address of the other family is dialed
+	// if the preferred address is not reachable. The zero
+	// value only dials the IPv4 address.
+	PreferAddress AddressFamily
+
+	// AuthMethods configures the ordered list of methods used
+	// to authenticate with the server instance. The ssh
+	// handshake fails once all methods are exhausted. A nil
+	// value authenticates with the runner private key and the
+	// backup keys.
+	AuthMethods []ssh.AuthMethod
+
+	// BackupKeys provides PEM encoded private keys that are
+	// tried, in order, if the runner private key is rejected by
+	// the server instance.
+	BackupKeys []string
+
+	// IdentitiesOnly restricts authentication to the runner
+	// private key, and the auth methods and backup keys are
+	// not offered. This prevents the server instance from
+	// rejecting the connection with too many authentication
+	// failures before the runner private key is offered, for
+	// example, when the auth methods include an ssh agent
+	// with many keys.
+	IdentitiesOnly bool
+
+	// HostKeyCommand is executed on the runner host after the
+	// server instance is provisioned, and writes the server
+	// instance host key to stdout. The host key is verified
+	// when connecting to the server instance. If empty, or if
+	// the command fails, the host key is not verified.
+	HostKeyCommand string
+
+	// HostKeyCallback optionally verifies the host key of the
+	// server instance, for example, using a known_hosts file.
+	// If nil, the first host key seen when the server instance
+	// is dialed is pinned, and subsequent connections with a
+	// different host key are rejected.
+	HostKeyCallback ssh.HostKeyCallback
+
+	// InsecureHostKey disables pinning of the host key. The
+	// host key is only verified if it is fetched with the
+	// host key command.
+	InsecureHostKey bool
+
+	// SecretProvider optionally returns the secrets exported
+	// to every pipeline step. The secrets are fetched once when
+	// the server instance is configured, and are written to a
+	// file in the pipeline root that is readable only by the
+	// ssh user and removed before the server instance is
+	// destroyed.
+	SecretProvider SecretProvider
+
+	// HostKeyAlgorithms restricts the host key algorithms
+	// accepted from the server instance, in order of
+	// preference, for example, ssh-ed25519. The connection
+	// fails with a HostKeyAlgorithmError if the server
+	// instance does not offer an accepted algorithm. If empty,
+	// the default algorithms of the ssh package are accepted.
+	HostKeyAlgorithms []string
+
+	// Isolation defines the minimum isolation level of the
+	// pipeline steps, for example, to confine untrusted
+	// pipeline code. A step may request a stricter isolation
+	// level. Isolation is only supported on linux.
+	Isolation string
+
+	// BeforeStep is invoked on the runner host before each
+	// pipeline step connects to the server instance, for
+	// example, to fetch a token or open a firewall port. An
+	// error aborts the step. This is distinct from the
+	// lifecycle scripts, which run on the server instance.
+	BeforeStep StepHook
+
+	// Locale optionally defines the locale exported as the
+	// LANG and LC_ALL variables of the pipeline steps, for
+	// example, en_US.UTF-8.
+	Locale string
+
+	// Timezone optionally defines the timezone exported as the
+	// TZ variable of the pipeline steps, for example, UTC.
+	Timezone string
+
+	// SetTimezone configures the timezone of the server
+	// instance with timedatectl. This has no effect if the
+	// timezone is empty.
+	SetTimezone bool
+
+	// PullImages optionally defines container images that are
+	// pre-pulled on the server instance when the server
+	// instance is configured, so that docker steps start with
+	// a warm image cache.
+	PullImages []string
+
+	// PullConcurrency defines the number of container images
+	// that are pulled in parallel. If zero, a default value
+	// is used.
+	PullConcurrency int
+
+	// PullRequired fails the pipeline if a container image
+	// cannot be pre-pulled. By default the failure is logged
+	// and ignored.
+	PullRequired bool
+
+	// Redact optionally defines regular expressions that are
+	// redacted from the step output, in addition to the
+	// secrets, for example, to redact credit card numbers or
+	// tokens with a known prefix. Matching output is replaced
+	// with ***.
+	Redact []string
+
+	// Shebang defines the policy for handling step files that
+	// begin with a shebang line, for example, a python script.
+	// If empty, the step file is wrapped.
+	Shebang ShebangPolicy
+
+	// Events receives a structured event when the pipeline
+	// environment is setup or destroyed, and when a pipeline
+	// step completes. If nil, events are discarded.
+	Events EventSink
 }
+
+// StepHook is a function invoked on the runner host for a
+// pipeline step.
+type StepHook func(ctx context.Context, step *Step) error
+
+// RootPolicy defines the policy for handling a pipeline root
+// directory that already exists on the server instance.
+type RootPolicy string
+
+// RootPolicy enumeration.
+const (
+	// RootReuse reuses the existing root directory and its
+	// contents. This is the default policy.
+	RootReuse RootPolicy = "reuse"
+
+	// RootFailIfExists fails the pipeline if the root
+	// directory already exists.
+	RootFailIfExists RootPolicy = "fail-if-exists"
+
+	// RootClean removes the existing root directory and its
+	// contents before it is re-created.
+	RootClean RootPolicy = "clean"
+)
+
+// ModePolicy defines the policy for handling files with
+// suspicious permissions.
+type ModePolicy string
+
+// ModePolicy enumeration.
+const (
+	// ModeIgnore does not validate file permissions. This is
+	// the default policy.
+	ModeIgnore ModePolicy = "ignore"
+
+	// ModeWarn logs a warning for files with suspicious
+	// permissions.
+	ModeWarn ModePolicy = "warn"
+
+	// ModeReject fails the pipeline if a file has suspicious
+	// permissions.
+	ModeReject ModePolicy = "reject"
+)
+
+// NamePolicy defines the policy for handling a server instance
+// name that is already used in the account.
+type NamePolicy string
+
+// NamePolicy enumeration.
+const (
+	// NameSuffix appends a unique suffix to the server
+	// instance name.
+	NameSuffix NamePolicy = "suffix"
+
+	// NameFail fails the pipeline if the server instance name
+	// is already used.
+	NameFail NamePolicy = "fail"
+
+	// NameReuse attaches the pipeline to the existing server
+	// instance instead of provisioning a new server instance.
+	// The existing server instance must be tagged as provisioned
+	// by the runner, otherwise the pipeline fails.
+	NameReuse NamePolicy = "reuse"
+)
+
+// LifetimePolicy defines the policy for enforcing the maximum
+// lifetime of a server instance.
+type LifetimePolicy string
+
+// LifetimePolicy enumeration.
+const (
+	// LifetimeTimer destroys the server instance with an
+	// in-process timer, which does not survive a runner
+	// restart. This is the default policy.
+	LifetimeTimer LifetimePolicy = "timer"
+
+	// LifetimeTag tags the server instance with the expiry
+	// time, and the server instance is destroyed by the
+	// reaper once the expiry time elapses. The lifetime is
+	// not enforced unless the reaper is running.
+	LifetimeTag LifetimePolicy = "tag"
+)
+
+// ShebangPolicy defines the policy for handling step files
+// that begin with a shebang line.
+type ShebangPolicy string
+
+// ShebangPolicy enumeration.
+const (
+	// ShebangWrap uploads the step file unmodified, and
+	// uploads a wrapper script that configures the step
+	// environment and executes the step file. This is the
+	// default policy.
+	ShebangWrap ShebangPolicy = "wrap"
+
+	// ShebangPrepend prepends the step environment to the
+	// step file, which replaces the shebang line as the first
+	// line of the step file.
+	ShebangPrepend ShebangPolicy = "prepend"
+)
+
+// AddressFamily defines the address family of the server
+// instance address.
+type AddressFamily string
+
+// AddressFamily enumeration.
+const (
+	AddressIPv4 AddressFamily = "ipv4"
+	AddressIPv6 AddressFamily = "ipv6"
+)
@@ -7,10 +7,16 @@ package engine
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
@@ -22,16 +28,88 @@ import (
 
 const (
 	// the time to wait for ssh connections to be established on a single
-	// ssh connection attempt.
+	// ssh connection attempt. This only bounds the tcp connection, and does
+	// not include the ssh handshake.
 	sshDialTimeout = time.Second * 10
 
+	// the time to wait for the ssh handshake to complete once the tcp
+	// connection is established. This includes the server version and login
+	// banner, key exchange and authentication, which can be slow with some
+	// hardened sshd configurations. The worst case time to connect is the
+	// sum of sshDialTimeout and the handshake timeout.
+	sshHandshakeTimeout = time.Minute
+
 	// the time to wait for our overall setup routine to connect to a recently
 	// launched droplet.
 	networkTimeout = time.Minute * 10
 )
 
+// registerKey registers the ssh public key with the account. It
+// is declared as a variable so that it can be replaced in unit
+// tests.
+var registerKey = platform.RegisterKey
+
+// provision provisions the server instance. It is declared as
+// a variable so that it can be replaced in unit tests.
+var provision = platform.Provision
+
+// isKeyError returns true if the provisioning error indicates
+// the runner key is not registered with the account. It is
+// declared as a variable so that it can be replaced in unit
+// tests.
+var isKeyError = platform.IsKeyError
+
+// destroy destroys the server instance. It is declared as a
+// variable so that it can be replaced in unit tests.
+var destroy = platform.Destroy
+
+// deregisterKey removes the ssh public key from the account. It
+// is declared as a variable so that it can be replaced in unit
+// tests.
+var deregisterKey = platform.DeregisterKey
+
+// isTransient returns true if the setup error is transient and
+// setup may succeed if retried. It is declared as a variable so
+// that it can be replaced in unit tests.
+var isTransient = platform.IsTransient
+
+// setupRetryInterval is the time to wait before setup is
+// retried. It is declared as a variable so that it can be
+// overridden in unit tests.
+var setupRetryInterval = time.Second * 10
+
+// defaultTransportExitCode is the default exit code reported
+// when the ssh session fails before the exit status is received.
+const defaultTransportExitCode = 255
+
+// killedExitCode is the exit code reported when the step is
+// killed because the context is cancelled or the step timeout
+// elapsed, consistent with a process killed by SIGKILL.
+const killedExitCode = 137
+
+// ErrOutputLimit is returned when the step output exceeds the
+// configured limit and the engine is configured to fail the step.
+var ErrOutputLimit = errors.New("step output exceeds the maximum size")
+
+// ErrStepTimeout is returned when the step is killed because
+// the step timeout elapsed.
+var ErrStepTimeout = errors.New("step exceeds the maximum execution time")
+
+// ErrRootExists is returned when the pipeline root directory
+// already exists and the engine is configured to fail.
+var ErrRootExists = errors.New("pipeline root directory already exists")
+
+// ErrNotProvisioned is returned when the provisioning setup
+// phase is skipped, and the spec does not include an existing
+// server instance.
+var ErrNotProvisioned = errors.New("server instance is not provisioned")
+
+// ErrNameExists is returned when the server instance name is
+// already used and the engine is configured to fail.
+var ErrNameExists = errors.New("server instance name already exists")
+
 // New returns a new engine.
-func New(publickeyFile, privatekeyFile string) (Engine, error) {
+func New(publickeyFile, privatekeyFile string, opts Opts) (Engine, error) {
 	publickey, err := ioutil.ReadFile(publickeyFile)
 	if err != nil {
 		return nil, err
@@ -44,10 +122,24 @@ func New(publickeyFile, privatekeyFile string) (Engine, error) {
 	if err != nil {
 		return nil, err
 	}
+	var client *http.Client
+	if len(opts.CACert) != 0 {
+		client, err = platform.NewHTTPClient(opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+	}
+	redact, err := compileRedact(opts.Redact)
+	if err != nil {
+		return nil, err
+	}
 	return &engine{
 		publickey:   string(publickey),
 		privatekey:  string(privatekey),
 		fingerprint: fingerprint,
+		client:      client,
+		opts:        opts,
+		redact:      redact,
 	}, err
 }
 
@@ -55,69 +147,459 @@ type engine struct {
 	privatekey  string
 	publickey   string
 	fingerprint string
+	client      *http.Client
+	opts        Opts
+
+	// redact is the compiled list of output redaction
+	// patterns.
+	redact []*regexp.Regexp
+
+	// keys caches the registered runner key ID, by account
+	// token, so that subsequent provisions skip registration.
+	mu   sync.Mutex
+	keys map[string]cachedKey
+
+	// provisions limits the number of concurrently
+	// provisioned server instances, by account token.
+	provisions map[string]chan struct{}
 }
 
-// Setup the pipeline environment.
-func (e *engine) Setup(ctx context.Context, spec *Spec) error {
-	err := platform.RegisterKey(ctx, platform.RegisterArgs{
-		Fingerprint: e.fingerprint,
-		Name:        "drone_runner_key",
-		Data:        e.publickey,
-		Token:       spec.Token,
-	})
+// cachedKey is a registered runner key ID.
+type cachedKey struct {
+	id      int
+	expires time.Time // Zero value if the key does not expire.
+}
+
+// Setup the pipeline environment. Setup is optionally retried
+// if provisioning or configuration fails with a transient
+// error, in which case the server instance is destroyed before
+// the next attempt.
+func (e *engine) Setup(ctx context.Context, spec *Spec) (err error) {
+	event := &Event{Type: EventSetup, Started: time.Now()}
+	defer func() {
+		event.Name = spec.Server.Name
+		event.ID = spec.id
+		e.emit(ctx, event, err)
+	}()
+
+	for attempt := 1; ; attempt++ {
+		err = e.setup(ctx, spec)
+		if err == nil || attempt > e.opts.SetupRetries || ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+		// setup is not retried in dry-run mode, since the
+		// server instance is not destroyed before the next
+		// attempt, and would be leaked.
+		if e.opts.DestroyDryRun {
+			return err
+		}
+		logger.FromContext(ctx).
+			WithError(err).
+			WithField("hostname", spec.Server.Name).
+			WithField("attempt", attempt).
+			Warn("setup failed with a transient error, retrying")
+
+		e.Destroy(ctx, spec)
+		spec.reset()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(setupRetryInterval):
+		}
+	}
+}
+
+// helper function runs the setup phases, in order, which by
+// default resolve the runner key, provision the server
+// instance, wait for the server instance to be ready, and
+// configure the server instance.
+func (e *engine) setup(ctx context.Context, spec *Spec) error {
+	phases, err := setupPhases(e.opts.SetupPhases)
+	if err != nil {
+		return err
+	}
+	// if the provisioning phase is skipped, the server
+	// instance must already be provisioned, for example, when
+	// an existing server instance is reused.
+	if !hasPhase(phases, PhaseProvision) && spec.ip == "" {
+		return ErrNotProvisioned
+	}
+	for _, phase := range phases {
+		if err := e.runPhase(ctx, spec, phase); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Provision resolves the runner key and provisions the server
+// instance.
+func (e *engine) Provision(ctx context.Context, spec *Spec) error {
+	if err := e.resolveKey(ctx, spec); err != nil {
+		return err
+	}
+	return e.provisionServer(ctx, spec)
+}
+
+// helper function registers the runner key with the account,
+// unless key registration is disabled, and retains the key with
+// the spec for provisioning.
+func (e *engine) resolveKey(ctx context.Context, spec *Spec) error {
+	ctx = platform.WithHTTPClient(ctx, e.client)
+	key, keyID, err := e.registerRunnerKey(ctx, spec)
 	if err != nil {
 		return err
 	}
+	spec.key, spec.keyID = key, keyID
+	return nil
+}
+
+// helper function waits for cloud-init to complete and for the
+// ready port to accept connections, if configured.
+func (e *engine) waitForReadiness(ctx context.Context, spec *Spec) error {
+	if timeout := e.opts.CloudInitTimeout; timeout > 0 {
+		if err := e.WaitForCloudInit(ctx, spec, timeout); err != nil {
+			return err
+		}
+	}
+	if e.opts.ReadyPort > 0 {
+		return e.waitForReady(ctx, spec)
+	}
+	return nil
+}
+
+// helper function provisions the server instance with the key
+// retained by the spec. If the key was not resolved, the server
+// instance is provisioned without the runner key, for example,
+// if the public key is baked into the server image.
+func (e *engine) provisionServer(ctx context.Context, spec *Spec) error {
+	ctx = platform.WithHTTPClient(ctx, e.client)
+	if err := e.acquireProvision(ctx, spec); err != nil {
+		return err
+	}
+
+	// the server name may include user-defined build metadata
+	// and is therefore sanitized to meet the naming constraints.
+	spec.Server.Name = platform.SanitizeName(spec.Server.Name)
+
+	// the account may already include a server instance with
+	// the same name, which is handled according to the policy.
+	existing, err := e.resolveName(ctx, spec)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		spec.id = existing.ID
+		spec.ip = existing.IP
+		spec.privateIP = existing.PrivateIP
+		e.loadHostKey(ctx, spec)
+		return nil
+	}
+
+	// optionally generate a keypair for the build. The public
+	// key is registered with the account and authorized on the
+	// server instance, which allows the build to provision child
+	// servers and ssh between them.
+	var keys []string
+	if spec.Server.Keypair {
+		spec.keypair, err = generateKeypair()
+		if err != nil {
+			logger.FromContext(ctx).
+				WithError(err).
+				Error("cannot generate build keypair")
+			return err
+		}
+		_, err = registerKey(ctx, platform.RegisterArgs{
+			Fingerprint: spec.keypair.fingerprint,
+			Name:        platform.BuildKeyName(spec.Server.Name),
+			Data:        string(spec.keypair.public),
+			Token:       spec.Token,
+		})
+		if err != nil {
+			return err
+		}
+		keys = append(keys, spec.keypair.fingerprint)
+	}
+
+	// optionally tag the server instance for monitoring
+	// alert policies.
+	var tags []string
+	if e.opts.AlertTag != "" {
+		tags = append(tags, e.opts.AlertTag)
+	}
+
+	// optionally tag the server instance with the expiry time
+	// so that the reaper enforces the maximum lifetime.
+	expiryTags, err := e.lifetimeTags(spec)
+	if err != nil {
+		return err
+	}
+	tags = append(tags, expiryTags...)
+
+	if err := checkFamily(e.opts.PreferAddress); err != nil {
+		return err
+	}
 
 	// provision the server instance.
-	instance, err := platform.Provision(ctx, platform.ProvisionArgs{
-		Key:    e.fingerprint,
-		Image:  spec.Server.Image,
+	instance, err := provision(ctx, platform.ProvisionArgs{
+		Key:    spec.key,
+		KeyID:  spec.keyID,
+		Keys:   keys,
+		Image:  imageFor(spec.Server, spec.Server.Region),
 		Name:   spec.Server.Name,
 		Region: spec.Server.Region,
 		Size:   spec.Server.Size,
+		Sizes:  spec.Server.Sizes,
 		Token:  spec.Token,
+		Labels: spec.Server.Labels,
+		Tags:   tags,
+		IPv6:   e.opts.PreferAddress != "",
 	})
 	if instance.ID > 0 {
 		spec.id = instance.ID
-		spec.ip = instance.IP
+		spec.ip, spec.fallbackIP = preferAddress(e.opts.PreferAddress, instance)
+		spec.privateIP = instance.PrivateIP
+		spec.size = instance.Size
+	}
+	if err != nil && instance.ID == 0 && isKeyError(err) {
+		// the cached key may be stale, and is removed so that
+		// the key is registered on the next attempt.
+		e.forgetRunnerKey(spec)
+	}
+	if err != nil && instance.ID == 0 {
+		// the server instance may be created server-side even
+		// though the request failed or was cancelled, and is
+		// destroyed to prevent a leak.
+		e.destroyOrphan(ctx, spec, err)
+		spec.releaseProvision()
 	}
 	if err != nil {
 		return err
 	}
 
+	e.scheduleExpiry(ctx, spec)
+	e.loadHostKey(ctx, spec)
+	return nil
+}
+
+// helper function optionally fetches the host key of the server
+// instance so that the host key is verified when connecting. If
+// the host key cannot be fetched, the host key is not verified.
+func (e *engine) loadHostKey(ctx context.Context, spec *Spec) {
+	command := e.opts.HostKeyCommand
+	if command == "" {
+		return
+	}
+	var err error
+	spec.hostkey, err = fetchHostKey(ctx, command, spec)
+	if err != nil {
+		logger.FromContext(ctx).
+			WithError(err).
+			WithField("id", spec.id).
+			WithField("ip", spec.ip).
+			Warn("cannot fetch host key, host key is not verified")
+	}
+}
+
+// helper function returns a copy of the step environment that
+// includes the server instance metadata, which is only known
+// once the server instance is provisioned.
+func serverEnv(spec *Spec, envs map[string]string) map[string]string {
+	if spec.size == "" {
+		return envs
+	}
+	out := map[string]string{}
+	for k, v := range envs {
+		out[k] = v
+	}
+	out["DRONE_SERVER_SIZE"] = spec.size
+	return out
+}
+
+// helper function returns the image for the region. The
+// default image is returned if the image is not overridden
+// for the region.
+func imageFor(server Server, region string) string {
+	if image, ok := server.Images[region]; ok && image != "" {
+		return image
+	}
+	return server.Image
+}
+
+// helper function registers the runner public key with the
+// account, unless registration is disabled, and returns the
+// fingerprint and ID of the key to authorize on the server
+// instance.
+func (e *engine) registerRunnerKey(ctx context.Context, spec *Spec) (string, int, error) {
+	if e.opts.SkipKeyRegistration {
+		logger.FromContext(ctx).
+			Debug("skipping runner key registration")
+		return "", 0, nil
+	}
+	e.mu.Lock()
+	cached, ok := e.keys[spec.Token]
+	e.mu.Unlock()
+	if ok && (cached.expires.IsZero() || time.Now().Before(cached.expires)) {
+		return e.fingerprint, cached.id, nil
+	}
+
+	name, err := e.runnerKeyName()
+	if err != nil {
+		return "", 0, err
+	}
+	id, err := registerKey(ctx, platform.RegisterArgs{
+		Fingerprint: e.fingerprint,
+		Name:        name,
+		Data:        e.publickey,
+		Token:       spec.Token,
+		Lookup:      e.opts.KeyLookup,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	cached = cachedKey{id: id}
+	if ttl := e.opts.KeyCacheTTL; ttl > 0 {
+		cached.expires = time.Now().Add(ttl)
+	}
+	e.mu.Lock()
+	if e.keys == nil {
+		e.keys = map[string]cachedKey{}
+	}
+	e.keys[spec.Token] = cached
+	e.mu.Unlock()
+	return e.fingerprint, id, nil
+}
+
+// helper function returns the name of the registered runner
+// key, which optionally embeds the key origin.
+func (e *engine) runnerKeyName() (string, error) {
+	if !e.opts.KeyOrigin {
+		return "drone_runner_key", nil
+	}
+	return platform.KeyName(platform.KeyOrigin{
+		Runner:  e.opts.RunnerName,
+		Created: time.Now(),
+	})
+}
+
+// helper function removes the cached runner key ID, in case
+// the key was removed from the account.
+func (e *engine) forgetRunnerKey(spec *Spec) {
+	e.mu.Lock()
+	delete(e.keys, spec.Token)
+	e.mu.Unlock()
+}
+
+// Configure configures the provisioned server instance. The
+// server instance can be re-configured without re-provisioning.
+func (e *engine) Configure(ctx context.Context, spec *Spec) (err error) {
+	if spec.id == 0 {
+		return errors.New("server instance not provisioned")
+	}
+
 	// establish an ssh connection with the server instance
 	// to setup the build environment (upload build scripts, etc)
 
-	client, err := dialRetry(
-		ctx,
-		spec.ip,
-		spec.Server.User,
-		e.privatekey,
-	)
+	client, err := e.dialRetry(ctx, spec)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	clientftp, err := sftp.NewClient(client)
+	fs, err := e.openFS(ctx, spec, client)
 	if err != nil {
 		logger.FromContext(ctx).
 			WithError(err).
 			WithField("hostname", spec.Server.Name).
-			WithField("ip", instance.IP).
-			WithField("id", instance.ID).
+			WithField("ip", spec.ip).
+			WithField("id", spec.id).
 			Debug("failed to create sftp client")
 		return err
 	}
-	if clientftp != nil {
-		defer clientftp.Close()
+	defer fs.Close()
+
+	// optionally log the tail of the cloud-init output log if
+	// the server instance cannot be configured, since a failed
+	// user data script is a common cause of confusing errors.
+	if e.opts.DumpCloudInit {
+		defer func() {
+			if err != nil {
+				dumpCloudInitLog(ctx, spec, fs)
+			}
+		}()
+	}
+
+	err = expandRoot(ctx, spec, client)
+	if err != nil {
+		return err
+	}
+
+	err = prepareRoot(ctx, spec, client, fs, e.opts.RootPolicy)
+	if err != nil {
+		return err
+	}
+
+	err = setHostname(ctx, spec, client)
+	if err != nil {
+		return err
+	}
+
+	err = enableSwap(ctx, spec, client, e.opts.SwapSize)
+	if err != nil {
+		return err
+	}
+
+	if e.opts.SetTimezone {
+		err = setTimezone(ctx, spec, client, e.opts.Timezone)
+		if err != nil {
+			return err
+		}
 	}
 
+	err = checkModes(ctx, spec.Files, e.opts.ModePolicy)
+	if err != nil {
+		return err
+	}
+
+	put := e.uploader(spec, client, fs)
+	err = configure(ctx, spec, fs, put)
+	if err != nil {
+		return err
+	}
+
+	err = e.uploadSecrets(ctx, spec, put)
+	if err != nil {
+		return err
+	}
+
+	err = mountSpaces(ctx, spec, client, put)
+	if err != nil {
+		return err
+	}
+
+	err = e.pullImages(ctx, spec, client)
+	if err != nil {
+		return err
+	}
+
+	logger.FromContext(ctx).
+		WithField("hostname", spec.Server.Name).
+		WithField("ip", spec.ip).
+		WithField("id", spec.id).
+		Debug("server configuration complete")
+	return nil
+}
+
+// helper function configures the server instance using the
+// server filesystem. All operations are idempotent, which means the
+// server instance can be safely re-configured.
+func configure(ctx context.Context, spec *Spec, fs filesystem, put uploadFunc) error {
 	// the pipeline workspace is created before pipeline
 	// execution begins. All files and folders created during
 	// pipeline execution are isolated to this workspace.
-	err = mkdir(clientftp, spec.Root, 0777)
+	err := fs.MkdirAll(spec.Root, 0777)
 	if err != nil {
 		logger.FromContext(ctx).
 			WithError(err).
@@ -133,7 +615,7 @@ func (e *engine) Setup(ctx context.Context, spec *Spec) error {
 		if file.IsDir == false {
 			continue
 		}
-		err = mkdir(clientftp, file.Path, file.Mode)
+		err = fs.MkdirAll(file.Path, file.Mode)
 		if err != nil {
 			logger.FromContext(ctx).
 				WithError(err).
@@ -150,7 +632,7 @@ func (e *engine) Setup(ctx context.Context, spec *Spec) error {
 		if file.IsDir == true {
 			continue
 		}
-		err = upload(clientftp, file.Path, file.Data, file.Mode)
+		err = put(file.Path, file.Data, file.Mode)
 		if err != nil {
 			logger.FromContext(ctx).
 				WithError(err).
@@ -159,64 +641,297 @@ func (e *engine) Setup(ctx context.Context, spec *Spec) error {
 		}
 	}
 
-	logger.FromContext(ctx).
-		WithField("hostname", spec.Server.Name).
-		WithField("ip", instance.IP).
-		WithField("id", instance.ID).
-		Debug("server configuration complete")
+	// the build keypair is uploaded to the home directory so
+	// that it is available to the pipeline steps.
+	if spec.keypair != nil {
+		dir, private, public := keypairPaths(spec.Platform.OS, spec.Root)
+		err = fs.MkdirAll(dir, 0700)
+		if err == nil {
+			err = put(private, spec.keypair.private, 0600)
+		}
+		if err == nil {
+			err = put(public, spec.keypair.public, 0644)
+		}
+		if err != nil {
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("path", dir).
+				Error("cannot write build keypair")
+			return err
+		}
+	}
 	return nil
 }
 
 // Destroy the pipeline environment.
-func (e *engine) Destroy(ctx context.Context, spec *Spec) error {
+func (e *engine) Destroy(ctx context.Context, spec *Spec) (_ *DestroyResult, err error) {
+	event := &Event{
+		Type:    EventDestroy,
+		Name:    spec.Server.Name,
+		ID:      spec.id,
+		Started: time.Now(),
+	}
+	defer func() {
+		e.emit(ctx, event, err)
+	}()
+
+	ctx = platform.WithHTTPClient(ctx, e.client)
+	defer spec.releaseProvision()
+
+	// in dry-run mode the server instance and the account are
+	// not modified. The server instance that would be
+	// destroyed is logged.
+	if e.opts.DestroyDryRun {
+		return e.destroyDryRun(ctx, spec)
+	}
+
+	spec.stopExpiry()
+	spec.closeConn()
+
+	// remove the build keypair from the account. An error is
+	// logged, but does not prevent the server from being
+	// destroyed.
+	if spec.keypair != nil {
+		deregisterKey(ctx, platform.DeregisterArgs{
+			Fingerprint: spec.keypair.fingerprint,
+			Token:       spec.Token,
+		})
+	}
+
 	// if the server was not successfully created
 	// exit since there is no droplet to delete.
 	if spec.id == 0 {
-		return nil
+		return &DestroyResult{Status: DestroyNotProvisioned}, nil
+	}
+	// run the teardown script before the server instance is
+	// destroyed. The spaces buckets are still mounted so that
+	// the script can flush files to the buckets.
+	if e.opts.TeardownScript != "" && spec.ip != "" {
+		if err := e.teardown(ctx, spec); err != nil && e.opts.TeardownRequired {
+			return &DestroyResult{Status: DestroyFailed}, err
+		}
 	}
+
+	// unmount the spaces buckets and remove the swapfile and
+	// secrets file before the server instance is destroyed.
+	// This is a best effort, and errors do not prevent the
+	// server instance from being destroyed.
+	if (len(spec.Mounts) != 0 || spec.swap || spec.secretsFile != "") && spec.ip != "" {
+		if client, err := e.connect(spec.ip, spec.Server.User, e.opts.HandshakeTimeout, e.hostKeyCallback(spec)); err == nil {
+			unmountSpaces(ctx, spec, client)
+			if spec.swap {
+				disableSwap(ctx, spec, client)
+			}
+			if spec.secretsFile != "" {
+				removeSecrets(ctx, spec, client)
+			}
+			client.Close()
+		}
+	}
+
 	logger.FromContext(ctx).
 		WithField("hostname", spec.Server.Name).
 		WithField("ip", spec.ip).
 		WithField("id", spec.id).
 		Debug("terminating server")
-	return platform.Destroy(ctx, platform.DestroyArgs{
-		ID:    spec.id,
-		IP:    spec.ip,
-		Token: spec.Token,
-	})
+	err = destroy(ctx, e.destroyArgs(spec))
+	switch {
+	case err == platform.ErrNotFound:
+		return &DestroyResult{Status: DestroyAlreadyGone}, nil
+	case err != nil:
+		return &DestroyResult{Status: DestroyFailed}, err
+	default:
+		return &DestroyResult{Status: DestroyDeleted}, nil
+	}
+}
+
+// helper function logs the server instance that would be
+// destroyed, without running the teardown script, removing the
+// build keypair or deleting the server instance.
+func (e *engine) destroyDryRun(ctx context.Context, spec *Spec) (*DestroyResult, error) {
+	if spec.id == 0 {
+		return &DestroyResult{Status: DestroyNotProvisioned}, nil
+	}
+	logger.FromContext(ctx).
+		WithField("hostname", spec.Server.Name).
+		WithField("ip", spec.ip).
+		WithField("id", spec.id).
+		Debug("dry run: skipping server teardown")
+	err := destroy(ctx, e.destroyArgs(spec))
+	switch {
+	case err == platform.ErrNotFound:
+		return &DestroyResult{Status: DestroyAlreadyGone}, nil
+	case err != nil:
+		return &DestroyResult{Status: DestroyFailed}, err
+	default:
+		return &DestroyResult{Status: DestroyDryRun}, nil
+	}
+}
+
+// helper function returns the arguments used to destroy the
+// server instance.
+func (e *engine) destroyArgs(spec *Spec) platform.DestroyArgs {
+	return platform.DestroyArgs{
+		ID:        spec.id,
+		IP:        spec.ip,
+		Token:     spec.Token,
+		Force:     e.opts.ForceDestroy,
+		Timeout:   e.opts.ForceDestroyTimeout,
+		Confirm:   e.opts.ConfirmDestroy,
+		Name:      spec.Server.Name,
+		DryRun:    e.opts.DestroyDryRun,
+		Resources: e.opts.DestroyResources,
+	}
 }
 
 // Run runs the pipeline step.
-func (e *engine) Run(ctx context.Context, spec *Spec, step *Step, output io.Writer) (*State, error) {
+func (e *engine) Run(ctx context.Context, spec *Spec, step *Step, output io.Writer) (state *State, err error) {
+	event := &Event{
+		Type:    EventStep,
+		Name:    step.Name,
+		ID:      spec.id,
+		Started: time.Now(),
+	}
+	defer func() {
+		if state != nil {
+			event.ExitCode = state.ExitCode
+			event.OOMKilled = state.OOMKilled
+		}
+		e.emit(ctx, event, err)
+	}()
+
+	ctx = platform.WithHTTPClient(ctx, e.client)
+
+	// validate the step file permissions before connecting
+	// to the server instance.
+	if err := checkModes(ctx, step.Files, e.opts.ModePolicy); err != nil {
+		return nil, err
+	}
+	if err := checkPriority(step.Nice, step.IONice); err != nil {
+		return nil, err
+	}
+	if err := checkIsolation(step.Isolation); err != nil {
+		return nil, err
+	}
+	if err := checkIsolation(e.opts.Isolation); err != nil {
+		return nil, err
+	}
+	isolation := isolationLevel(step, e.opts.Isolation)
+
+	// invoke the local hook before connecting to the server
+	// instance, which aborts the step if the hook fails.
+	if hook := e.opts.BeforeStep; hook != nil {
+		if err := hook(ctx, step); err != nil {
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("step", step.Name).
+				Error("local pre-step hook failed")
+			return nil, err
+		}
+	}
+
+	// wait for available session slots to prevent a burst of
+	// parallel steps from exceeding the sshd session limit. A
+	// slot is held for each channel the step opens.
+	release, err := spec.acquire(ctx, e.opts.MaxSessions, stepChannels)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	// we should not need dialRetry here, since we've already confirmed we
 	// can connect via the Setup method.
-	client, err := dial(
-		spec.ip,
-		spec.Server.User,
-		e.privatekey,
-	)
+	client, done, err := e.reuse(ctx, spec)
 	if err != nil {
-		return nil, err
+		// query the api to determine whether the server was
+		// removed or is present but unreachable.
+		return nil, probe(ctx, spec, err)
 	}
-	defer client.Close()
+	defer done()
 
-	clientftp, err := sftp.NewClient(client)
+	fs, err := e.openFS(ctx, spec, client)
 	if err != nil {
 		return nil, err
 	}
-	defer clientftp.Close()
+	defer fs.Close()
 
 	// unlike os/exec there is no good way to set environment
 	// the working directory or configure environment variables.
 	// we work around this by pre-pending these configurations
 	// to the pipeline execution script.
+	put := e.uploader(spec, client, fs)
+	envs := serverEnv(spec, step.Envs)
+	if step.ClearEnv {
+		envs = isolateEnv(spec.Platform.OS, step.Envs)
+	}
+	envs = localeEnv(spec.Platform.OS, envs, e.opts.Locale, e.opts.Timezone)
+	// each step is assigned a unique result file path, since
+	// parallel steps share the server instance.
+	resultpath := resultPath(spec.Platform.OS, step.Name)
+	envs = resultEnv(envs, resultpath)
+	// optionally send environment variables with the ssh
+	// protocol. This is not possible for detached steps, or
+	// isolated steps which do not inherit the ssh session
+	// environment.
+	var sent map[string]string
+	switch {
+	case step.Direct:
+		// direct steps do not have a step script, and all
+		// variables are sent with the ssh protocol if the
+		// server instance accepts the variables.
+		envs = directEnv(step, envs, e.opts.EnvAllow, e.opts.EnvDeny)
+		switch {
+		case !step.Detach && !step.ClearEnv && spec.acceptsEnv(client):
+			sent, envs = envs, nil
+		case len(step.Secrets) != 0:
+			logger.FromContext(ctx).
+				WithError(ErrDirectSecrets).
+				WithField("step", step.Name).
+				Error("cannot send direct step secrets")
+			return nil, ErrDirectSecrets
+		}
+	case !step.Detach && !step.ClearEnv:
+		sent, envs = e.splitEnv(spec, client, envs)
+	}
 	for _, file := range step.Files {
+		// a step file that begins with a shebang line is
+		// uploaded unmodified, and is executed by a wrapper
+		// script, since the shebang line must be the first
+		// line of the file.
+		wrap := e.opts.Shebang != ShebangPrepend && hasShebang(spec.Platform.OS, file.Data)
 		w := new(bytes.Buffer)
+		if wrap {
+			writeShebang(w)
+		}
 		writeWorkdir(w, step.WorkingDir)
+		// isolated steps do not source the pipeline secrets
+		// file, and only receive the secrets of the step.
+		if !step.ClearEnv {
+			writeSecretsFile(w, spec.secretsFile)
+		}
 		writeSecrets(w, spec.Platform.OS, step.Secrets)
-		writeEnviron(w, spec.Platform.OS, step.Envs)
-		w.Write(file.Data)
-		err = upload(clientftp, file.Path, w.Bytes(), file.Mode)
+		writeEnviron(w, spec.Platform.OS, envs, e.opts.EnvAllow, e.opts.EnvDeny)
+		if wrap {
+			script := shebangPath(file.Path)
+			err = put(script, file.Data, file.Mode|0700)
+			if err != nil {
+				logger.FromContext(ctx).
+					WithError(err).
+					WithField("path", script).
+					Error("cannot write file")
+				return nil, err
+			}
+			writeExec(w, script)
+		} else {
+			w.Write(file.Data)
+		}
+		if e.opts.DumpScript {
+			logger.FromContext(ctx).
+				WithField("path", file.Path).
+				WithField("script", maskSecrets(w.String(), step.Secrets)).
+				Info("generated step script")
+		}
+		err = put(file.Path, w.Bytes(), file.Mode)
 		if err != nil {
 			logger.FromContext(ctx).
 				WithError(err).
@@ -226,15 +941,394 @@ func (e *engine) Run(ctx context.Context, spec *Spec, step *Step, output io.Writ
 		}
 	}
 
+	// detached steps are started in the background and the
+	// step output is written to a log file on the server
+	// instance instead of the writer.
+	if step.Detach {
+		cmd := commandLine(step, step.Command, step.Args, envs)
+		if step.ClearEnv {
+			cmd = isolateCommand(spec.Platform.OS, cmd)
+		}
+		cmd = priorityCommand(spec.Platform.OS, step, cmd)
+		cmd = isolationCommand(spec.Platform.OS, isolation, spec.Root, cmd)
+		if err := runDetached(ctx, spec, client, step, cmd); err != nil {
+			return nil, err
+		}
+		return &State{Exited: true}, nil
+	}
+
+	// flush the step output after every write if the output
+	// is buffered, to prevent slow steps from appearing hung.
+	output = newFlushWriter(output)
+
+	// optionally buffer the step output to reduce the number of
+	// small writes for chatty steps. The buffered output is
+	// flushed on an interval and when the step completes.
+	if size := e.opts.OutputBufferSize; size > 0 {
+		buffered := newBufferWriter(output, size, e.opts.OutputFlushInterval)
+		defer buffered.Stop()
+		output = buffered
+	}
+
+	// optionally write a trailer line with the exit code once
+	// the step completes. The trailer is written to the step
+	// output before it is prefixed or limited.
+	var trailer *trailerWriter
+	if e.opts.StepTrailer != "" {
+		trailer = newTrailerWriter(output)
+		output = trailer
+	}
+
+	// optionally prefix every line of the step output with
+	// the step name, to identify the step that produced the
+	// line when the output of multiple steps is aggregated.
+	if e.opts.PrefixOutput {
+		output = newPrefixWriter(output, "["+step.Name+"] ")
+	}
+
+	// optionally limit the size of the step output to prevent
+	// a misbehaving step from flooding the log.
+	var limiter *limitWriter
+	if e.opts.MaxOutput > 0 {
+		limiter = newLimitWriter(output, e.opts.MaxOutput)
+		output = limiter
+	}
+
+	// optionally retain the last lines of output to provide
+	// context if the step fails. The step secrets are masked
+	// in the retained lines, since the tail is logged by the
+	// runner and not by the caller.
+	var tail *tailWriter
+	if e.opts.TailLines > 0 {
+		tail = newTailWriter(e.opts.TailLines)
+		output = io.MultiWriter(output, newMaskWriter(tail, step.Secrets))
+	}
+
+	// optionally scan the step output for signatures that
+	// diagnose the cause of a step failure.
+	var scanner *signatureWriter
+	if e.opts.ScanOutput {
+		signatures := e.opts.Signatures
+		if signatures == nil {
+			signatures = DefaultSignatures
+		}
+		scanner = newSignatureWriter(signatures)
+		output = io.MultiWriter(output, scanner)
+	}
+
+	// mask the secrets returned by the secrets provider in the
+	// step output. The step secrets are masked by the caller.
+	// The mask writer is added above the writers that retain
+	// or scan the output, so that secrets do not leak through
+	// the runner log.
+	output = newMaskWriter(output, spec.secrets)
+
+	// optionally redact output matching the redaction
+	// patterns, in addition to the secrets. The output is
+	// redacted before it is retained or scanned.
+	var redactor *redactWriter
+	if len(e.redact) != 0 {
+		redactor = newRedactWriter(output, e.redact)
+		output = redactor
+	}
+
+	// optionally normalize windows line endings in the step
+	// output. This is disabled by default to preserve the
+	// exact bytes written by the step.
+	var crlf *crlfWriter
+	if e.opts.NormalizeNewlines && spec.Platform.OS == "windows" {
+		crlf = newCRLFWriter(output)
+		output = crlf
+	}
+
+	// optionally replace invalid utf-8 sequences in the step
+	// output, which may otherwise corrupt the log encoding.
+	var sanitizer *utf8Writer
+	if e.opts.SanitizeOutput {
+		sanitizer = newUTF8Writer(output)
+		output = sanitizer
+	}
+
+	// capture the step stdout if it is piped to the stdin of
+	// a subsequent pipeline step. The captured output is
+	// limited to the maximum output size.
+	var captured *captureWriter
+	var stdout = output
+	if isPiped(spec, step.Name) {
+		captured = newCaptureWriter(e.opts.MaxOutput)
+		stdout = io.MultiWriter(output, captured)
+	}
+	// the step stdin is written to the session separately from
+	// the step script. If the stdin is piped from a previous
+	// step, the step stdin data is ignored.
+	var stdin io.Reader
+	if step.StdinFrom != "" {
+		stdin = bytes.NewReader(spec.getOutput(step.StdinFrom))
+	} else if step.Stdin != nil {
+		stdin = bytes.NewReader(step.Stdin)
+	}
+
+	log := logger.FromContext(ctx)
+
+	state = &State{
+		ExitCode:  0,
+		Exited:    true,
+		OOMKilled: false,
+	}
+
+	// flush writes the output retained by the writers that
+	// buffer partial sequences.
+	flush := func() {
+		if sanitizer != nil {
+			sanitizer.Flush()
+		}
+		if crlf != nil {
+			crlf.Flush()
+		}
+		if redactor != nil {
+			redactor.Flush()
+		}
+	}
+
+	// the step is killed once the step timeout elapses, even
+	// if the pipeline context does not set a deadline.
+	runctx := ctx
+	if timeout := e.stepTimeout(step); timeout > 0 {
+		var cancel context.CancelFunc
+		runctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// the step commands may be optionally executed in separate
+	// ssh sessions, in which case execution stops at the first
+	// failed command.
+	execs := step.Execs
+	if len(execs) == 0 {
+		execs = []*Exec{{Command: step.Command, Args: step.Args}}
+	}
+	for _, exec := range execs {
+		cmd := commandLine(step, exec.Command, exec.Args, envs)
+		if step.ClearEnv {
+			cmd = isolateCommand(spec.Platform.OS, cmd)
+		}
+		cmd = priorityCommand(spec.Platform.OS, step, cmd)
+		cmd = isolationCommand(spec.Platform.OS, isolation, spec.Root, cmd)
+		var aborterr error
+		err, aborterr = e.runSession(runctx, spec, client, cmd, sent, stdin, stdout, output)
+		if aborterr != nil && runctx.Err() != nil {
+			// the step was killed, and the output written
+			// before the step was killed is flushed. The state
+			// is returned with the context error so that the
+			// step is recorded as cancelled rather than failed.
+			flush()
+			state.ExitCode = killedExitCode
+			state.Exited = false
+			if ctx.Err() == nil {
+				log.WithField("step", step.Name).
+					WithField("timeout", e.stepTimeout(step)).
+					Debug("step timed out")
+				return state, ErrStepTimeout
+			}
+			return state, aborterr
+		}
+		if aborterr != nil {
+			return nil, aborterr
+		}
+		if err != nil {
+			state.FailedCommand = exec.Name
+			if exec.Name != "" {
+				log.WithError(err).
+					WithField("command", exec.Name).
+					Debug("step command failed")
+			}
+			break
+		}
+		// stdin is only piped to the first command.
+		stdin = nil
+	}
+
+	flush()
+
+	if captured != nil {
+		if captured.Truncated() {
+			log.WithField("limit", captured.limit).
+				Warn("piped step output exceeds the maximum size and is truncated")
+		}
+		spec.setOutput(step.Name, captured.Bytes())
+	}
+
+	// the exit status of the step command is used if it was
+	// received, otherwise the ssh session failed and the exit
+	// code is the configured transport exit code.
+	switch exiterr := err.(type) {
+	case nil:
+	case *ssh.ExitError:
+		state.ExitCode = exiterr.ExitStatus()
+	default:
+		state.ExitCode = e.transportExitCode()
+		state.TransportError = true
+		log.WithError(err).
+			WithField("step", step.Name).
+			Debug("ssh session failed without an exit status")
+	}
+
+	// the step may write a structured result file which takes
+	// precedence over the ssh exit status.
+	result, resulterr := readResult(fs, resultpath)
+	if resulterr != nil {
+		log.WithError(resulterr).
+			WithField("path", resultpath).
+			Debug("cannot read step result file")
+	} else if result != nil {
+		log.WithField("ssh.exit", state.ExitCode).
+			WithField("message", result.Message).
+			Debug("step result file found")
+		applyResult(state, result)
+		// the result file is unique to this step and is
+		// removed once read.
+		fs.Remove(resultpath)
+	}
+
+	log.WithField("ssh.exit", state.ExitCode).
+		Debug("ssh session finished")
+
+	if trailer != nil {
+		trailer.Trailer(e.opts.StepTrailer, step.Name, state.ExitCode)
+	}
+
+	if scanner != nil && state.ExitCode != 0 {
+		state.Diagnosis = scanner.Diagnosis()
+		if state.Diagnosis == DiagnosisOOM {
+			state.OOMKilled = true
+		}
+		if state.Diagnosis != "" {
+			log.WithField("step", step.Name).
+				WithField("diagnosis", state.Diagnosis).
+				Debug("step failure diagnosed")
+		}
+	}
+
+	if tail != nil && state.ExitCode != 0 {
+		log.WithField("step", step.Name).
+			WithField("exit", state.ExitCode).
+			WithField("tail", strings.Join(tail.Lines(), "\n")).
+			Info("step failed")
+	}
+
+	if limiter != nil && limiter.Truncated() {
+		log.WithField("limit", e.opts.MaxOutput).
+			Debug("step output truncated")
+		if e.opts.MaxOutputFail {
+			return state, ErrOutputLimit
+		}
+	}
+	return state, err
+}
+
+// helper function returns the exit code reported when the ssh
+// session fails before the exit status is received.
+func (e *engine) transportExitCode() int {
+	if code := e.opts.TransportExitCode; code != 0 {
+		return code
+	}
+	return defaultTransportExitCode
+}
+
+// helper function returns the step timeout, or the default
+// step timeout if the step does not specify a timeout.
+func (e *engine) stepTimeout(step *Step) time.Duration {
+	if step.Timeout > 0 {
+		return step.Timeout
+	}
+	return e.opts.DefaultStepTimeout
+}
+
+// helper function sets the operating system hostname of the
+// server instance, if it differs from the server name. The
+// server name is used as the hostname by default.
+func setHostname(ctx context.Context, spec *Spec, client *ssh.Client) error {
+	name := spec.Server.Hostname
+	if name == "" || name == spec.Server.Name {
+		return nil
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	err = session.Run(hostnameCommand(spec.Platform.OS, name))
+	if err != nil {
+		logger.FromContext(ctx).
+			WithError(err).
+			WithField("hostname", name).
+			Error("cannot set hostname")
+	}
+	return err
+}
+
+// helper function prepares the pipeline root directory
+// according to the policy, in case the directory already
+// exists on the server instance.
+func prepareRoot(ctx context.Context, spec *Spec, client *ssh.Client, fs filesystem, policy RootPolicy) error {
+	switch policy {
+	case "", RootReuse, RootFailIfExists, RootClean:
+	default:
+		return fmt.Errorf("unknown root policy: %s", policy)
+	}
+	if err := fs.Stat(spec.Root); err != nil {
+		// the directory does not exist, or cannot be read,
+		// in which case it is created by the configure step.
+		return nil
+	}
+
+	log := logger.FromContext(ctx).
+		WithField("path", spec.Root).
+		WithField("policy", policy)
+
+	switch policy {
+	case RootFailIfExists:
+		log.Error("workspace directory already exists")
+		return ErrRootExists
+	case RootClean:
+		log.Debug("removing existing workspace directory")
+		session, err := client.NewSession()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		err = session.Run(removeCommand(spec.Platform.OS, spec.Root))
+		if err != nil {
+			log.WithError(err).
+				Error("cannot remove workspace directory")
+			return err
+		}
+	default:
+		log.Debug("reusing existing workspace directory")
+	}
+	return nil
+}
+
+// helper function runs the command in a new ssh session and
+// returns the command result, which is non-nil if the command
+// fails. The error is returned if execution is aborted, for
+// example, if the context is cancelled or the server instance
+// fails.
+func (e *engine) runSession(ctx context.Context, spec *Spec, client *ssh.Client, cmd string, envs map[string]string, stdin io.Reader, stdout, stderr io.Writer) (result, err error) {
 	session, err := client.NewSession()
 	if err != nil {
 		return nil, err
 	}
 	defer session.Close()
 
-	session.Stdout = output
-	session.Stderr = output
-	cmd := step.Command + " " + strings.Join(step.Args, " ")
+	if err := setenv(session, envs); err != nil {
+		return nil, err
+	}
+
+	if stdin != nil {
+		session.Stdin = stdin
+	}
+	session.Stdout = stdout
+	session.Stderr = stderr
 
 	log := logger.FromContext(ctx)
 	log.Debug("ssh session started")
@@ -244,8 +1338,22 @@ func (e *engine) Run(ctx context.Context, spec *Spec, step *Step, output io.Writ
 		done <- session.Run(cmd)
 	}()
 
+	// the watchdog detects a server instance that stops
+	// responding during execution, for example, because of a
+	// kernel panic, so that the step fails quickly.
+	watchctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	failed := watchdog(watchctx, spec, client)
+
 	select {
 	case err = <-done:
+		return err, nil
+	case err = <-failed:
+		log.WithError(err).Error("server instance failed")
+		if e.opts.InstanceFailed != nil {
+			e.opts.InstanceFailed(ctx, spec, err)
+		}
+		return nil, err
 	case <-ctx.Done():
 		// BUG(bradrydzewski): openssh does not support the signal
 		// command and will not signal remote processes. This may
@@ -258,51 +1366,144 @@ func (e *engine) Run(ctx context.Context, spec *Spec, step *Step, output io.Writ
 		log.Debug("ssh session killed")
 		return nil, ctx.Err()
 	}
+}
 
-	state := &State{
-		ExitCode:  0,
-		Exited:    true,
-		OOMKilled: false,
+// helper function dials the ssh server using the client
+// configuration. The timeout limits the time to complete the
+// ssh handshake. If the dialer is nil, the tcp connection is
+// established with the default network dialer.
+func dial(server string, config *ssh.ClientConfig, timeout time.Duration, dialer func(context.Context, string, string) (net.Conn, error)) (*ssh.Client, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "22")
+	}
+	if timeout == 0 {
+		timeout = sshHandshakeTimeout
 	}
+	if dialer == nil {
+		dialer = new(net.Dialer).DialContext
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sshDialTimeout)
+	defer cancel()
+	conn, err := dialer(ctx, "tcp", server)
 	if err != nil {
-		state.ExitCode = 255
+		return nil, err
 	}
-	if exiterr, ok := err.(*ssh.ExitError); ok {
-		state.ExitCode = exiterr.ExitStatus()
+	// the deadline bounds the ssh handshake and is cleared once
+	// the connection is established.
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, server, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
 
-	log.WithField("ssh.exit", state.ExitCode).
-		Debug("ssh session finished")
-	return state, err
+// helper function dials the ssh server and authenticates using
+// the configured auth methods.
+func (e *engine) connect(server, username string, timeout time.Duration, callback ssh.HostKeyCallback) (*ssh.Client, error) {
+	auth, err := e.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	// the ssh handshake does not wrap the error returned by the
+	// host key callback, so the error is recorded to preserve
+	// the host key mismatch.
+	var mismatch error
+	if callback != nil {
+		verify := callback
+		callback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := verify(hostname, remote, key)
+			if errors.Is(err, ErrHostKeyMismatch) {
+				mismatch = err
+			}
+			return err
+		}
+	}
+	client, err := dial(server, e.clientConfig(username, auth, callback), timeout, e.opts.Dialer)
+	if err != nil && mismatch != nil {
+		return nil, mismatch
+	}
+	return client, hostKeyAlgorithmError(err, e.opts.HostKeyAlgorithms)
 }
 
-// helper function configures and dials the ssh server.
-func dial(server, username, privatekey string) (*ssh.Client, error) {
-	if !strings.HasSuffix(server, ":22") {
-		server = server + ":22"
+// helper function returns the ssh client configuration. If the
+// host key callback is nil, the host key is not verified.
+func (e *engine) clientConfig(username string, auth []ssh.AuthMethod, callback ssh.HostKeyCallback) *ssh.ClientConfig {
+	if callback == nil {
+		callback = ssh.InsecureIgnoreHostKey()
 	}
 	config := &ssh.ClientConfig{
 		User:            username,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth:            auth,
+		HostKeyCallback: callback,
 	}
-	pem := []byte(privatekey)
-	signer, err := ssh.ParsePrivateKey(pem)
-	if err != nil {
-		return nil, err
+	config.RekeyThreshold = e.opts.RekeyThreshold
+	config.HostKeyAlgorithms = e.opts.HostKeyAlgorithms
+	return config
+}
+
+// helper function returns the ordered list of auth methods used
+// to authenticate with the server instance. By default, the
+// runner private key is used, followed by the backup keys if
+// the runner private key is rejected. If identities only is
+// enabled, only the runner private key is used.
+func (e *engine) authMethods() ([]ssh.AuthMethod, error) {
+	if len(e.opts.AuthMethods) != 0 && !e.opts.IdentitiesOnly {
+		return e.opts.AuthMethods, nil
+	}
+	keys := append([]string{e.privatekey}, e.opts.BackupKeys...)
+	if e.opts.IdentitiesOnly {
+		keys = keys[:1]
+	}
+	var signers []ssh.Signer
+	for _, pem := range keys {
+		signer, err := ssh.ParsePrivateKey([]byte(pem))
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	// the ssh handshake tries each auth method type once, and
+	// the keys are therefore combined into a single method,
+	// which tries each key in order.
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, nil
+}
+
+// helper function returns the function used to determine whether an
+// error connecting to the server instance is retryable.
+func (e *engine) retryable() func(error) bool {
+	if e.opts.Retryable != nil {
+		return e.opts.Retryable
 	}
-	config.Auth = append(config.Auth, ssh.PublicKeys(signer))
-	return ssh.Dial("tcp", server, config)
+	return retryable
+}
+
+// helper function returns true if the error is retryable. All errors are
+// retried by default, since the ssh daemon may not be running or the
+// authorized keys may not be installed while the server instance boots.
+func retryable(error) bool {
+	return true
 }
 
 // helper function configures and dials the ssh server and retries if there is
-// an error connecting.
-func dialRetry(ctx context.Context, server, username, privatekey string) (*ssh.Client, error) {
+// an error connecting. Errors that are not retryable are returned immediately.
+func (e *engine) dialRetry(ctx context.Context, spec *Spec) (*ssh.Client, error) {
 	var err error
 	var client *ssh.Client
-	client, err = dial(server, username, privatekey)
+	username := spec.Server.User
+	timeout := e.opts.HandshakeTimeout
+	retryable := e.retryable()
+
+	client, err = e.connect(spec.ip, username, timeout, e.hostKeyCallback(spec))
 	if err == nil {
 		return client, nil
 	}
+	if !retryable(err) || isHostKeyAlgorithmError(err) || errors.Is(err, ErrHostKeyMismatch) {
+		return nil, err
+	}
 
 	ctx, cancel := context.WithTimeout(ctx, networkTimeout)
 	defer cancel()
@@ -313,13 +1514,19 @@ func dialRetry(ctx context.Context, server, username, privatekey string) (*ssh.C
 			return nil, ctx.Err()
 		default:
 		}
+
+		// optionally probe the route to the server instance
+		// before dialing, and fallback to the private address
+		// if the public address is not yet routable.
+		server := e.address(ctx, spec)
+
 		logger.FromContext(ctx).
 			WithField("host", server).
 			WithField("user", username).
 			WithField("retry_attempt", i).
 			Debug("dialing the vm")
 
-		client, err = dial(server, username, privatekey)
+		client, err = e.connect(server, username, timeout, e.hostKeyCallback(spec))
 		if err == nil {
 			return client, nil
 		}
@@ -334,6 +1541,22 @@ func dialRetry(ctx context.Context, server, username, privatekey string) (*ssh.C
 			client.Close()
 		}
 
+		if !retryable(err) || isHostKeyAlgorithmError(err) || errors.Is(err, ErrHostKeyMismatch) {
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("ip", server).
+				Debug("cannot dial vm, error is not retryable")
+			return nil, err
+		}
+
+		// optionally dial the address of the other family if
+		// the preferred address is not reachable.
+		if spec.fallbackIP != "" {
+			if client, err := e.dialFallback(ctx, spec, username, timeout); err == nil {
+				return client, nil
+			}
+		}
+
 		select {
 		case <-ctx.Done():
 			// we've been cancelled
@@ -342,25 +1565,49 @@ func dialRetry(ctx context.Context, server, username, privatekey string) (*ssh.C
 			// waiting 10 seconds before retry
 		}
 	}
-	return client, err
 }
 
-// helper function writes the file to the remote server and then
-// configures the file permissions.
-func upload(client *sftp.Client, path string, data []byte, mode uint32) error {
-	f, err := client.Create(path)
+// uploadChunkSize is the size of the chunks in which files are
+// written to the remote server. The chunks written are tracked
+// so that an interrupted upload can be resumed.
+const uploadChunkSize = 1 << 20
+
+// helper function writes the file to the remote server, starting
+// at the offset, and then configures the file permissions. The
+// file is truncated if the offset is zero. If the rate is greater
+// than zero, the upload is throttled to rate bytes per second.
+// The number of bytes written is returned, in whole chunks, so
+// that an interrupted upload can be resumed.
+func upload(client *sftp.Client, path string, data []byte, offset int64, mode uint32, rate int64) (int64, error) {
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := client.OpenFile(path, flags)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer f.Close()
-	if _, err := f.Write(data); err != nil {
-		return err
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
 	}
-	err = f.Chmod(os.FileMode(mode))
-	if err != nil {
-		return err
+	var w io.Writer = f
+	if rate > 0 {
+		w = newThrottleWriter(f, rate)
 	}
-	return nil
+	var written int64
+	for chunk := data[offset:]; len(chunk) > 0; {
+		n := len(chunk)
+		if n > uploadChunkSize {
+			n = uploadChunkSize
+		}
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return written, err
+		}
+		written += int64(n)
+		chunk = chunk[n:]
+	}
+	return written, f.Chmod(os.FileMode(mode))
 }
 
 // helper function creates the folder on the remote server and
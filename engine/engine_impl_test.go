@@ -0,0 +1,1750 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+	"github.com/drone/runner-go/logger"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRun_StdinFrom(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	spec.Steps = []*Step{
+		{Name: "build", Command: "echo", Args: []string{"hello"}},
+		{Name: "package", Command: "tr", Args: []string{"a-z", "A-Z"}, StdinFrom: "build"},
+	}
+
+	var outputs []string
+	for _, step := range spec.Steps {
+		buf := new(syncBuffer)
+		state, err := engine.Run(context.Background(), spec, step, buf)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if state.ExitCode != 0 {
+			t.Errorf("Want exit code 0, got %d", state.ExitCode)
+		}
+		outputs = append(outputs, buf.String())
+	}
+	if got, want := outputs[0], "hello\n"; got != want {
+		t.Errorf("Want build output %q, got %q", want, got)
+	}
+	if got, want := outputs[1], "HELLO\n"; got != want {
+		t.Errorf("Want piped output %q, got %q", want, got)
+	}
+}
+
+func TestImageFor(t *testing.T) {
+	server := Server{
+		Image: "docker-18-04",
+		Images: map[string]string{
+			"ams3": "snapshot-ams3",
+			"sfo2": "",
+		},
+	}
+	tests := []struct {
+		region string
+		want   string
+	}{
+		{"ams3", "snapshot-ams3"},
+		{"nyc1", "docker-18-04"},
+		{"sfo2", "docker-18-04"},
+	}
+	for _, test := range tests {
+		if got := imageFor(server, test.region); got != test.want {
+			t.Errorf("Want image %q for region %s, got %q", test.want, test.region, got)
+		}
+	}
+}
+
+func TestProvision_RegionImage(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	var image string
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		image = args.Image
+		return platform.Instance{ID: 1, IP: "1.2.3.4"}, nil
+	}
+
+	spec := &Spec{
+		Server: Server{
+			Name:   "drone-temp-foo",
+			Image:  "docker-18-04",
+			Region: "ams3",
+			Images: map[string]string{"ams3": "snapshot-ams3"},
+		},
+	}
+	if err := new(engine).Provision(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := image, "snapshot-ams3"; got != want {
+		t.Errorf("Want image %q, got %q", want, got)
+	}
+}
+
+func TestProvision_Sizes(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	var sizes []string
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		sizes = append([]string{args.Size}, args.Sizes...)
+		return platform.Instance{ID: 1, IP: "1.2.3.4", Size: "s-2vcpu-4gb"}, nil
+	}
+
+	spec := &Spec{
+		Server: Server{
+			Name:  "drone-temp-foo",
+			Size:  "s-4vcpu-8gb",
+			Sizes: []string{"s-2vcpu-4gb"},
+		},
+	}
+	if err := new(engine).Provision(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	if got := strings.Join(sizes, ","); got != "s-4vcpu-8gb,s-2vcpu-4gb" {
+		t.Errorf("Unexpected sizes %s", got)
+	}
+
+	// the size of the provisioned instance is exported to the
+	// pipeline steps.
+	envs := serverEnv(spec, map[string]string{"GOOS": "linux"})
+	if got, want := envs["DRONE_SERVER_SIZE"], "s-2vcpu-4gb"; got != want {
+		t.Errorf("Want server size %q, got %q", want, got)
+	}
+	if envs["GOOS"] != "linux" {
+		t.Errorf("Want step environment retained")
+	}
+}
+
+func TestRegisterRunnerKey(t *testing.T) {
+	var got platform.RegisterArgs
+	registerKey = func(ctx context.Context, args platform.RegisterArgs) (int, error) {
+		got = args
+		return 512189, nil
+	}
+	defer stubPlatform()()
+
+	e := &engine{fingerprint: "aa:bb", publickey: "ssh-rsa AAAA"}
+	key, id, err := e.registerRunnerKey(context.Background(), &Spec{Token: "token"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := key, "aa:bb"; got != want {
+		t.Errorf("Want key fingerprint %q, got %q", want, got)
+	}
+	if got, want := id, 512189; got != want {
+		t.Errorf("Want key id %d, got %d", want, got)
+	}
+	if got.Fingerprint != "aa:bb" || got.Token != "token" {
+		t.Errorf("Unexpected register arguments %v", got)
+	}
+}
+
+func TestRegisterRunnerKey_Origin(t *testing.T) {
+	var got platform.RegisterArgs
+	registerKey = func(ctx context.Context, args platform.RegisterArgs) (int, error) {
+		got = args
+		return 512189, nil
+	}
+	defer stubPlatform()()
+
+	e := &engine{
+		fingerprint: "aa:bb",
+		opts:        Opts{KeyOrigin: true, RunnerName: "runner-1"},
+	}
+	if _, _, err := e.registerRunnerKey(context.Background(), &Spec{Token: "token"}); err != nil {
+		t.Error(err)
+		return
+	}
+	origin, ok := platform.ParseKeyName(got.Name)
+	if !ok {
+		t.Errorf("Want key origin embedded in key name, got %q", got.Name)
+		return
+	}
+	if origin.Runner != "runner-1" {
+		t.Errorf("Want key origin runner-1, got %q", origin.Runner)
+	}
+}
+
+func TestRegisterRunnerKey_Cache(t *testing.T) {
+	var calls int
+	registerKey = func(ctx context.Context, args platform.RegisterArgs) (int, error) {
+		calls++
+		return 512189, nil
+	}
+	defer stubPlatform()()
+
+	e := &engine{fingerprint: "aa:bb"}
+	spec := &Spec{Token: "token"}
+	for i := 0; i < 2; i++ {
+		_, id, err := e.registerRunnerKey(context.Background(), spec)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if id != 512189 {
+			t.Errorf("Want key id 512189, got %d", id)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Want key registered once, got %d", calls)
+	}
+
+	// the key is registered again for a different account.
+	e.registerRunnerKey(context.Background(), &Spec{Token: "other"})
+	if calls != 2 {
+		t.Errorf("Want key registered per account, got %d", calls)
+	}
+
+	// the key is registered again once the cache is cleared.
+	e.forgetRunnerKey(spec)
+	e.registerRunnerKey(context.Background(), spec)
+	if calls != 3 {
+		t.Errorf("Want key registered after cache cleared, got %d", calls)
+	}
+}
+
+func TestRegisterRunnerKey_CacheTTL(t *testing.T) {
+	var calls int
+	registerKey = func(ctx context.Context, args platform.RegisterArgs) (int, error) {
+		calls++
+		return 512189, nil
+	}
+	defer stubPlatform()()
+
+	e := &engine{fingerprint: "aa:bb", opts: Opts{KeyCacheTTL: time.Millisecond * 50}}
+	spec := &Spec{Token: "token"}
+	e.registerRunnerKey(context.Background(), spec)
+	e.registerRunnerKey(context.Background(), spec)
+	if calls != 1 {
+		t.Errorf("Want key registered once within the ttl, got %d", calls)
+	}
+
+	// the key is registered again once the ttl has elapsed.
+	time.Sleep(time.Millisecond * 100)
+	e.registerRunnerKey(context.Background(), spec)
+	if calls != 2 {
+		t.Errorf("Want key registered after the ttl elapsed, got %d", calls)
+	}
+}
+
+func TestProvision_KeyCacheInvalidate(t *testing.T) {
+	defer stubPlatform()()
+	findByName = func(context.Context, string, string) (*platform.Instance, error) {
+		return nil, platform.ErrNotFound
+	}
+	defer mockOrphanInterval()()
+
+	var calls int
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		calls++
+		return 1, nil
+	}
+	keyerr := errors.New("ssh_keys invalid key identifiers")
+	isKeyError = func(err error) bool {
+		return err == keyerr
+	}
+	var provisionErr error
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		return platform.Instance{}, provisionErr
+	}
+
+	e := new(engine)
+	spec := &Spec{Token: "token", Server: Server{Name: "drone-temp-foo"}}
+
+	// the cached key is retained when provisioning fails for
+	// reasons unrelated to the key.
+	provisionErr = errors.New("region unavailable")
+	e.Provision(context.Background(), spec)
+	e.Provision(context.Background(), spec)
+	if calls != 1 {
+		t.Errorf("Want key registered once, got %d", calls)
+	}
+
+	// the cached key is removed when provisioning fails
+	// because the key is not registered with the account.
+	provisionErr = keyerr
+	e.Provision(context.Background(), spec)
+	provisionErr = nil
+	e.Provision(context.Background(), spec)
+	if calls != 2 {
+		t.Errorf("Want key registered after key error, got %d", calls)
+	}
+}
+
+func TestSetup_Retry(t *testing.T) {
+	defer stubPlatform()()
+	setupRetryInterval = 0
+
+	engine, spec, closer := mockEngine(t, Opts{SetupRetries: 1})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spec.Root = dir
+
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	transient := errors.New("service unavailable")
+	isTransient = func(err error) bool {
+		return err == transient
+	}
+
+	// the first attempt creates a server instance, but fails
+	// with a transient error before the network is ready.
+	addr := spec.ip
+	var attempts int
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		attempts++
+		if attempts == 1 {
+			return platform.Instance{ID: 1}, transient
+		}
+		return platform.Instance{ID: 2, IP: addr}, nil
+	}
+	var destroyed []int
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		destroyed = append(destroyed, args.ID)
+		return nil
+	}
+
+	if err := engine.Setup(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	if attempts != 2 {
+		t.Errorf("Want 2 setup attempts, got %d", attempts)
+	}
+	if len(destroyed) != 1 || destroyed[0] != 1 {
+		t.Errorf("Want the partially created server instance destroyed, got %v", destroyed)
+	}
+	if spec.id != 2 {
+		t.Errorf("Want server instance 2, got %d", spec.id)
+	}
+}
+
+func TestSetup_RetryDryRun(t *testing.T) {
+	defer stubPlatform()()
+	setupRetryInterval = 0
+
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	transient := errors.New("service unavailable")
+	isTransient = func(err error) bool {
+		return err == transient
+	}
+	var attempts int
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		attempts++
+		return platform.Instance{ID: 1}, transient
+	}
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		t.Errorf("Expect server instance not destroyed between attempts")
+		return nil
+	}
+
+	// setup is not retried in dry-run mode, and the server
+	// instance id is retained so that it can be logged.
+	engine := &engine{opts: Opts{SetupRetries: 2, DestroyDryRun: true}}
+	spec := &Spec{}
+	if err := engine.Setup(context.Background(), spec); err != transient {
+		t.Errorf("Want transient error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Want 1 setup attempt, got %d", attempts)
+	}
+	if spec.id != 1 {
+		t.Errorf("Want server instance id retained, got %d", spec.id)
+	}
+}
+
+func TestSetup_RetryPermanent(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	var attempts int
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		attempts++
+		return platform.Instance{ID: 1}, platform.ErrImageRegion
+	}
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		return nil
+	}
+
+	// permanent errors are not retried.
+	engine := &engine{opts: Opts{SetupRetries: 3}}
+	if err := engine.Setup(context.Background(), new(Spec)); err != platform.ErrImageRegion {
+		t.Errorf("Want image region error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Want 1 setup attempt, got %d", attempts)
+	}
+}
+
+func TestRegisterRunnerKey_Skip(t *testing.T) {
+	registerKey = func(ctx context.Context, args platform.RegisterArgs) (int, error) {
+		t.Errorf("Expect key registration skipped")
+		return 0, nil
+	}
+	defer stubPlatform()()
+
+	e := &engine{
+		fingerprint: "aa:bb",
+		opts:        Opts{SkipKeyRegistration: true},
+	}
+	key, id, err := e.registerRunnerKey(context.Background(), &Spec{})
+	if err != nil {
+		t.Error(err)
+	}
+	if key != "" || id != 0 {
+		t.Errorf("Expect no key when registration skipped, got %q %d", key, id)
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	defer stubPlatform()()
+
+	apierr := errors.New("api error")
+	tests := []struct {
+		id     int
+		err    error
+		status DestroyStatus
+		fail   bool
+	}{
+		{id: 0, status: DestroyNotProvisioned},
+		{id: 1, status: DestroyDeleted},
+		{id: 1, err: platform.ErrNotFound, status: DestroyAlreadyGone},
+		{id: 1, err: apierr, status: DestroyFailed, fail: true},
+	}
+	for _, test := range tests {
+		var called bool
+		destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+			called = true
+			if !args.Force {
+				t.Errorf("Expect force destroy")
+			}
+			return test.err
+		}
+		spec := &Spec{id: test.id}
+		engine := &engine{opts: Opts{ForceDestroy: true}}
+		res, err := engine.Destroy(context.Background(), spec)
+		if got, want := err != nil, test.fail; got != want {
+			t.Errorf("Want error %v for status %d, got %v", want, test.status, err)
+		}
+		if res == nil || res.Status != test.status {
+			t.Errorf("Want status %d, got %v", test.status, res)
+		}
+		if got, want := called, test.id != 0; got != want {
+			t.Errorf("Want destroy called %v, got %v", want, got)
+		}
+	}
+}
+
+func TestDestroy_DryRun(t *testing.T) {
+	defer stubPlatform()()
+	var got platform.DestroyArgs
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		got = args
+		return nil
+	}
+	engine := &engine{opts: Opts{DestroyDryRun: true}}
+	res, err := engine.Destroy(context.Background(), &Spec{id: 1})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !got.DryRun {
+		t.Errorf("Expect dry-run destroy")
+	}
+	if res.Status != DestroyDryRun {
+		t.Errorf("Want status dry-run, got %d", res.Status)
+	}
+}
+
+func TestDestroy_DryRunNoSideEffects(t *testing.T) {
+	defer stubPlatform()()
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		return nil
+	}
+	var deregistered bool
+	deregisterKey = func(context.Context, platform.DeregisterArgs) error {
+		deregistered = true
+		return nil
+	}
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "teardown")
+
+	engine, spec, server := newMockEngine(t, Opts{
+		DestroyDryRun:  true,
+		TeardownScript: "touch " + marker,
+	})
+	defer server.Close()
+	spec.swap = true
+	spec.Mounts = []*Mount{{Bucket: "cache", Path: "/cache"}}
+	spec.keypair = &keypair{fingerprint: "aa:bb"}
+
+	// the teardown script is not run, the buckets are not
+	// unmounted and the build keypair is not removed in
+	// dry-run mode.
+	res, err := engine.Destroy(context.Background(), spec)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.Status != DestroyDryRun {
+		t.Errorf("Want status dry-run, got %d", res.Status)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("Expect teardown script not run in dry-run mode")
+	}
+	if got := atomic.LoadInt32(&server.peak); got != 0 {
+		t.Errorf("Expect no ssh sessions in dry-run mode, got %d", got)
+	}
+	if deregistered {
+		t.Errorf("Expect build keypair not removed in dry-run mode")
+	}
+}
+
+func TestDestroy_Confirm(t *testing.T) {
+	defer stubPlatform()()
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		if !args.Confirm {
+			t.Errorf("Expect destroy confirmation")
+		}
+		if got, want := args.Name, "drone-temp-foo"; got != want {
+			t.Errorf("Want name %q, got %q", want, got)
+		}
+		return platform.ErrNotOwned
+	}
+	spec := &Spec{id: 1, Server: Server{Name: "drone-temp-foo"}}
+	engine := &engine{opts: Opts{ConfirmDestroy: true}}
+	res, err := engine.Destroy(context.Background(), spec)
+	if err != platform.ErrNotOwned {
+		t.Errorf("Want ErrNotOwned, got %v", err)
+	}
+	if res.Status != DestroyFailed {
+		t.Errorf("Want status %d, got %d", DestroyFailed, res.Status)
+	}
+}
+
+func TestConfigure_Rerun(t *testing.T) {
+	client, closer := mockSftp(t)
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "drone-random")
+	spec := &Spec{
+		Root: root,
+		Files: []*File{
+			{Path: filepath.Join(root, "home"), Mode: 0700, IsDir: true},
+			{Path: filepath.Join(root, "home", ".netrc"), Mode: 0600, Data: []byte("machine github.com")},
+		},
+	}
+
+	// configuring the server instance a second time must
+	// succeed and produce the same result.
+	for i := 0; i < 2; i++ {
+		if err := configure(context.Background(), spec, &sftpFS{client: client}, rawUploader(&sftpFS{client: client}, 0)); err != nil {
+			t.Errorf("Configure attempt %d failed: %s", i+1, err)
+			return
+		}
+		data, err := ioutil.ReadFile(filepath.Join(root, "home", ".netrc"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if got, want := string(data), "machine github.com"; got != want {
+			t.Errorf("Want file content %q, got %q", want, got)
+		}
+	}
+}
+
+func TestRun_Stdin(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the step script reads the environment from the prelude
+	// and the data from stdin.
+	script := filepath.Join(dir, "script.sh")
+	step := &Step{
+		Name:       "apply",
+		Command:    "sh",
+		Args:       []string{script},
+		Envs:       map[string]string{"GREETING": "hello"},
+		Stdin:      []byte("world\n"),
+		WorkingDir: dir,
+		Files: []*File{
+			{Path: script, Mode: 0700, Data: []byte("echo $GREETING\ncat -\n")},
+		},
+	}
+	buf := new(syncBuffer)
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := buf.String(), "hello\nworld\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+}
+
+func TestRun_ClearEnv(t *testing.T) {
+	// the mock server executes commands with the environment
+	// of the test process, which simulates the environment of
+	// the ssh session.
+	os.Setenv("DRONE_TEST_SESSION", "inherited")
+	defer os.Unsetenv("DRONE_TEST_SESSION")
+
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the pipeline secrets file is not sourced by the
+	// isolated step.
+	secrets := filepath.Join(dir, "drone-secrets.env")
+	if err := ioutil.WriteFile(secrets, []byte("export DRONE_TEST_SECRET=leaked\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	spec.secretsFile = secrets
+
+	script := filepath.Join(dir, "script.sh")
+	step := &Step{
+		Name:       "untrusted",
+		Command:    "sh",
+		Args:       []string{script},
+		ClearEnv:   true,
+		Envs:       map[string]string{"GOOS": "linux"},
+		WorkingDir: dir,
+		Files: []*File{
+			{Path: script, Mode: 0700, Data: []byte("echo ${DRONE_TEST_SESSION:-unset} ${DRONE_TEST_SECRET:-unset} $GOOS $PATH\n")},
+		},
+	}
+	buf := new(syncBuffer)
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := buf.String(), "unset unset linux "+isolatedPath+"\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+}
+
+func TestRun_Tail(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{TailLines: 2})
+	defer closer()
+
+	log, hook := test.NewNullLogger()
+	ctx := logger.WithContext(context.Background(), logger.Logrus(logrus.NewEntry(log)))
+
+	step := &Step{
+		Name:    "build",
+		Command: "printf",
+		Args:    []string{`'line 1\nline 2\nline 3\n'`, "&&", "exit", "1"},
+	}
+	state, _ := engine.Run(ctx, spec, step, new(syncBuffer))
+	if state == nil || state.ExitCode != 1 {
+		t.Errorf("Want exit code 1, got %v", state)
+		return
+	}
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Errorf("Expect step failure logged")
+		return
+	}
+	if got, want := entry.Data["tail"], "line 2\nline 3"; got != want {
+		t.Errorf("Want tail %q, got %q", want, got)
+	}
+}
+
+func TestRun_TailSecrets(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{TailLines: 2})
+	defer closer()
+
+	log, hook := test.NewNullLogger()
+	ctx := logger.WithContext(context.Background(), logger.Logrus(logrus.NewEntry(log)))
+
+	// the step secret printed by the failing step is masked
+	// in the tail written to the runner log.
+	step := &Step{
+		Name:    "build",
+		Command: "printf",
+		Args:    []string{`'password: correct-horse\n'`, "&&", "exit", "1"},
+		Secrets: []*Secret{{Name: "PASSWORD", Env: "PASSWORD", Data: []byte("correct-horse"), Mask: true}},
+	}
+	engine.Run(ctx, spec, step, new(syncBuffer))
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Errorf("Expect step failure logged")
+		return
+	}
+	if got, want := entry.Data["tail"], "password: [secret:password]"; got != want {
+		t.Errorf("Want tail %q, got %q", want, got)
+	}
+}
+
+func TestRun_MaxOutputFail(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{MaxOutput: 8, MaxOutputFail: true})
+	defer closer()
+
+	// the step state is returned with the error, so that the
+	// exit code of the step is not lost.
+	step := &Step{
+		Name:    "build",
+		Command: "printf",
+		Args:    []string{`'hello world\n'`, "&&", "exit", "3"},
+	}
+	state, err := engine.Run(context.Background(), spec, step, new(syncBuffer))
+	if err != ErrOutputLimit {
+		t.Errorf("Want ErrOutputLimit, got %v", err)
+	}
+	if state == nil {
+		t.Errorf("Want step state returned with the output limit error")
+		return
+	}
+	if got, want := state.ExitCode, 3; got != want {
+		t.Errorf("Want exit code %d, got %d", want, got)
+	}
+}
+
+func TestRun_TailProviderSecrets(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{TailLines: 2})
+	defer closer()
+	spec.secrets = []*Secret{{Name: "TOKEN", Data: []byte("s3cr3t"), Mask: true}}
+
+	log, hook := test.NewNullLogger()
+	ctx := logger.WithContext(context.Background(), logger.Logrus(logrus.NewEntry(log)))
+
+	// the secret returned by the secrets provider is masked
+	// in the tail written to the runner log.
+	step := &Step{
+		Name:    "build",
+		Command: "printf",
+		Args:    []string{`'token: s3cr3t\n'`, "&&", "exit", "1"},
+	}
+	engine.Run(ctx, spec, step, new(syncBuffer))
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Errorf("Expect step failure logged")
+		return
+	}
+	if got, want := entry.Data["tail"], "token: [secret:token]"; got != want {
+		t.Errorf("Want tail %q, got %q", want, got)
+	}
+}
+
+func TestRun_StepTrailer(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{
+		StepTrailer:  "##[step-complete exit={exit}]",
+		PrefixOutput: true,
+	})
+	defer closer()
+
+	step := &Step{
+		Name:    "build",
+		Command: "printf",
+		Args:    []string{"hello", "&&", "exit", "3"},
+	}
+	buf := new(syncBuffer)
+	state, _ := engine.Run(context.Background(), spec, step, buf)
+	if state == nil || state.ExitCode != 3 {
+		t.Errorf("Want exit code 3, got %v", state)
+		return
+	}
+	// the trailer is written on a new line, and is not
+	// prefixed with the step name.
+	if got, want := buf.String(), "[build] hello\n##[step-complete exit=3]\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+}
+
+func TestRun_Execs(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	step := &Step{
+		Name: "build",
+		Execs: []*Exec{
+			{Name: "echo hello", Command: "echo", Args: []string{"hello"}},
+			{Name: "exit 3", Command: "exit", Args: []string{"3"}},
+			{Name: "echo unreachable", Command: "echo", Args: []string{"unreachable"}},
+		},
+	}
+	buf := new(syncBuffer)
+	state, err := engine.Run(context.Background(), spec, step, buf)
+	if _, ok := err.(*ssh.ExitError); !ok {
+		t.Errorf("Want exit error, got %v", err)
+		return
+	}
+	if got, want := state.ExitCode, 3; got != want {
+		t.Errorf("Want exit code %d, got %d", want, got)
+	}
+	if got, want := state.FailedCommand, "exit 3"; got != want {
+		t.Errorf("Want failed command %q, got %q", want, got)
+	}
+	if got, want := buf.String(), "hello\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+}
+
+func TestRun_DefaultStepTimeout(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{DefaultStepTimeout: time.Millisecond * 100})
+	defer closer()
+
+	// the pipeline context does not set a deadline, and the
+	// step is killed once the default step timeout elapses.
+	step := &Step{Name: "build", Command: "sleep", Args: []string{"5"}}
+	start := time.Now()
+	state, err := engine.Run(context.Background(), spec, step, new(syncBuffer))
+	if err != ErrStepTimeout {
+		t.Errorf("Want step timeout error, got %v", err)
+	}
+	if state == nil || state.ExitCode != killedExitCode {
+		t.Errorf("Want killed exit code, got %v", state)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*4 {
+		t.Errorf("Want step killed by the default timeout, took %s", elapsed)
+	}
+}
+
+func TestRun_StepTimeout(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{DefaultStepTimeout: time.Millisecond * 100})
+	defer closer()
+
+	// the step timeout takes precedence over the default
+	// step timeout.
+	step := &Step{
+		Name:    "build",
+		Command: "sleep",
+		Args:    []string{"0.5"},
+		Timeout: time.Second * 5,
+	}
+	state, err := engine.Run(context.Background(), spec, step, new(syncBuffer))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if state.ExitCode != 0 {
+		t.Errorf("Want exit code 0, got %d", state.ExitCode)
+	}
+
+	// the pipeline context error is returned if the pipeline
+	// is cancelled before the step timeout elapses.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, err = engine.Run(ctx, spec, step, new(syncBuffer))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Want deadline exceeded, got %v", err)
+	}
+}
+
+func TestRun_BeforeStep(t *testing.T) {
+	buf := new(syncBuffer)
+	errHook := errors.New("cannot open firewall")
+	var hookErr error
+	engine, spec, closer := mockEngine(t, Opts{
+		BeforeStep: func(ctx context.Context, step *Step) error {
+			// the hook writes to the step output to verify
+			// the hook is invoked before the step.
+			buf.Write([]byte("hook " + step.Name + "\n"))
+			return hookErr
+		},
+	})
+	defer closer()
+
+	// the hook is invoked before the step runs on the server
+	// instance.
+	step := &Step{Name: "build", Command: "echo", Args: []string{"hello"}}
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := buf.String(), "hook build\nhello\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+
+	// the hook error aborts the step.
+	buf = new(syncBuffer)
+	hookErr = errHook
+	state, err := engine.Run(context.Background(), spec, step, buf)
+	if err != errHook {
+		t.Errorf("Want hook error, got %v", err)
+	}
+	if state != nil {
+		t.Errorf("Want no step state")
+	}
+	if got, want := buf.String(), "hook build\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+}
+
+func TestRun_Cancel(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{SanitizeOutput: true})
+	defer closer()
+
+	// the step writes an incomplete utf-8 sequence, which is
+	// retained by the writer until the output is flushed.
+	step := &Step{Name: "build", Command: "printf", Args: []string{`'hello\342\202'`, "&&", "sleep", "5"}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	buf := new(syncBuffer)
+	state, err := engine.Run(ctx, spec, step, buf)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Want deadline exceeded, got %v", err)
+	}
+	if state == nil {
+		t.Errorf("Want state returned when the step is cancelled")
+		return
+	}
+	if state.Exited {
+		t.Errorf("Want step not exited")
+	}
+	if got, want := state.ExitCode, killedExitCode; got != want {
+		t.Errorf("Want exit code %d, got %d", want, got)
+	}
+	if got, want := buf.String(), "hello\uFFFD"; got != want {
+		t.Errorf("Want output flushed %q, got %q", want, got)
+	}
+}
+
+func TestRun_ExitCode255(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{TransportExitCode: -1})
+	defer closer()
+
+	// a command that exits 255 reports the exit status of
+	// the command, and is not a transport error.
+	step := &Step{Name: "build", Command: "exit", Args: []string{"255"}}
+	state, err := engine.Run(context.Background(), spec, step, new(syncBuffer))
+	if _, ok := err.(*ssh.ExitError); !ok {
+		t.Errorf("Want exit error, got %v", err)
+		return
+	}
+	if got, want := state.ExitCode, 255; got != want {
+		t.Errorf("Want exit code %d, got %d", want, got)
+	}
+	if state.TransportError {
+		t.Errorf("Expect exit status is not a transport error")
+	}
+}
+
+func TestRun_StepResult(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	// the step writes the result file to the location
+	// exported in the environment, and the exit code in the
+	// result file takes precedence over the ssh exit status.
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "script.sh")
+	step := &Step{
+		Name:       "build",
+		Command:    "sh",
+		Args:       []string{script},
+		WorkingDir: dir,
+		Files: []*File{
+			{Path: script, Mode: 0700, Data: []byte(`echo '{"exit_code": 3}' > "$DRONE_STEP_RESULT"; echo "$DRONE_STEP_RESULT"` + "\n")},
+		},
+	}
+	buf := new(syncBuffer)
+	state, err := engine.Run(context.Background(), spec, step, buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := state.ExitCode, 3; got != want {
+		t.Errorf("Want exit code %d, got %d", want, got)
+	}
+	path := strings.TrimSpace(buf.String())
+	if !strings.Contains(path, "drone-step-result-build-") {
+		t.Errorf("Unexpected result path %q", path)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Want result file removed after the step completes")
+	}
+}
+
+func TestRun_TransportError(t *testing.T) {
+	tests := []struct {
+		opts Opts
+		code int
+	}{
+		{opts: Opts{}, code: 255},
+		{opts: Opts{TransportExitCode: -1}, code: -1},
+	}
+	for _, test := range tests {
+		engine, spec, server := newMockEngine(t, test.opts)
+		server.update(func() { server.noexit = true })
+
+		// the session is closed before the exit status of the
+		// command is received.
+		step := &Step{Name: "build", Command: "exit", Args: []string{"0"}}
+		state, err := engine.Run(context.Background(), spec, step, new(syncBuffer))
+		server.Close()
+		if _, ok := err.(*ssh.ExitMissingError); !ok {
+			t.Errorf("Want exit missing error, got %v", err)
+			continue
+		}
+		if got, want := state.ExitCode, test.code; got != want {
+			t.Errorf("Want exit code %d, got %d", want, got)
+		}
+		if !state.TransportError {
+			t.Errorf("Expect transport error")
+		}
+	}
+}
+
+func TestRun_NormalizeNewlines(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{NormalizeNewlines: true})
+	defer closer()
+	spec.Platform.OS = "windows"
+
+	step := &Step{
+		Name:    "build",
+		Command: "printf",
+		Args:    []string{`'hello\r\nworld\r\n'`},
+	}
+	buf := new(syncBuffer)
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := buf.String(), "hello\nworld\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+}
+
+func TestRun_SanitizeOutput(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{SanitizeOutput: true})
+	defer closer()
+
+	step := &Step{
+		Name:    "build",
+		Command: "printf",
+		Args:    []string{`'caf\351 caf\303\251\n'`},
+	}
+	buf := new(syncBuffer)
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := buf.String(), "caf\ufffd caf\u00e9\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+}
+
+func TestRun_Flush(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	step := &Step{
+		Name:    "build",
+		Command: "echo",
+		Args:    []string{"hello", "&&", "sleep", "0.1", "&&", "echo", "world"},
+	}
+	buf := new(flushBuffer)
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	// the output is flushed as it is written, before the
+	// step completes.
+	if len(buf.flushed) < 2 || buf.flushed[0] != len("hello\n") {
+		t.Errorf("Expect output flushed incrementally, got %v", buf.flushed)
+	}
+}
+
+func TestRun_MaxSessions(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{MaxSessions: 4})
+	defer server.Close()
+
+	// each step opens an sftp and an exec channel, and holds
+	// a session for each channel. The limit allows headroom
+	// for a channel that is closing.
+	atomic.StoreInt32(&server.limit, 5)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			step := &Step{
+				Name:    "sleep",
+				Command: "sleep",
+				Args:    []string{"0.1"},
+			}
+			_, err := engine.Run(context.Background(), spec, step, new(syncBuffer))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Want step to wait for a session, got %s", err)
+		}
+	}
+	if got := atomic.LoadInt32(&server.peak); got > 5 {
+		t.Errorf("Want at most 5 open channels, got %d", got)
+	}
+}
+
+func TestRun_MaxSessionsCancel(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{MaxSessions: 1})
+	defer closer()
+
+	release, err := spec.acquire(context.Background(), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	step := &Step{Name: "echo", Command: "echo"}
+	state, err := engine.Run(ctx, spec, step, new(syncBuffer))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Want deadline exceeded, got %v", err)
+	}
+	if state != nil {
+		t.Errorf("Want nil state")
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	server.Close()
+
+	// the default predicate retries the connection until the
+	// context deadline is exceeded.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err := engine.dialRetry(ctx, spec)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Want deadline exceeded, got %v", err)
+	}
+}
+
+func TestDialRetry_Predicate(t *testing.T) {
+	var attempts int
+	engine, spec, server := newMockEngine(t, Opts{
+		Retryable: func(err error) bool {
+			attempts++
+			return false
+		},
+	})
+	server.Close()
+
+	// the custom predicate prevents the connection from being
+	// retried, and the dial error is returned immediately.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := engine.dialRetry(ctx, spec)
+	if err == nil || err == context.DeadlineExceeded {
+		t.Errorf("Want dial error, got %v", err)
+	}
+	if got, want := attempts, 1; got != want {
+		t.Errorf("Want %d attempts, got %d", want, got)
+	}
+}
+
+func TestDial_SlowBanner(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+	server.update(func() { server.delay = time.Millisecond * 200 })
+
+	_, err := engine.connect(spec.ip, "root", time.Millisecond*50, nil)
+	if err == nil {
+		t.Errorf("Expect handshake timeout")
+	}
+
+	client, err := engine.connect(spec.ip, "root", time.Second*5, nil)
+	if err != nil {
+		t.Errorf("Expect handshake completes with slow banner, got %s", err)
+		return
+	}
+	client.Close()
+}
+
+func TestClientConfig_RekeyThreshold(t *testing.T) {
+	engine := &engine{}
+	if got := engine.clientConfig("root", nil, nil).RekeyThreshold; got != 0 {
+		t.Errorf("Want default rekey threshold, got %d", got)
+	}
+	engine.opts.RekeyThreshold = 1 << 32
+	if got, want := engine.clientConfig("root", nil, nil).RekeyThreshold, uint64(1<<32); got != want {
+		t.Errorf("Want rekey threshold %d, got %d", want, got)
+	}
+}
+
+func TestDial_RekeyThreshold(t *testing.T) {
+	// a small threshold rekeys the connection many times
+	// while the file is uploaded.
+	engine, spec, closer := mockEngine(t, Opts{RekeyThreshold: 4096})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	path := filepath.Join(dir, "data")
+	spec.Root = filepath.Join(dir, "drone-random")
+	spec.Files = []*File{{Path: path, Mode: 0600, Data: data}}
+	if err := engine.Configure(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Want uploaded file content unchanged")
+	}
+}
+
+func TestDial_Dialer(t *testing.T) {
+	var addrs []string
+	engine, spec, closer := mockEngine(t, Opts{
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			addrs = append(addrs, network+"://"+addr)
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	})
+	defer closer()
+
+	client, err := engine.connect(spec.ip, "root", 0, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	client.Close()
+	if len(addrs) != 1 || addrs[0] != "tcp://"+spec.ip {
+		t.Errorf("Want dialer invoked with the server address, got %v", addrs)
+	}
+}
+
+func TestDial_DialerError(t *testing.T) {
+	errDial := errors.New("proxy unavailable")
+	engine, spec, closer := mockEngine(t, Opts{
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, errDial
+		},
+	})
+	defer closer()
+
+	_, err := engine.connect(spec.ip, "root", 0, nil)
+	if err != errDial {
+		t.Errorf("Want dialer error, got %v", err)
+	}
+}
+
+func TestDial_BackupKey(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+
+	// the runner private key is replaced with a key that is
+	// not authorized by the server.
+	authorized := engine.privatekey
+	kp, err := generateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.privatekey = string(kp.private)
+	if _, err := engine.connect(spec.ip, "root", 0, nil); err == nil {
+		t.Errorf("Expect error when runner key is rejected")
+	}
+
+	engine.opts.BackupKeys = []string{authorized}
+	client, err := engine.connect(spec.ip, "root", 0, nil)
+	if err != nil {
+		t.Errorf("Expect backup key accepted, got %s", err)
+		return
+	}
+	client.Close()
+}
+
+func TestDial_AuthMethods(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+	server.update(func() {
+		server.config.PasswordCallback = func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("password rejected")
+		}
+	})
+
+	signer, err := ssh.ParsePrivateKey([]byte(engine.privatekey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first auth method is rejected and the second auth
+	// method is accepted by the server.
+	engine.opts.AuthMethods = []ssh.AuthMethod{
+		ssh.Password("password"),
+		ssh.PublicKeys(signer),
+	}
+	client, err := engine.connect(spec.ip, "root", 0, nil)
+	if err != nil {
+		t.Errorf("Expect second auth method accepted, got %s", err)
+		return
+	}
+	client.Close()
+
+	// the handshake fails once all auth methods are rejected.
+	engine.opts.AuthMethods = []ssh.AuthMethod{
+		ssh.Password("password"),
+	}
+	if _, err := engine.connect(spec.ip, "root", 0, nil); err == nil {
+		t.Errorf("Expect error when all auth methods are rejected")
+	}
+}
+
+func TestDial_IdentitiesOnly(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+	server.update(func() { server.config.MaxAuthTries = 2 })
+
+	signer, err := ssh.ParsePrivateKey([]byte(engine.privatekey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signers []ssh.Signer
+	for i := 0; i < 3; i++ {
+		kp, err := generateKeypair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := ssh.ParsePrivateKey(kp.private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers = append(signers, other)
+	}
+
+	// the server rejects the connection with too many
+	// authentication failures before the runner private key
+	// is offered.
+	engine.opts.AuthMethods = []ssh.AuthMethod{
+		ssh.PublicKeys(append(signers, signer)...),
+	}
+	if _, err := engine.connect(spec.ip, "root", 0, nil); err == nil {
+		t.Errorf("Expect error when too many keys are offered")
+	}
+
+	// only the runner private key is offered.
+	engine.opts.IdentitiesOnly = true
+	client, err := engine.connect(spec.ip, "root", 0, nil)
+	if err != nil {
+		t.Errorf("Expect runner key accepted, got %s", err)
+		return
+	}
+	client.Close()
+}
+
+func TestConfigure_RootPolicy(t *testing.T) {
+	tests := []struct {
+		policy RootPolicy
+		err    error
+		stale  bool
+	}{
+		{policy: "", stale: true},
+		{policy: RootReuse, stale: true},
+		{policy: RootFailIfExists, err: ErrRootExists, stale: true},
+		{policy: RootClean, stale: false},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "drone-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		// simulate a stale workspace from a previous build.
+		stale := filepath.Join(dir, "stale.txt")
+		if err := ioutil.WriteFile(stale, []byte("stale"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		engine, spec, closer := mockEngine(t, Opts{RootPolicy: test.policy})
+		spec.Root = dir
+		err = engine.Configure(context.Background(), spec)
+		closer()
+
+		if err != test.err {
+			t.Errorf("Want error %v for policy %q, got %v", test.err, test.policy, err)
+		}
+		_, staterr := os.Stat(stale)
+		if got, want := staterr == nil, test.stale; got != want {
+			t.Errorf("Want stale file exists %v for policy %q, got %v", want, test.policy, got)
+		}
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("Want workspace directory exists for policy %q", test.policy)
+		}
+	}
+}
+
+func TestConfigure_RootPolicyUnknown(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{RootPolicy: "invalid"})
+	defer closer()
+	spec.Root = filepath.Join(os.TempDir(), "drone-test-unknown-policy")
+	if err := engine.Configure(context.Background(), spec); err == nil {
+		t.Errorf("Expect error when unknown root policy")
+	}
+}
+
+// helper function returns an sftp client connected to an
+// in-memory sftp server backed by the local filesystem. The
+// returned function closes the client and server.
+func mockSftp(t *testing.T) (*sftp.Client, func()) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() {
+		server.Close()
+		client.Close()
+	}
+}
+
+// mockServer is an in-memory ssh server used for unit testing.
+// Commands are executed on the host machine using the default
+// shell, and the sftp subsystem is served from the host
+// filesystem.
+type mockServer struct {
+	addr     string
+	config   *ssh.ServerConfig
+	listener net.Listener
+
+	limit  int32 // Limit of concurrently open channels.
+	active int32 // Number of open channels.
+	peak   int32 // Peak number of open channels.
+
+	// mu guards the server configuration and the options
+	// below, which tests update while the server is running.
+	mu sync.Mutex
+
+	// delay before the server sends its version banner.
+	delay time.Duration
+
+	// host public key of the server.
+	hostkey ssh.PublicKey
+
+	// disables the sftp subsystem.
+	nosftp bool
+
+	// rejects environment variable requests.
+	noenv bool
+
+	// closes the session without sending the exit status.
+	noexit bool
+}
+
+// helper function starts a mock ssh server that authorizes
+// the public key.
+func newMockServer(t testing.TB, authorized ssh.PublicKey) *mockServer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &mockServer{
+		addr:     listener.Addr().String(),
+		config:   config,
+		listener: listener,
+		hostkey:  signer.PublicKey(),
+	}
+	go server.serve()
+	return server
+}
+
+// Close stops the mock ssh server.
+func (s *mockServer) Close() error {
+	return s.listener.Close()
+}
+
+// update applies the changes to the server configuration or
+// options while holding the lock.
+func (s *mockServer) update(fn func()) {
+	s.mu.Lock()
+	fn()
+	s.mu.Unlock()
+}
+
+func (s *mockServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *mockServer) handle(conn net.Conn) {
+	s.mu.Lock()
+	delay := s.delay
+	config := *s.config
+	s.mu.Unlock()
+
+	time.Sleep(delay)
+	_, chans, reqs, err := ssh.NewServerConn(conn, &config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newch := range chans {
+		if newch.ChannelType() != "session" {
+			newch.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		limit := atomic.LoadInt32(&s.limit)
+		n := atomic.AddInt32(&s.active, 1)
+		if limit > 0 && n > limit {
+			atomic.AddInt32(&s.active, -1)
+			newch.Reject(ssh.ResourceShortage, "too many sessions")
+			continue
+		}
+		for peak := atomic.LoadInt32(&s.peak); n > peak; peak = atomic.LoadInt32(&s.peak) {
+			if atomic.CompareAndSwapInt32(&s.peak, peak, n) {
+				break
+			}
+		}
+		ch, requests, err := newch.Accept()
+		if err != nil {
+			atomic.AddInt32(&s.active, -1)
+			continue
+		}
+		go func() {
+			s.session(ch, requests)
+			atomic.AddInt32(&s.active, -1)
+		}()
+	}
+}
+
+func (s *mockServer) session(ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+	s.mu.Lock()
+	noenv, noexit, nosftp := s.noenv, s.noexit, s.nosftp
+	s.mu.Unlock()
+	var env []string
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			if noenv {
+				req.Reply(false, nil)
+				continue
+			}
+			var payload struct{ Name, Value string }
+			ssh.Unmarshal(req.Payload, &payload)
+			env = append(env, payload.Name+"="+payload.Value)
+			req.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(req.Payload, &payload)
+			req.Reply(true, nil)
+
+			cmd := exec.Command("sh", "-c", payload.Command)
+			cmd.Env = append(os.Environ(), env...)
+			cmd.Stdin = ch
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+
+			status := struct{ Status uint32 }{}
+			if err := cmd.Run(); err != nil {
+				status.Status = 255
+				if exiterr, ok := err.(*exec.ExitError); ok {
+					status.Status = uint32(exiterr.ExitCode())
+				}
+			}
+			if !noexit {
+				ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+			}
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			ssh.Unmarshal(req.Payload, &payload)
+			if payload.Name != "sftp" || nosftp {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// helper function saves the platform functions that unit tests
+// replace with mocks. The returned function restores them.
+func stubPlatform() func() {
+	register, prov, keyError := registerKey, provision, isKeyError
+	dest, dereg, transient := destroy, deregisterKey, isTransient
+	find, parkFn, unparkFn, list := findByName, park, unpark, listParked
+	interval := setupRetryInterval
+	return func() {
+		registerKey, provision, isKeyError = register, prov, keyError
+		destroy, deregisterKey, isTransient = dest, dereg, transient
+		findByName, park, unpark, listParked = find, parkFn, unparkFn, list
+		setupRetryInterval = interval
+	}
+}
+
+// helper function returns an engine and spec configured to
+// connect to a mock ssh server. The returned function stops
+// the mock ssh server.
+func mockEngine(t testing.TB, opts Opts) (*engine, *Spec, func()) {
+	engine, spec, server := newMockEngine(t, opts)
+	return engine, spec, func() {
+		server.Close()
+	}
+}
+
+// helper function returns an engine and spec configured to
+// connect to the returned mock ssh server.
+func newMockEngine(t testing.TB, opts Opts) (*engine, *Spec, *mockServer) {
+	kp, err := generateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(kp.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newMockServer(t, pub)
+	engine := &engine{
+		privatekey:  string(kp.private),
+		publickey:   string(kp.public),
+		fingerprint: kp.fingerprint,
+		opts:        opts,
+	}
+	spec := &Spec{
+		Server: Server{User: "root"},
+		id:     1,
+		ip:     server.addr,
+	}
+	return engine, spec, server
+}
+
+// syncBuffer is a goroutine-safe buffer. The ssh session
+// copies stdout and stderr to the output concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"time"
+)
+
+// Event types.
+const (
+	EventSetup   = "setup"
+	EventStep    = "step"
+	EventDestroy = "destroy"
+)
+
+// Event is a structured event emitted when the pipeline
+// environment is setup or destroyed, or when a pipeline step
+// completes, which can be aggregated by an observability
+// pipeline.
+type Event struct {
+	Type     string        // Event type
+	Name     string        // Step name, or server name
+	ID       int           // Server instance id
+	Started  time.Time     // Start time
+	Finished time.Time     // End time
+	Duration time.Duration // Execution time
+	Error    string        // Error message, if any
+
+	// ExitCode and OOMKilled are only set for step events.
+	ExitCode  int
+	OOMKilled bool
+}
+
+// EventSink receives the engine events. Emit is invoked
+// synchronously and should not block.
+type EventSink interface {
+	Emit(ctx context.Context, event *Event)
+}
+
+// NopSink is an EventSink that discards events.
+type NopSink struct{}
+
+// Emit discards the event.
+func (NopSink) Emit(context.Context, *Event) {}
+
+// helper function emits an event to the configured sink. The
+// event end time and duration are calculated from the start
+// time.
+func (e *engine) emit(ctx context.Context, event *Event, err error) {
+	sink := e.opts.Events
+	if sink == nil {
+		sink = NopSink{}
+	}
+	event.Finished = time.Now()
+	event.Duration = event.Finished.Sub(event.Started)
+	if err != nil {
+		event.Error = err.Error()
+	}
+	sink.Emit(ctx, event)
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+// recordSink is an EventSink that records the events.
+type recordSink struct {
+	sync.Mutex
+	events []*Event
+}
+
+func (s *recordSink) Emit(_ context.Context, event *Event) {
+	s.Lock()
+	s.events = append(s.events, event)
+	s.Unlock()
+}
+
+func TestEvents_Run(t *testing.T) {
+	sink := new(recordSink)
+	engine, spec, closer := mockEngine(t, Opts{Events: sink})
+	defer closer()
+
+	step := &Step{Name: "test", Command: "exit", Args: []string{"3"}}
+	state, err := engine.Run(context.Background(), spec, step, new(syncBuffer))
+	if state == nil || err == nil {
+		t.Errorf("Want step exit error, got %v", err)
+		return
+	}
+	if len(sink.events) != 1 {
+		t.Errorf("Want one event emitted, got %d", len(sink.events))
+		return
+	}
+	event := sink.events[0]
+	if event.Type != EventStep || event.Name != "test" || event.ID != spec.id {
+		t.Errorf("Unexpected step event %+v", event)
+	}
+	if event.ExitCode != state.ExitCode || event.ExitCode != 3 {
+		t.Errorf("Want exit code 3, got %d", event.ExitCode)
+	}
+	if event.OOMKilled {
+		t.Errorf("Want step not oom killed")
+	}
+	if event.Finished.Before(event.Started) || event.Duration != event.Finished.Sub(event.Started) {
+		t.Errorf("Unexpected step timing %+v", event)
+	}
+	if event.Error != err.Error() {
+		t.Errorf("Want step error recorded, got %q", event.Error)
+	}
+}
+
+func TestEvents_Setup(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		return platform.Instance{ID: 1}, platform.ErrImageRegion
+	}
+
+	sink := new(recordSink)
+	engine := &engine{opts: Opts{Events: sink}}
+	spec := &Spec{Server: Server{Name: "drone-temp-foo"}}
+	engine.Setup(context.Background(), spec)
+	if len(sink.events) != 1 {
+		t.Errorf("Want one event emitted, got %d", len(sink.events))
+		return
+	}
+	event := sink.events[0]
+	if event.Type != EventSetup || event.Name != "drone-temp-foo" || event.ID != 1 {
+		t.Errorf("Unexpected setup event %+v", event)
+	}
+	if event.Error != platform.ErrImageRegion.Error() {
+		t.Errorf("Want setup error recorded, got %q", event.Error)
+	}
+}
+
+func TestEvents_Destroy(t *testing.T) {
+	sink := new(recordSink)
+	engine := &engine{opts: Opts{Events: sink}}
+	spec := &Spec{Server: Server{Name: "drone-temp-foo"}}
+	if _, err := engine.Destroy(context.Background(), spec); err != nil {
+		t.Error(err)
+	}
+	if len(sink.events) != 1 {
+		t.Errorf("Want one event emitted, got %d", len(sink.events))
+		return
+	}
+	event := sink.events[0]
+	if event.Type != EventDestroy || event.Name != "drone-temp-foo" || event.Error != "" {
+		t.Errorf("Unexpected destroy event %+v", event)
+	}
+}
+
+func TestEvents_Nop(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	// events are discarded if no sink is configured.
+	step := &Step{Name: "test", Command: "true"}
+	if _, err := engine.Run(context.Background(), spec, step, new(syncBuffer)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/drone/runner-go/logger"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The pipeline root directory may reference the environment of
+// the ssh user on the server instance, which is not known until
+// the server instance is provisioned. The variables are resolved
+// by querying the server instance before the root directory is
+// created. The following variables are supported:
+//
+//   $HOME or ${HOME}  the home directory of the ssh user.
+//   $USER or ${USER}  the username of the ssh user.
+//
+// Variables are not supported on windows.
+
+// helper function resolves the variables in the pipeline root
+// directory, and replaces the root directory in all paths
+// derived from the root directory.
+func expandRoot(ctx context.Context, spec *Spec, client *ssh.Client) error {
+	if spec.Platform.OS == "windows" || !strings.Contains(spec.Root, "$") {
+		return nil
+	}
+	out, err := execute(client, `printf '%s\n%s\n' "$HOME" "$USER"`)
+	if err != nil {
+		logger.FromContext(ctx).
+			WithError(err).
+			WithField("path", spec.Root).
+			Error("cannot resolve workspace directory")
+		return err
+	}
+	parts := strings.Split(string(out), "\n")
+	if len(parts) < 2 || parts[0] == "" {
+		return errors.New("cannot resolve the home directory")
+	}
+	root := expandVars(spec.Root, parts[0], parts[1])
+	logger.FromContext(ctx).
+		WithField("path", spec.Root).
+		WithField("resolved", root).
+		Debug("resolved workspace directory")
+	spec.replaceRoot(spec.Root, root)
+	return nil
+}
+
+// helper function replaces the supported variables in the
+// string.
+func expandVars(s, home, user string) string {
+	return strings.NewReplacer(
+		"${HOME}", home,
+		"$HOME", home,
+		"${USER}", user,
+		"$USER", user,
+	).Replace(s)
+}
+
+// helper function replaces the root directory in the spec
+// root directory, files, and steps.
+func (s *Spec) replaceRoot(old, new string) {
+	replace := func(v string) string {
+		return strings.Replace(v, old, new, -1)
+	}
+	s.Root = new
+	for _, file := range s.Files {
+		file.Path = replace(file.Path)
+	}
+	for _, step := range s.Steps {
+		step.WorkingDir = replace(step.WorkingDir)
+		step.Command = replace(step.Command)
+		for i, arg := range step.Args {
+			step.Args[i] = replace(arg)
+		}
+		for k, v := range step.Envs {
+			step.Envs[k] = replace(v)
+		}
+		for _, file := range step.Files {
+			file.Path = replace(file.Path)
+		}
+		for _, exec := range step.Execs {
+			exec.Command = replace(exec.Command)
+			for i, arg := range exec.Args {
+				exec.Args[i] = replace(arg)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandVars(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"/tmp/drone-random", "/tmp/drone-random"},
+		{"$HOME/drone", "/home/builder/drone"},
+		{"${HOME}/drone", "/home/builder/drone"},
+		{"/srv/$USER/drone", "/srv/builder/drone"},
+		{"/srv/${USER}/drone", "/srv/builder/drone"},
+		{"$PWD/drone", "$PWD/drone"},
+	}
+	for _, test := range tests {
+		if got := expandVars(test.in, "/home/builder", "builder"); got != test.want {
+			t.Errorf("Want %q expanded to %q, got %q", test.in, test.want, got)
+		}
+	}
+}
+
+func TestReplaceRoot(t *testing.T) {
+	spec := &Spec{
+		Root: "$HOME/drone",
+		Files: []*File{
+			{Path: "$HOME/drone/home", IsDir: true},
+		},
+		Steps: []*Step{
+			{
+				Command:    "/bin/sh",
+				Args:       []string{"-e", "$HOME/drone/opt/build"},
+				Envs:       map[string]string{"DRONE_WORKSPACE": "$HOME/drone/drone/src"},
+				WorkingDir: "$HOME/drone/drone/src",
+				Files:      []*File{{Path: "$HOME/drone/opt/build"}},
+				Execs:      []*Exec{{Command: "/bin/sh", Args: []string{"-e", "$HOME/drone/opt/build-0"}}},
+			},
+		},
+	}
+	spec.replaceRoot(spec.Root, "/root/drone")
+
+	step := spec.Steps[0]
+	for _, got := range []string{
+		spec.Root,
+		spec.Files[0].Path,
+		step.Args[1],
+		step.Envs["DRONE_WORKSPACE"],
+		step.WorkingDir,
+		step.Files[0].Path,
+		step.Execs[0].Args[1],
+	} {
+		if strings.Contains(got, "$HOME") {
+			t.Errorf("Want root directory replaced, got %q", got)
+		}
+	}
+	if got, want := step.WorkingDir, "/root/drone/drone/src"; got != want {
+		t.Errorf("Want working directory %q, got %q", want, got)
+	}
+}
+
+func TestConfigure_ExpandRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the mock server executes commands with the environment
+	// of the test process.
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	defer os.Setenv("HOME", home)
+
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+	spec.Root = "$HOME/drone"
+	spec.Files = []*File{
+		{Path: "$HOME/drone/home", Mode: 0700, IsDir: true},
+	}
+	if err := engine.Configure(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := spec.Root, filepath.Join(dir, "drone"); got != want {
+		t.Errorf("Want root directory %q, got %q", want, got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "drone", "home")); err != nil {
+		t.Errorf("Want directory created in the home directory")
+	}
+}
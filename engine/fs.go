@@ -0,0 +1,395 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/drone/runner-go/logger"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// filesystem provides access to the filesystem of the server
+// instance.
+type filesystem interface {
+	// WriteFile writes the file and configures the file
+	// permissions. If the rate is greater than zero, the
+	// upload is throttled to rate bytes per second.
+	WriteFile(path string, data []byte, mode uint32, rate int64) error
+
+	// ReadFile reads the file. If the file does not exist,
+	// an error is returned for which os.IsNotExist is true.
+	ReadFile(path string) ([]byte, error)
+
+	// MkdirAll creates the folder and any parent folders,
+	// and configures the folder permissions.
+	MkdirAll(path string, mode uint32) error
+
+	// Chmod configures the file permissions.
+	Chmod(path string, mode uint32) error
+
+	// Remove removes the file.
+	Remove(path string) error
+
+	// Stat returns an error if the file does not exist or
+	// cannot be read.
+	Stat(path string) error
+
+	// Close closes the filesystem.
+	Close() error
+}
+
+// newSFTPClient creates an sftp client. It is declared as a
+// variable so that it can be replaced in unit tests.
+var newSFTPClient = sftp.NewClient
+
+// helper function returns the sftp client options. The packet
+// size is not checked, since sizes larger than 32768 bytes are
+// supported by the openssh sftp server.
+func (e *engine) sftpOptions() []sftp.ClientOption {
+	var opts []sftp.ClientOption
+	if e.opts.SFTPMaxPacket > 0 {
+		opts = append(opts, sftp.MaxPacketUnchecked(e.opts.SFTPMaxPacket))
+	}
+	if e.opts.SFTPConcurrency > 0 {
+		opts = append(opts, sftp.MaxConcurrentRequestsPerFile(e.opts.SFTPConcurrency))
+	}
+	return opts
+}
+
+// helper function returns the filesystem of the server
+// instance. The filesystem is accessed using the sftp
+// subsystem. If the sftp subsystem is disabled, for example,
+// on hardened images, files are transferred using scp.
+func (e *engine) openFS(ctx context.Context, spec *Spec, client *ssh.Client) (filesystem, error) {
+	if e.opts.SCP && spec.Platform.OS != "windows" {
+		return &scpFS{client: client}, nil
+	}
+	// the file permissions are not verified on windows, which
+	// does not implement posix file permissions.
+	verify := e.opts.VerifyUploads && spec.Platform.OS != "windows"
+	clientftp, err := newSFTPClient(client, e.sftpOptions()...)
+	if err == nil && e.opts.UploadRetries > 0 {
+		return &retryFS{
+			sftpFS:  &sftpFS{client: clientftp, verify: verify},
+			retries: e.opts.UploadRetries,
+			dial: func() (*ssh.Client, error) {
+				return e.connect(spec.ip, spec.Server.User, e.opts.HandshakeTimeout, e.hostKeyCallback(spec))
+			},
+			reopen: func(client *ssh.Client) (*sftp.Client, error) {
+				return newSFTPClient(client, e.sftpOptions()...)
+			},
+			client: client,
+		}, nil
+	}
+	if err == nil {
+		return &sftpFS{client: clientftp, verify: verify}, nil
+	}
+	if spec.Platform.OS == "windows" {
+		return nil, err
+	}
+	logger.FromContext(ctx).
+		WithError(err).
+		WithField("ip", spec.ip).
+		Debug("sftp subsystem unavailable, using scp")
+	return &scpFS{client: client}, nil
+}
+
+// sftpFS provides access to the filesystem of the server
+// instance using the sftp subsystem.
+type sftpFS struct {
+	client *sftp.Client
+	verify bool // Verify the file permissions are applied.
+}
+
+// ChmodError is returned when the file permissions configured
+// on the server instance do not match the requested file
+// permissions, for example, because the sftp server ignores
+// chmod requests.
+type ChmodError struct {
+	Path string
+	Want os.FileMode
+	Got  os.FileMode
+}
+
+func (e *ChmodError) Error() string {
+	return fmt.Sprintf("file mode not applied: %s: want %s, got %s", e.Path, e.Want, e.Got)
+}
+
+func (fs *sftpFS) WriteFile(path string, data []byte, mode uint32, rate int64) error {
+	if _, err := upload(fs.client, path, data, 0, mode, rate); err != nil {
+		return err
+	}
+	return fs.verifyMode(path, mode)
+}
+
+func (fs *sftpFS) ReadFile(path string) ([]byte, error) {
+	f, err := fs.client.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func (fs *sftpFS) MkdirAll(path string, mode uint32) error {
+	return mkdir(fs.client, path, mode)
+}
+
+func (fs *sftpFS) Chmod(path string, mode uint32) error {
+	if err := fs.client.Chmod(path, os.FileMode(mode)); err != nil {
+		return err
+	}
+	return fs.verifyMode(path, mode)
+}
+
+func (fs *sftpFS) Remove(path string) error {
+	return fs.client.Remove(path)
+}
+
+func (fs *sftpFS) Stat(path string) error {
+	_, err := fs.client.Stat(path)
+	return err
+}
+
+func (fs *sftpFS) Close() error {
+	return fs.client.Close()
+}
+
+// helper function returns a ChmodError if verification is
+// enabled, and the file permissions of the remote file do not
+// match the requested file permissions.
+func (fs *sftpFS) verifyMode(path string, mode uint32) error {
+	if !fs.verify {
+		return nil
+	}
+	info, err := fs.client.Stat(path)
+	if err != nil {
+		return err
+	}
+	want := os.FileMode(mode).Perm()
+	if got := info.Mode().Perm(); got != want {
+		return &ChmodError{Path: path, Want: want, Got: got}
+	}
+	return nil
+}
+
+// retryFS provides access to the filesystem of the server
+// instance using the sftp subsystem, and retries uploads that
+// are interrupted because the connection is lost. The sftp
+// client is re-established, dialing the server instance again
+// if the ssh connection is lost, and the upload is resumed
+// from the last chunk written.
+type retryFS struct {
+	*sftpFS
+
+	retries int
+	client  *ssh.Client
+	conn    *ssh.Client // Connection dialed to resume uploads.
+	dial    func() (*ssh.Client, error)
+	reopen  func(*ssh.Client) (*sftp.Client, error)
+}
+
+func (fs *retryFS) WriteFile(path string, data []byte, mode uint32, rate int64) error {
+	var offset int64
+	for attempt := 1; ; attempt++ {
+		n, err := upload(fs.sftpFS.client, path, data, offset, mode, rate)
+		offset += n
+		if err == nil {
+			return fs.verifyMode(path, mode)
+		}
+		if attempt > fs.retries || !isConnLost(err) {
+			return err
+		}
+		if err := fs.reconnect(); err != nil {
+			return err
+		}
+	}
+}
+
+func (fs *retryFS) Close() error {
+	err := fs.sftpFS.Close()
+	if fs.conn != nil {
+		fs.conn.Close()
+	}
+	return err
+}
+
+// helper function re-establishes the sftp client. The sftp
+// client is opened with the existing ssh connection if it is
+// still alive, otherwise the server instance is dialed again.
+func (fs *retryFS) reconnect() error {
+	fs.sftpFS.client.Close()
+	client := fs.client
+	if fs.conn != nil {
+		client = fs.conn
+	}
+	if clientftp, err := fs.reopen(client); err == nil {
+		fs.sftpFS.client = clientftp
+		return nil
+	}
+	if fs.conn != nil {
+		fs.conn.Close()
+		fs.conn = nil
+	}
+	conn, err := fs.dial()
+	if err != nil {
+		return err
+	}
+	clientftp, err := fs.reopen(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	fs.conn = conn
+	fs.sftpFS.client = clientftp
+	return nil
+}
+
+// helper function returns true if the error indicates the
+// connection with the server instance was lost.
+func isConnLost(err error) bool {
+	switch err := err.(type) {
+	case *sftp.StatusError:
+		// ssh_FX_CONNECTION_LOST
+		return err.Code == 7
+	case net.Error:
+		return true
+	default:
+		// the sftp client does not preserve the underlying
+		// error if a packet cannot be sent to the server.
+		return err == io.EOF ||
+			err == io.ErrUnexpectedEOF ||
+			strings.HasPrefix(err.Error(), "failed to send packet")
+	}
+}
+
+// scpFS provides access to the filesystem of the server
+// instance using scp and shell commands, for server instances
+// that disable the sftp subsystem.
+type scpFS struct {
+	client *ssh.Client
+}
+
+func (fs *scpFS) WriteFile(name string, data []byte, mode uint32, rate int64) error {
+	session, err := fs.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.Start(fmt.Sprintf("scp -qt %s", shellQuote(path.Dir(name)))); err != nil {
+		return err
+	}
+
+	var w io.Writer = stdin
+	if rate > 0 {
+		w = newThrottleWriter(stdin, rate)
+	}
+	r := bufio.NewReader(stdout)
+	err = scpAck(r)
+	if err == nil {
+		_, err = fmt.Fprintf(stdin, "C%04o %d %s\n", mode&0777, len(data), path.Base(name))
+	}
+	if err == nil {
+		err = scpAck(r)
+	}
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err == nil {
+		_, err = stdin.Write([]byte{0})
+	}
+	if err == nil {
+		err = scpAck(r)
+	}
+	stdin.Close()
+	if werr := session.Wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+	// scp only configures the permissions of new files.
+	return fs.Chmod(name, mode)
+}
+
+func (fs *scpFS) ReadFile(path string) ([]byte, error) {
+	if err := fs.Stat(path); err != nil {
+		return nil, err
+	}
+	return fs.run(fmt.Sprintf("cat %s", shellQuote(path)))
+}
+
+func (fs *scpFS) MkdirAll(path string, mode uint32) error {
+	_, err := fs.run(fmt.Sprintf("mkdir -p %s && chmod %o %s", shellQuote(path), mode, shellQuote(path)))
+	return err
+}
+
+func (fs *scpFS) Chmod(path string, mode uint32) error {
+	_, err := fs.run(fmt.Sprintf("chmod %o %s", mode, shellQuote(path)))
+	return err
+}
+
+func (fs *scpFS) Remove(path string) error {
+	_, err := fs.run(fmt.Sprintf("rm -f %s", shellQuote(path)))
+	return err
+}
+
+func (fs *scpFS) Stat(path string) error {
+	_, err := fs.run(fmt.Sprintf("test -e %s", shellQuote(path)))
+	if _, ok := err.(*ssh.ExitError); ok {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (fs *scpFS) Close() error {
+	return nil
+}
+
+// helper function runs the command and returns the output.
+func (fs *scpFS) run(cmd string) ([]byte, error) {
+	session, err := fs.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	return session.Output(cmd)
+}
+
+// helper function reads the scp acknowledgement. The remote
+// scp process responds with a zero byte on success, or with a
+// non-zero byte followed by an error message.
+func scpAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	return errors.New("scp: " + strings.TrimSuffix(msg, "\n"))
+}
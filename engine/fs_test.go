@@ -0,0 +1,477 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConfigure_SCP(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+	server.update(func() { server.nosftp = true })
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	netrc := filepath.Join(dir, "home", ".netrc")
+	spec.Root = filepath.Join(dir, "drone-random")
+	spec.Files = []*File{
+		{Path: filepath.Join(dir, "home"), Mode: 0700, IsDir: true},
+		{Path: netrc, Mode: 0600, Data: []byte("machine github.com")},
+	}
+	if err := engine.Configure(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := ioutil.ReadFile(netrc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := string(data), "machine github.com"; got != want {
+		t.Errorf("Want file content %q, got %q", want, got)
+	}
+	info, err := os.Stat(netrc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := info.Mode().Perm(), os.FileMode(0600); got != want {
+		t.Errorf("Want file mode %v, got %v", want, got)
+	}
+}
+
+func TestRun_SCP(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+	server.update(func() { server.nosftp = true })
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "script.sh")
+	step := &Step{
+		Name:       "build",
+		Command:    "sh",
+		Args:       []string{script},
+		WorkingDir: dir,
+		Files: []*File{
+			{Path: script, Mode: 0700, Data: []byte("echo hello\n")},
+		},
+	}
+	buf := new(syncBuffer)
+	state, err := engine.Run(context.Background(), spec, step, buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := state.ExitCode, 0; got != want {
+		t.Errorf("Want exit code %d, got %d", want, got)
+	}
+	if got, want := buf.String(), "hello\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+}
+
+func TestSCP_ReadFile(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+	server.update(func() { server.nosftp = true })
+
+	client, err := engine.connect(spec.ip, spec.Server.User, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	fs := &scpFS{client: client}
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "drone-step-result.json")
+	if err := fs.WriteFile(path, []byte(`{"exit_code": 2}`), 0600, 0); err != nil {
+		t.Error(err)
+		return
+	}
+	res, err := readResult(fs, path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res == nil || res.ExitCode == nil || *res.ExitCode != 2 {
+		t.Errorf("Want exit code 2 from result file")
+	}
+
+	if err := fs.Remove(path); err != nil {
+		t.Error(err)
+	}
+	res, err = readResult(fs, path)
+	if err != nil {
+		t.Error(err)
+	}
+	if res != nil {
+		t.Errorf("Want nil result when file does not exist")
+	}
+}
+
+func TestSCP_QuotedPath(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+	server.update(func() { server.nosftp = true })
+
+	client, err := engine.connect(spec.ip, spec.Server.User, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	fs := &scpFS{client: client}
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "it's a; dir", "drone step.json")
+	if err := fs.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(path, []byte("hello"), 0600, 0); err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "hello"; got != want {
+		t.Errorf("Want file content %q, got %q", want, got)
+	}
+	if err := fs.Remove(path); err != nil {
+		t.Error(err)
+	}
+	if err := fs.Stat(path); err != os.ErrNotExist {
+		t.Errorf("Want ErrNotExist after remove, got %v", err)
+	}
+}
+
+func TestSCPAck(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"\x00", ""},
+		{"\x01scp: permission denied\n", "scp: scp: permission denied"},
+		{"\x01scp: permission denied", "scp: scp: permission denied"},
+		{"\x02", "scp: "},
+	}
+	for _, test := range tests {
+		err := scpAck(bufio.NewReader(strings.NewReader(test.in)))
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("Want nil error for %q, got %v", test.in, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.want {
+			t.Errorf("Want error %q for %q, got %v", test.want, test.in, err)
+		}
+	}
+}
+
+func TestConfigure_SFTPOptions(t *testing.T) {
+	defer func() {
+		newSFTPClient = sftp.NewClient
+	}()
+	var applied int
+	newSFTPClient = func(conn *ssh.Client, opts ...sftp.ClientOption) (*sftp.Client, error) {
+		applied = len(opts)
+		return sftp.NewClient(conn, opts...)
+	}
+
+	// a small packet size splits the upload into many packets
+	// that are written concurrently.
+	engine, spec, closer := mockEngine(t, Opts{SFTPMaxPacket: 1024, SFTPConcurrency: 4})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	path := filepath.Join(dir, "data")
+	spec.Root = filepath.Join(dir, "drone-random")
+	spec.Files = []*File{{Path: path, Mode: 0600, Data: data}}
+	if err := engine.Configure(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	if applied != 2 {
+		t.Errorf("Want 2 sftp client options applied, got %d", applied)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Want uploaded file content unchanged")
+	}
+}
+
+func TestSFTPOptions(t *testing.T) {
+	if opts := new(engine).sftpOptions(); len(opts) != 0 {
+		t.Errorf("Want no sftp client options by default, got %d", len(opts))
+	}
+	e := &engine{opts: Opts{SFTPMaxPacket: 1 << 18, SFTPConcurrency: 128}}
+	for _, opt := range e.sftpOptions() {
+		if err := opt(new(sftp.Client)); err != nil {
+			t.Errorf("Want sftp client option applied, got %s", err)
+		}
+	}
+}
+
+// BenchmarkUpload measures the sftp upload throughput using the
+// default and tuned sftp client options. The mock server runs
+// on the loopback interface, therefore the benchmark does not
+// reflect the round trip time of distant regions.
+func BenchmarkUpload(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		opts Opts
+	}{
+		{name: "default", opts: Opts{}},
+		{name: "tuned", opts: Opts{SFTPMaxPacket: 1 << 17, SFTPConcurrency: 128}},
+	}
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<18)
+	for _, bench := range benchmarks {
+		b.Run(bench.name, func(b *testing.B) {
+			engine, spec, closer := mockEngine(b, bench.opts)
+			defer closer()
+
+			dir, err := ioutil.TempDir("", "drone-bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			client, err := engine.connect(spec.ip, spec.Server.User, 0, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+			fs, err := engine.openFS(context.Background(), spec, client)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer fs.Close()
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := fs.WriteFile(filepath.Join(dir, "data"), data, 0600, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryFS_ConnectionLost(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{UploadRetries: 1})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client, err := engine.connect(spec.ip, spec.Server.User, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<18)
+
+	// the connection of the first sftp client is lost once
+	// half of the file is written.
+	broken, _, err := newPipeClient(client, int64(len(data)/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resumed *countWriter
+	fs := &retryFS{
+		sftpFS:  &sftpFS{client: broken},
+		retries: 1,
+		client:  client,
+		reopen: func(conn *ssh.Client) (*sftp.Client, error) {
+			clientftp, w, err := newPipeClient(conn, -1)
+			resumed = w
+			return clientftp, err
+		},
+	}
+	defer fs.Close()
+
+	path := filepath.Join(dir, "data")
+	if err := fs.WriteFile(path, data, 0600, 0); err != nil {
+		t.Error(err)
+		return
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Want uploaded file content unchanged")
+	}
+	if resumed == nil {
+		t.Errorf("Want sftp client re-established")
+		return
+	}
+	if resumed.n >= int64(len(data)) {
+		t.Errorf("Want upload resumed, got %d bytes written", resumed.n)
+	}
+}
+
+func TestIsConnLost(t *testing.T) {
+	if !isConnLost(io.EOF) {
+		t.Errorf("Want EOF is connection lost")
+	}
+	if !isConnLost(&sftp.StatusError{Code: 7}) {
+		t.Errorf("Want status connection lost is connection lost")
+	}
+	if !isConnLost(errors.New("failed to send packet: EOF")) {
+		t.Errorf("Want failed packet is connection lost")
+	}
+	if isConnLost(os.ErrPermission) {
+		t.Errorf("Want permission error is not connection lost")
+	}
+}
+
+// helper function returns an sftp client that writes to the
+// sftp subsystem through a writer that fails once n bytes are
+// written. A negative n never fails.
+func newPipeClient(client *ssh.Client, n int64) (*sftp.Client, *countWriter, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return nil, nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	cw := &countWriter{w: w, limit: n}
+	clientftp, err := sftp.NewClientPipe(r, cw)
+	return clientftp, cw, err
+}
+
+// countWriter counts the bytes written, and simulates a lost
+// connection once the limit is exceeded.
+type countWriter struct {
+	w     io.WriteCloser
+	n     int64
+	limit int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	if w.limit >= 0 && w.n+int64(len(p)) > w.limit {
+		w.w.Close()
+		return 0, io.EOF
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countWriter) Close() error {
+	return w.w.Close()
+}
+
+func TestSFTPFS_VerifyMode(t *testing.T) {
+	// the in-memory sftp server ignores chmod requests, and
+	// reports files with mode 0644.
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server := sftp.NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, sftp.InMemHandler())
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.Close()
+		client.Close()
+	}()
+
+	fs := &sftpFS{client: client}
+	if err := fs.WriteFile("/script.sh", []byte("echo hello"), 0755, 0); err != nil {
+		t.Errorf("Expect file permissions not verified by default, got %s", err)
+	}
+
+	fs.verify = true
+	err = fs.WriteFile("/script.sh", []byte("echo hello"), 0755, 0)
+	if err, ok := err.(*ChmodError); !ok || err.Want != 0755 || err.Got != 0644 {
+		t.Errorf("Want chmod error, got %v", err)
+	}
+	if err := fs.Chmod("/script.sh", 0755); err == nil {
+		t.Errorf("Want chmod error")
+	}
+	if err := fs.WriteFile("/netrc", []byte("machine github.com"), 0644, 0); err != nil {
+		t.Errorf("Expect matching file permissions accepted, got %s", err)
+	}
+}
+
+func TestSFTPFS_VerifyModeApplied(t *testing.T) {
+	client, closer := mockSftp(t)
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := &sftpFS{client: client, verify: true}
+	if err := fs.WriteFile(filepath.Join(dir, "script.sh"), []byte("echo hello"), 0755, 0); err != nil {
+		t.Errorf("Expect file permissions verified, got %s", err)
+	}
+}
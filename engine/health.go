@@ -0,0 +1,82 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+	"github.com/drone/runner-go/logger"
+)
+
+// instanceStatus returns the status of the server instance. It
+// is declared as a variable so that it can be replaced in unit
+// tests.
+var instanceStatus = platform.Status
+
+// Status returns the health of the pipeline environment. Errors
+// querying the api or connecting to the server instance are
+// recorded in the health status and are not returned.
+func (e *engine) Status(ctx context.Context, spec *Spec) (*HealthStatus, error) {
+	ctx = platform.WithHTTPClient(ctx, e.client)
+	health := new(HealthStatus)
+	if spec.id == 0 {
+		return health, nil
+	}
+
+	status, err := instanceStatus(ctx, spec.id, spec.Token)
+	switch {
+	case err == platform.ErrNotFound:
+		health.InstanceError = ErrInstanceGone
+	case err != nil:
+		health.InstanceError = err
+	default:
+		health.Instance = status
+	}
+
+	// there is no need to connect to the server instance if
+	// it no longer exists.
+	if health.InstanceError == ErrInstanceGone || status == "archive" {
+		return health, nil
+	}
+
+	client, err := e.connect(spec.ip, spec.Server.User, e.opts.HandshakeTimeout, e.hostKeyCallback(spec))
+	if err != nil {
+		health.SSHError = err
+		return health, nil
+	}
+	defer client.Close()
+	health.Reachable = true
+
+	fs, err := e.openFS(ctx, spec, client)
+	if err != nil {
+		health.SSHError = err
+		return health, nil
+	}
+	defer fs.Close()
+
+	// the workspace is ready once the pipeline root directory
+	// is created by the Configure method.
+	if spec.Root == "" {
+		health.WorkspaceReady = true
+	} else if err := fs.Stat(spec.Root); err == nil {
+		health.WorkspaceReady = true
+	}
+
+	logger.FromContext(ctx).
+		WithField("id", spec.id).
+		WithField("ip", spec.ip).
+		WithField("status", health.Instance).
+		WithField("workspace", health.WorkspaceReady).
+		Trace("server instance health")
+
+	return health, nil
+}
+
+// Healthy returns true if the server instance is active, can
+// be reached, and the workspace is ready.
+func (h *HealthStatus) Healthy() bool {
+	return h.Instance == "active" && h.Reachable && h.WorkspaceReady
+}
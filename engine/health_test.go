@@ -0,0 +1,132 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+// helper function replaces the instance status function with
+// a function that returns the status and error. The returned
+// function restores the default.
+func mockInstanceStatus(status string, err error) func() {
+	instanceStatus = func(context.Context, int, string) (string, error) {
+		return status, err
+	}
+	return func() {
+		instanceStatus = platform.Status
+	}
+}
+
+func TestStatus(t *testing.T) {
+	defer mockInstanceStatus("active", nil)()
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spec.Root = dir
+
+	health, err := engine.Status(context.Background(), spec)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !health.Healthy() {
+		t.Errorf("Expect healthy, got %+v", health)
+	}
+}
+
+func TestStatus_WorkspaceNotReady(t *testing.T) {
+	defer mockInstanceStatus("active", nil)()
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	spec.Root = filepath.Join(os.TempDir(), "drone-test-missing")
+
+	health, _ := engine.Status(context.Background(), spec)
+	if !health.Reachable {
+		t.Errorf("Expect reachable, got %v", health.SSHError)
+	}
+	if health.WorkspaceReady {
+		t.Errorf("Expect workspace not ready")
+	}
+	if health.Healthy() {
+		t.Errorf("Expect not healthy")
+	}
+}
+
+func TestStatus_Unreachable(t *testing.T) {
+	defer mockInstanceStatus("active", nil)()
+	engine, spec, closer := mockEngine(t, Opts{})
+	closer()
+
+	health, err := engine.Status(context.Background(), spec)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := health.Instance, "active"; got != want {
+		t.Errorf("Want instance status %q, got %q", want, got)
+	}
+	if health.Reachable || health.SSHError == nil {
+		t.Errorf("Expect ssh error, got %+v", health)
+	}
+	if health.Healthy() {
+		t.Errorf("Expect not healthy")
+	}
+}
+
+func TestStatus_Gone(t *testing.T) {
+	defer mockInstanceStatus("", platform.ErrNotFound)()
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	health, _ := engine.Status(context.Background(), spec)
+	if health.InstanceError != ErrInstanceGone {
+		t.Errorf("Want instance gone error, got %v", health.InstanceError)
+	}
+	if health.Reachable {
+		t.Errorf("Expect ssh probe skipped")
+	}
+}
+
+func TestStatus_APIError(t *testing.T) {
+	apierr := errors.New("api error")
+	defer mockInstanceStatus("", apierr)()
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	// the ssh probe is attempted when the server instance
+	// status cannot be determined.
+	health, _ := engine.Status(context.Background(), spec)
+	if health.InstanceError != apierr {
+		t.Errorf("Want api error, got %v", health.InstanceError)
+	}
+	if !health.Reachable {
+		t.Errorf("Expect reachable, got %v", health.SSHError)
+	}
+}
+
+func TestStatus_NotProvisioned(t *testing.T) {
+	engine := &engine{}
+	health, err := engine.Status(context.Background(), &Spec{})
+	if err != nil {
+		t.Error(err)
+	}
+	if health.Healthy() || health.Instance != "" {
+		t.Errorf("Expect empty health status, got %+v", health)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/drone/runner-go/logger"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrHostKeyMismatch is returned when the host key of the
+// server instance does not match the pinned host key. The error
+// is not retried, since the host key of the server instance
+// does not change.
+var ErrHostKeyMismatch = errors.New("host key does not match the pinned host key")
+
+// HostKeyAlgorithmError is returned when the server instance
+// does not offer any of the accepted host key algorithms.
+type HostKeyAlgorithmError struct {
+	Algorithms []string
+	Err        error
+}
+
+func (e *HostKeyAlgorithmError) Error() string {
+	return fmt.Sprintf("server instance does not offer an accepted host key algorithm (%s): %s",
+		strings.Join(e.Algorithms, ", "), e.Err)
+}
+
+// helper function returns a HostKeyAlgorithmError if the ssh
+// handshake failed because the server instance does not offer
+// an accepted host key algorithm. Otherwise the error is
+// returned unchanged.
+func hostKeyAlgorithmError(err error, algorithms []string) error {
+	if err == nil || len(algorithms) == 0 {
+		return err
+	}
+	if !strings.Contains(err.Error(), "no common algorithm for host key") {
+		return err
+	}
+	return &HostKeyAlgorithmError{Algorithms: algorithms, Err: err}
+}
+
+// helper function returns true if the error indicates the
+// server instance does not offer an accepted host key
+// algorithm. The error is not retried, since the algorithms
+// offered by the server instance do not change.
+func isHostKeyAlgorithmError(err error) bool {
+	_, ok := err.(*HostKeyAlgorithmError)
+	return ok
+}
+
+// helper function runs the host key command and returns the
+// host public key of the server instance. The command is
+// executed on the runner host with the server instance id, name
+// and address in the environment, and must write the host key
+// to stdout in authorized_keys or known_hosts format.
+func fetchHostKey(ctx context.Context, command string, spec *Spec) (ssh.PublicKey, error) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("DRONE_INSTANCE_ID=%d", spec.id),
+		fmt.Sprintf("DRONE_INSTANCE_IP=%s", spec.ip),
+		fmt.Sprintf("DRONE_INSTANCE_NAME=%s", spec.Server.Name),
+	)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		logger.FromContext(ctx).
+			WithError(err).
+			WithField("stderr", stderr.String()).
+			Debug("host key command failed")
+		return nil, err
+	}
+	return parseHostKey(stdout.Bytes())
+}
+
+// helper function parses the host public key in authorized_keys
+// or known_hosts format.
+func parseHostKey(data []byte) (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err == nil {
+		return key, nil
+	}
+	_, _, key, _, _, err = ssh.ParseKnownHosts(data)
+	return key, err
+}
+
+// helper function returns the callback used to verify the host
+// key of the server instance. The host key callback provided to
+// the engine takes precedence. Otherwise the first host key
+// seen is pinned and verified for subsequent connections,
+// unless host key verification is disabled.
+func (e *engine) hostKeyCallback(spec *Spec) ssh.HostKeyCallback {
+	switch {
+	case e.opts.HostKeyCallback != nil:
+		return e.opts.HostKeyCallback
+	case e.opts.InsecureHostKey:
+		return spec.hostKeyCallback()
+	default:
+		return spec.pinHostKey
+	}
+}
+
+// helper function pins the host key of the server instance the
+// first time the server instance is dialed, and returns an
+// error if the host key does not match the pinned host key on
+// subsequent connections. The host key is pinned in the spec,
+// unless the host key was already fetched with the host key
+// command.
+func (s *Spec) pinHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hostkey == nil {
+		s.hostkey = key
+		return nil
+	}
+	if !bytes.Equal(s.hostkey.Marshal(), key.Marshal()) {
+		return fmt.Errorf("%w: %s", ErrHostKeyMismatch, hostname)
+	}
+	return nil
+}
+
+// helper function returns the callback used to verify the host
+// key of the server instance. A nil callback is returned if the
+// host key is not known.
+func (s *Spec) hostKeyCallback() ssh.HostKeyCallback {
+	if s.hostkey == nil {
+		return nil
+	}
+	return ssh.FixedHostKey(s.hostkey)
+}
@@ -0,0 +1,246 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestFetchHostKey(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+
+	// the command verifies the server instance details are
+	// provided in the environment.
+	command := fmt.Sprintf(
+		`test "$DRONE_INSTANCE_ID" = 1 && test "$DRONE_INSTANCE_IP" = %s && echo %q`,
+		spec.ip,
+		bytes.TrimSpace(ssh.MarshalAuthorizedKey(server.hostkey)),
+	)
+	key, err := fetchHostKey(context.Background(), command, spec)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	spec.hostkey = key
+
+	client, err := engine.connect(spec.ip, "root", 0, spec.hostKeyCallback())
+	if err != nil {
+		t.Errorf("Expect host key verified, got %s", err)
+		return
+	}
+	client.Close()
+}
+
+func TestFetchHostKey_Mismatch(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+
+	other, err := generateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := fetchHostKey(context.Background(), fmt.Sprintf("echo %q", bytes.TrimSpace(other.public)), spec)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	spec.hostkey = key
+
+	if _, err := engine.connect(spec.ip, "root", 0, spec.hostKeyCallback()); err == nil {
+		t.Errorf("Expect host key mismatch error")
+	}
+}
+
+func TestFetchHostKey_KnownHosts(t *testing.T) {
+	_, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+
+	line := "1.2.3.4 " + string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(server.hostkey)))
+	key, err := fetchHostKey(context.Background(), fmt.Sprintf("echo %q", line), spec)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(key.Marshal()) != string(server.hostkey.Marshal()) {
+		t.Errorf("Unexpected host key")
+	}
+}
+
+func TestProvision_HostKeyUnavailable(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	provision = func(context.Context, platform.ProvisionArgs) (platform.Instance, error) {
+		return platform.Instance{ID: 1, IP: "1.2.3.4"}, nil
+	}
+
+	// the server instance is provisioned if the host key
+	// cannot be fetched, and the host key is not verified.
+	engine := &engine{opts: Opts{HostKeyCommand: "exit 1"}}
+	spec := &Spec{}
+	if err := engine.Provision(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	if spec.hostKeyCallback() != nil {
+		t.Errorf("Expect host key not verified")
+	}
+}
+
+func TestPinHostKey(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+
+	// the host key is pinned on the first connection, and
+	// verified on subsequent connections.
+	for i := 0; i < 2; i++ {
+		client, err := engine.connect(spec.ip, "root", 0, engine.hostKeyCallback(spec))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		client.Close()
+	}
+	if spec.hostkey == nil || !bytes.Equal(spec.hostkey.Marshal(), server.hostkey.Marshal()) {
+		t.Errorf("Want host key pinned in the spec")
+	}
+}
+
+func TestPinHostKey_Mismatch(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{})
+	defer server.Close()
+
+	client, err := engine.connect(spec.ip, "root", 0, engine.hostKeyCallback(spec))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	client.Close()
+
+	// a server with a different host key impersonates the
+	// server instance, and the connection is rejected.
+	authorized, _, _, _, err := ssh.ParseAuthorizedKey([]byte(engine.publickey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newMockServer(t, authorized)
+	defer other.Close()
+	spec.ip = other.addr
+
+	_, err = engine.dialRetry(context.Background(), spec)
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Errorf("Want ErrHostKeyMismatch, got %v", err)
+	}
+
+	// the host key is not pinned if pinning is disabled.
+	engine.opts.InsecureHostKey = true
+	spec.hostkey = nil
+	client, err = engine.connect(spec.ip, "root", 0, engine.hostKeyCallback(spec))
+	if err != nil {
+		t.Errorf("Want host key not verified, got %v", err)
+		return
+	}
+	client.Close()
+	if spec.hostkey != nil {
+		t.Errorf("Want host key not pinned")
+	}
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pair, err := generateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publickey := filepath.Join(dir, "id_rsa.pub")
+	privatekey := filepath.Join(dir, "id_rsa")
+	ioutil.WriteFile(publickey, pair.public, 0600)
+	ioutil.WriteFile(privatekey, pair.private, 0600)
+
+	// the host key callback provided to the engine takes
+	// precedence over pinning.
+	var called bool
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		called = true
+		return nil
+	}
+	e, err := New(publickey, privatekey, Opts{HostKeyCallback: callback})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	e.(*engine).hostKeyCallback(new(Spec))("", nil, nil)
+	if !called {
+		t.Errorf("Want host key callback provided to the engine used")
+	}
+}
+
+func TestConnect_HostKeyAlgorithms(t *testing.T) {
+	engine, spec, server := newMockEngine(t, Opts{
+		HostKeyAlgorithms: []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSA},
+	})
+	defer server.Close()
+
+	config := engine.clientConfig("root", nil, nil)
+	if got := config.HostKeyAlgorithms; len(got) != 2 || got[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("Want host key algorithm preference applied, got %v", got)
+	}
+
+	var algorithm string
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		algorithm = key.Type()
+		return nil
+	}
+	client, err := engine.connect(spec.ip, "root", 0, callback)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	client.Close()
+	if got, want := algorithm, ssh.KeyAlgoED25519; got != want {
+		t.Errorf("Want host key algorithm %s, got %s", want, got)
+	}
+}
+
+func TestConnect_HostKeyAlgorithmsMismatch(t *testing.T) {
+	var attempts int
+	engine, spec, server := newMockEngine(t, Opts{
+		HostKeyAlgorithms: []string{ssh.KeyAlgoRSA},
+		Retryable: func(error) bool {
+			attempts++
+			return true
+		},
+	})
+	defer server.Close()
+
+	// the mock server only offers an ed25519 host key, and
+	// the connection is not retried.
+	_, err := engine.dialRetry(context.Background(), spec)
+	if _, ok := err.(*HostKeyAlgorithmError); !ok {
+		t.Errorf("Want host key algorithm error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Want a single connection attempt, got %d", attempts)
+	}
+}
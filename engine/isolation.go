@@ -0,0 +1,119 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A pipeline step can optionally run confined, for example, to
+// run untrusted pipeline code. The process isolation level runs
+// the step command in new pid and mount namespaces, so that the
+// step cannot see or signal other processes on the server
+// instance. The filesystem isolation level additionally runs the
+// step command in a chroot that is populated by the engine with
+// read-only bind mounts of the system directories, and a
+// read-write bind mount of the pipeline root. Isolation uses
+// unshare and chroot, which require root, and is only supported
+// on linux. Step isolation is not supported on windows, and is
+// ignored.
+
+// Isolation levels, in order of increasing isolation.
+const (
+	IsolationNone       = "none"
+	IsolationProcess    = "process"
+	IsolationFilesystem = "filesystem"
+)
+
+// chrootDir is the name of the folder in the pipeline root in
+// which the chroot is populated.
+const chrootDir = ".chroot"
+
+// chrootSystemDirs are the system directories that are bind
+// mounted, read-only, in the chroot. Directories that do not
+// exist on the server instance are skipped.
+var chrootSystemDirs = []string{"/bin", "/sbin", "/lib", "/lib64", "/usr", "/etc"}
+
+// helper function returns the rank of the isolation level, or
+// false if the level is not known. The empty level ranks as no
+// isolation.
+func isolationRank(level string) (int, bool) {
+	switch level {
+	case "", IsolationNone:
+		return 0, true
+	case IsolationProcess:
+		return 1, true
+	case IsolationFilesystem:
+		return 2, true
+	default:
+		return 0, false
+	}
+}
+
+// helper function returns an error if the isolation level is
+// not known.
+func checkIsolation(level string) error {
+	if _, ok := isolationRank(level); !ok {
+		return fmt.Errorf("unknown isolation level %q", level)
+	}
+	return nil
+}
+
+// helper function returns the stricter of the step isolation
+// level and the minimum isolation level configured for the
+// engine.
+func isolationLevel(step *Step, min string) string {
+	a, _ := isolationRank(step.Isolation)
+	b, _ := isolationRank(min)
+	if b > a {
+		return min
+	}
+	return step.Isolation
+}
+
+// helper function wraps the command line so that the command
+// runs at the isolation level. The command is returned
+// unchanged on windows, or if the command is not isolated.
+func isolationCommand(os, level, root, cmd string) string {
+	if os == "windows" {
+		return cmd
+	}
+	switch level {
+	case IsolationProcess:
+		return "unshare --mount --pid --fork --mount-proc " + cmd
+	case IsolationFilesystem:
+		return "unshare --mount --pid --fork sh -c " + shellQuote(chrootScript(root, cmd))
+	default:
+		return cmd
+	}
+}
+
+// helper function returns the shell script that populates the
+// chroot in the pipeline root and executes the command in the
+// chroot. The script runs in a new mount namespace, and the
+// mounts are therefore removed when the command exits.
+func chrootScript(root, cmd string) string {
+	dir := path.Join(root, chrootDir)
+	var lines []string
+	lines = append(lines, "set -e")
+	for _, sys := range chrootSystemDirs {
+		target := dir + sys
+		lines = append(lines, fmt.Sprintf(
+			"if [ -d %s ]; then mkdir -p %s && mount --bind -o ro %s %s; fi",
+			sys, target, sys, target,
+		))
+	}
+	lines = append(lines,
+		fmt.Sprintf("mkdir -p %s/dev %s/proc %s/tmp %s", dir, dir, dir, dir+root),
+		fmt.Sprintf("mount --rbind /dev %s/dev", dir),
+		fmt.Sprintf("mount -t proc proc %s/proc", dir),
+		fmt.Sprintf("mount -t tmpfs tmpfs %s/tmp", dir),
+		fmt.Sprintf("mount --bind %s %s", root, dir+root),
+		fmt.Sprintf("exec chroot %s %s", dir, cmd),
+	)
+	return strings.Join(lines, "\n")
+}
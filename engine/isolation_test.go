@@ -0,0 +1,84 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestIsolationCommand(t *testing.T) {
+	tests := []struct {
+		os    string
+		level string
+		want  string
+	}{
+		{"linux", "", "/bin/sh build.sh"},
+		{"linux", IsolationNone, "/bin/sh build.sh"},
+		{"linux", IsolationProcess, "unshare --mount --pid --fork --mount-proc /bin/sh build.sh"},
+		{"windows", IsolationProcess, "/bin/sh build.sh"},
+		{"windows", IsolationFilesystem, "/bin/sh build.sh"},
+	}
+	for _, test := range tests {
+		if got := isolationCommand(test.os, test.level, "/tmp/drone-random", "/bin/sh build.sh"); got != test.want {
+			t.Errorf("Want command %q, got %q", test.want, got)
+		}
+	}
+}
+
+func TestIsolationCommand_Filesystem(t *testing.T) {
+	got := isolationCommand("linux", IsolationFilesystem, "/tmp/drone-random", "/bin/sh build.sh")
+	want := "unshare --mount --pid --fork sh -c '" + strings.Join([]string{
+		"set -e",
+		"if [ -d /bin ]; then mkdir -p /tmp/drone-random/.chroot/bin && mount --bind -o ro /bin /tmp/drone-random/.chroot/bin; fi",
+		"if [ -d /sbin ]; then mkdir -p /tmp/drone-random/.chroot/sbin && mount --bind -o ro /sbin /tmp/drone-random/.chroot/sbin; fi",
+		"if [ -d /lib ]; then mkdir -p /tmp/drone-random/.chroot/lib && mount --bind -o ro /lib /tmp/drone-random/.chroot/lib; fi",
+		"if [ -d /lib64 ]; then mkdir -p /tmp/drone-random/.chroot/lib64 && mount --bind -o ro /lib64 /tmp/drone-random/.chroot/lib64; fi",
+		"if [ -d /usr ]; then mkdir -p /tmp/drone-random/.chroot/usr && mount --bind -o ro /usr /tmp/drone-random/.chroot/usr; fi",
+		"if [ -d /etc ]; then mkdir -p /tmp/drone-random/.chroot/etc && mount --bind -o ro /etc /tmp/drone-random/.chroot/etc; fi",
+		"mkdir -p /tmp/drone-random/.chroot/dev /tmp/drone-random/.chroot/proc /tmp/drone-random/.chroot/tmp /tmp/drone-random/.chroot/tmp/drone-random",
+		"mount --rbind /dev /tmp/drone-random/.chroot/dev",
+		"mount -t proc proc /tmp/drone-random/.chroot/proc",
+		"mount -t tmpfs tmpfs /tmp/drone-random/.chroot/tmp",
+		"mount --bind /tmp/drone-random /tmp/drone-random/.chroot/tmp/drone-random",
+		"exec chroot /tmp/drone-random/.chroot /bin/sh build.sh",
+	}, "\n") + "'"
+	if got != want {
+		t.Errorf("Want command %q, got %q", want, got)
+	}
+}
+
+func TestIsolationLevel(t *testing.T) {
+	tests := []struct {
+		step, min, want string
+	}{
+		{"", "", ""},
+		{IsolationProcess, "", IsolationProcess},
+		{"", IsolationProcess, IsolationProcess},
+		{IsolationNone, IsolationFilesystem, IsolationFilesystem},
+		{IsolationFilesystem, IsolationProcess, IsolationFilesystem},
+	}
+	for _, test := range tests {
+		if got := isolationLevel(&Step{Isolation: test.step}, test.min); got != test.want {
+			t.Errorf("Want isolation %q for step %q and minimum %q, got %q", test.want, test.step, test.min, got)
+		}
+	}
+	if err := checkIsolation("container"); err == nil {
+		t.Errorf("Expect unknown isolation level error")
+	}
+}
+
+func TestRun_IsolationUnknown(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{Isolation: "container"})
+	defer closer()
+
+	// an unknown minimum isolation level fails the step instead
+	// of running the step without isolation.
+	step := &Step{Name: "build", Command: "true"}
+	if _, err := engine.Run(context.Background(), spec, step, new(syncBuffer)); err == nil {
+		t.Errorf("Expect unknown isolation level error")
+	}
+}
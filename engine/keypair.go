@@ -0,0 +1,59 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keypair is an ssh keypair generated for a single build.
+// The public key is authorized on the server instance and
+// registered with the account, and the private key is
+// injected into the build environment, which allows the build
+// to ssh into child servers it provisions.
+type keypair struct {
+	private     []byte // PEM encoded private key.
+	public      []byte // Public key in authorized_keys format.
+	fingerprint string // MD5 fingerprint of the public key.
+}
+
+// helper function generates a new rsa ssh keypair.
+func generateKeypair() (*keypair, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &keypair{
+		private: pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}),
+		public:      ssh.MarshalAuthorizedKey(pub),
+		fingerprint: ssh.FingerprintLegacyMD5(pub),
+	}, nil
+}
+
+// helper function returns the file paths of the private and
+// public key in the build home directory.
+func keypairPaths(os, root string) (dir, private, public string) {
+	sep := "/"
+	if os == "windows" {
+		sep = "\\"
+	}
+	dir = strings.Join([]string{root, "home", "drone", ".ssh"}, sep)
+	private = dir + sep + "id_rsa"
+	public = private + ".pub"
+	return
+}
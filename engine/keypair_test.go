@@ -0,0 +1,56 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateKeypair(t *testing.T) {
+	kp, err := generateKeypair()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	signer, err := ssh.ParsePrivateKey(kp.private)
+	if err != nil {
+		t.Errorf("Cannot parse generated private key: %s", err)
+		return
+	}
+	public := ssh.MarshalAuthorizedKey(signer.PublicKey())
+	if !bytes.Equal(public, kp.public) {
+		t.Errorf("Want public key derived from the private key")
+	}
+
+	fingerprint, err := calcFingerprint(kp.public)
+	if err != nil {
+		t.Error(err)
+	}
+	if got, want := kp.fingerprint, fingerprint; got != want {
+		t.Errorf("Want fingerprint %q, got %q", want, got)
+	}
+}
+
+func TestKeypairPaths(t *testing.T) {
+	dir, private, public := keypairPaths("linux", "/tmp/drone-random")
+	if got, want := dir, "/tmp/drone-random/home/drone/.ssh"; got != want {
+		t.Errorf("Want keypair dir %q, got %q", want, got)
+	}
+	if got, want := private, "/tmp/drone-random/home/drone/.ssh/id_rsa"; got != want {
+		t.Errorf("Want private key path %q, got %q", want, got)
+	}
+	if got, want := public, "/tmp/drone-random/home/drone/.ssh/id_rsa.pub"; got != want {
+		t.Errorf("Want public key path %q, got %q", want, got)
+	}
+
+	_, private, _ = keypairPaths("windows", `C:\Windows\Temp\drone-random`)
+	if got, want := private, `C:\Windows\Temp\drone-random\home\drone\.ssh\id_rsa`; got != want {
+		t.Errorf("Want private key path %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+	"github.com/drone/runner-go/logger"
+)
+
+// helper function returns the tags applied to the server
+// instance to enforce the maximum lifetime. The server instance
+// is only tagged if the lifetime is enforced by the reaper, or
+// if the server instance is provisioned in setup-only mode, in
+// which case the server instance is not destroyed by the
+// runner.
+func (e *engine) lifetimeTags(spec *Spec) ([]string, error) {
+	var tagged bool
+	switch e.opts.LifetimePolicy {
+	case "", LifetimeTimer:
+	case LifetimeTag:
+		tagged = e.opts.MaxLifetime > 0
+	default:
+		return nil, fmt.Errorf("unknown lifetime policy: %s", e.opts.LifetimePolicy)
+	}
+	switch {
+	case !spec.expires.IsZero():
+		return []string{platform.ExpiryTag(spec.expires)}, nil
+	case tagged:
+		expires := time.Now().Add(e.opts.MaxLifetime)
+		return []string{platform.ExpiryTag(expires)}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// helper function schedules the server instance to be destroyed
+// once the maximum lifetime elapses, if the lifetime is enforced
+// by an in-process timer. A server instance provisioned in
+// setup-only mode is not scheduled, since it expires with the
+// expiry tag. A new context is used, since the provisioning
+// context may be cancelled.
+func (e *engine) scheduleExpiry(ctx context.Context, spec *Spec) {
+	lifetime := e.opts.MaxLifetime
+	if lifetime <= 0 || (e.opts.LifetimePolicy != "" && e.opts.LifetimePolicy != LifetimeTimer) {
+		return
+	}
+	if !spec.expires.IsZero() {
+		return
+	}
+
+	log := logger.FromContext(ctx).
+		WithField("hostname", spec.Server.Name).
+		WithField("id", spec.id).
+		WithField("lifetime", lifetime)
+
+	// the server instance is always confirmed before it is
+	// destroyed, since the destroy is not requested by the
+	// pipeline.
+	args := e.destroyArgs(spec)
+	args.Confirm = true
+
+	spec.mu.Lock()
+	defer spec.mu.Unlock()
+	keypair := spec.keypair
+	spec.expiry = time.AfterFunc(lifetime, func() {
+		log.Warn("server instance exceeds the maximum lifetime, destroying")
+		defer spec.releaseProvision()
+		ctx := logger.WithContext(context.Background(), log)
+		ctx = platform.WithHTTPClient(ctx, e.client)
+		if err := destroy(ctx, args); err != nil && err != platform.ErrNotFound {
+			log.WithError(err).
+				Error("cannot destroy server instance that exceeds the maximum lifetime")
+			return
+		}
+		// the build keypair is removed from the account
+		// with the server instance.
+		if keypair != nil && !args.DryRun {
+			deregisterKey(ctx, platform.DeregisterArgs{
+				Fingerprint: keypair.fingerprint,
+				Token:       args.Token,
+			})
+		}
+	})
+}
+
+// helper function stops the timer that destroys the server
+// instance once the maximum lifetime elapses.
+func (s *Spec) stopExpiry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+func TestProvision_MaxLifetime(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		return platform.Instance{ID: 1, IP: "1.2.3.4"}, nil
+	}
+	destroyed := make(chan platform.DestroyArgs, 1)
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		destroyed <- args
+		return nil
+	}
+
+	// the provisioning context is cancelled once the server
+	// instance is provisioned, and does not prevent the server
+	// instance from being destroyed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine := &engine{opts: Opts{MaxLifetime: time.Millisecond * 10, MaxProvisions: 1}}
+	spec := &Spec{Token: "token", Server: Server{Name: "drone-temp-foo"}}
+	if err := engine.Provision(ctx, spec); err != nil {
+		t.Error(err)
+		return
+	}
+	cancel()
+
+	select {
+	case args := <-destroyed:
+		if args.ID != 1 || args.Name != "drone-temp-foo" || !args.Confirm {
+			t.Errorf("Want expired server instance destroyed, got %+v", args)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expect server instance destroyed once the lifetime elapses")
+		return
+	}
+
+	// the provisioning slot is released once the expired
+	// server instance is destroyed.
+	for i := 0; ; i++ {
+		engine.mu.Lock()
+		held := len(engine.provisions["token"])
+		engine.mu.Unlock()
+		if held == 0 {
+			break
+		}
+		if i == 100 {
+			t.Errorf("Want provisioning slot released")
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestProvision_MaxLifetimeDryRun(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		return platform.Instance{ID: 1, IP: "1.2.3.4"}, nil
+	}
+	destroyed := make(chan platform.DestroyArgs, 1)
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		destroyed <- args
+		return nil
+	}
+
+	// the server instance is not deleted once the lifetime
+	// elapses in dry-run mode, and the destroy options are
+	// passed to the platform.
+	engine := &engine{opts: Opts{
+		MaxLifetime:      time.Millisecond * 10,
+		DestroyDryRun:    true,
+		ForceDestroy:     true,
+		DestroyResources: true,
+	}}
+	spec := &Spec{Token: "token", Server: Server{Name: "drone-temp-foo"}}
+	if err := engine.Provision(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	select {
+	case args := <-destroyed:
+		if !args.DryRun || !args.Force || !args.Resources || !args.Confirm {
+			t.Errorf("Want dry-run destroy with the destroy options, got %+v", args)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expect dry-run destroy once the lifetime elapses")
+	}
+}
+
+func TestProvision_MaxLifetimeStopped(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		return platform.Instance{ID: 1}, nil
+	}
+	var calls int
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		calls++
+		return nil
+	}
+
+	// the timer is stopped when the server instance is
+	// destroyed before the lifetime elapses.
+	engine := &engine{opts: Opts{MaxLifetime: time.Millisecond * 50}}
+	spec := &Spec{Token: "token"}
+	if err := engine.Provision(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := engine.Destroy(context.Background(), spec); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if calls != 1 {
+		t.Errorf("Want server instance destroyed once, got %d", calls)
+	}
+}
+
+func TestProvision_MaxLifetimeTag(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	var tags []string
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		tags = args.Tags
+		return platform.Instance{ID: 1}, nil
+	}
+
+	engine := &engine{opts: Opts{MaxLifetime: time.Hour, LifetimePolicy: LifetimeTag}}
+	spec := &Spec{Token: "token"}
+	if err := engine.Provision(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(tags) != 1 || !strings.HasPrefix(tags[0], "drone-expires:") {
+		t.Errorf("Want server instance tagged with the expiry time, got %v", tags)
+	}
+	if spec.expiry != nil {
+		t.Errorf("Expect no in-process timer when the reaper enforces the lifetime")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+
+	"github.com/drone/runner-go/logger"
+)
+
+// helper function blocks until a provisioning slot is available
+// for the account token, or the context is cancelled. The slot
+// is held by the spec until the server instance is destroyed.
+func (e *engine) acquireProvision(ctx context.Context, spec *Spec) error {
+	limit := e.opts.MaxProvisions
+	if limit <= 0 {
+		return nil
+	}
+	spec.mu.Lock()
+	held := spec.release != nil
+	spec.mu.Unlock()
+	if held {
+		return nil
+	}
+
+	e.mu.Lock()
+	if e.provisions == nil {
+		e.provisions = map[string]chan struct{}{}
+	}
+	slots, ok := e.provisions[spec.Token]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		e.provisions[spec.Token] = slots
+	}
+	e.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		logger.FromContext(ctx).
+			WithField("limit", limit).
+			Debug("waiting for an available provisioning slot")
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	spec.mu.Lock()
+	spec.release = func() {
+		<-slots
+	}
+	spec.mu.Unlock()
+	return nil
+}
+
+// helper function releases the provisioning slot held by the
+// spec, if any.
+func (s *Spec) releaseProvision() {
+	s.mu.Lock()
+	release := s.release
+	s.release = nil
+	s.mu.Unlock()
+	if release != nil {
+		release()
+	}
+}
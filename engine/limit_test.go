@@ -0,0 +1,121 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+func TestProvision_MaxProvisions(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+
+	// active tracks the number of server instances that are
+	// provisioned and not yet destroyed.
+	var active, peak, id int32
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		return platform.Instance{ID: int(atomic.AddInt32(&id, 1)), IP: "1.2.3.4"}, nil
+	}
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		atomic.AddInt32(&active, -1)
+		return nil
+	}
+
+	engine := &engine{opts: Opts{MaxProvisions: 2}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			spec := &Spec{Token: "token", Server: Server{Name: "drone-temp-foo"}}
+			if err := engine.Provision(context.Background(), spec); err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+			engine.Destroy(context.Background(), spec)
+		}()
+	}
+	wg.Wait()
+
+	if got, want := atomic.LoadInt32(&peak), int32(2); got != want {
+		t.Errorf("Want at most %d concurrent server instances, got %d", want, got)
+	}
+	if got := atomic.LoadInt32(&id); got != 10 {
+		t.Errorf("Want 10 server instances provisioned, got %d", got)
+	}
+}
+
+func TestProvision_MaxProvisionsTimeout(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		return platform.Instance{ID: 1, IP: "1.2.3.4"}, nil
+	}
+
+	engine := &engine{opts: Opts{MaxProvisions: 1}}
+	if err := engine.Provision(context.Background(), &Spec{Token: "a"}); err != nil {
+		t.Error(err)
+		return
+	}
+	// the limit applies per account token.
+	if err := engine.Provision(context.Background(), &Spec{Token: "b"}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the slot is held until the server instance is destroyed,
+	// and the provision request waits for an available slot.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := engine.Provision(ctx, &Spec{Token: "a"}); err != context.DeadlineExceeded {
+		t.Errorf("Want provision to wait for an available slot, got %v", err)
+	}
+}
+
+func TestProvision_MaxProvisionsError(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	findByName = func(ctx context.Context, name, token string) (*platform.Instance, error) {
+		return nil, platform.ErrNotFound
+	}
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		return platform.Instance{}, platform.ErrImageRegion
+	}
+
+	// the slot is released when provisioning fails and no
+	// server instance is created.
+	engine := &engine{opts: Opts{MaxProvisions: 1}}
+	spec := &Spec{Token: "token"}
+	if err := engine.Provision(context.Background(), spec); err == nil {
+		t.Errorf("Expect provision error")
+	}
+	if spec.release != nil {
+		t.Errorf("Expect provisioning slot released")
+	}
+	if got := len(engine.provisions["token"]); got != 0 {
+		t.Errorf("Want no provisioning slots held, got %d", got)
+	}
+}
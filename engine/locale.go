@@ -0,0 +1,68 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+
+	"github.com/drone/runner-go/logger"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The pipeline steps can optionally run with a configured
+// locale and timezone, which are not set by default, so that
+// locale and timezone sensitive builds produce reproducible
+// date and number formatting. The locale and timezone are
+// exported by the step script, and the timezone is optionally
+// set on the server instance with timedatectl. The locale and
+// timezone are not supported on windows, and are ignored.
+
+// helper function returns the step environment with the locale
+// and timezone variables. Variables defined by the step take
+// precedence.
+func localeEnv(os string, envs map[string]string, locale, timezone string) map[string]string {
+	if os == "windows" || (locale == "" && timezone == "") {
+		return envs
+	}
+	out := map[string]string{}
+	if locale != "" {
+		out["LANG"] = locale
+		out["LC_ALL"] = locale
+	}
+	if timezone != "" {
+		out["TZ"] = timezone
+	}
+	for k, v := range envs {
+		out[k] = v
+	}
+	return out
+}
+
+// helper function sets the timezone of the server instance.
+func setTimezone(ctx context.Context, spec *Spec, client *ssh.Client, timezone string) error {
+	if timezone == "" || spec.Platform.OS == "windows" {
+		return nil
+	}
+	log := logger.FromContext(ctx).
+		WithField("hostname", spec.Server.Name).
+		WithField("timezone", timezone)
+
+	out, err := execute(client, timezoneCommand(timezone))
+	if err != nil {
+		log.WithError(err).
+			WithField("output", string(out)).
+			Error("cannot set timezone")
+		return err
+	}
+	log.Debug("timezone set")
+	return nil
+}
+
+// helper function returns the shell command to set the
+// timezone.
+func timezoneCommand(timezone string) string {
+	return "timedatectl set-timezone " + shellQuote(timezone)
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLocaleEnv(t *testing.T) {
+	envs := map[string]string{"GOPATH": "/go", "TZ": "America/New_York"}
+	got := localeEnv("linux", envs, "en_US.UTF-8", "UTC")
+	want := map[string]string{
+		"GOPATH": "/go",
+		"LANG":   "en_US.UTF-8",
+		"LC_ALL": "en_US.UTF-8",
+		"TZ":     "America/New_York",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Unexpected locale environment")
+		t.Log(diff)
+	}
+
+	// the step environment is not modified if the locale
+	// and timezone are not configured, or on windows.
+	if got := localeEnv("linux", envs, "", ""); len(got) != 2 {
+		t.Errorf("Want step environment unmodified, got %v", got)
+	}
+	if got := localeEnv("windows", envs, "en_US.UTF-8", "UTC"); len(got) != 2 {
+		t.Errorf("Want step environment unmodified on windows, got %v", got)
+	}
+}
+
+func TestLocaleEnv_Script(t *testing.T) {
+	buf := new(bytes.Buffer)
+	envs := localeEnv("linux", nil, "en_US.UTF-8", "UTC")
+	writeEnviron(buf, "linux", envs, nil, nil)
+	want := "export LANG=\"en_US.UTF-8\"\nexport LC_ALL=\"en_US.UTF-8\"\nexport TZ=\"UTC\"\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+func TestTimezoneCommand(t *testing.T) {
+	got := timezoneCommand("Europe/Berlin")
+	want := "timedatectl set-timezone 'Europe/Berlin'"
+	if got != want {
+		t.Errorf("Want timezone command %q, got %q", want, got)
+	}
+}
+
+func TestSetTimezone_Disabled(t *testing.T) {
+	// the ssh client is not used when the timezone is not
+	// configured or not supported.
+	spec := &Spec{}
+	if err := setTimezone(context.Background(), spec, nil, ""); err != nil {
+		t.Error(err)
+	}
+	spec.Platform.OS = "windows"
+	if err := setTimezone(context.Background(), spec, nil, "UTC"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRun_Locale(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{Locale: "C.UTF-8", Timezone: "UTC"})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "build.sh")
+	step := &Step{
+		Name:    "build",
+		Command: "sh",
+		Args:    []string{script},
+		Files:   []*File{{Path: script, Mode: 0700, Data: []byte(`echo "$LANG $LC_ALL $TZ"`)}},
+	}
+	buf := new(syncBuffer)
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := buf.String(), "C.UTF-8 C.UTF-8 UTC\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+}
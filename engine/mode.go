@@ -0,0 +1,74 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/drone/runner-go/logger"
+)
+
+// unix setuid and setgid permission bits.
+const (
+	modeSetuid = 04000
+	modeSetgid = 02000
+)
+
+// ModeError is returned when a file has suspicious permissions
+// and the mode policy rejects the file.
+type ModeError struct {
+	Path   string
+	Mode   uint32
+	Reason string
+}
+
+func (e *ModeError) Error() string {
+	return fmt.Sprintf("file %s has mode %#o: %s", e.Path, e.Mode, e.Reason)
+}
+
+// helper function validates the file permissions using the
+// mode policy. Suspicious permissions are logged if the policy
+// is ModeWarn, and return an error if the policy is ModeReject.
+func checkModes(ctx context.Context, files []*File, policy ModePolicy) error {
+	if policy != ModeWarn && policy != ModeReject {
+		return nil
+	}
+	for _, file := range files {
+		err := checkMode(file)
+		if err == nil {
+			continue
+		}
+		if policy == ModeReject {
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("path", file.Path).
+				Error("file has suspicious permissions")
+			return err
+		}
+		logger.FromContext(ctx).
+			WithError(err).
+			WithField("path", file.Path).
+			Warn("file has suspicious permissions")
+	}
+	return nil
+}
+
+// helper function returns an error if the file has suspicious
+// permissions. Files without permissions cannot be read by the
+// pipeline, and setuid or setgid bits on uploaded files are
+// not expected. The setgid bit is permitted on directories,
+// where it controls group inheritance.
+func checkMode(file *File) error {
+	switch {
+	case file.Mode&0777 == 0:
+		return &ModeError{Path: file.Path, Mode: file.Mode, Reason: "no permissions"}
+	case file.IsDir && file.Mode&modeSetuid != 0:
+		return &ModeError{Path: file.Path, Mode: file.Mode, Reason: "setuid bit on directory"}
+	case !file.IsDir && file.Mode&(modeSetuid|modeSetgid) != 0:
+		return &ModeError{Path: file.Path, Mode: file.Mode, Reason: "setuid or setgid bit on file"}
+	}
+	return nil
+}
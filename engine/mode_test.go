@@ -0,0 +1,78 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCheckMode(t *testing.T) {
+	tests := []struct {
+		file *File
+		ok   bool
+	}{
+		{file: &File{Path: "/opt/build.sh", Mode: 0700}, ok: true},
+		{file: &File{Path: "/home/.netrc", Mode: 0600}, ok: true},
+		{file: &File{Path: "/opt/build.sh", Mode: 0}, ok: false},
+		{file: &File{Path: "/opt/build.sh", Mode: 04755}, ok: false},
+		{file: &File{Path: "/opt/build.sh", Mode: 02755}, ok: false},
+		{file: &File{Path: "/opt", Mode: 02775, IsDir: true}, ok: true},
+		{file: &File{Path: "/opt", Mode: 04775, IsDir: true}, ok: false},
+		{file: &File{Path: "/opt", Mode: 0, IsDir: true}, ok: false},
+	}
+	for _, test := range tests {
+		err := checkMode(test.file)
+		if test.ok && err != nil {
+			t.Errorf("Want mode %#o ok, got error %s", test.file.Mode, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("Want mode %#o error", test.file.Mode)
+		}
+		if _, ok := err.(*ModeError); err != nil && !ok {
+			t.Errorf("Want mode error, got %T", err)
+		}
+	}
+}
+
+func TestCheckModes(t *testing.T) {
+	files := []*File{
+		{Path: "/opt/clone.sh", Mode: 0700},
+		{Path: "/opt/build.sh", Mode: 04700},
+	}
+	tests := []struct {
+		policy ModePolicy
+		err    bool
+	}{
+		{policy: "", err: false},
+		{policy: ModeIgnore, err: false},
+		{policy: ModeWarn, err: false},
+		{policy: ModeReject, err: true},
+	}
+	for _, test := range tests {
+		err := checkModes(context.Background(), files, test.policy)
+		if got := err != nil; got != test.err {
+			t.Errorf("Want error %v for policy %q, got %v", test.err, test.policy, err)
+		}
+	}
+}
+
+func TestRun_ModeReject(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{ModePolicy: ModeReject})
+	defer closer()
+
+	step := &Step{
+		Name:    "build",
+		Command: "sh",
+		Args:    []string{"/tmp/drone-mode-test.sh"},
+		Files: []*File{
+			{Path: "/tmp/drone-mode-test.sh", Mode: 04700, Data: []byte("echo hello\n")},
+		},
+	}
+	_, err := engine.Run(context.Background(), spec, step, new(syncBuffer))
+	if _, ok := err.(*ModeError); !ok {
+		t.Errorf("Want mode error, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/drone/runner-go/logger"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrMountTool is returned when a spaces bucket cannot be
+	// mounted because s3fs is not installed on the server
+	// instance image.
+	ErrMountTool = errors.New("cannot mount spaces bucket: s3fs is not installed on the server instance")
+
+	// ErrMountPlatform is returned when a spaces bucket is
+	// mounted on an unsupported platform.
+	ErrMountPlatform = errors.New("cannot mount spaces bucket: platform not supported")
+)
+
+// helper function mounts the spaces buckets on the server
+// instance. The bucket credentials are written to a file in the
+// pipeline root directory, which is readable only by the owner.
+func mountSpaces(ctx context.Context, spec *Spec, client *ssh.Client, put uploadFunc) error {
+	if len(spec.Mounts) == 0 {
+		return nil
+	}
+	if spec.Platform.OS == "windows" {
+		return ErrMountPlatform
+	}
+	if _, err := execute(client, "command -v s3fs"); err != nil {
+		return ErrMountTool
+	}
+	for i, mount := range spec.Mounts {
+		passwd := fmt.Sprintf("%s/spaces-%d.passwd", spec.Root, i)
+		err := put(passwd, []byte(mount.AccessKey+":"+mount.SecretKey), 0600)
+		if err != nil {
+			return err
+		}
+		out, err := execute(client, mountCommand(mount, spec.Server.Region, passwd))
+		if err != nil {
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("bucket", mount.Bucket).
+				WithField("path", mount.Path).
+				WithField("output", string(out)).
+				Error("cannot mount spaces bucket")
+			return err
+		}
+	}
+	return nil
+}
+
+// helper function unmounts the spaces buckets from the server
+// instance. Errors are logged and otherwise ignored.
+func unmountSpaces(ctx context.Context, spec *Spec, client *ssh.Client) {
+	for _, mount := range spec.Mounts {
+		out, err := execute(client, unmountCommand(mount))
+		if err != nil {
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("path", mount.Path).
+				WithField("output", string(out)).
+				Debug("cannot unmount spaces bucket")
+		}
+	}
+}
+
+// helper function returns the shell command to mount the spaces
+// bucket as a read-only filesystem. The bucket is not mounted
+// again if the path is already a mount point, which means the
+// server instance can be safely re-configured.
+func mountCommand(mount *Mount, region, passwd string) string {
+	endpoint := mount.Endpoint
+	if endpoint == "" {
+		endpoint = region + ".digitaloceanspaces.com"
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	return fmt.Sprintf(
+		"mountpoint -q %s || (mkdir -p %s && s3fs %s %s -o passwd_file=%s -o url=%s -o use_path_request_style -o ro)",
+		mount.Path,
+		mount.Path,
+		mount.Bucket,
+		mount.Path,
+		passwd,
+		endpoint,
+	)
+}
+
+// helper function returns the shell command to unmount the
+// spaces bucket.
+func unmountCommand(mount *Mount) string {
+	return fmt.Sprintf("fusermount -u %s || umount %s", mount.Path, mount.Path)
+}
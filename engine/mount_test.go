@@ -0,0 +1,83 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+)
+
+func TestMountCommand(t *testing.T) {
+	tests := []struct {
+		mount  *Mount
+		region string
+		want   string
+	}{
+		{
+			mount:  &Mount{Bucket: "datasets", Endpoint: "ams3.digitaloceanspaces.com", Path: "/mnt/datasets"},
+			region: "nyc1",
+			want:   "mountpoint -q /mnt/datasets || (mkdir -p /mnt/datasets && s3fs datasets /mnt/datasets -o passwd_file=/tmp/spaces-0.passwd -o url=https://ams3.digitaloceanspaces.com -o use_path_request_style -o ro)",
+		},
+		// the endpoint defaults to the server instance region.
+		{
+			mount:  &Mount{Bucket: "datasets", Path: "/mnt/datasets"},
+			region: "sfo2",
+			want:   "mountpoint -q /mnt/datasets || (mkdir -p /mnt/datasets && s3fs datasets /mnt/datasets -o passwd_file=/tmp/spaces-0.passwd -o url=https://sfo2.digitaloceanspaces.com -o use_path_request_style -o ro)",
+		},
+		// the endpoint scheme is preserved.
+		{
+			mount:  &Mount{Bucket: "datasets", Endpoint: "http://localhost:9000", Path: "/mnt/datasets"},
+			region: "sfo2",
+			want:   "mountpoint -q /mnt/datasets || (mkdir -p /mnt/datasets && s3fs datasets /mnt/datasets -o passwd_file=/tmp/spaces-0.passwd -o url=http://localhost:9000 -o use_path_request_style -o ro)",
+		},
+	}
+	for _, test := range tests {
+		if got := mountCommand(test.mount, test.region, "/tmp/spaces-0.passwd"); got != test.want {
+			t.Errorf("Want mount command %q, got %q", test.want, got)
+		}
+	}
+}
+
+func TestUnmountCommand(t *testing.T) {
+	got := unmountCommand(&Mount{Path: "/mnt/datasets"})
+	want := "fusermount -u /mnt/datasets || umount /mnt/datasets"
+	if got != want {
+		t.Errorf("Want unmount command %q, got %q", want, got)
+	}
+}
+
+func TestMountSpaces_NoTool(t *testing.T) {
+	if _, err := exec.LookPath("s3fs"); err == nil {
+		t.Skip("s3fs is installed")
+	}
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	client, err := engine.connect(spec.ip, spec.Server.User, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	spec.Mounts = []*Mount{{Bucket: "datasets", Path: "/mnt/datasets"}}
+	put := func(string, []byte, uint32) error {
+		t.Errorf("Expect credentials not uploaded")
+		return nil
+	}
+	if err := mountSpaces(context.Background(), spec, client, put); err != ErrMountTool {
+		t.Errorf("Want ErrMountTool, got %v", err)
+	}
+}
+
+func TestMountSpaces_Windows(t *testing.T) {
+	spec := &Spec{
+		Platform: Platform{OS: "windows"},
+		Mounts:   []*Mount{{Bucket: "datasets", Path: "C:\\datasets"}},
+	}
+	if err := mountSpaces(context.Background(), spec, nil, nil); err != ErrMountPlatform {
+		t.Errorf("Want ErrMountPlatform, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+	"github.com/drone/runner-go/logger"
+)
+
+// findByName returns the server instance with the matching
+// name. It is declared as a variable so that it can be replaced
+// in unit tests.
+var findByName = platform.FindByName
+
+// the number of times, and the interval at which, the account
+// is searched for a server instance that may have been created
+// after provisioning was cancelled or failed. The create
+// request may complete server-side after the client gives up,
+// in which case the server instance is not immediately listed.
+var (
+	orphanAttempts = 3
+	orphanInterval = time.Second * 5
+)
+
+// helper function searches the account for a server instance
+// that was created despite the failed provisioning request, and
+// destroys the server instance to prevent a leak. A new context
+// is used, since the provisioning context may be cancelled.
+func (e *engine) destroyOrphan(ctx context.Context, spec *Spec, cause error) {
+	// there is no orphan if the api rejected the request.
+	if ctx.Err() == nil && platform.IsAPIError(cause) {
+		return
+	}
+
+	log := logger.FromContext(ctx).
+		WithField("name", spec.Server.Name)
+
+	ctx = logger.WithContext(context.Background(), log)
+	ctx = platform.WithHTTPClient(ctx, e.client)
+	for i := 0; i < orphanAttempts; i++ {
+		if i > 0 {
+			time.Sleep(orphanInterval)
+		}
+		instance, err := findByName(ctx, spec.Server.Name, spec.Token)
+		if err == platform.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			log.WithError(err).
+				Warn("cannot search for orphaned server instance")
+			return
+		}
+		log.WithField("id", instance.ID).
+			Warn("destroying server instance created after provisioning failed")
+		err = destroy(ctx, platform.DestroyArgs{
+			ID:      instance.ID,
+			IP:      instance.IP,
+			Token:   spec.Token,
+			Confirm: true,
+			Name:    spec.Server.Name,
+		})
+		if err != nil {
+			log.WithError(err).
+				WithField("id", instance.ID).
+				Error("cannot destroy orphaned server instance")
+		}
+		return
+	}
+}
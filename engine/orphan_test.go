@@ -0,0 +1,91 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+func TestProvision_Orphan(t *testing.T) {
+	defer stubPlatform()()
+	defer mockOrphanInterval()()
+
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+
+	// the provisioning request is cancelled by the client, and
+	// the server instance is created server-side after the
+	// client gives up.
+	ctx, cancel := context.WithCancel(context.Background())
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		cancel()
+		return platform.Instance{}, ctx.Err()
+	}
+	var searches int
+	findByName = func(ctx context.Context, name, token string) (*platform.Instance, error) {
+		if ctx.Err() != nil {
+			t.Errorf("Expect search uses a context that is not cancelled")
+		}
+		if searches++; searches < 2 {
+			return nil, platform.ErrNotFound
+		}
+		return &platform.Instance{ID: 7, IP: "1.2.3.4"}, nil
+	}
+	var destroyed platform.DestroyArgs
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		destroyed = args
+		return nil
+	}
+
+	spec := &Spec{Token: "token", Server: Server{Name: "drone-temp-foo"}}
+	if err := new(engine).Provision(ctx, spec); err != context.Canceled {
+		t.Errorf("Want error %v, got %v", context.Canceled, err)
+	}
+	if destroyed.ID != 7 || destroyed.Name != "drone-temp-foo" || !destroyed.Confirm {
+		t.Errorf("Want orphaned server instance destroyed, got %+v", destroyed)
+	}
+}
+
+func TestProvision_OrphanNotFound(t *testing.T) {
+	defer stubPlatform()()
+	defer mockOrphanInterval()()
+
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	provision = func(ctx context.Context, args platform.ProvisionArgs) (platform.Instance, error) {
+		return platform.Instance{}, context.DeadlineExceeded
+	}
+	var searches int
+	findByName = func(ctx context.Context, name, token string) (*platform.Instance, error) {
+		searches++
+		return nil, platform.ErrNotFound
+	}
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		t.Errorf("Expect destroy not called when no server instance is found")
+		return nil
+	}
+
+	spec := &Spec{Token: "token", Server: Server{Name: "drone-temp-foo"}}
+	new(engine).Provision(context.Background(), spec)
+	if searches != orphanAttempts {
+		t.Errorf("Want %d searches, got %d", orphanAttempts, searches)
+	}
+}
+
+// helper function shortens the orphan search interval for
+// unit tests. The returned function restores the interval.
+func mockOrphanInterval() func() {
+	restore := orphanInterval
+	orphanInterval = time.Millisecond
+	return func() {
+		orphanInterval = restore
+	}
+}
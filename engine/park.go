@@ -0,0 +1,260 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+	"github.com/drone/runner-go/logger"
+)
+
+// A server instance can be parked instead of destroyed once the
+// pipeline completes, so that a subsequent pipeline with the same
+// cache key (e.g. the repository name) reuses the server instance
+// with a warm cache of dependencies, and skips provisioning. The
+// pipeline workspace is removed when the server instance is
+// parked, however, files outside the workspace are preserved.
+//
+// Parked server instances are tagged with the cache key and the
+// time the server instance was parked. A parked server instance
+// expires once the park ttl has elapsed, after which it is not
+// reused and is destroyed by Evict.
+//
+// Claiming a parked server instance is not atomic, since the
+// digitalocean api does not support conditional updates.
+// Runners that share an account should use distinct cache keys.
+
+// defaultParkTTL is the default time a parked server instance
+// can be reused.
+const defaultParkTTL = time.Hour * 24
+
+var (
+	// park, unpark and listParked are declared as variables
+	// so that they can be replaced in unit tests.
+	park       = platform.Park
+	unpark     = platform.Unpark
+	listParked = platform.ListParked
+)
+
+var (
+	// ErrNotParked is returned when no parked server instance
+	// matches the cache key.
+	ErrNotParked = errors.New("no parked server instance found")
+
+	// ErrParkExpired is returned when the parked server
+	// instance has expired and cannot be reused.
+	ErrParkExpired = errors.New("parked server instance has expired")
+
+	// ErrParkKeypair is returned when a server instance that
+	// is provisioned with a build keypair is parked, since the
+	// build keypair is not available to subsequent pipelines.
+	ErrParkKeypair = errors.New("cannot park a server instance provisioned with a build keypair")
+)
+
+// Handle identifies a parked server instance.
+type Handle struct {
+	ID        int
+	IP        string
+	PrivateIP string
+	Size      string
+	Key       string    // Cache key of the parked instance.
+	Parked    time.Time // Time the instance was parked.
+	Expires   time.Time // Time after which the instance is evicted.
+}
+
+// Park removes the pipeline workspace from the server instance
+// and parks the server instance for reuse by a subsequent
+// pipeline with the same cache key, instead of destroying the
+// server instance. The server instance must be destroyed if
+// parking fails.
+func (e *engine) Park(ctx context.Context, spec *Spec, key string) (*Handle, error) {
+	ctx = platform.WithHTTPClient(ctx, e.client)
+	if spec.id == 0 {
+		return nil, ErrNotProvisioned
+	}
+	if spec.keypair != nil {
+		return nil, ErrParkKeypair
+	}
+	// the lifetime of the pipeline no longer applies once the
+	// server instance is parked, and the parked server
+	// instance expires with the park ttl.
+	spec.stopExpiry()
+	spec.closeConn()
+
+	log := logger.FromContext(ctx).
+		WithField("hostname", spec.Server.Name).
+		WithField("ip", spec.ip).
+		WithField("id", spec.id).
+		WithField("key", key)
+
+	client, err := e.connect(spec.ip, spec.Server.User, e.opts.HandshakeTimeout, e.hostKeyCallback(spec))
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	// the spaces buckets are mounted with the credentials of
+	// the pipeline, and are unmounted before the workspace is
+	// removed.
+	unmountSpaces(ctx, spec, client)
+
+	out, err := execute(client, removeCommand(spec.Platform.OS, spec.Root))
+	if err != nil {
+		log.WithError(err).
+			WithField("output", string(out)).
+			Error("cannot remove workspace directory")
+		return nil, err
+	}
+
+	parked, err := park(ctx, platform.ParkArgs{
+		ID:    spec.id,
+		Key:   key,
+		Token: spec.Token,
+	})
+	if err != nil {
+		return nil, err
+	}
+	spec.releaseProvision()
+
+	log.Debug("server instance parked")
+	return &Handle{
+		ID:        spec.id,
+		IP:        spec.ip,
+		PrivateIP: spec.privateIP,
+		Size:      spec.size,
+		Key:       key,
+		Parked:    parked,
+		Expires:   parked.Add(e.parkTTL()),
+	}, nil
+}
+
+// Resume claims the parked server instance and configures the
+// server instance for the pipeline, skipping provisioning. The
+// server instance should be destroyed if configuration fails.
+func (e *engine) Resume(ctx context.Context, spec *Spec, handle *Handle) error {
+	ctx = platform.WithHTTPClient(ctx, e.client)
+	if !handle.Expires.IsZero() && time.Now().After(handle.Expires) {
+		return ErrParkExpired
+	}
+	// the maximum lifetime is enforced from the time the
+	// server instance is resumed.
+	tags, err := e.lifetimeTags(spec)
+	if err != nil {
+		return err
+	}
+	if err := e.acquireProvision(ctx, spec); err != nil {
+		return err
+	}
+	err = unpark(ctx, platform.UnparkArgs{
+		ID:     handle.ID,
+		Key:    handle.Key,
+		Parked: handle.Parked,
+		Token:  spec.Token,
+		Tags:   tags,
+	})
+	if err != nil {
+		spec.releaseProvision()
+		if err == platform.ErrNotFound {
+			return ErrNotParked
+		}
+		return err
+	}
+
+	spec.id = handle.ID
+	spec.ip = handle.IP
+	spec.privateIP = handle.PrivateIP
+	spec.size = handle.Size
+	e.scheduleExpiry(ctx, spec)
+
+	logger.FromContext(ctx).
+		WithField("hostname", spec.Server.Name).
+		WithField("ip", spec.ip).
+		WithField("id", spec.id).
+		WithField("key", handle.Key).
+		Debug("resuming parked server instance")
+	return e.Configure(ctx, spec)
+}
+
+// FindParked returns the most recently parked server instance
+// with the cache key that has not expired. If no server
+// instance is found, ErrNotParked is returned.
+func (e *engine) FindParked(ctx context.Context, token, key string) (*Handle, error) {
+	ctx = platform.WithHTTPClient(ctx, e.client)
+	list, err := listParked(ctx, platform.ListParkedArgs{
+		Key:   key,
+		Token: token,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, parked := range list {
+		handle := e.newHandle(parked)
+		handle.Key = key
+		if time.Now().Before(handle.Expires) {
+			return handle, nil
+		}
+	}
+	return nil, ErrNotParked
+}
+
+// Evict destroys the parked server instances that have expired,
+// and returns the evicted server instances.
+func (e *engine) Evict(ctx context.Context, token string) ([]*Handle, error) {
+	ctx = platform.WithHTTPClient(ctx, e.client)
+	list, err := listParked(ctx, platform.ListParkedArgs{Token: token})
+	if err != nil {
+		return nil, err
+	}
+	var evicted []*Handle
+	for _, parked := range list {
+		handle := e.newHandle(parked)
+		if time.Now().Before(handle.Expires) {
+			continue
+		}
+		err := destroy(ctx, platform.DestroyArgs{
+			ID:      handle.ID,
+			IP:      handle.IP,
+			Token:   token,
+			Confirm: e.opts.ConfirmDestroy,
+			DryRun:  e.opts.DestroyDryRun,
+		})
+		if err != nil && err != platform.ErrNotFound {
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("id", handle.ID).
+				WithField("key", handle.Key).
+				Error("cannot evict parked server instance")
+			return evicted, err
+		}
+		evicted = append(evicted, handle)
+	}
+	return evicted, nil
+}
+
+// helper function returns the handle for the parked server
+// instance.
+func (e *engine) newHandle(parked platform.Parked) *Handle {
+	return &Handle{
+		ID:        parked.ID,
+		IP:        parked.IP,
+		PrivateIP: parked.PrivateIP,
+		Size:      parked.Size,
+		Key:       parked.Key,
+		Parked:    parked.Parked,
+		Expires:   parked.Parked.Add(e.parkTTL()),
+	}
+}
+
+// helper function returns the time a parked server instance
+// can be reused.
+func (e *engine) parkTTL() time.Duration {
+	if ttl := e.opts.ParkTTL; ttl > 0 {
+		return ttl
+	}
+	return defaultParkTTL
+}
@@ -0,0 +1,283 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+func TestPark(t *testing.T) {
+	defer stubPlatform()()
+	parked := time.Now().Truncate(time.Second)
+	park = func(ctx context.Context, args platform.ParkArgs) (time.Time, error) {
+		if args.ID != 1 || args.Key != "octocat/hello-world" {
+			t.Errorf("Unexpected park arguments %v", args)
+		}
+		return parked, nil
+	}
+
+	engine, spec, closer := mockEngine(t, Opts{ParkTTL: time.Hour})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// files outside the workspace are preserved.
+	cache := filepath.Join(dir, "cache")
+	ioutil.WriteFile(cache, []byte("cache"), 0600)
+	spec.Root = filepath.Join(dir, "drone-random")
+	os.MkdirAll(filepath.Join(spec.Root, "src"), 0700)
+
+	handle, err := engine.Park(context.Background(), spec, "octocat/hello-world")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if handle.ID != 1 || handle.IP != spec.ip {
+		t.Errorf("Unexpected handle %v", handle)
+	}
+	if got, want := handle.Expires, parked.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("Want handle expires at %s, got %s", want, got)
+	}
+	if _, err := os.Stat(spec.Root); !os.IsNotExist(err) {
+		t.Errorf("Want workspace directory removed")
+	}
+	if _, err := os.Stat(cache); err != nil {
+		t.Errorf("Want files outside the workspace preserved")
+	}
+}
+
+func TestPark_MaxLifetime(t *testing.T) {
+	defer stubPlatform()()
+	park = func(ctx context.Context, args platform.ParkArgs) (time.Time, error) {
+		return time.Now(), nil
+	}
+	var destroyed int32
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		atomic.AddInt32(&destroyed, 1)
+		return nil
+	}
+
+	engine, spec, closer := mockEngine(t, Opts{MaxLifetime: time.Millisecond * 20})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spec.Root = filepath.Join(dir, "drone-random")
+
+	// the lifetime timer of the pipeline is stopped when the
+	// server instance is parked, and the parked server
+	// instance is not destroyed once the lifetime elapses.
+	engine.scheduleExpiry(context.Background(), spec)
+	if _, err := engine.Park(context.Background(), spec, "octocat"); err != nil {
+		t.Error(err)
+		return
+	}
+	time.Sleep(time.Millisecond * 60)
+	if atomic.LoadInt32(&destroyed) != 0 {
+		t.Errorf("Expect parked server instance not destroyed")
+	}
+}
+
+func TestPark_NotProvisioned(t *testing.T) {
+	engine := &engine{}
+	_, err := engine.Park(context.Background(), &Spec{}, "octocat")
+	if err != ErrNotProvisioned {
+		t.Errorf("Want ErrNotProvisioned, got %v", err)
+	}
+}
+
+func TestPark_Keypair(t *testing.T) {
+	engine := &engine{}
+	_, err := engine.Park(context.Background(), &Spec{id: 1, keypair: &keypair{}}, "octocat")
+	if err != ErrParkKeypair {
+		t.Errorf("Want keypair error, got %v", err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	defer stubPlatform()()
+	var claimed bool
+	unpark = func(ctx context.Context, args platform.UnparkArgs) error {
+		claimed = args.ID == 1 && args.Key == "octocat"
+		return nil
+	}
+
+	engine, parked, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the spec is not provisioned, and the parked server
+	// instance is configured instead.
+	spec := &Spec{
+		Server: Server{User: "root"},
+		Root:   filepath.Join(dir, "drone-random"),
+	}
+	handle := &Handle{
+		ID:      1,
+		IP:      parked.ip,
+		Key:     "octocat",
+		Expires: time.Now().Add(time.Hour),
+	}
+	if err := engine.Resume(context.Background(), spec, handle); err != nil {
+		t.Error(err)
+		return
+	}
+	if !claimed {
+		t.Errorf("Want parked server instance claimed")
+	}
+	if spec.id != 1 || spec.ip != parked.ip {
+		t.Errorf("Want spec configured with the parked server instance")
+	}
+	if _, err := os.Stat(spec.Root); err != nil {
+		t.Errorf("Want workspace directory created")
+	}
+}
+
+func TestResume_MaxLifetime(t *testing.T) {
+	defer stubPlatform()()
+	var tags []string
+	unpark = func(ctx context.Context, args platform.UnparkArgs) error {
+		tags = args.Tags
+		return nil
+	}
+
+	// the lifetime is enforced with an expiry tag applied when
+	// the server instance is claimed.
+	engine, parked, closer := mockEngine(t, Opts{MaxLifetime: time.Hour, LifetimePolicy: LifetimeTag})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spec := &Spec{
+		Server: Server{User: "root"},
+		Root:   filepath.Join(dir, "drone-random"),
+	}
+	handle := &Handle{ID: 1, IP: parked.ip, Key: "octocat"}
+	if err := engine.Resume(context.Background(), spec, handle); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(tags) != 1 || !strings.HasPrefix(tags[0], "drone-expires:") {
+		t.Errorf("Want claimed server instance tagged with the expiry time, got %v", tags)
+	}
+
+	// the lifetime is enforced with an in-process timer
+	// started when the server instance is resumed.
+	engine.opts.LifetimePolicy = LifetimeTimer
+	spec = &Spec{
+		Server: Server{User: "root"},
+		Root:   filepath.Join(dir, "drone-random"),
+	}
+	if err := engine.Resume(context.Background(), spec, handle); err != nil {
+		t.Error(err)
+		return
+	}
+	defer spec.stopExpiry()
+	if spec.expiry == nil {
+		t.Errorf("Want lifetime timer started when the server instance is resumed")
+	}
+}
+
+func TestResume_Claimed(t *testing.T) {
+	defer stubPlatform()()
+	unpark = func(ctx context.Context, args platform.UnparkArgs) error {
+		return platform.ErrNotFound
+	}
+	engine := &engine{}
+	err := engine.Resume(context.Background(), new(Spec), &Handle{ID: 1, Key: "octocat"})
+	if err != ErrNotParked {
+		t.Errorf("Want not parked error, got %v", err)
+	}
+}
+
+func TestResume_Expired(t *testing.T) {
+	engine := &engine{}
+	err := engine.Resume(context.Background(), new(Spec), &Handle{ID: 1, Expires: time.Now().Add(-time.Minute)})
+	if err != ErrParkExpired {
+		t.Errorf("Want expired error, got %v", err)
+	}
+}
+
+func TestFindParked(t *testing.T) {
+	defer stubPlatform()()
+	listParked = func(ctx context.Context, args platform.ListParkedArgs) ([]platform.Parked, error) {
+		if args.Key != "octocat" {
+			t.Errorf("Want parked instances listed by key")
+		}
+		return []platform.Parked{
+			{Instance: platform.Instance{ID: 1}, Parked: time.Now().Add(-time.Hour * 2)},
+			{Instance: platform.Instance{ID: 2}, Parked: time.Now().Add(-time.Minute)},
+		}, nil
+	}
+
+	// the first instance has expired and is not reused.
+	engine := &engine{opts: Opts{ParkTTL: time.Hour}}
+	handle, err := engine.FindParked(context.Background(), "token", "octocat")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if handle.ID != 2 {
+		t.Errorf("Want unexpired instance, got %d", handle.ID)
+	}
+
+	engine.opts.ParkTTL = time.Second
+	if _, err := engine.FindParked(context.Background(), "token", "octocat"); err != ErrNotParked {
+		t.Errorf("Want not parked error, got %v", err)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	defer stubPlatform()()
+	listParked = func(ctx context.Context, args platform.ListParkedArgs) ([]platform.Parked, error) {
+		return []platform.Parked{
+			{Instance: platform.Instance{ID: 1}, Parked: time.Now().Add(-time.Hour * 25)},
+			{Instance: platform.Instance{ID: 2}, Parked: time.Now()},
+		}, nil
+	}
+	var destroyed []int
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		destroyed = append(destroyed, args.ID)
+		return nil
+	}
+
+	engine := &engine{}
+	evicted, err := engine.Evict(context.Background(), "token")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(evicted) != 1 || evicted[0].ID != 1 {
+		t.Errorf("Want expired instance evicted, got %v", evicted)
+	}
+	if len(destroyed) != 1 || destroyed[0] != 1 {
+		t.Errorf("Want expired instance destroyed, got %v", destroyed)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"fmt"
+)
+
+// SetupPhase defines a phase of the pipeline environment
+// setup. The phases can be reordered, or skipped, to support
+// different key handling modes: skipping the key phase
+// provisions the server instance without registering the
+// runner key, for example, if the public key is baked into the
+// server image, and skipping the provisioning phase configures
+// an existing server instance.
+type SetupPhase string
+
+// SetupPhase enumeration.
+const (
+	// PhaseKey registers the runner key with the account.
+	PhaseKey SetupPhase = "key"
+
+	// PhaseProvision provisions the server instance.
+	PhaseProvision SetupPhase = "provision"
+
+	// PhaseReady waits for the server instance to be ready.
+	PhaseReady SetupPhase = "ready"
+
+	// PhaseConfigure configures the server instance.
+	PhaseConfigure SetupPhase = "configure"
+)
+
+// defaultSetupPhases defines the default setup phases, in
+// order.
+var defaultSetupPhases = []SetupPhase{
+	PhaseKey,
+	PhaseProvision,
+	PhaseReady,
+	PhaseConfigure,
+}
+
+// helper function returns the setup phases, in order. The
+// default phases are returned if the list is empty. An error is
+// returned if a phase is not known, or is repeated.
+func setupPhases(phases []SetupPhase) ([]SetupPhase, error) {
+	if len(phases) == 0 {
+		return defaultSetupPhases, nil
+	}
+	seen := map[SetupPhase]bool{}
+	for _, phase := range phases {
+		switch phase {
+		case PhaseKey, PhaseProvision, PhaseReady, PhaseConfigure:
+		default:
+			return nil, fmt.Errorf("unknown setup phase: %s", phase)
+		}
+		if seen[phase] {
+			return nil, fmt.Errorf("duplicate setup phase: %s", phase)
+		}
+		seen[phase] = true
+	}
+	return phases, nil
+}
+
+// helper function returns true if the list includes the phase.
+func hasPhase(phases []SetupPhase, phase SetupPhase) bool {
+	for _, p := range phases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function runs the setup phase.
+func (e *engine) runPhase(ctx context.Context, spec *Spec, phase SetupPhase) error {
+	switch phase {
+	case PhaseKey:
+		return e.resolveKey(ctx, spec)
+	case PhaseProvision:
+		return e.provisionServer(ctx, spec)
+	case PhaseReady:
+		return e.waitForReadiness(ctx, spec)
+	default:
+		return e.Configure(ctx, spec)
+	}
+}
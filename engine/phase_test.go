@@ -0,0 +1,126 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+func TestSetupPhases(t *testing.T) {
+	phases, err := setupPhases(nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(phases, defaultSetupPhases) {
+		t.Errorf("Want default setup phases, got %v", phases)
+	}
+	if _, err := setupPhases([]SetupPhase{PhaseProvision, "reboot"}); err == nil {
+		t.Errorf("Expect unknown setup phase error")
+	}
+	if _, err := setupPhases([]SetupPhase{PhaseProvision, PhaseProvision}); err == nil {
+		t.Errorf("Expect duplicate setup phase error")
+	}
+}
+
+func TestSetup_Phases(t *testing.T) {
+	defer stubPlatform()()
+	var order []string
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		order = append(order, "key")
+		return 1, nil
+	}
+	var args platform.ProvisionArgs
+	provision = func(ctx context.Context, in platform.ProvisionArgs) (platform.Instance, error) {
+		order = append(order, "provision")
+		args = in
+		return platform.Instance{ID: 1, IP: "1.2.3.4"}, nil
+	}
+
+	// the resolved key is used to provision the server
+	// instance.
+	engine := &engine{
+		fingerprint: "aa:bb:cc",
+		opts:        Opts{SetupPhases: []SetupPhase{PhaseKey, PhaseProvision, PhaseReady}},
+	}
+	if err := engine.Setup(context.Background(), &Spec{Token: "token"}); err != nil {
+		t.Error(err)
+		return
+	}
+	if want := []string{"key", "provision"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("Want phases %v, got %v", want, order)
+	}
+	if args.Key != "aa:bb:cc" || args.KeyID != 1 {
+		t.Errorf("Want resolved key used to provision, got %q and %d", args.Key, args.KeyID)
+	}
+}
+
+func TestSetup_SkipKeyPhase(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		t.Errorf("Expect runner key not registered")
+		return 1, nil
+	}
+	var args platform.ProvisionArgs
+	provision = func(ctx context.Context, in platform.ProvisionArgs) (platform.Instance, error) {
+		args = in
+		return platform.Instance{ID: 1, IP: "1.2.3.4"}, nil
+	}
+
+	engine := &engine{
+		fingerprint: "aa:bb:cc",
+		opts:        Opts{SetupPhases: []SetupPhase{PhaseProvision}},
+	}
+	if err := engine.Setup(context.Background(), &Spec{Token: "token"}); err != nil {
+		t.Error(err)
+		return
+	}
+	if args.Key != "" || args.KeyID != 0 {
+		t.Errorf("Want server instance provisioned without the runner key")
+	}
+}
+
+func TestSetup_SkipProvisionPhase(t *testing.T) {
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		t.Errorf("Expect runner key not registered")
+		return 1, nil
+	}
+	provision = func(ctx context.Context, in platform.ProvisionArgs) (platform.Instance, error) {
+		t.Errorf("Expect server instance not provisioned")
+		return platform.Instance{}, nil
+	}
+
+	// the existing server instance is configured.
+	engine, spec, closer := mockEngine(t, Opts{SetupPhases: []SetupPhase{PhaseConfigure}})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spec.Root = filepath.Join(dir, "drone-random")
+
+	if err := engine.Setup(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := os.Stat(spec.Root); err != nil {
+		t.Errorf("Want existing server instance configured")
+	}
+
+	// the server instance must be provisioned if the
+	// provisioning phase is skipped.
+	if err := engine.Setup(context.Background(), new(Spec)); err != ErrNotProvisioned {
+		t.Errorf("Want ErrNotProvisioned, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxCapture is the default number of bytes of stdout captured
+// for a piped step, if the step output is not limited.
+const maxCapture = 16 << 20
+
+// helper function returns true if the stdout of the named
+// step is piped to the stdin of a subsequent step.
+func isPiped(spec *Spec, name string) bool {
+	for _, step := range spec.Steps {
+		if step.StdinFrom == name {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function stores the captured stdout of the named
+// step so that it can be piped to subsequent steps.
+func (s *Spec) setOutput(name string, data []byte) {
+	s.mu.Lock()
+	if s.outputs == nil {
+		s.outputs = map[string][]byte{}
+	}
+	s.outputs[name] = data
+	s.mu.Unlock()
+}
+
+// helper function returns the captured stdout of the named
+// step. A nil value is returned if no output was captured.
+func (s *Spec) getOutput(name string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.outputs[name]
+}
+
+// captureWriter is an io.Writer that captures the step stdout
+// up to the limit. Writes beyond the limit are discarded so that
+// the remote session is not interrupted.
+type captureWriter struct {
+	sync.Mutex
+
+	buf       bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+// newCaptureWriter returns a writer that captures up to n bytes.
+// If n is not positive the default limit is used.
+func newCaptureWriter(n int64) *captureWriter {
+	if n <= 0 {
+		n = maxCapture
+	}
+	return &captureWriter{limit: n}
+}
+
+// Write captures p until the limit is reached, at which point
+// all subsequent output is discarded.
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if remain := w.limit - int64(w.buf.Len()); int64(len(p)) > remain {
+		w.truncated = true
+		w.buf.Write(p[:remain])
+		return len(p), nil
+	}
+	return w.buf.Write(p)
+}
+
+// Bytes returns the captured output.
+func (w *captureWriter) Bytes() []byte {
+	w.Lock()
+	defer w.Unlock()
+	return w.buf.Bytes()
+}
+
+// Truncated returns true if output exceeded the limit.
+func (w *captureWriter) Truncated() bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.truncated
+}
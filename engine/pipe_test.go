@@ -0,0 +1,52 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import "testing"
+
+func TestIsPiped(t *testing.T) {
+	spec := &Spec{
+		Steps: []*Step{
+			{Name: "build"},
+			{Name: "test"},
+			{Name: "package", StdinFrom: "build"},
+		},
+	}
+	if !isPiped(spec, "build") {
+		t.Errorf("Expect build step is piped")
+	}
+	if isPiped(spec, "test") {
+		t.Errorf("Expect test step is not piped")
+	}
+}
+
+func TestOutput(t *testing.T) {
+	spec := new(Spec)
+	if got := spec.getOutput("build"); got != nil {
+		t.Errorf("Expect nil output when not captured, got %q", got)
+	}
+	spec.setOutput("build", []byte("hello"))
+	if got, want := string(spec.getOutput("build")), "hello"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+}
+
+func TestCaptureWriter(t *testing.T) {
+	w := newCaptureWriter(5)
+	w.Write([]byte("hel"))
+	if n, err := w.Write([]byte("lo world")); err != nil || n != 8 {
+		t.Errorf("Want write beyond the limit discarded, got %d, %v", n, err)
+	}
+	w.Write([]byte("!"))
+	if got, want := string(w.Bytes()), "hello"; got != want {
+		t.Errorf("Want captured output %q, got %q", want, got)
+	}
+	if !w.Truncated() {
+		t.Errorf("Expect captured output truncated")
+	}
+	if got := newCaptureWriter(0).limit; got != maxCapture {
+		t.Errorf("Want default limit %d, got %d", maxCapture, got)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A pipeline step can optionally run with a lower, or higher,
+// scheduling priority, for example, to deprioritize a step
+// that runs alongside a background service. The step command
+// is prefixed with nice, and optionally ionice, which is only
+// available on linux. Step priority is not supported on
+// windows, and is ignored.
+
+// ionice scheduling classes.
+const (
+	IONiceBestEffort = "best-effort"
+	IONiceIdle       = "idle"
+)
+
+// nice values range from -20, the highest priority, to 19,
+// the lowest priority. Negative values require root.
+const (
+	minNice = -20
+	maxNice = 19
+)
+
+// helper function returns the ionice command line flags for
+// the scheduling class, or false if the class is not known.
+func ioniceClass(class string) (string, bool) {
+	switch class {
+	case IONiceIdle:
+		return "-c 3", true
+	case IONiceBestEffort:
+		return "-c 2", true
+	default:
+		return "", false
+	}
+}
+
+// helper function returns an error if the nice value or ionice
+// scheduling class is invalid.
+func checkPriority(nice int, ionice string) error {
+	if nice < minNice || nice > maxNice {
+		return fmt.Errorf("nice value %d is out of range [%d, %d]", nice, minNice, maxNice)
+	}
+	if _, ok := ioniceClass(ionice); !ok && ionice != "" {
+		return fmt.Errorf("unknown ionice class %q", ionice)
+	}
+	return nil
+}
+
+// helper function prepends the nice and ionice commands to the
+// command line, if the step defines a priority.
+func priorityCommand(os string, step *Step, cmd string) string {
+	if os == "windows" || (step.Nice == 0 && step.IONice == "") {
+		return cmd
+	}
+	var parts []string
+	if step.Nice != 0 {
+		parts = append(parts, fmt.Sprintf("nice -n %d", step.Nice))
+	}
+	if flags, ok := ioniceClass(step.IONice); ok {
+		parts = append(parts, "ionice "+flags)
+	}
+	return strings.Join(append(parts, cmd), " ")
+}
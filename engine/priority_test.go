@@ -0,0 +1,87 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPriorityCommand(t *testing.T) {
+	tests := []struct {
+		os     string
+		nice   int
+		ionice string
+		want   string
+	}{
+		{"linux", 0, "", "/bin/sh build.sh"},
+		{"linux", 10, "", "nice -n 10 /bin/sh build.sh"},
+		{"linux", -5, "", "nice -n -5 /bin/sh build.sh"},
+		{"linux", 19, "idle", "nice -n 19 ionice -c 3 /bin/sh build.sh"},
+		{"linux", 0, "best-effort", "ionice -c 2 /bin/sh build.sh"},
+		{"windows", 10, "idle", "/bin/sh build.sh"},
+	}
+	for _, test := range tests {
+		step := &Step{Nice: test.nice, IONice: test.ionice}
+		if got := priorityCommand(test.os, step, "/bin/sh build.sh"); got != test.want {
+			t.Errorf("Want command %q, got %q", test.want, got)
+		}
+	}
+}
+
+func TestCheckPriority(t *testing.T) {
+	tests := []struct {
+		nice   int
+		ionice string
+		valid  bool
+	}{
+		{0, "", true},
+		{-20, "", true},
+		{19, "idle", true},
+		{20, "", false},
+		{-21, "", false},
+		{0, "realtime", false},
+	}
+	for _, test := range tests {
+		err := checkPriority(test.nice, test.ionice)
+		if got := err == nil; got != test.valid {
+			t.Errorf("Want nice %d ionice %q valid %v, got %v", test.nice, test.ionice, test.valid, err)
+		}
+	}
+}
+
+func TestRun_Priority(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	// the step runs with the lower scheduling priority,
+	// relative to the niceness of the ssh session.
+	var niceness []int
+	for _, nice := range []int{0, 5} {
+		step := &Step{Name: "build", Command: "nice", Nice: nice}
+		buf := new(syncBuffer)
+		if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+			t.Error(err)
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(buf.String()))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		niceness = append(niceness, n)
+	}
+	if want := niceness[0] + 5; niceness[1] != want && niceness[1] != maxNice {
+		t.Errorf("Want niceness %d, got %d", want, niceness[1])
+	}
+
+	// an invalid priority is rejected before the step runs.
+	step := &Step{Name: "build", Command: "true", Nice: 20}
+	if _, err := engine.Run(context.Background(), spec, step, new(syncBuffer)); err == nil {
+		t.Errorf("Want error when nice value is out of range")
+	}
+}
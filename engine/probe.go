@@ -0,0 +1,57 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+	"github.com/drone/runner-go/logger"
+)
+
+var (
+	// ErrInstanceGone is returned when the server instance
+	// cannot be reached because it no longer exists. The
+	// pipeline cannot be resumed without re-provisioning.
+	ErrInstanceGone = errors.New("server instance no longer exists")
+
+	// ErrInstanceUnreachable is returned when the server
+	// instance exists but cannot be reached, for example,
+	// because the ssh daemon is restarting. The connection
+	// may succeed if retried.
+	ErrInstanceUnreachable = errors.New("server instance is unreachable")
+)
+
+// helper function queries the digitalocean api to determine
+// whether a server instance that cannot be reached over ssh
+// still exists. The original error is returned if the server
+// instance status cannot be determined.
+func probe(ctx context.Context, spec *Spec, cause error) error {
+	status, err := platform.Status(ctx, spec.id, spec.Token)
+	logger.FromContext(ctx).
+		WithError(cause).
+		WithField("id", spec.id).
+		WithField("ip", spec.ip).
+		WithField("status", status).
+		Debug("cannot reach server instance")
+	return classify(status, err, cause)
+}
+
+// helper function returns an error that distinguishes a
+// server instance that no longer exists from a server instance
+// that exists but cannot be reached.
+func classify(status string, err, cause error) error {
+	switch {
+	case err == platform.ErrNotFound:
+		return ErrInstanceGone
+	case err != nil:
+		return cause
+	case status == "archive":
+		return ErrInstanceGone
+	default:
+		return ErrInstanceUnreachable
+	}
+}
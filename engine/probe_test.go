@@ -0,0 +1,32 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+func TestClassify(t *testing.T) {
+	cause := errors.New("connection refused")
+	tests := []struct {
+		status string
+		err    error
+		want   error
+	}{
+		{status: "", err: platform.ErrNotFound, want: ErrInstanceGone},
+		{status: "archive", err: nil, want: ErrInstanceGone},
+		{status: "active", err: nil, want: ErrInstanceUnreachable},
+		{status: "off", err: nil, want: ErrInstanceUnreachable},
+		{status: "", err: errors.New("api error"), want: cause},
+	}
+	for _, test := range tests {
+		if got := classify(test.status, test.err, cause); got != test.want {
+			t.Errorf("Want error %v for status %q, got %v", test.want, test.status, got)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/drone/runner-go/logger"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The engine can optionally pre-pull container images on the
+// server instance when the server instance is configured, so
+// that the first docker step does not pay the image pull cost.
+// The images are pulled in parallel, each image with its own
+// ssh session, and a failed pull is logged and ignored unless
+// the pull is required.
+
+// defaultPullConcurrency is the default number of images that
+// are pulled in parallel. The number of parallel pulls should
+// not exceed the sshd session limit.
+const defaultPullConcurrency = 4
+
+// PullError is returned when a container image cannot be
+// pre-pulled.
+type PullError struct {
+	Image  string
+	Output string
+	Err    error
+}
+
+func (e *PullError) Error() string {
+	return fmt.Sprintf("cannot pull image %s: %s", e.Image, e.Err)
+}
+
+// helper function pre-pulls the container images on the server
+// instance. Pull failures are logged, and the first failure is
+// returned if the pull is required.
+func (e *engine) pullImages(ctx context.Context, spec *Spec, client *ssh.Client) error {
+	if len(e.opts.PullImages) == 0 {
+		return nil
+	}
+	log := logger.FromContext(ctx).
+		WithField("hostname", spec.Server.Name).
+		WithField("ip", spec.ip).
+		WithField("id", spec.id)
+
+	errs := pullAll(e.opts.PullImages, e.opts.PullConcurrency, func(image string) error {
+		out, err := execute(client, pullCommand(image))
+		if err != nil {
+			return &PullError{Image: image, Output: string(out), Err: err}
+		}
+		return nil
+	})
+	for _, err := range errs {
+		log.WithError(err).
+			WithField("image", err.Image).
+			WithField("output", err.Output).
+			Warn("cannot pre-pull image")
+	}
+	if len(errs) != 0 && e.opts.PullRequired {
+		return errs[0]
+	}
+	log.WithField("images", len(e.opts.PullImages)-len(errs)).
+		Debug("images pre-pulled")
+	return nil
+}
+
+// helper function invokes the pull function for every image,
+// with at most limit invocations in parallel. The errors are
+// returned in image order.
+func pullAll(images []string, limit int, pull func(image string) error) []*PullError {
+	if limit <= 0 {
+		limit = defaultPullConcurrency
+	}
+	results := make([]error, len(images))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, image := range images {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, image string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = pull(image)
+		}(i, image)
+	}
+	wg.Wait()
+
+	var errs []*PullError
+	for i, err := range results {
+		switch err := err.(type) {
+		case nil:
+		case *PullError:
+			errs = append(errs, err)
+		default:
+			errs = append(errs, &PullError{Image: images[i], Err: err})
+		}
+	}
+	return errs
+}
+
+// helper function returns the shell command to pull the
+// container image.
+func pullCommand(image string) string {
+	return "docker pull " + shellQuote(image)
+}
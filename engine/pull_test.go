@@ -0,0 +1,112 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPullCommand(t *testing.T) {
+	got := pullCommand("golang:1.12")
+	want := "docker pull 'golang:1.12'"
+	if got != want {
+		t.Errorf("Want pull command %q, got %q", want, got)
+	}
+}
+
+func TestPullAll(t *testing.T) {
+	var mu sync.Mutex
+	var active, peak int
+	var pulled []string
+	images := []string{"golang:1.12", "node:12", "redis:5", "postgres:11", "alpine:3"}
+	errs := pullAll(images, 2, func(image string) error {
+		mu.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		pulled = append(pulled, image)
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond * 10)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+		if image == "redis:5" {
+			return errors.New("manifest unknown")
+		}
+		return nil
+	})
+	if len(pulled) != len(images) {
+		t.Errorf("Want %d images pulled, got %d", len(images), len(pulled))
+	}
+	if peak != 2 {
+		t.Errorf("Want 2 images pulled in parallel, got %d", peak)
+	}
+	if len(errs) != 1 || errs[0].Image != "redis:5" {
+		t.Errorf("Want pull error for redis:5, got %v", errs)
+	}
+}
+
+func TestPullImages(t *testing.T) {
+	tests := []struct {
+		required bool
+		fail     bool
+	}{
+		{required: false, fail: false},
+		{required: true, fail: true},
+	}
+	for _, test := range tests {
+		engine, spec, closer := mockEngine(t, Opts{
+			PullImages:   []string{"golang:1.12", "missing:latest"},
+			PullRequired: test.required,
+		})
+		defer closer()
+		defer mockDocker(t)()
+
+		client, err := engine.dialRetry(context.Background(), spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		err = engine.pullImages(context.Background(), spec, client)
+		if test.fail {
+			if perr, ok := err.(*PullError); !ok || perr.Image != "missing:latest" {
+				t.Errorf("Want PullError for missing:latest, got %v", err)
+			}
+		} else if err != nil {
+			t.Errorf("Want pull failure ignored, got %v", err)
+		}
+	}
+}
+
+// helper function installs a fake docker binary in the PATH
+// that fails to pull images named missing. The returned
+// function restores the PATH.
+func mockDocker(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := []byte("#!/bin/sh\ncase \"$2\" in missing*) exit 1;; esac\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker"), script, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
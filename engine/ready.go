@@ -0,0 +1,97 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drone/runner-go/logger"
+)
+
+// readyInterval is the interval at which the readiness port
+// is probed. It is declared as a variable so that it can be
+// overridden in unit tests.
+var readyInterval = time.Second * 5
+
+// readyTimeout is the default time to wait for the server
+// instance to signal readiness.
+const readyTimeout = time.Minute * 5
+
+// ErrReadyTimeout is returned when the server instance does
+// not signal readiness before the timeout.
+var ErrReadyTimeout = errors.New("timeout waiting for the server instance to signal readiness")
+
+// helper function blocks until the readiness port accepts tcp
+// connections or, if a path is configured, until the http
+// endpoint returns a 200 status code.
+func (e *engine) waitForReady(ctx context.Context, spec *Spec) error {
+	timeout := e.opts.ReadyTimeout
+	if timeout == 0 {
+		timeout = readyTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(spec.ip, strconv.Itoa(e.opts.ReadyPort))
+	log := logger.FromContext(ctx).
+		WithField("hostname", spec.Server.Name).
+		WithField("addr", addr).
+		WithField("path", e.opts.ReadyPath)
+
+	for {
+		err := probeReady(ctx, addr, e.opts.ReadyPath)
+		if err == nil {
+			log.Debug("server instance is ready")
+			return nil
+		}
+		log.WithError(err).Trace("waiting for the server instance to signal readiness")
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return ErrReadyTimeout
+			}
+			return ctx.Err()
+		case <-time.After(readyInterval):
+		}
+	}
+}
+
+// helper function probes the readiness address. If the path
+// is empty the address must accept tcp connections, otherwise
+// the http endpoint must return a 200 status code.
+func probeReady(ctx context.Context, addr, path string) error {
+	if path == "" {
+		conn, err := dialTimeout("tcp", addr, routeProbeTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequest("GET", "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: routeProbeTimeout}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("readiness endpoint returned status %d", res.StatusCode)
+	}
+	return nil
+}
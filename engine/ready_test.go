@@ -0,0 +1,85 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func mockReadyInterval() func() {
+	readyInterval = time.Millisecond * 10
+	return func() {
+		readyInterval = time.Second * 5
+	}
+}
+
+func TestWaitForReady_TCP(t *testing.T) {
+	defer mockReadyInterval()()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	engine := &engine{opts: Opts{ReadyPort: listener.Addr().(*net.TCPAddr).Port}}
+	spec := &Spec{ip: "127.0.0.1"}
+	if err := engine.waitForReady(context.Background(), spec); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWaitForReady_HTTP(t *testing.T) {
+	defer mockReadyInterval()()
+
+	// the endpoint becomes ready after the third request.
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if atomic.AddInt32(&count, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	engine := &engine{opts: Opts{ReadyPath: "healthz"}}
+	engine.opts.ReadyPort, _ = strconv.Atoi(port)
+	spec := &Spec{ip: host}
+	if err := engine.waitForReady(context.Background(), spec); err != nil {
+		t.Error(err)
+	}
+	if got, want := atomic.LoadInt32(&count), int32(3); got != want {
+		t.Errorf("Want %d readiness requests, got %d", want, got)
+	}
+}
+
+func TestWaitForReady_Timeout(t *testing.T) {
+	defer mockReadyInterval()()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	engine := &engine{opts: Opts{ReadyPath: "/", ReadyTimeout: time.Millisecond * 50}}
+	engine.opts.ReadyPort, _ = strconv.Atoi(port)
+	spec := &Spec{ip: host}
+	if err := engine.waitForReady(context.Background(), spec); err != ErrReadyTimeout {
+		t.Errorf("Want ready timeout error, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+)
+
+// The step output can optionally be redacted using regular
+// expressions, in addition to the known secret values, for
+// example, to redact credit card numbers or tokens with a known
+// prefix. The output is redacted one line at a time, and the
+// partial line at the end of each write is held until the next
+// write so that a match split across writes is redacted. At
+// most maxRedactTail bytes of a partial line are held.
+
+// redactMask replaces the redacted output.
+const redactMask = "***"
+
+// maxRedactTail is the maximum length of a partial line that
+// is held to redact matches split across writes.
+const maxRedactTail = 256
+
+// maxRedactHold is the maximum length of a match that is held
+// because it may continue in the next write.
+const maxRedactHold = 65536
+
+// helper function compiles the redaction patterns.
+func compileRedact(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %s", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// redactWriter is an io.Writer that replaces output matching
+// the patterns with a mask.
+type redactWriter struct {
+	sync.Mutex
+
+	w        io.Writer
+	patterns []*regexp.Regexp
+	pending  []byte // Output held from the previous write.
+}
+
+// newRedactWriter returns a writer that wraps writer w and
+// redacts output matching the patterns.
+func newRedactWriter(w io.Writer, patterns []*regexp.Regexp) *redactWriter {
+	return &redactWriter{w: w, patterns: patterns}
+}
+
+// Write redacts p and writes the redacted output to the
+// underlying writer, holding the trailing partial line.
+func (w *redactWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.pending = append(w.pending, p...)
+
+	// the output is written up to the last complete line, or
+	// up to the tail if the partial line is too long. A match
+	// that spans the cut is held until the next write.
+	cut := bytes.LastIndexByte(w.pending, '\n') + 1
+	if tail := len(w.pending) - maxRedactTail; tail > cut {
+		cut = w.spanned(tail)
+		if cut == 0 && len(w.pending) > maxRedactHold {
+			cut = len(w.pending)
+		}
+	}
+	if cut == 0 {
+		return len(p), nil
+	}
+	if _, err := w.w.Write(w.redact(w.pending[:cut])); err != nil {
+		return 0, err
+	}
+	w.pending = append(w.pending[:0], w.pending[cut:]...)
+	return len(p), nil
+}
+
+// Flush redacts and writes the output held from the previous
+// write, if any, to the underlying writer.
+func (w *redactWriter) Flush() error {
+	w.Lock()
+	defer w.Unlock()
+	if len(w.pending) == 0 {
+		return nil
+	}
+	_, err := w.w.Write(w.redact(w.pending))
+	w.pending = w.pending[:0]
+	return err
+}
+
+// helper function returns the cut moved before any match that
+// spans the cut.
+func (w *redactWriter) spanned(cut int) int {
+	for moved := true; moved; {
+		moved = false
+		for _, re := range w.patterns {
+			for _, loc := range re.FindAllIndex(w.pending, -1) {
+				if loc[0] < cut && loc[1] > cut {
+					cut = loc[0]
+					moved = true
+				}
+			}
+		}
+	}
+	return cut
+}
+
+// helper function replaces the output matching the patterns
+// with the mask.
+func (w *redactWriter) redact(b []byte) []byte {
+	out := append([]byte(nil), b...)
+	for _, re := range w.patterns {
+		out = re.ReplaceAllLiteral(out, []byte(redactMask))
+	}
+	return out
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/drone/runner-go/logger"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestCompileRedact(t *testing.T) {
+	patterns, err := compileRedact([]string{`ghp_[A-Za-z0-9]+`, `\d{4}-\d{4}`})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(patterns) != 2 {
+		t.Errorf("Want 2 compiled patterns, got %d", len(patterns))
+	}
+	if _, err := compileRedact([]string{`(unclosed`}); err == nil {
+		t.Errorf("Expect invalid pattern error")
+	}
+}
+
+func TestRedactWriter(t *testing.T) {
+	patterns, _ := compileRedact([]string{`ghp_[A-Za-z0-9]+`, `\b(?:\d{4}[ -]?){3}\d{4}\b`})
+	buf := new(bytes.Buffer)
+	w := newRedactWriter(buf, patterns)
+	w.Write([]byte("token ghp_abc123\ncard 4111 1111 1111 1111\n"))
+	if got, want := buf.String(), "token ***\ncard ***\n"; got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+func TestRedactWriter_Split(t *testing.T) {
+	patterns, _ := compileRedact([]string{`ghp_[A-Za-z0-9]+`})
+	buf := new(bytes.Buffer)
+	w := newRedactWriter(buf, patterns)
+
+	// the partial line is held until the line is complete,
+	// since the match may continue in the next write.
+	w.Write([]byte("login\ntoken gh"))
+	if got, want := buf.String(), "login\n"; got != want {
+		t.Errorf("Want partial line held, got %q", got)
+	}
+	w.Write([]byte("p_abc"))
+	w.Write([]byte("123 ok\ndone"))
+	if got, want := buf.String(), "login\ntoken *** ok\n"; got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+
+	// the held partial line is written when flushed.
+	w.Flush()
+	if got, want := buf.String(), "login\ntoken *** ok\ndone"; got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+func TestRedactWriter_LongLine(t *testing.T) {
+	patterns, _ := compileRedact([]string{`ghp_[A-Za-z0-9]+`})
+	buf := new(bytes.Buffer)
+	w := newRedactWriter(buf, patterns)
+
+	// a partial line longer than the tail is written, except
+	// for a match that spans the cut.
+	padding := strings.Repeat(".", maxRedactTail)
+	w.Write([]byte(padding + "ghp_abc"))
+	w.Write([]byte(strings.Repeat("x", maxRedactTail-len("ghp_abc")) + "123"))
+	if strings.Contains(buf.String(), "ghp_") {
+		t.Errorf("Want match spanning the cut held, got %q", buf.String())
+	}
+	w.Write([]byte(" ok\n"))
+	want := padding + "*** ok\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+func TestRun_Redact(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+	engine.redact, _ = compileRedact([]string{`ghp_[A-Za-z0-9]+`})
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "build.sh")
+	step := &Step{
+		Name:    "build",
+		Command: "sh",
+		Args:    []string{script},
+		Files:   []*File{{Path: script, Mode: 0700, Data: []byte("printf 'token=ghp_'\nprintf 'abc123'\n")}},
+	}
+	buf := new(syncBuffer)
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := buf.String(), "token=***"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+}
+
+func TestRun_RedactTail(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{TailLines: 2})
+	defer closer()
+	engine.redact, _ = compileRedact([]string{`ghp_[A-Za-z0-9]+`})
+
+	log, hook := test.NewNullLogger()
+	ctx := logger.WithContext(context.Background(), logger.Logrus(logrus.NewEntry(log)))
+
+	// the output is redacted in the tail written to the runner
+	// log, in addition to the step log.
+	step := &Step{
+		Name:    "build",
+		Command: "printf",
+		Args:    []string{`'token=ghp_abc123\n'`, "&&", "exit", "1"},
+	}
+	engine.Run(ctx, spec, step, new(syncBuffer))
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Errorf("Expect step failure logged")
+		return
+	}
+	if got, want := entry.Data["tail"], "token=***"; got != want {
+		t.Errorf("Want tail %q, got %q", want, got)
+	}
+}
@@ -6,6 +6,8 @@ package resource
 
 import (
 	"errors"
+	"regexp"
+	"strings"
 
 	"github.com/drone/runner-go/manifest"
 
@@ -35,6 +37,13 @@ func match(r *manifest.RawResource) bool {
 	return r.Kind == Kind && r.Type == Type
 }
 
+// hostname matches a legal hostname label as defined by
+// RFC 1123.
+var hostname = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// checksum matches a hex-encoded sha256 digest.
+var checksum = regexp.MustCompile(`^[a-fA-F0-9]{64}$`)
+
 // lint returns an error if any pipeline values are invalid.
 func lint(pipeline *Pipeline) error {
 	// ensure server configuration provided.
@@ -42,11 +51,57 @@ func lint(pipeline *Pipeline) error {
 		return errors.New("Linter: invalid or missing API token")
 	}
 
+	// ensure the server hostname is legal, if provided.
+	if name := pipeline.Server.Hostname; name != "" && !isHostname(name) {
+		return errors.New("Linter: invalid server hostname")
+	}
+
+	// ensure spaces buckets define the bucket and mount path.
+	for _, spaces := range pipeline.Spaces {
+		if spaces.Bucket == "" || spaces.Path == "" {
+			return errors.New("Linter: spaces bucket and path are required")
+		}
+	}
+
 	// ensure pipeline steps are not unique.
 	names := map[string]struct{}{}
 	for _, step := range pipeline.Steps {
-		if step.Detach {
-			return errors.New("Linter: detached steps are not allowed")
+		if step.Detach && pipeline.Platform.OS == "windows" {
+			return errors.New("Linter: detached steps are not supported on windows")
+		}
+		if len(step.Entrypoint) != 0 && len(step.Commands) != 0 {
+			return errors.New("Linter: entrypoint and commands cannot be used together")
+		}
+		if len(step.Entrypoint) != 0 && pipeline.Platform.OS == "windows" {
+			return errors.New("Linter: entrypoint is not supported on windows")
+		}
+		if url := step.Script.URL; url != "" {
+			if !checksum.MatchString(step.Script.SHA256) {
+				return errors.New("Linter: script url requires a valid sha256 checksum")
+			}
+			if len(step.Commands) != 0 || len(step.Entrypoint) != 0 {
+				return errors.New("Linter: script url cannot be used with commands or entrypoint")
+			}
+			if pipeline.Platform.OS == "windows" {
+				return errors.New("Linter: script url is not supported on windows")
+			}
+		}
+		if nice := step.Priority.Nice; nice < -20 || nice > 19 {
+			return errors.New("Linter: nice value must be between -20 and 19")
+		}
+		if class := step.Priority.IONice; class != "" && class != "idle" && class != "best-effort" {
+			return errors.New("Linter: ionice class must be idle or best-effort")
+		}
+		if step.Priority != (Priority{}) && pipeline.Platform.OS == "windows" {
+			return errors.New("Linter: step priority is not supported on windows")
+		}
+		switch step.Isolation {
+		case "", "none", "process", "filesystem":
+		default:
+			return errors.New("Linter: isolation must be none, process or filesystem")
+		}
+		if step.Isolation != "" && step.Isolation != "none" && pipeline.Platform.OS == "windows" {
+			return errors.New("Linter: step isolation is not supported on windows")
 		}
 		if step.Name == "" {
 			return errors.New("Linter: invalid or missing step name")
@@ -54,7 +109,24 @@ func lint(pipeline *Pipeline) error {
 		if _, ok := names[step.Name]; ok {
 			return errors.New("Linter: duplicate step name")
 		}
+		if _, ok := names[step.StdinFrom]; !ok && step.StdinFrom != "" {
+			return errors.New("Linter: stdin_from must reference a previous step")
+		}
 		names[step.Name] = struct{}{}
 	}
 	return nil
 }
+
+// helper function returns true if the name is a legal
+// hostname.
+func isHostname(name string) bool {
+	if len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !hostname.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
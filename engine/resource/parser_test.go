@@ -5,6 +5,7 @@
 package resource
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/drone/runner-go/manifest"
@@ -161,8 +162,96 @@ func TestLint(t *testing.T) {
 	}
 
 	p.Steps = []*Step{{Name: "build", Detach: true}}
+	if err := lint(p); err != nil {
+		t.Errorf("Expect no lint error, got %s", err)
+	}
+
+	p.Platform.OS = "windows"
+	if err := lint(p); err == nil {
+		t.Errorf("Expect error when step detached on windows")
+	}
+	p.Platform.OS = ""
+
+	p.Steps = []*Step{{Name: "build"}, {Name: "package", StdinFrom: "build"}}
+	if err := lint(p); err != nil {
+		t.Errorf("Expect no lint error, got %s", err)
+	}
+
+	p.Steps = []*Step{{Name: "package", StdinFrom: "build"}, {Name: "build"}}
+	if err := lint(p); err == nil {
+		t.Errorf("Expect error when stdin_from references a later step")
+	}
+
+	p.Steps = []*Step{{Name: "build", StdinFrom: "build"}}
+	if err := lint(p); err == nil {
+		t.Errorf("Expect error when stdin_from references itself")
+	}
+
+	p.Steps = []*Step{{Name: "test", Entrypoint: []string{"/usr/local/bin/test-runner", "-v"}}}
+	if err := lint(p); err != nil {
+		t.Errorf("Expect no lint error, got %s", err)
+	}
+
+	p.Steps = []*Step{{Name: "test", Entrypoint: []string{"test-runner"}, Commands: []string{"make"}}}
+	if err := lint(p); err == nil {
+		t.Errorf("Expect error when entrypoint and commands are used together")
+	}
+
+	p.Steps = []*Step{{Name: "test", Script: Script{URL: "https://example.com/test.sh", SHA256: strings.Repeat("a", 64)}}}
+	if err := lint(p); err != nil {
+		t.Errorf("Expect no lint error, got %s", err)
+	}
+
+	p.Steps = []*Step{{Name: "test", Script: Script{URL: "https://example.com/test.sh"}}}
+	if err := lint(p); err == nil {
+		t.Errorf("Expect error when script checksum is missing")
+	}
+
+	p.Steps = []*Step{{Name: "test", Script: Script{URL: "https://example.com/test.sh", SHA256: "abc"}}}
+	if err := lint(p); err == nil {
+		t.Errorf("Expect error when script checksum is invalid")
+	}
+
+	p.Steps = []*Step{{Name: "test", Script: Script{URL: "https://example.com/test.sh", SHA256: strings.Repeat("a", 64)}, Commands: []string{"make"}}}
+	if err := lint(p); err == nil {
+		t.Errorf("Expect error when script and commands are used together")
+	}
+
+	p.Steps = []*Step{{Name: "test", Priority: Priority{Nice: 10, IONice: "idle"}}}
+	if err := lint(p); err != nil {
+		t.Errorf("Expect no lint error, got %s", err)
+	}
+
+	p.Platform.OS = "windows"
+	if err := lint(p); err == nil {
+		t.Errorf("Expect error when step priority is used on windows")
+	}
+	p.Platform.OS = ""
+
+	p.Steps = []*Step{{Name: "test", Priority: Priority{Nice: 20}}}
+	if err := lint(p); err == nil {
+		t.Errorf("Expect error when nice value is out of range")
+	}
+
+	p.Steps = []*Step{{Name: "test", Priority: Priority{IONice: "realtime"}}}
+	if err := lint(p); err == nil {
+		t.Errorf("Expect error when ionice class is unknown")
+	}
+
+	p.Steps = []*Step{{Name: "test", Isolation: "filesystem"}}
+	if err := lint(p); err != nil {
+		t.Errorf("Expect no lint error, got %s", err)
+	}
+
+	p.Platform.OS = "windows"
+	if err := lint(p); err == nil {
+		t.Errorf("Expect error when step isolation is used on windows")
+	}
+	p.Platform.OS = ""
+
+	p.Steps = []*Step{{Name: "test", Isolation: "container"}}
 	if err := lint(p); err == nil {
-		t.Errorf("Expect error when step detached")
+		t.Errorf("Expect error when isolation level is unknown")
 	}
 }
 
@@ -184,3 +273,39 @@ func TestLint_ServerError(t *testing.T) {
 		t.Errorf("Expect lint error for missing token")
 	}
 }
+
+func TestLint_Hostname(t *testing.T) {
+	p := new(Pipeline)
+	p.Token = manifest.Variable{Secret: "token"}
+
+	for _, name := range []string{"build", "build-01", "build.example.com"} {
+		p.Server.Hostname = name
+		if err := lint(p); err != nil {
+			t.Errorf("Expect no lint error for hostname %q, got %s", name, err)
+		}
+	}
+	for _, name := range []string{"-build", "build-", "build_01", "build..local", strings.Repeat("a", 64)} {
+		p.Server.Hostname = name
+		if err := lint(p); err == nil {
+			t.Errorf("Expect lint error for hostname %q", name)
+		}
+	}
+}
+
+func TestLint_Spaces(t *testing.T) {
+	p := new(Pipeline)
+	p.Token = manifest.Variable{Secret: "token"}
+
+	p.Spaces = []*Spaces{{Bucket: "datasets", Path: "/mnt/datasets"}}
+	if err := lint(p); err != nil {
+		t.Errorf("Expect no lint error, got %s", err)
+	}
+	p.Spaces = []*Spaces{{Bucket: "datasets"}}
+	if err := lint(p); err == nil {
+		t.Errorf("Expect lint error for missing path")
+	}
+	p.Spaces = []*Spaces{{Path: "/mnt/datasets"}}
+	if err := lint(p); err == nil {
+		t.Errorf("Expect lint error for missing bucket")
+	}
+}
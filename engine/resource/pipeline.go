@@ -35,15 +35,60 @@ type (
 		Trigger   manifest.Conditions `json:"conditions,omitempty"`
 		Workspace manifest.Workspace  `json:"workspace,omitempty"`
 
-		Steps []*Step `json:"steps,omitempty"`
+		Spaces []*Spaces `json:"spaces,omitempty"`
+		Steps  []*Step   `json:"steps,omitempty"`
+	}
+
+	// Spaces defines a spaces bucket mounted as a read-only
+	// filesystem on the remote server.
+	Spaces struct {
+		Bucket    string            `json:"bucket,omitempty"`
+		Endpoint  string            `json:"endpoint,omitempty"`
+		Path      string            `json:"path,omitempty"`
+		AccessKey manifest.Variable `json:"access_key,omitempty" yaml:"access_key"`
+		SecretKey manifest.Variable `json:"secret_key,omitempty" yaml:"secret_key"`
 	}
 
 	// Server defines a remote server.
 	Server struct {
-		Image  string `json:"image,omitempty"`
-		Region string `json:"region,omitempty"`
-		Size   string `json:"size,omitempty"`
-		User   string `json:"user,omitempty`
+		Name     string `json:"name,omitempty"`
+		Hostname string `json:"hostname,omitempty"`
+		Image    string `json:"image,omitempty"`
+		Region   string `json:"region,omitempty"`
+		Size     string `json:"size,omitempty"`
+		User     string `json:"user,omitempty"`
+		Keypair  bool   `json:"keypair,omitempty"`
+
+		Labels map[string]string `json:"labels,omitempty"`
+
+		// Images overrides the image for the region in which
+		// the server instance is provisioned.
+		Images map[string]string `json:"images,omitempty"`
+
+		// Sizes provides fallback sizes, in order of
+		// preference, if the size is out of capacity.
+		Sizes []string `json:"sizes,omitempty"`
+
+		// Root overrides the pipeline root directory on the
+		// server instance. The root directory may reference
+		// the $HOME and $USER variables of the ssh user.
+		Root string `json:"root,omitempty"`
+	}
+
+	// Script defines a step script that is fetched from the
+	// url on the server instance, and verified using the
+	// sha256 checksum before it is executed.
+	Script struct {
+		URL    string `json:"url,omitempty"`
+		SHA256 string `json:"sha256,omitempty"`
+	}
+
+	// Priority defines the scheduling priority of a step.
+	// The nice value ranges from -20 to 19, and the ionice
+	// class is idle or best-effort.
+	Priority struct {
+		Nice   int    `json:"nice,omitempty"`
+		IONice string `json:"ionice,omitempty"`
 	}
 
 	// Step defines a Pipeline step.
@@ -55,6 +100,14 @@ type (
 		Environment map[string]*manifest.Variable `json:"environment,omitempty"`
 		Failure     string                        `json:"failure,omitempty"`
 		Commands    []string                      `json:"commands,omitempty"`
+		Entrypoint  []string                      `json:"entrypoint,omitempty"`
+		Script      Script                        `json:"script,omitempty"`
+		Separate    bool                          `json:"separate_commands,omitempty" yaml:"separate_commands"`
+		LoginShell  bool                          `json:"login_shell,omitempty" yaml:"login_shell"`
+		ClearEnv    bool                          `json:"clear_env,omitempty" yaml:"clear_env"`
+		StdinFrom   string                        `json:"stdin_from,omitempty" yaml:"stdin_from"`
+		Priority    Priority                      `json:"priority,omitempty"`
+		Isolation   string                        `json:"isolation,omitempty"`
 		When        manifest.Conditions           `json:"when,omitempty"`
 	}
 )
@@ -0,0 +1,111 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dchest/uniuri"
+)
+
+// A pipeline step may optionally write a structured result
+// file to the location exported in the DRONE_STEP_RESULT
+// environment variable. If the file exists when the step
+// completes, the exit code in the result file takes
+// precedence over the ssh exit status, which is unreliable
+// for some shells (e.g. powershell on windows).
+//
+// Example result file:
+//
+//	{"exit_code": 1, "message": "tests failed"}
+//
+// Each step is assigned a unique result file location, since
+// parallel steps execute on the same server instance.
+const (
+	resultDir        = "/tmp/"
+	resultDirWindows = `C:\Windows\Temp\`
+)
+
+// stepResult defines the structure of the result file.
+type stepResult struct {
+	ExitCode *int   `json:"exit_code"`
+	Message  string `json:"message"`
+}
+
+// helper function returns a unique result file path for the
+// named step based on the target platform.
+func resultPath(os, name string) string {
+	file := fmt.Sprintf("drone-step-result-%s-%s.json",
+		resultName(name),
+		uniuri.NewLenChars(8, []byte("abcdefghijklmnopqrstuvwxyz0123456789")),
+	)
+	switch os {
+	case "windows":
+		return resultDirWindows + file
+	default:
+		return resultDir + file
+	}
+}
+
+// helper function replaces characters in the step name that
+// are not safe to use in a file name.
+func resultName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z',
+			r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9',
+			r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// helper function returns a copy of the environment with the
+// result file path exported as DRONE_STEP_RESULT.
+func resultEnv(envs map[string]string, path string) map[string]string {
+	out := map[string]string{}
+	for k, v := range envs {
+		out[k] = v
+	}
+	out["DRONE_STEP_RESULT"] = path
+	return out
+}
+
+// helper function parses the step result file.
+func parseResult(b []byte) (*stepResult, error) {
+	res := new(stepResult)
+	err := json.Unmarshal(b, res)
+	return res, err
+}
+
+// helper function reads and parses the step result file from
+// the remote server. A nil result is returned if the file does
+// not exist.
+func readResult(fs filesystem, path string) (*stepResult, error) {
+	b, err := fs.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseResult(b)
+}
+
+// helper function updates the process state with the exit code
+// from the step result. If the step result is nil or does not
+// define an exit code, the ssh exit status is retained.
+func applyResult(state *State, res *stepResult) {
+	if res == nil || res.ExitCode == nil {
+		return
+	}
+	state.ExitCode = *res.ExitCode
+}
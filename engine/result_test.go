@@ -0,0 +1,113 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseResult(t *testing.T) {
+	res, err := parseResult([]byte(`{"exit_code": 2, "message": "tests failed"}`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.ExitCode == nil || *res.ExitCode != 2 {
+		t.Errorf("Want exit code 2, got %v", res.ExitCode)
+	}
+	if got, want := res.Message, "tests failed"; got != want {
+		t.Errorf("Want message %q, got %q", want, got)
+	}
+
+	if _, err := parseResult([]byte(`{`)); err == nil {
+		t.Errorf("Expect error parsing malformed result file")
+	}
+}
+
+func TestReadResult(t *testing.T) {
+	client, closer := mockSftp(t)
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "drone-step-result.json")
+	ioutil.WriteFile(path, []byte(`{"exit_code": 0}`), 0600)
+
+	res, err := readResult(&sftpFS{client: client}, path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res == nil || res.ExitCode == nil || *res.ExitCode != 0 {
+		t.Errorf("Want exit code 0 from result file")
+	}
+}
+
+func TestReadResult_NotExist(t *testing.T) {
+	client, closer := mockSftp(t)
+	defer closer()
+
+	res, err := readResult(&sftpFS{client: client}, "/tmp/drone-test-does-not-exist.json")
+	if err != nil {
+		t.Error(err)
+	}
+	if res != nil {
+		t.Errorf("Expect nil result when the file does not exist")
+	}
+}
+
+func TestApplyResult(t *testing.T) {
+	code := 0
+	state := &State{ExitCode: 255, Exited: true}
+	applyResult(state, &stepResult{ExitCode: &code})
+	if state.ExitCode != 0 {
+		t.Errorf("Want exit code from result file, got %d", state.ExitCode)
+	}
+}
+
+func TestApplyResult_Fallback(t *testing.T) {
+	state := &State{ExitCode: 1, Exited: true}
+	applyResult(state, nil)
+	if state.ExitCode != 1 {
+		t.Errorf("Want ssh exit code when no result file, got %d", state.ExitCode)
+	}
+	applyResult(state, &stepResult{Message: "no exit code"})
+	if state.ExitCode != 1 {
+		t.Errorf("Want ssh exit code when result has no exit code, got %d", state.ExitCode)
+	}
+}
+
+func TestResultPath(t *testing.T) {
+	got := resultPath("linux", "go test")
+	if !strings.HasPrefix(got, "/tmp/drone-step-result-go_test-") || !strings.HasSuffix(got, ".json") {
+		t.Errorf("Unexpected result path %q", got)
+	}
+	if got == resultPath("linux", "go test") {
+		t.Errorf("Want unique result path for each step")
+	}
+	got = resultPath("windows", "build/windows")
+	if !strings.HasPrefix(got, `C:\Windows\Temp\drone-step-result-build_windows-`) {
+		t.Errorf("Unexpected result path %q", got)
+	}
+}
+
+func TestResultEnv(t *testing.T) {
+	envs := map[string]string{"GOOS": "linux"}
+	got := resultEnv(envs, "/tmp/result.json")
+	if got["DRONE_STEP_RESULT"] != "/tmp/result.json" || got["GOOS"] != "linux" {
+		t.Errorf("Unexpected environment %v", got)
+	}
+	if _, ok := envs["DRONE_STEP_RESULT"]; ok {
+		t.Errorf("Want step environment unmodified")
+	}
+}
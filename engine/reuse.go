@@ -0,0 +1,72 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/drone/runner-go/logger"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// livenessTimeout is the default time to wait for a reused ssh
+// connection to respond to the liveness check.
+const livenessTimeout = time.Second * 5
+
+// helper function returns an ssh client connected to the server
+// instance, and a function that must be invoked once the client
+// is no longer needed. If connection reuse is enabled, the client
+// is cached with the spec and reused by subsequent steps, once a
+// keepalive request confirms the connection is alive. A dead
+// connection, for example, because the server instance rebooted,
+// is closed and the server instance is dialed again.
+func (e *engine) reuse(ctx context.Context, spec *Spec) (*ssh.Client, func(), error) {
+	if !e.opts.ReuseConnections {
+		client, err := e.connect(spec.ip, spec.Server.User, e.opts.HandshakeTimeout, e.hostKeyCallback(spec))
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func() { client.Close() }, nil
+	}
+
+	spec.connMu.Lock()
+	defer spec.connMu.Unlock()
+
+	if spec.conn != nil {
+		timeout := e.opts.LivenessTimeout
+		if timeout == 0 {
+			timeout = livenessTimeout
+		}
+		if keepalive(spec.conn, timeout) {
+			return spec.conn, func() {}, nil
+		}
+		logger.FromContext(ctx).
+			WithField("hostname", spec.Server.Name).
+			WithField("ip", spec.ip).
+			WithField("id", spec.id).
+			Debug("cached ssh connection is not alive, reconnecting")
+		spec.conn.Close()
+		spec.conn = nil
+	}
+
+	client, err := e.connect(spec.ip, spec.Server.User, e.opts.HandshakeTimeout, e.hostKeyCallback(spec))
+	if err != nil {
+		return nil, nil, err
+	}
+	spec.conn = client
+	return client, func() {}, nil
+}
+
+// helper function closes the cached ssh connection, if any.
+func (s *Spec) closeConn() {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRun_ReuseConnection(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{ReuseConnections: true})
+	defer closer()
+	defer spec.closeConn()
+
+	step := &Step{Name: "build", Command: "echo", Args: []string{"hello"}}
+	if _, err := engine.Run(context.Background(), spec, step, new(syncBuffer)); err != nil {
+		t.Fatal(err)
+	}
+	client := spec.conn
+	if client == nil {
+		t.Fatalf("Want ssh connection cached")
+	}
+
+	if _, err := engine.Run(context.Background(), spec, step, new(syncBuffer)); err != nil {
+		t.Fatal(err)
+	}
+	if spec.conn != client {
+		t.Errorf("Want cached ssh connection reused")
+	}
+
+	// the cached connection is dead, and the server instance
+	// is dialed again.
+	client.Close()
+	buf := new(syncBuffer)
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Fatal(err)
+	}
+	if spec.conn == client {
+		t.Errorf("Want dead ssh connection replaced")
+	}
+	if got, want := buf.String(), "hello\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+
+	spec.closeConn()
+	if spec.conn != nil {
+		t.Errorf("Want cached ssh connection closed")
+	}
+}
+
+func TestRun_NoReuseConnection(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	step := &Step{Name: "build", Command: "echo", Args: []string{"hello"}}
+	if _, err := engine.Run(context.Background(), spec, step, new(syncBuffer)); err != nil {
+		t.Fatal(err)
+	}
+	if spec.conn != nil {
+		t.Errorf("Want ssh connection not cached")
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/drone/runner-go/logger"
+)
+
+// routeProbeTimeout is the time to wait for the tcp probe to
+// connect to the ssh port. It is declared as a variable so
+// that it can be overridden in unit tests.
+var routeProbeTimeout = time.Second * 2
+
+// dialTimeout dials the tcp address. It is declared as a
+// variable so that it can be replaced in unit tests.
+var dialTimeout = net.DialTimeout
+
+// route describes the result of probing the ssh port of the
+// server instance.
+type route int
+
+// route enumeration.
+const (
+	// routeOpen indicates the ssh port accepted the tcp
+	// connection.
+	routeOpen route = iota
+
+	// routeRefused indicates the server instance is routable,
+	// but the ssh daemon is not yet listening.
+	routeRefused
+
+	// routeUnreachable indicates the server instance is not
+	// yet routable, for example, while network routes are
+	// propagated.
+	routeUnreachable
+)
+
+func (r route) String() string {
+	switch r {
+	case routeOpen:
+		return "open"
+	case routeRefused:
+		return "refused"
+	default:
+		return "unreachable"
+	}
+}
+
+// helper function returns the address used to dial the server
+// instance. If route probing is enabled, the ssh port is probed
+// before dialing, and the private address is used if the public
+// address is not routable and the private address is.
+func (e *engine) address(ctx context.Context, spec *Spec) string {
+	if !e.opts.RouteProbe {
+		return spec.ip
+	}
+	log := logger.FromContext(ctx).
+		WithField("ip", spec.ip)
+
+	public := probeRoute(spec.ip)
+	log.WithField("route", public).
+		Debug("probed route to the vm")
+	if public != routeUnreachable || spec.privateIP == "" || !e.opts.RouteFallback {
+		return spec.ip
+	}
+
+	private := probeRoute(spec.privateIP)
+	log.WithField("private_ip", spec.privateIP).
+		WithField("route", private).
+		Debug("probed route to the vm private address")
+	if private == routeUnreachable {
+		return spec.ip
+	}
+
+	// subsequent connections use the private address, since
+	// the public address is not routable.
+	log.WithField("private_ip", spec.privateIP).
+		Info("public address is not routable, using the private address")
+	spec.ip = spec.privateIP
+	return spec.ip
+}
+
+// helper function probes the ssh port of the server with a
+// short timeout to determine whether the server is routable.
+func probeRoute(server string) route {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "22")
+	}
+	conn, err := dialTimeout("tcp", server, routeProbeTimeout)
+	if err == nil {
+		conn.Close()
+	}
+	return classifyRoute(err)
+}
+
+// helper function classifies the tcp probe error.
+func classifyRoute(err error) route {
+	if err == nil {
+		return routeOpen
+	}
+	if operr, ok := err.(*net.OpError); ok {
+		if syserr, ok := operr.Err.(*os.SyscallError); ok {
+			err = syserr.Err
+		} else {
+			err = operr.Err
+		}
+	}
+	if err == syscall.ECONNREFUSED {
+		return routeRefused
+	}
+	return routeUnreachable
+}
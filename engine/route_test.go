@@ -0,0 +1,103 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// unroutable is an address in the TEST-NET-1 block, which is
+// reserved for documentation and is not routable.
+const unroutable = "192.0.2.1:22"
+
+// helper function replaces the tcp dialer with a dialer that
+// times out when dialing the unroutable address. The returned
+// function restores the default.
+func mockUnroutable() func() {
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if address == unroutable {
+			return nil, &net.OpError{Op: "dial", Err: errors.New("i/o timeout")}
+		}
+		return net.DialTimeout(network, address, timeout)
+	}
+	return func() {
+		dialTimeout = net.DialTimeout
+	}
+}
+
+func TestClassifyRoute(t *testing.T) {
+	tests := []struct {
+		err  error
+		want route
+	}{
+		{nil, routeOpen},
+		{&net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}, routeRefused},
+		{&net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.EHOSTUNREACH}}, routeUnreachable},
+		{&net.OpError{Op: "dial", Err: errors.New("i/o timeout")}, routeUnreachable},
+	}
+	for _, test := range tests {
+		if got := classifyRoute(test.err); got != test.want {
+			t.Errorf("Want route %s for error %v, got %s", test.want, test.err, got)
+		}
+	}
+}
+
+func TestProbeRoute(t *testing.T) {
+	defer mockUnroutable()()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+
+	if got := probeRoute(addr); got != routeOpen {
+		t.Errorf("Want route open, got %s", got)
+	}
+	listener.Close()
+	if got := probeRoute(addr); got != routeRefused {
+		t.Errorf("Want route refused, got %s", got)
+	}
+	if got := probeRoute(unroutable); got != routeUnreachable {
+		t.Errorf("Want route unreachable, got %s", got)
+	}
+}
+
+func TestAddress_Fallback(t *testing.T) {
+	defer mockUnroutable()()
+
+	engine, spec, closer := mockEngine(t, Opts{RouteProbe: true, RouteFallback: true})
+	defer closer()
+
+	// the public address is not routable, and the private
+	// address is used instead.
+	spec.privateIP = spec.ip
+	spec.ip = unroutable
+	if got, want := engine.address(context.Background(), spec), spec.privateIP; got != want {
+		t.Errorf("Want private address %s, got %s", want, got)
+	}
+	if spec.ip != spec.privateIP {
+		t.Errorf("Expect private address used for subsequent connections")
+	}
+}
+
+func TestAddress_NoFallback(t *testing.T) {
+	defer mockUnroutable()()
+
+	engine, spec, closer := mockEngine(t, Opts{RouteProbe: true})
+	defer closer()
+
+	spec.privateIP = spec.ip
+	spec.ip = unroutable
+	if got, want := engine.address(context.Background(), spec), unroutable; got != want {
+		t.Errorf("Want public address %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/drone/runner-go/logger"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The engine can optionally fetch the full set of secrets from
+// a secrets provider once, when the server instance is
+// configured, instead of the secrets being injected into every
+// step script. The secrets are written to a file in the
+// pipeline root that is only readable by the ssh user, and the
+// file is sourced by every step script. Direct steps, which do
+// not have a step script, do not receive the secrets.
+
+// secretsFile is the name of the file in the pipeline root to
+// which the secrets are written.
+const (
+	secretsFile        = "drone-secrets.env"
+	secretsFileWindows = "drone-secrets.ps1"
+)
+
+// SecretProvider returns the secrets exported to every pipeline
+// step, by environment variable name.
+type SecretProvider func(ctx context.Context) (map[string][]byte, error)
+
+// helper function fetches the secrets from the secrets provider
+// and writes the secrets to the secrets file on the server
+// instance. The secrets are retained in the spec so that the
+// secrets are masked in the step output.
+func (e *engine) uploadSecrets(ctx context.Context, spec *Spec, put uploadFunc) error {
+	if e.opts.SecretProvider == nil {
+		return nil
+	}
+	log := logger.FromContext(ctx).
+		WithField("hostname", spec.Server.Name).
+		WithField("ip", spec.ip).
+		WithField("id", spec.id)
+
+	secrets, err := e.opts.SecretProvider(ctx)
+	if err != nil {
+		log.WithError(err).Error("cannot fetch secrets from the provider")
+		return err
+	}
+
+	var names []string
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	spec.secrets = nil
+	for _, name := range names {
+		writeEnv(buf, spec.Platform.OS, name, string(secrets[name]))
+		spec.secrets = append(spec.secrets, &Secret{
+			Name: name,
+			Env:  name,
+			Data: secrets[name],
+			Mask: true,
+		})
+	}
+
+	path := secretsPath(spec)
+	if err := put(path, buf.Bytes(), 0600); err != nil {
+		log.WithError(err).
+			WithField("path", path).
+			Error("cannot write secrets file")
+		return err
+	}
+	spec.secretsFile = path
+
+	log.WithField("secrets", len(names)).
+		Debug("secrets file written")
+	return nil
+}
+
+// helper function removes the secrets file from the server
+// instance. Errors are logged, but are not returned.
+func removeSecrets(ctx context.Context, spec *Spec, client *ssh.Client) {
+	out, err := execute(client, removeCommand(spec.Platform.OS, spec.secretsFile))
+	if err != nil {
+		logger.FromContext(ctx).
+			WithError(err).
+			WithField("path", spec.secretsFile).
+			WithField("output", string(out)).
+			Warn("cannot remove secrets file")
+		return
+	}
+	spec.secretsFile = ""
+}
+
+// helper function returns the secrets file path based on the
+// target platform.
+func secretsPath(spec *Spec) string {
+	switch spec.Platform.OS {
+	case "windows":
+		return spec.Root + "\\" + secretsFileWindows
+	default:
+		return spec.Root + "/" + secretsFile
+	}
+}
+
+// helper function writes a shell command to the io.Writer that
+// sources the secrets file, if the secrets file was written.
+func writeSecretsFile(w io.Writer, path string) {
+	if path == "" {
+		return
+	}
+	fmt.Fprintf(w, ". '%s'", path)
+	fmt.Fprintln(w)
+}
+
+// maskWriter is an io.Writer that masks the secrets in the
+// step output.
+type maskWriter struct {
+	sync.Mutex
+
+	w io.Writer
+	r *strings.Replacer
+}
+
+// newMaskWriter returns a writer that masks the secrets. If
+// there are no secrets to mask, the writer is returned.
+func newMaskWriter(w io.Writer, secrets []*Secret) io.Writer {
+	var oldnew []string
+	for _, secret := range secrets {
+		if len(secret.Data) == 0 || !secret.Mask {
+			continue
+		}
+		masked := fmt.Sprintf("[secret:%s]", strings.ToLower(secret.Name))
+		oldnew = append(oldnew, string(secret.Data), masked)
+	}
+	if len(oldnew) == 0 {
+		return w
+	}
+	return &maskWriter{w: w, r: strings.NewReplacer(oldnew...)}
+}
+
+func (w *maskWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if _, err := io.WriteString(w.w, w.r.Replace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
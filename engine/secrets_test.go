@@ -0,0 +1,121 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+func TestSecretProvider(t *testing.T) {
+	defer stubPlatform()()
+	destroy = func(context.Context, platform.DestroyArgs) error {
+		return nil
+	}
+
+	var calls int
+	engine, spec, closer := mockEngine(t, Opts{
+		SecretProvider: func(context.Context) (map[string][]byte, error) {
+			calls++
+			return map[string][]byte{"TOKEN": []byte("s3cr3t")}, nil
+		},
+	})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spec.Root = filepath.Join(dir, "drone-random")
+
+	if err := engine.Configure(context.Background(), spec); err != nil {
+		t.Error(err)
+		return
+	}
+	path := filepath.Join(spec.Root, secretsFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Errorf("Want secrets file written")
+		return
+	}
+	if got, want := info.Mode().Perm(), os.FileMode(0600); got != want {
+		t.Errorf("Want secrets file mode %s, got %s", want, got)
+	}
+
+	// the secrets are fetched once, and are available to
+	// every step. The secrets are masked in the step output.
+	script := filepath.Join(dir, "build.sh")
+	for _, name := range []string{"build", "test"} {
+		step := &Step{
+			Name:    name,
+			Command: "sh",
+			Args:    []string{script},
+			Files:   []*File{{Path: script, Mode: 0700, Data: []byte(`echo "token=$TOKEN"`)}},
+		}
+		buf := new(syncBuffer)
+		if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+			t.Error(err)
+			return
+		}
+		if got, want := buf.String(), "token=[secret:token]\n"; got != want {
+			t.Errorf("Want output %q, got %q", want, got)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Want secrets fetched once, got %d", calls)
+	}
+
+	// the secrets file is removed before the server instance
+	// is destroyed.
+	if _, err := engine.Destroy(context.Background(), spec); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Want secrets file removed")
+	}
+}
+
+func TestSecretProvider_Error(t *testing.T) {
+	errProvider := errors.New("vault sealed")
+	engine, spec, closer := mockEngine(t, Opts{
+		SecretProvider: func(context.Context) (map[string][]byte, error) {
+			return nil, errProvider
+		},
+	})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spec.Root = filepath.Join(dir, "drone-random")
+
+	if err := engine.Configure(context.Background(), spec); err != errProvider {
+		t.Errorf("Want provider error, got %v", err)
+	}
+	if spec.secretsFile != "" {
+		t.Errorf("Want secrets file not written")
+	}
+}
+
+func TestWriteSecretsFile(t *testing.T) {
+	buf := new(syncBuffer)
+	writeSecretsFile(buf, "")
+	if buf.String() != "" {
+		t.Errorf("Want secrets file not sourced if not written")
+	}
+	writeSecretsFile(buf, "/tmp/drone-random/drone-secrets.env")
+	if got, want := buf.String(), ". '/tmp/drone-random/drone-secrets.env'\n"; got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// defaultMaxSessions is the default number of concurrent ssh
+// sessions opened with a server instance. The value is below
+// the openssh MaxSessions default of ten.
+const defaultMaxSessions = 8
+
+// stepChannels is the number of ssh channels a pipeline step
+// holds open concurrently: the sftp channel, which is open for
+// the duration of the step, and one exec channel at a time for
+// the setenv probe, the step command, or an scp transfer.
+const stepChannels = 2
+
+// helper function blocks until n session slots are available
+// for the server instance, or the context is cancelled. The n
+// slots are acquired together, so that parallel steps cannot
+// hold slots while waiting for one another. The returned
+// function releases the slots.
+func (s *Spec) acquire(ctx context.Context, limit, n int) (func(), error) {
+	if limit <= 0 {
+		limit = defaultMaxSessions
+	}
+	if n > limit {
+		n = limit
+	}
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = semaphore.NewWeighted(int64(limit))
+	}
+	sessions := s.sessions
+	s.mu.Unlock()
+
+	if err := sessions.Acquire(ctx, int64(n)); err != nil {
+		return nil, err
+	}
+	return func() { sessions.Release(int64(n)) }, nil
+}
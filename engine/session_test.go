@@ -0,0 +1,85 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAcquire(t *testing.T) {
+	spec := new(Spec)
+	release1, err := spec.acquire(context.Background(), 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := spec.acquire(context.Background(), 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the limit is reached and the request is blocked until
+	// the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := spec.acquire(ctx, 2, 1); err != context.Canceled {
+		t.Errorf("Want context canceled, got %v", err)
+	}
+
+	release1()
+	release3, err := spec.acquire(context.Background(), 2, 1)
+	if err != nil {
+		t.Errorf("Want session acquired after release, got %s", err)
+		return
+	}
+	release2()
+	release3()
+}
+
+func TestAcquire_Channels(t *testing.T) {
+	spec := new(Spec)
+	release1, err := spec.acquire(context.Background(), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the request is blocked until all of the slots are
+	// available, even though one slot is available.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := spec.acquire(ctx, 3, 2); err != context.Canceled {
+		t.Errorf("Want context canceled, got %v", err)
+	}
+
+	release1()
+	release2, err := spec.acquire(context.Background(), 3, 2)
+	if err != nil {
+		t.Errorf("Want sessions acquired after release, got %s", err)
+		return
+	}
+	release2()
+
+	// the number of slots is capped at the limit.
+	release3, err := spec.acquire(context.Background(), 1, 2)
+	if err != nil {
+		t.Errorf("Want sessions capped at the limit, got %s", err)
+		return
+	}
+	release3()
+}
+
+func TestAcquire_Default(t *testing.T) {
+	spec := new(Spec)
+	for i := 0; i < defaultMaxSessions; i++ {
+		if _, err := spec.acquire(context.Background(), 0, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := spec.acquire(ctx, 0, 1); err != context.Canceled {
+		t.Errorf("Want default limit %d, got %v", defaultMaxSessions, err)
+	}
+}
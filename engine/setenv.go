@@ -0,0 +1,87 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// setenvProbe is the variable sent to determine whether the
+// server instance accepts environment variables sent with the
+// ssh protocol.
+const setenvProbe = "DRONE_SETENV_PROBE"
+
+// helper function splits the step environment into variables
+// sent with the ssh protocol, and variables exported by the
+// step script. Variables are sent with the ssh protocol if the
+// name matches the list and the server instance accepts the
+// variables, which requires the AcceptEnv sshd option.
+// Otherwise all variables are exported by the step script.
+// Only variables permitted by the allow and deny lists are
+// sent or exported.
+func (e *engine) splitEnv(spec *Spec, client *ssh.Client, envs map[string]string) (sent, exported map[string]string) {
+	if len(e.opts.SendEnv) == 0 || spec.Platform.OS == "windows" {
+		return nil, envs
+	}
+	permitted := map[string]string{}
+	for k, v := range envs {
+		if permitEnv(k, e.opts.EnvAllow, e.opts.EnvDeny) {
+			permitted[k] = v
+		}
+	}
+	envs = permitted
+	sent = map[string]string{}
+	exported = map[string]string{}
+	for k, v := range envs {
+		if matchEnv(k, e.opts.SendEnv) {
+			sent[k] = v
+		} else {
+			exported[k] = v
+		}
+	}
+	if len(sent) == 0 || !spec.acceptsEnv(client) {
+		return nil, envs
+	}
+	return sent, exported
+}
+
+// helper function sets the environment variables on the ssh
+// session.
+func setenv(session *ssh.Session, envs map[string]string) error {
+	for k, v := range envs {
+		if err := session.Setenv(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// helper function returns true if the server instance accepts
+// environment variables sent with the ssh protocol. The result
+// is cached for the lifetime of the spec.
+func (s *Spec) acceptsEnv(client *ssh.Client) bool {
+	s.mu.Lock()
+	cached := s.setenv
+	s.mu.Unlock()
+	if cached != nil {
+		return *cached
+	}
+	ok := probeSetenv(client)
+	s.mu.Lock()
+	s.setenv = &ok
+	s.mu.Unlock()
+	return ok
+}
+
+// helper function returns true if the ssh server accepts the
+// environment variable request.
+func probeSetenv(client *ssh.Client) bool {
+	session, err := client.NewSession()
+	if err != nil {
+		return false
+	}
+	defer session.Close()
+	return session.Setenv(setenvProbe, "true") == nil
+}
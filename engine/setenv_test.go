@@ -0,0 +1,111 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun_SendEnv(t *testing.T) {
+	tests := []struct {
+		noenv    bool
+		exported bool
+	}{
+		// the variable is sent with the ssh protocol, and is
+		// not exported by the step script.
+		{noenv: false, exported: false},
+		// the server rejects the variable, and the variable
+		// is exported by the step script instead.
+		{noenv: true, exported: true},
+	}
+	for _, test := range tests {
+		engine, spec, server := newMockEngine(t, Opts{SendEnv: []string{"GO*"}})
+		server.update(func() { server.noenv = test.noenv })
+
+		dir, err := ioutil.TempDir("", "drone-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		script := filepath.Join(dir, "script.sh")
+		step := &Step{
+			Name:       "build",
+			Command:    "sh",
+			Args:       []string{script},
+			Envs:       map[string]string{"GOOS": "linux", "CGO": "0"},
+			WorkingDir: dir,
+			Files: []*File{
+				{Path: script, Mode: 0700, Data: []byte("echo $GOOS $CGO\n")},
+			},
+		}
+		buf := new(syncBuffer)
+		_, err = engine.Run(context.Background(), spec, step, buf)
+		server.Close()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got, want := buf.String(), "linux 0\n"; got != want {
+			t.Errorf("Want output %q, got %q", want, got)
+		}
+		data, _ := ioutil.ReadFile(script)
+		if got, want := strings.Contains(string(data), "GOOS="), test.exported; got != want {
+			t.Errorf("Want variable exported by the step script %v, got %v", want, got)
+		}
+		if !strings.Contains(string(data), "CGO=") {
+			t.Errorf("Want variables that do not match exported by the step script")
+		}
+	}
+}
+
+func TestRun_SendEnvDenied(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{
+		SendEnv: []string{"DRONE_*"},
+		EnvDeny: []string{"DRONE_NETRC_*"},
+	})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the denied variable matches the send list, and the
+	// server accepts the variable, but the variable is not
+	// sent to the step.
+	script := filepath.Join(dir, "script.sh")
+	step := &Step{
+		Name:    "build",
+		Command: "sh",
+		Args:    []string{script},
+		Envs: map[string]string{
+			"DRONE_BRANCH":         "master",
+			"DRONE_NETRC_PASSWORD": "password",
+		},
+		WorkingDir: dir,
+		Files: []*File{
+			{Path: script, Mode: 0700, Data: []byte("echo \"$DRONE_BRANCH:$DRONE_NETRC_PASSWORD\"\n")},
+		},
+	}
+	buf := new(syncBuffer)
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := buf.String(), "master:\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+	data, _ := ioutil.ReadFile(script)
+	if strings.Contains(string(data), "DRONE_BRANCH=") {
+		t.Errorf("Want permitted variable sent with the ssh protocol")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	"github.com/drone/runner-go/logger"
+)
+
+// ErrNoKeypair is returned in setup-only mode when the server
+// instance was not provisioned with a build keypair, for
+// example, because an existing server instance was reused, or
+// the provisioning phase was skipped.
+var ErrNoKeypair = errors.New("server instance is not provisioned with a build keypair")
+
+// SetupOnly provisions and configures the server instance, and
+// returns the connection details without destroying the server
+// instance, for interactive use. The server instance is tagged
+// with its expiry time so that the reaper removes the server
+// instance, and the build key, once the ttl has elapsed.
+func (e *engine) SetupOnly(ctx context.Context, spec *Spec, ttl time.Duration) (*Connection, error) {
+	expires := time.Now().Add(ttl)
+
+	// the build keypair is always generated in setup-only
+	// mode so that the runner private key is never shared.
+	spec.Server.Keypair = true
+	spec.expires = expires
+
+	// the server instance is destroyed if setup fails, since
+	// it cannot be used interactively.
+	if err := e.Setup(ctx, spec); err != nil {
+		e.Destroy(ctx, spec)
+		return nil, err
+	}
+	// the provisioning slot is released, since the server
+	// instance is not destroyed by the runner.
+	defer spec.releaseProvision()
+	return writeConnection(ctx, spec, expires)
+}
+
+// helper function writes the build private key to a local file
+// and returns the connection details for the server instance.
+func writeConnection(ctx context.Context, spec *Spec, expires time.Time) (*Connection, error) {
+	if spec.keypair == nil {
+		return nil, ErrNoKeypair
+	}
+	f, err := ioutil.TempFile("", "drone-key-")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Write(spec.keypair.private); err != nil {
+		return nil, err
+	}
+
+	logger.FromContext(ctx).
+		WithField("ip", spec.ip).
+		WithField("path", f.Name()).
+		WithField("expires", expires).
+		Debug("server instance ready for interactive use")
+
+	return &Connection{
+		IP:      spec.ip,
+		User:    spec.Server.User,
+		KeyPath: f.Name(),
+		Expires: expires,
+	}, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+func TestSetupOnly(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{MaxProvisions: 1, MaxLifetime: time.Minute})
+	defer closer()
+
+	addr := spec.ip
+	spec.id, spec.ip = 0, ""
+
+	var args platform.ProvisionArgs
+	defer stubPlatform()()
+	registerKey = func(context.Context, platform.RegisterArgs) (int, error) {
+		return 1, nil
+	}
+	provision = func(ctx context.Context, in platform.ProvisionArgs) (platform.Instance, error) {
+		args = in
+		return platform.Instance{ID: 1, IP: addr}, nil
+	}
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spec.Root = dir
+
+	conn, err := engine.SetupOnly(context.Background(), spec, time.Hour)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.Remove(conn.KeyPath)
+
+	if got, want := conn.IP, addr; got != want {
+		t.Errorf("Want ip %q, got %q", want, got)
+	}
+	if got, want := conn.User, "root"; got != want {
+		t.Errorf("Want user %q, got %q", want, got)
+	}
+	if d := time.Until(conn.Expires); d < time.Minute*59 || d > time.Hour {
+		t.Errorf("Want expiry in one hour, got %s", conn.Expires)
+	}
+
+	// the build keypair is generated and authorized on the
+	// server instance, and the private key is written to the
+	// key file.
+	if len(args.Keys) != 1 || args.Keys[0] != spec.keypair.fingerprint {
+		t.Errorf("Expect build key authorized, got %v", args.Keys)
+	}
+	data, err := ioutil.ReadFile(conn.KeyPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(data, spec.keypair.private) {
+		t.Errorf("Expect build private key written to key file")
+	}
+	if info, _ := os.Stat(conn.KeyPath); info.Mode().Perm() != 0600 {
+		t.Errorf("Want key file mode 0600, got %s", info.Mode())
+	}
+
+	// the provisioning slot is released, since the server
+	// instance is not destroyed by the runner.
+	if held := len(engine.provisions[spec.Token]); held != 0 {
+		t.Errorf("Want provisioning slot released, got %d held", held)
+	}
+
+	// the server instance is tagged with the expiry time, so
+	// that the reaper removes the server instance.
+	want := platform.ExpiryTag(conn.Expires)
+	if len(args.Tags) != 1 || args.Tags[0] != want {
+		t.Errorf("Want expiry tag %q, got %v", want, args.Tags)
+	}
+
+	// the server instance is not destroyed once the maximum
+	// lifetime elapses, before the expiry time.
+	if spec.expiry != nil {
+		t.Errorf("Expect no lifetime timer in setup-only mode")
+	}
+}
+
+func TestSetupOnly_NoKeypair(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{SetupPhases: []SetupPhase{PhaseConfigure}})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spec.Root = dir
+
+	// the existing server instance is configured without a
+	// build keypair, and the connection cannot be returned.
+	if _, err := engine.SetupOnly(context.Background(), spec, time.Hour); err != ErrNoKeypair {
+		t.Errorf("Want ErrNoKeypair, got %v", err)
+	}
+}
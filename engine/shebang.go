@@ -0,0 +1,48 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// The step environment is configured by prepending shell
+// commands to the step file, which corrupts a step file that
+// begins with a shebang line, for example, a python script,
+// because the shebang line is no longer the first line. These
+// step files are instead uploaded unmodified alongside the
+// step file path, and the step file path is replaced with a
+// shell script that configures the environment and executes
+// the original step file. Shebang lines are ignored on windows.
+
+// shebangSuffix is appended to the step file path to name the
+// original step file.
+const shebangSuffix = ".drone-exec"
+
+// helper function returns true if the step file begins with a
+// shebang line.
+func hasShebang(os string, data []byte) bool {
+	return os != "windows" && bytes.HasPrefix(data, []byte("#!"))
+}
+
+// helper function returns the path of the original step file.
+func shebangPath(path string) string {
+	return path + shebangSuffix
+}
+
+// helper function writes the shebang line of the wrapper
+// script to the io.Writer.
+func writeShebang(w io.Writer) {
+	fmt.Fprintln(w, "#!/bin/sh")
+}
+
+// helper function writes a shell command to the io.Writer that
+// replaces the wrapper script with the original step file.
+func writeExec(w io.Writer, path string) {
+	fmt.Fprintf(w, "exec %s \"$@\"", shellQuote(path))
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestRun_Shebang(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is not installed")
+	}
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "build.py")
+	data := []byte("#!/usr/bin/env python3\nimport os\nprint('greeting=' + os.environ['GREETING'])\n")
+	step := &Step{
+		Name:       "build",
+		Command:    script,
+		Envs:       map[string]string{"GREETING": "hello"},
+		WorkingDir: dir,
+		Files:      []*File{{Path: script, Mode: 0700, Data: data}},
+	}
+	buf := new(syncBuffer)
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := buf.String(), "greeting=hello\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+
+	// the step file is uploaded unmodified.
+	got, err := ioutil.ReadFile(shebangPath(script))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Want step file uploaded unmodified, got %q", got)
+	}
+}
+
+func TestRun_ShebangPrepend(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{Shebang: ShebangPrepend})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "build.sh")
+	step := &Step{
+		Name:       "build",
+		Command:    "sh",
+		Args:       []string{script},
+		Envs:       map[string]string{"GREETING": "hello"},
+		WorkingDir: dir,
+		Files:      []*File{{Path: script, Mode: 0700, Data: []byte("#!/bin/sh\necho $GREETING\n")}},
+	}
+	buf := new(syncBuffer)
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := os.Stat(shebangPath(script)); !os.IsNotExist(err) {
+		t.Errorf("Want step file not wrapped")
+	}
+}
+
+func TestHasShebang(t *testing.T) {
+	tests := []struct {
+		os   string
+		data string
+		want bool
+	}{
+		{os: "linux", data: "#!/usr/bin/env python\nprint('hello')", want: true},
+		{os: "linux", data: "echo hello", want: false},
+		{os: "linux", data: "\n#!/bin/sh", want: false},
+		{os: "windows", data: "#!/usr/bin/env python", want: false},
+	}
+	for _, test := range tests {
+		if got := hasShebang(test.os, []byte(test.data)); got != test.want {
+			t.Errorf("Want shebang %v for %q, got %v", test.want, test.data, got)
+		}
+	}
+}
+
+func TestWriteExec(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writeShebang(buf)
+	writeExec(buf, "/tmp/drone-random/build.py.drone-exec")
+	want := "#!/bin/sh\nexec '/tmp/drone-random/build.py.drone-exec' \"$@\"\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
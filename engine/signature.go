@@ -0,0 +1,120 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+const (
+	// DiagnosisDiskFull indicates the step failed because the
+	// server instance disk is full.
+	DiagnosisDiskFull = "disk full"
+
+	// DiagnosisOOM indicates the step failed because the server
+	// instance ran out of memory.
+	DiagnosisOOM = "out of memory"
+)
+
+// maxSignatureLine is the maximum length of a partial line that
+// is retained to match signatures split across writes.
+const maxSignatureLine = 4096
+
+// DefaultSignatures is the default list of output signatures
+// that diagnose common disk-full and out of memory failures.
+var DefaultSignatures = []Signature{
+	{Pattern: "No space left on device", Diagnosis: DiagnosisDiskFull},
+	{Pattern: "Disk quota exceeded", Diagnosis: DiagnosisDiskFull},
+	{Pattern: "ENOSPC", Diagnosis: DiagnosisDiskFull},
+	{Pattern: "Cannot allocate memory", Diagnosis: DiagnosisOOM},
+	{Pattern: "out of memory", Diagnosis: DiagnosisOOM},
+	{Pattern: "java.lang.OutOfMemoryError", Diagnosis: DiagnosisOOM},
+}
+
+// Signature is a pattern in the step output that diagnoses the
+// cause of a step failure. The pattern is matched against each
+// line of output, ignoring case.
+type Signature struct {
+	Pattern   string
+	Diagnosis string
+}
+
+// signatureWriter is an io.Writer that scans every line written
+// for the signatures, and retains the diagnosis of the first
+// matching signature.
+type signatureWriter struct {
+	sync.Mutex
+
+	signatures []Signature
+	partial    []byte
+	diagnosis  string
+}
+
+// newSignatureWriter returns a writer that scans the lines
+// written for the signatures.
+func newSignatureWriter(signatures []Signature) *signatureWriter {
+	lowered := make([]Signature, len(signatures))
+	for i, signature := range signatures {
+		lowered[i] = Signature{
+			Pattern:   strings.ToLower(signature.Pattern),
+			Diagnosis: signature.Diagnosis,
+		}
+	}
+	return &signatureWriter{signatures: lowered}
+}
+
+// Write scans p for the signatures, one line at a time.
+func (w *signatureWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.diagnosis != "" {
+		return len(p), nil
+	}
+	data := append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			break
+		}
+		if w.scan(data[:i]) {
+			w.partial = nil
+			return len(p), nil
+		}
+		data = data[i+1:]
+	}
+	if len(data) > maxSignatureLine {
+		data = data[len(data)-maxSignatureLine:]
+	}
+	w.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// Diagnosis returns the diagnosis of the first signature that
+// matched the output, or an empty string if no signature
+// matched. A trailing line that is not terminated by a newline
+// is included.
+func (w *signatureWriter) Diagnosis() string {
+	w.Lock()
+	defer w.Unlock()
+	if w.diagnosis == "" && len(w.partial) != 0 {
+		w.scan(w.partial)
+	}
+	return w.diagnosis
+}
+
+// helper function returns true if the line matches a signature,
+// in which case the diagnosis is retained.
+func (w *signatureWriter) scan(line []byte) bool {
+	lowered := strings.ToLower(string(line))
+	for _, signature := range w.signatures {
+		if strings.Contains(lowered, signature.Pattern) {
+			w.diagnosis = signature.Diagnosis
+			return true
+		}
+	}
+	return false
+}
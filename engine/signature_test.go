@@ -0,0 +1,74 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSignatureWriter(t *testing.T) {
+	tests := []struct {
+		writes    []string
+		diagnosis string
+	}{
+		{[]string{"cp: error writing 'a.out': No space left on device\n"}, DiagnosisDiskFull},
+		{[]string{"write /tmp/cache: no space ", "left on device\n"}, DiagnosisDiskFull},
+		{[]string{"FATAL ERROR: JavaScript heap out of memory"}, DiagnosisOOM},
+		{[]string{"exit status 1\n"}, ""},
+	}
+	for _, test := range tests {
+		w := newSignatureWriter(DefaultSignatures)
+		for _, s := range test.writes {
+			if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+				t.Errorf("Want %d bytes written, got %d, %v", len(s), n, err)
+			}
+		}
+		if got, want := w.Diagnosis(), test.diagnosis; got != want {
+			t.Errorf("Want diagnosis %q, got %q", want, got)
+		}
+	}
+}
+
+func TestRun_ScanOutput(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{ScanOutput: true})
+	defer closer()
+
+	step := &Step{
+		Name:    "build",
+		Command: "echo",
+		Args:    []string{"'write error: No space left on device'", "&&", "exit", "1"},
+	}
+	state, _ := engine.Run(context.Background(), spec, step, new(syncBuffer))
+	if state == nil || state.ExitCode != 1 {
+		t.Errorf("Want exit code 1, got %v", state)
+		return
+	}
+	if got, want := state.Diagnosis, DiagnosisDiskFull; got != want {
+		t.Errorf("Want diagnosis %q, got %q", want, got)
+	}
+	if state.OOMKilled {
+		t.Errorf("Want step not oom killed")
+	}
+}
+
+func TestRun_ScanOutputSuccess(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{
+		ScanOutput: true,
+		Signatures: []Signature{{Pattern: "killed", Diagnosis: DiagnosisOOM}},
+	})
+	defer closer()
+
+	// the output of a successful step is not diagnosed.
+	step := &Step{Name: "build", Command: "echo", Args: []string{"killed"}}
+	state, err := engine.Run(context.Background(), spec, step, new(syncBuffer))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if state.Diagnosis != "" || state.OOMKilled {
+		t.Errorf("Want no diagnosis for a successful step, got %q", state.Diagnosis)
+	}
+}
@@ -4,6 +4,14 @@
 
 package engine
 
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/semaphore"
+)
+
 type (
 	// Spec provides the pipeline spec. This provides the
 	// required instructions for reproducable pipeline
@@ -15,39 +23,132 @@ type (
 		Root     string   `json:"root,omitempty"`
 		Files    []*File  `json:"files,omitempty"`
 		Steps    []*Step  `json:"steps,omitempty"`
+		Mounts   []*Mount `json:"mounts,omitempty"`
 
 		// the engine sets these variables after having
 		// successfully provisioned an instance using the API
-		id int    // ID of the provisioned instance.
-		ip string // IP of the provisioned instance.
+		id        int           // ID of the provisioned instance.
+		ip        string        // IP of the provisioned instance.
+		privateIP string        // Private IP of the provisioned instance.
+		size      string        // Size of the provisioned instance.
+		keypair   *keypair      // Keypair generated for the build.
+		hostkey   ssh.PublicKey // Host key of the provisioned instance.
+
+		// the engine captures step output that is piped to
+		// the stdin of subsequent steps.
+		mu      sync.Mutex
+		outputs map[string][]byte
+
+		// the engine limits the number of concurrent ssh
+		// sessions opened with the instance.
+		sessions *semaphore.Weighted
+
+		// the engine caches whether gzip is installed on the
+		// instance, to compress uploaded files.
+		gzip *bool
+
+		// the engine caches whether the instance accepts
+		// environment variables sent with the ssh protocol.
+		setenv *bool
+
+		// the engine removes the swapfile before the instance
+		// is destroyed, if the swapfile was enabled.
+		swap bool
+
+		// the engine optionally writes the secrets returned by
+		// the secrets provider to a file, which is sourced by
+		// the step scripts and removed before the instance is
+		// destroyed.
+		secrets     []*Secret
+		secretsFile string
+
+		// the engine optionally caches the ssh connection with
+		// the instance, which is reused by subsequent steps.
+		connMu sync.Mutex
+		conn   *ssh.Client
+
+		// the runner key is resolved before the instance is
+		// provisioned, with the key fingerprint and key id
+		// registered with the account.
+		key   string
+		keyID int
+
+		// the engine optionally dials the address of the other
+		// address family if the preferred address is not
+		// reachable. The addresses are swapped once the
+		// fallback address is used, so that subsequent steps
+		// use the address that is reachable.
+		fallbackIP string
+
+		// the engine releases the provisioning slot when the
+		// instance is destroyed.
+		release func()
+
+		// the engine optionally destroys the instance once the
+		// maximum lifetime elapses, unless the timer is stopped
+		// when the instance is destroyed.
+		expiry *time.Timer
+
+		// the instance is tagged with the expiry time if it
+		// is provisioned in setup-only mode.
+		expires time.Time
 	}
 
 	// Server provides the secret configuration.
 	Server struct {
-		Name   string `json:"name,omitempty"`
-		Image  string `json:"image,omitempty"`
-		Region string `json:"region,omitempty"`
-		Size   string `json:"size,omitempty"`
-		User   string `json:"user,omitempty"`
+		Name     string `json:"name,omitempty"`
+		Hostname string `json:"hostname,omitempty"`
+		Image    string `json:"image,omitempty"`
+		Region   string `json:"region,omitempty"`
+		Size     string `json:"size,omitempty"`
+		User     string `json:"user,omitempty"`
+		Keypair  bool   `json:"keypair,omitempty"`
+
+		Labels map[string]string `json:"labels,omitempty"`
+
+		// Images overrides the image for the region in which
+		// the server instance is provisioned.
+		Images map[string]string `json:"images,omitempty"`
+
+		// Sizes provides fallback sizes, in order of
+		// preference, if the size is out of capacity.
+		Sizes []string `json:"sizes,omitempty"`
 	}
 
 	// Step defines a pipeline step.
 	Step struct {
 		Args         []string          `json:"args,omitempty"`
+		ClearEnv     bool              `json:"clear_env,omitempty"`
 		Command      string            `json:"command,omitempty"`
 		Detach       bool              `json:"detach,omitempty"`
 		DependsOn    []string          `json:"depends_on,omitempty"`
+		Direct       bool              `json:"direct,omitempty"`
 		Envs         map[string]string `json:"environment,omitempty"`
+		Execs        []*Exec           `json:"execs,omitempty"`
 		Files        []*File           `json:"files,omitempty"`
 		IgnoreErr    bool              `json:"ignore_err,omitempty"`
 		IgnoreStdout bool              `json:"ignore_stderr,omitempty"`
 		IgnoreStderr bool              `json:"ignore_stdout,omitempty"`
+		IONice       string            `json:"ionice,omitempty"`
+		Isolation    string            `json:"isolation,omitempty"`
 		Name         string            `json:"name,omitempt"`
+		Nice         int               `json:"nice,omitempty"`
 		RunPolicy    RunPolicy         `json:"run_policy,omitempty"`
 		Secrets      []*Secret         `json:"secrets,omitempty"`
+		Stdin        []byte            `json:"stdin,omitempty"`
+		StdinFrom    string            `json:"stdin_from,omitempty"`
+		Timeout      time.Duration     `json:"timeout,omitempty"`
 		WorkingDir   string            `json:"working_dir,omitempty"`
 	}
 
+	// Exec defines a step command that is executed in a
+	// separate ssh session.
+	Exec struct {
+		Name    string   `json:"name,omitempty"`
+		Command string   `json:"command,omitempty"`
+		Args    []string `json:"args,omitempty"`
+	}
+
 	// File defines a file that should be uploaded or
 	// mounted somewhere in the step container or virtual
 	// machine prior to command execution.
@@ -66,6 +167,16 @@ type (
 		Version string `json:"version,omitempty"`
 	}
 
+	// Mount represents a spaces bucket mounted as a read-only
+	// filesystem on the server instance.
+	Mount struct {
+		Bucket    string `json:"bucket,omitempty"`
+		Endpoint  string `json:"endpoint,omitempty"`
+		Path      string `json:"path,omitempty"`
+		AccessKey string `json:"access_key,omitempty"`
+		SecretKey string `json:"secret_key,omitempty"`
+	}
+
 	// Secret represents a secret variable.
 	Secret struct {
 		Name string `json:"name,omitempty"`
@@ -79,7 +190,84 @@ type (
 		ExitCode  int  // Container exit code
 		Exited    bool // Container exited
 		OOMKilled bool // Container is oom killed
+
+		// FailedCommand is the name of the failed command, if
+		// the step commands are executed separately.
+		FailedCommand string
+
+		// TransportError is true if the ssh session failed
+		// before the exit status of the step was received, in
+		// which case the exit code is not the exit status of
+		// the step command.
+		TransportError bool
+
+		// Diagnosis is the cause of the step failure detected
+		// in the step output, for example, disk full. It is
+		// empty if no output signature matched.
+		Diagnosis string
 	}
+
+	// HealthStatus represents the health of the pipeline
+	// environment.
+	HealthStatus struct {
+		// Instance is the status of the server instance
+		// (new, active, off or archive). It is empty if the
+		// status cannot be determined.
+		Instance      string
+		InstanceError error
+
+		// Reachable is true if an ssh connection to the
+		// server instance can be established.
+		Reachable bool
+		SSHError  error
+
+		// WorkspaceReady is true if the pipeline root
+		// directory exists on the server instance.
+		WorkspaceReady bool
+	}
+
+	// Connection provides the details required to connect to
+	// a server instance provisioned in setup-only mode.
+	Connection struct {
+		IP      string
+		User    string
+		KeyPath string    // Path of the private key file.
+		Expires time.Time // Time after which the instance can be removed.
+	}
+
+	// DestroyResult represents the result of destroying the
+	// pipeline environment.
+	DestroyResult struct {
+		Status DestroyStatus
+	}
+)
+
+// DestroyStatus defines the outcome of destroying the server
+// instance.
+type DestroyStatus int
+
+// DestroyStatus enumeration.
+const (
+	// DestroyNotProvisioned indicates the server instance was
+	// never provisioned, and there was nothing to delete.
+	DestroyNotProvisioned DestroyStatus = iota
+
+	// DestroyDeleted indicates the server instance was
+	// deleted.
+	DestroyDeleted
+
+	// DestroyAlreadyGone indicates the server instance no
+	// longer existed when it was deleted.
+	DestroyAlreadyGone
+
+	// DestroyFailed indicates the server instance could not
+	// be deleted.
+	DestroyFailed
+
+	// DestroyDryRun indicates the server instance would have
+	// been deleted, but the engine is configured in dry-run
+	// mode.
+	DestroyDryRun
 )
 
 // RunPolicy defines the policy for starting containers
@@ -94,3 +282,25 @@ const (
 	RunAlways
 	RunNever
 )
+
+// helper function resets the state set by the engine when the
+// instance is provisioned, so that a new instance can be
+// provisioned using the spec.
+func (s *Spec) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.id = 0
+	s.ip = ""
+	s.key = ""
+	s.keyID = 0
+	s.privateIP = ""
+	s.fallbackIP = ""
+	s.size = ""
+	s.keypair = nil
+	s.hostkey = nil
+	s.gzip = nil
+	s.setenv = nil
+	s.swap = false
+	s.secrets = nil
+	s.secretsFile = ""
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/drone/runner-go/logger"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// swapfile is the path of the swapfile created on the server
+// instance.
+const swapfile = "/drone.swap"
+
+// helper function creates and enables a swapfile of the given
+// size, in megabytes, on the server instance. Swap is not
+// supported on windows, in which case the swapfile is not
+// created.
+func enableSwap(ctx context.Context, spec *Spec, client *ssh.Client, size int) error {
+	if size <= 0 || spec.Platform.OS == "windows" {
+		return nil
+	}
+	log := logger.FromContext(ctx).
+		WithField("hostname", spec.Server.Name).
+		WithField("path", swapfile).
+		WithField("size", size)
+
+	out, err := execute(client, swapCommand(swapfile, size))
+	if err != nil {
+		log.WithError(err).
+			WithField("output", string(out)).
+			Error("cannot enable swapfile")
+		return err
+	}
+	spec.swap = true
+	log.Debug("swapfile enabled")
+	return nil
+}
+
+// helper function disables and removes the swapfile from the
+// server instance. Errors are logged and otherwise ignored.
+func disableSwap(ctx context.Context, spec *Spec, client *ssh.Client) {
+	out, err := execute(client, swapoffCommand(swapfile))
+	if err != nil {
+		logger.FromContext(ctx).
+			WithError(err).
+			WithField("path", swapfile).
+			WithField("output", string(out)).
+			Debug("cannot remove swapfile")
+		return
+	}
+	spec.swap = false
+}
+
+// helper function returns the shell command to create and
+// enable the swapfile. The swapfile is not created again if it
+// is already enabled, which means the server instance can be
+// safely re-configured. The file is allocated with dd if the
+// filesystem does not support fallocate.
+func swapCommand(path string, size int) string {
+	return fmt.Sprintf(
+		"grep -q '^%s ' /proc/swaps || ((fallocate -l %dM %s || dd if=/dev/zero of=%s bs=1M count=%d) && chmod 0600 %s && mkswap %s && swapon %s)",
+		path,
+		size,
+		path,
+		path,
+		size,
+		path,
+		path,
+		path,
+	)
+}
+
+// helper function returns the shell command to disable and
+// remove the swapfile.
+func swapoffCommand(path string) string {
+	return fmt.Sprintf(
+		"(! grep -q '^%s ' /proc/swaps || swapoff %s) && rm -f %s",
+		path,
+		path,
+		path,
+	)
+}
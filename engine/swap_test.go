@@ -0,0 +1,42 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSwapCommand(t *testing.T) {
+	got := swapCommand("/drone.swap", 1024)
+	want := "grep -q '^/drone.swap ' /proc/swaps || ((fallocate -l 1024M /drone.swap || dd if=/dev/zero of=/drone.swap bs=1M count=1024) && chmod 0600 /drone.swap && mkswap /drone.swap && swapon /drone.swap)"
+	if got != want {
+		t.Errorf("Want swap command %q, got %q", want, got)
+	}
+}
+
+func TestSwapoffCommand(t *testing.T) {
+	got := swapoffCommand("/drone.swap")
+	want := "(! grep -q '^/drone.swap ' /proc/swaps || swapoff /drone.swap) && rm -f /drone.swap"
+	if got != want {
+		t.Errorf("Want swapoff command %q, got %q", want, got)
+	}
+}
+
+func TestEnableSwap_Disabled(t *testing.T) {
+	// the ssh client is not used when the swapfile is
+	// disabled or not supported.
+	spec := &Spec{}
+	if err := enableSwap(context.Background(), spec, nil, 0); err != nil {
+		t.Error(err)
+	}
+	spec.Platform.OS = "windows"
+	if err := enableSwap(context.Background(), spec, nil, 1024); err != nil {
+		t.Error(err)
+	}
+	if spec.swap {
+		t.Errorf("Want swapfile not enabled")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/drone/runner-go/logger"
+)
+
+// teardownTimeout is the default time to wait for the teardown
+// script to complete.
+const teardownTimeout = time.Minute
+
+// ErrTeardownTimeout is returned when the teardown script does
+// not complete before the timeout.
+var ErrTeardownTimeout = errors.New("timeout waiting for the teardown script")
+
+// helper function executes the teardown script on the server
+// instance. The script is terminated, by closing the ssh
+// connection, if it does not complete before the timeout.
+// Errors are logged and returned.
+func (e *engine) teardown(ctx context.Context, spec *Spec) error {
+	log := logger.FromContext(ctx).
+		WithField("hostname", spec.Server.Name).
+		WithField("ip", spec.ip).
+		WithField("id", spec.id)
+
+	timeout := e.opts.TeardownTimeout
+	if timeout == 0 {
+		timeout = teardownTimeout
+	}
+
+	client, err := e.connect(spec.ip, spec.Server.User, e.opts.HandshakeTimeout, e.hostKeyCallback(spec))
+	if err != nil {
+		log.WithError(err).Warn("cannot connect to run the teardown script")
+		return err
+	}
+	defer client.Close()
+
+	log.Debug("running teardown script")
+
+	done := make(chan error, 1)
+	go func() {
+		out, err := execute(client, e.opts.TeardownScript)
+		if err != nil {
+			log.WithField("output", string(out)).
+				Trace("teardown script output")
+		}
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		err = ErrTeardownTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		log.WithError(err).Warn("teardown script failed")
+		return err
+	}
+	log.Debug("teardown script complete")
+	return nil
+}
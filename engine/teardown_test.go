@@ -0,0 +1,108 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+func TestDestroy_Teardown(t *testing.T) {
+	defer stubPlatform()()
+
+	dir, err := ioutil.TempDir("", "drone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "teardown")
+
+	engine, spec, closer := mockEngine(t, Opts{
+		TeardownScript: "echo done > " + path,
+	})
+	defer closer()
+
+	// the teardown script must complete before the server
+	// instance is destroyed.
+	var ran bool
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		_, err := os.Stat(path)
+		ran = err == nil
+		return nil
+	}
+	res, err := engine.Destroy(context.Background(), spec)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.Status != DestroyDeleted {
+		t.Errorf("Want status deleted, got %d", res.Status)
+	}
+	if !ran {
+		t.Errorf("Expect teardown script executed before the server instance is destroyed")
+	}
+}
+
+func TestDestroy_TeardownFailure(t *testing.T) {
+	defer stubPlatform()()
+	tests := []struct {
+		required bool
+		status   DestroyStatus
+		called   bool
+	}{
+		// the teardown failure is logged, and the server
+		// instance is destroyed.
+		{required: false, status: DestroyDeleted, called: true},
+		// the teardown failure prevents the server instance
+		// from being destroyed.
+		{required: true, status: DestroyFailed, called: false},
+	}
+	for _, test := range tests {
+		engine, spec, closer := mockEngine(t, Opts{
+			TeardownScript:   "exit 1",
+			TeardownRequired: test.required,
+		})
+		var called bool
+		destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+			called = true
+			return nil
+		}
+		res, err := engine.Destroy(context.Background(), spec)
+		closer()
+		if got, want := err != nil, test.required; got != want {
+			t.Errorf("Want error %v, got %v", want, err)
+		}
+		if res.Status != test.status {
+			t.Errorf("Want status %d, got %d", test.status, res.Status)
+		}
+		if called != test.called {
+			t.Errorf("Want destroy called %v, got %v", test.called, called)
+		}
+	}
+}
+
+func TestDestroy_TeardownTimeout(t *testing.T) {
+	defer stubPlatform()()
+	engine, spec, closer := mockEngine(t, Opts{
+		TeardownScript:   "sleep 5",
+		TeardownTimeout:  time.Millisecond * 100,
+		TeardownRequired: true,
+	})
+	defer closer()
+
+	destroy = func(ctx context.Context, args platform.DestroyArgs) error {
+		return nil
+	}
+	_, err := engine.Destroy(context.Background(), spec)
+	if err != ErrTeardownTimeout {
+		t.Errorf("Want teardown timeout error, got %v", err)
+	}
+}
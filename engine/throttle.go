@@ -0,0 +1,73 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"io"
+	"time"
+)
+
+// throttleWriter is an io.Writer that limits the rate at
+// which bytes are written to the underlying writer using a
+// token bucket. The bucket holds up to one second of tokens.
+type throttleWriter struct {
+	w      io.Writer
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	// now and sleep are declared as fields so that they can
+	// be replaced in unit tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// newThrottleWriter returns a writer that wraps writer w and
+// limits throughput to rate bytes per second.
+func newThrottleWriter(w io.Writer, rate int64) *throttleWriter {
+	return &throttleWriter{
+		w:      w,
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// Write writes p to the underlying writer in chunks, waiting
+// for the bucket to refill before each chunk is written.
+func (w *throttleWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := len(p)
+		if float64(chunk) > w.rate {
+			chunk = int(w.rate)
+		}
+		w.refill()
+		if need := float64(chunk) - w.tokens; need > 0 {
+			w.sleep(time.Duration(need / w.rate * float64(time.Second)))
+			w.refill()
+		}
+		m, err := w.w.Write(p[:chunk])
+		n += m
+		w.tokens -= float64(m)
+		if err != nil {
+			return n, err
+		}
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+// helper function adds tokens to the bucket for the time
+// elapsed since the bucket was last refilled.
+func (w *throttleWriter) refill() {
+	now := w.now()
+	w.tokens += now.Sub(w.last).Seconds() * w.rate
+	if w.tokens > w.rate {
+		w.tokens = w.rate
+	}
+	w.last = now
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestThrottleWriter(t *testing.T) {
+	clock := time.Unix(0, 0)
+	slept := time.Duration(0)
+
+	buf := new(bytes.Buffer)
+	w := newThrottleWriter(buf, 100)
+	w.last = clock
+	w.now = func() time.Time { return clock }
+	w.sleep = func(d time.Duration) {
+		slept += d
+		clock = clock.Add(d)
+	}
+
+	data := bytes.Repeat([]byte("a"), 1000)
+	n, err := w.Write(data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := n, len(data); got != want {
+		t.Errorf("Want %d bytes written, got %d", want, got)
+	}
+	if got, want := buf.Len(), len(data); got != want {
+		t.Errorf("Want %d bytes in buffer, got %d", want, got)
+	}
+
+	// the bucket starts full, so the first second of data
+	// is written immediately and the remainder is throttled.
+	if slept < 9*time.Second || slept > 9*time.Second+time.Millisecond {
+		t.Errorf("Want throttled for 9s, got %s", slept)
+	}
+}
+
+func TestThrottleWriter_Refill(t *testing.T) {
+	clock := time.Unix(0, 0)
+	slept := time.Duration(0)
+
+	w := newThrottleWriter(new(bytes.Buffer), 100)
+	w.last = clock
+	w.now = func() time.Time { return clock }
+	w.sleep = func(d time.Duration) {
+		slept += d
+		clock = clock.Add(d)
+	}
+
+	w.Write(bytes.Repeat([]byte("a"), 100))
+
+	// once the bucket has been idle long enough to refill,
+	// subsequent writes are not throttled.
+	clock = clock.Add(time.Second)
+	w.Write(bytes.Repeat([]byte("a"), 100))
+	if slept != 0 {
+		t.Errorf("Want no throttling after refill, got %s", slept)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"sort"
+	"strings"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -38,10 +39,14 @@ func writeSecrets(w io.Writer, os string, secrets []*Secret) {
 }
 
 // helper function writes a shell command to the io.Writer that
-// exports the key value pairs as environment variables.
-func writeEnviron(w io.Writer, os string, envs map[string]string) {
+// exports the key value pairs as environment variables. Only
+// variables permitted by the allow and deny lists are exported.
+func writeEnviron(w io.Writer, os string, envs map[string]string, allow, deny []string) {
 	var keys []string
 	for k := range envs {
+		if !permitEnv(k, allow, deny) {
+			continue
+		}
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
@@ -50,6 +55,61 @@ func writeEnviron(w io.Writer, os string, envs map[string]string) {
 	}
 }
 
+// isolatedPath is the PATH exported for steps that are isolated
+// from the pipeline environment, unless the step defines a PATH.
+const isolatedPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// helper function returns the environment of a step that is
+// isolated from the pipeline environment. A minimal PATH is
+// added unless the step defines a PATH.
+func isolateEnv(os string, envs map[string]string) map[string]string {
+	out := map[string]string{}
+	for k, v := range envs {
+		out[k] = v
+	}
+	if _, ok := out["PATH"]; !ok && os != "windows" {
+		out["PATH"] = isolatedPath
+	}
+	return out
+}
+
+// helper function returns the command that executes the step
+// command with an empty environment, so that the environment of
+// the ssh session is not inherited by isolated steps.
+func isolateCommand(os, cmd string) string {
+	if os == "windows" {
+		return cmd
+	}
+	return "env -i PATH=" + isolatedPath + " " + cmd
+}
+
+// helper function returns true if the environment variable
+// is permitted by the allow and deny lists. An empty allow
+// list permits all variables, and the deny list takes
+// precedence over the allow list.
+func permitEnv(name string, allow, deny []string) bool {
+	if matchEnv(name, deny) {
+		return false
+	}
+	return len(allow) == 0 || matchEnv(name, allow)
+}
+
+// helper function returns true if the environment variable
+// matches a name in the list. A name ending with an asterisk
+// matches by prefix.
+func matchEnv(name string, list []string) bool {
+	for _, pattern := range list {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
 // helper function writes a shell command to the io.Writer that
 // exports and key value pair as an environment variable.
 func writeEnv(w io.Writer, os, key, value string) {
@@ -63,6 +123,41 @@ func writeEnv(w io.Writer, os, key, value string) {
 	}
 }
 
+// helper function masks the secret values in the string. The
+// quoted form of the secret is masked as well, since secrets
+// are exported in the step script as quoted strings.
+func maskSecrets(s string, secrets []*Secret) string {
+	var oldnew []string
+	for _, secret := range secrets {
+		if len(secret.Data) == 0 {
+			continue
+		}
+		masked := fmt.Sprintf("[secret:%s]", strings.ToLower(secret.Name))
+		quoted := fmt.Sprintf("%q", secret.Data)
+		quoted = quoted[1 : len(quoted)-1]
+		oldnew = append(oldnew, string(secret.Data), masked)
+		if quoted != string(secret.Data) {
+			oldnew = append(oldnew, quoted, masked)
+		}
+	}
+	if len(oldnew) == 0 {
+		return s
+	}
+	return strings.NewReplacer(oldnew...).Replace(s)
+}
+
+// helper function returns a shell command for setting the
+// hostname that is compatible with the operating system. On
+// windows the new hostname takes effect after a restart.
+func hostnameCommand(os, name string) string {
+	switch os {
+	case "windows":
+		return fmt.Sprintf("powershell -noprofile -noninteractive -command \"Rename-Computer -NewName %s -Force\"", name)
+	default:
+		return fmt.Sprintf("hostnamectl set-hostname %s", name)
+	}
+}
+
 // helper function returns a shell command for removing a
 // directory that is compatible with the operating system.
 func removeCommand(os, path string) string {
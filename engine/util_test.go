@@ -59,7 +59,7 @@ func TestWriteSecrets(t *testing.T) {
 func TestWriteEnv(t *testing.T) {
 	buf := new(bytes.Buffer)
 	env := map[string]string{"a": "b", "c": "d"}
-	writeEnviron(buf, "linux", env)
+	writeEnviron(buf, "linux", env, nil, nil)
 
 	want := "export a=\"b\"\nexport c=\"d\"\n"
 	if got := buf.String(); got != want {
@@ -67,13 +67,91 @@ func TestWriteEnv(t *testing.T) {
 	}
 
 	buf.Reset()
-	writeEnviron(buf, "windows", env)
+	writeEnviron(buf, "windows", env, nil, nil)
 	want = "$Env:a = \"b\"\n$Env:c = \"d\"\n"
 	if got := buf.String(); got != want {
 		t.Errorf("Want environment script %q, got %q", want, got)
 	}
 }
 
+func TestMaskSecrets(t *testing.T) {
+	secrets := []*Secret{
+		{Name: "PASSWORD", Env: "PASSWORD", Data: []byte("correct-horse")},
+		{Name: "token", Env: "TOKEN", Data: []byte(`battery"staple`)},
+		{Name: "empty", Env: "EMPTY"},
+	}
+	buf := new(bytes.Buffer)
+	writeSecrets(buf, "linux", secrets)
+	buf.WriteString("echo correct-horse\n")
+
+	want := "export PASSWORD=\"[secret:password]\"\nexport TOKEN=\"[secret:token]\"\nexport EMPTY=\"\"\necho [secret:password]\n"
+	if got := maskSecrets(buf.String(), secrets); got != want {
+		t.Errorf("Want masked script %q, got %q", want, got)
+	}
+
+	if got, want := maskSecrets("echo hello", nil), "echo hello"; got != want {
+		t.Errorf("Want unmodified script %q, got %q", want, got)
+	}
+}
+
+func TestHostnameCommand(t *testing.T) {
+	got := hostnameCommand("linux", "build-01")
+	want := "hostnamectl set-hostname build-01"
+	if got != want {
+		t.Errorf("Want hostname script %q, got %q", want, got)
+	}
+
+	got = hostnameCommand("windows", "build-01")
+	want = `powershell -noprofile -noninteractive -command "Rename-Computer -NewName build-01 -Force"`
+	if got != want {
+		t.Errorf("Want hostname script %q, got %q", want, got)
+	}
+}
+
+func TestWriteEnv_Filter(t *testing.T) {
+	env := map[string]string{
+		"AWS_ACCESS_KEY":    "a",
+		"AWS_REGION":        "b",
+		"DRONE_BRANCH":      "c",
+		"DRONE_COMMIT":      "d",
+		"DRONE_NETRC_TOKEN": "e",
+		"GOPATH":            "f",
+	}
+	tests := []struct {
+		allow []string
+		deny  []string
+		want  string
+	}{
+		// default exports all variables.
+		{
+			want: "export AWS_ACCESS_KEY=\"a\"\nexport AWS_REGION=\"b\"\nexport DRONE_BRANCH=\"c\"\nexport DRONE_COMMIT=\"d\"\nexport DRONE_NETRC_TOKEN=\"e\"\nexport GOPATH=\"f\"\n",
+		},
+		// allow by prefix and exact name.
+		{
+			allow: []string{"DRONE_*", "GOPATH"},
+			want:  "export DRONE_BRANCH=\"c\"\nexport DRONE_COMMIT=\"d\"\nexport DRONE_NETRC_TOKEN=\"e\"\nexport GOPATH=\"f\"\n",
+		},
+		// deny by prefix and exact name.
+		{
+			deny: []string{"AWS_*", "DRONE_NETRC_TOKEN"},
+			want: "export DRONE_BRANCH=\"c\"\nexport DRONE_COMMIT=\"d\"\nexport GOPATH=\"f\"\n",
+		},
+		// deny takes precedence over allow.
+		{
+			allow: []string{"DRONE_*"},
+			deny:  []string{"DRONE_NETRC_*"},
+			want:  "export DRONE_BRANCH=\"c\"\nexport DRONE_COMMIT=\"d\"\n",
+		},
+	}
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		writeEnviron(buf, "linux", env, test.allow, test.deny)
+		if got := buf.String(); got != test.want {
+			t.Errorf("Want environment script %q, got %q", test.want, got)
+		}
+	}
+}
+
 func TestRemoveCommand(t *testing.T) {
 	got := removeCommand("linux", "/tmp/drone-temp")
 	want := "rm -rf /tmp/drone-temp"
@@ -87,3 +165,23 @@ func TestRemoveCommand(t *testing.T) {
 		t.Errorf("Want rm script %q, got %q", want, got)
 	}
 }
+
+func TestIsolateEnv(t *testing.T) {
+	envs := isolateEnv("linux", map[string]string{"GOOS": "linux"})
+	if got, want := envs["PATH"], isolatedPath; got != want {
+		t.Errorf("Want minimal path %q, got %q", want, got)
+	}
+	envs = isolateEnv("linux", map[string]string{"PATH": "/opt/bin"})
+	if got, want := envs["PATH"], "/opt/bin"; got != want {
+		t.Errorf("Want step path %q, got %q", want, got)
+	}
+	if _, ok := isolateEnv("windows", nil)["PATH"]; ok {
+		t.Errorf("Want path unchanged on windows")
+	}
+
+	got := isolateCommand("linux", "/bin/sh -e /tmp/drone-temp/opt/build")
+	want := "env -i PATH=" + isolatedPath + " /bin/sh -e /tmp/drone-temp/opt/build"
+	if got != want {
+		t.Errorf("Want isolated command %q, got %q", want, got)
+	}
+}
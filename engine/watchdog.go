@@ -0,0 +1,102 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+	"github.com/drone/runner-go/logger"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrInstanceOff is returned when the server instance stops
+// responding during pipeline execution and is powered off,
+// for example, because of a kernel panic.
+var ErrInstanceOff = errors.New("server instance is powered off")
+
+var (
+	// watchdogInterval is the interval at which the watchdog
+	// checks the server instance is responsive.
+	watchdogInterval = time.Second * 30
+
+	// watchdogTimeout is the time to wait for the server
+	// instance to respond to a keepalive request.
+	watchdogTimeout = time.Second * 15
+)
+
+// helper function starts a watchdog that periodically sends
+// keepalive requests to the server instance. If the server
+// instance does not respond, the digitalocean api is queried
+// for the server status. The returned channel receives an
+// error if the server instance has failed.
+func watchdog(ctx context.Context, spec *Spec, client *ssh.Client) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchdogInterval):
+			}
+			if keepalive(client, watchdogTimeout) {
+				continue
+			}
+			status, err := platform.Status(ctx, spec.id, spec.Token)
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("id", spec.id).
+				WithField("ip", spec.ip).
+				WithField("status", status).
+				Debug("server instance is unresponsive")
+			if err := diagnose(status, err); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	return errc
+}
+
+// helper function sends a keepalive request to the server
+// and returns true if the server responds before the timeout.
+func keepalive(client *ssh.Client, timeout time.Duration) bool {
+	done := make(chan error, 1)
+	go func() {
+		// the server is not required to support the request
+		// type, however, it is required to reply.
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// helper function returns an error if the status of an
+// unresponsive server instance indicates the server has
+// failed. A nil error is returned if the server is running
+// or the status cannot be determined, in which case the
+// server may recover.
+func diagnose(status string, err error) error {
+	switch {
+	case err == platform.ErrNotFound:
+		return ErrInstanceGone
+	case err != nil:
+		return nil
+	case status == "archive":
+		return ErrInstanceGone
+	case status == "off":
+		return ErrInstanceOff
+	default:
+		return nil
+	}
+}
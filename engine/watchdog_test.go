@@ -0,0 +1,51 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/drone-runners/drone-runner-digitalocean/internal/platform"
+)
+
+func TestDiagnose(t *testing.T) {
+	tests := []struct {
+		status string
+		err    error
+		want   error
+	}{
+		{status: "", err: platform.ErrNotFound, want: ErrInstanceGone},
+		{status: "archive", err: nil, want: ErrInstanceGone},
+		{status: "off", err: nil, want: ErrInstanceOff},
+		{status: "active", err: nil, want: nil},
+		{status: "new", err: nil, want: nil},
+		{status: "", err: errors.New("api error"), want: nil},
+	}
+	for _, test := range tests {
+		if got := diagnose(test.status, test.err); got != test.want {
+			t.Errorf("Want error %v for status %q, got %v", test.want, test.status, got)
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{})
+	defer closer()
+
+	client, err := engine.connect(spec.ip, spec.Server.User, 0, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !keepalive(client, time.Second) {
+		t.Errorf("Expect server responds to keepalive")
+	}
+	client.Close()
+	if keepalive(client, time.Second) {
+		t.Errorf("Expect closed connection fails keepalive")
+	}
+}
@@ -0,0 +1,474 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// truncatedMarker is written to the log when step output
+// exceeds the configured limit.
+const truncatedMarker = "\n[output truncated]\n"
+
+// limitWriter is an io.Writer that stops writing to the
+// underlying writer once the limit is reached. Writes beyond
+// the limit are silently discarded so that the remote session
+// is not interrupted.
+type limitWriter struct {
+	sync.Mutex
+
+	w         io.Writer
+	limit     int64
+	written   int64
+	truncated bool
+}
+
+// newLimitWriter returns a writer that wraps writer w and
+// limits output to n bytes.
+func newLimitWriter(w io.Writer, n int64) *limitWriter {
+	return &limitWriter{w: w, limit: n}
+}
+
+// Write writes p to the underlying writer until the limit is
+// reached, at which point a marker is written and all
+// subsequent output is discarded.
+func (w *limitWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.truncated {
+		return len(p), nil
+	}
+	if remain := w.limit - w.written; int64(len(p)) > remain {
+		w.truncated = true
+		if _, err := w.w.Write(p[:remain]); err != nil {
+			return 0, err
+		}
+		w.written = w.limit
+		_, err := io.WriteString(w.w, truncatedMarker)
+		return len(p), err
+	}
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Truncated returns true if output exceeded the limit.
+func (w *limitWriter) Truncated() bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.truncated
+}
+
+// tailWriter is an io.Writer that retains the most recent
+// lines written, discarding older lines.
+type tailWriter struct {
+	sync.Mutex
+
+	lines   []string
+	size    int
+	next    int
+	full    bool
+	partial []byte
+}
+
+// newTailWriter returns a writer that retains the last n
+// lines written.
+func newTailWriter(n int) *tailWriter {
+	return &tailWriter{lines: make([]string, n), size: n}
+}
+
+// Write writes p to the ring buffer, one line at a time.
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	data := append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			break
+		}
+		w.push(string(data[:i]))
+		data = data[i+1:]
+	}
+	w.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// Lines returns the retained lines, oldest first. A trailing
+// line that is not terminated by a newline is included.
+func (w *tailWriter) Lines() []string {
+	w.Lock()
+	defer w.Unlock()
+	var lines []string
+	if w.full {
+		lines = append(lines, w.lines[w.next:]...)
+	}
+	lines = append(lines, w.lines[:w.next]...)
+	if len(w.partial) != 0 {
+		lines = append(lines, string(w.partial))
+		if len(lines) > w.size {
+			lines = lines[1:]
+		}
+	}
+	return lines
+}
+
+// helper function adds the line to the ring buffer.
+func (w *tailWriter) push(line string) {
+	w.lines[w.next] = line
+	w.next++
+	if w.next == w.size {
+		w.next = 0
+		w.full = true
+	}
+}
+
+// crlfWriter is an io.Writer that replaces CRLF line endings
+// with LF. A carriage return that is not followed by a line
+// feed is written unchanged.
+type crlfWriter struct {
+	sync.Mutex
+
+	w  io.Writer
+	cr bool // Trailing carriage return held from the previous write.
+}
+
+// newCRLFWriter returns a writer that wraps writer w and
+// normalizes CRLF line endings to LF.
+func newCRLFWriter(w io.Writer) *crlfWriter {
+	return &crlfWriter{w: w}
+}
+
+// Write writes p to the underlying writer, replacing CRLF
+// line endings with LF. A trailing carriage return is held
+// until the next write, since the line feed may be split
+// across writes.
+func (w *crlfWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	buf := make([]byte, 0, len(p)+1)
+	if w.cr {
+		w.cr = false
+		if p[0] != '\n' {
+			buf = append(buf, '\r')
+		}
+	}
+	for i, b := range p {
+		if b != '\r' {
+			buf = append(buf, b)
+			continue
+		}
+		if i == len(p)-1 {
+			w.cr = true
+		} else if p[i+1] != '\n' {
+			buf = append(buf, b)
+		}
+	}
+	if _, err := w.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the carriage return held from the previous
+// write, if any, to the underlying writer.
+func (w *crlfWriter) Flush() error {
+	w.Lock()
+	defer w.Unlock()
+	if !w.cr {
+		return nil
+	}
+	w.cr = false
+	_, err := w.w.Write([]byte{'\r'})
+	return err
+}
+
+// prefixWriter is an io.Writer that prefixes every line with
+// the prefix, for example, to identify the step that produced
+// the line when the output of multiple steps is aggregated.
+type prefixWriter struct {
+	sync.Mutex
+
+	w       io.Writer
+	prefix  []byte
+	partial bool // Previous write ended with a partial line.
+}
+
+// newPrefixWriter returns a writer that wraps writer w and
+// prefixes every line with the prefix.
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+// Write writes p to the underlying writer, inserting the prefix
+// at the start of every line. A line that is split across
+// writes is only prefixed once.
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	buf := make([]byte, 0, len(p)+len(w.prefix))
+	for _, line := range bytes.SplitAfter(p, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		if !w.partial {
+			buf = append(buf, w.prefix...)
+		}
+		buf = append(buf, line...)
+		w.partial = line[len(line)-1] != '\n'
+	}
+	if _, err := w.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// trailerWriter is an io.Writer that writes a trailer line once
+// the step completes, for example, so that log processors can
+// delimit step boundaries in the aggregated output.
+type trailerWriter struct {
+	sync.Mutex
+
+	w       io.Writer
+	partial bool // Previous write ended with a partial line.
+}
+
+// newTrailerWriter returns a writer that wraps writer w and
+// tracks whether the output ends with a partial line.
+func newTrailerWriter(w io.Writer) *trailerWriter {
+	return &trailerWriter{w: w}
+}
+
+// Write writes p to the underlying writer.
+func (w *trailerWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.partial = p[n-1] != '\n'
+	}
+	return n, err
+}
+
+// Trailer writes the trailer line to the underlying writer,
+// replacing the {step} and {exit} placeholders in the format
+// with the step name and exit code. The trailer is written on
+// a new line if the output ends with a partial line.
+func (w *trailerWriter) Trailer(format, name string, code int) error {
+	w.Lock()
+	defer w.Unlock()
+	line := strings.NewReplacer(
+		"{step}", name,
+		"{exit}", strconv.Itoa(code),
+	).Replace(format) + "\n"
+	if w.partial {
+		line = "\n" + line
+	}
+	w.partial = false
+	_, err := io.WriteString(w.w, line)
+	return err
+}
+
+// utf8Writer is an io.Writer that replaces invalid UTF-8
+// sequences with the unicode replacement character. Valid
+// output is written unchanged.
+type utf8Writer struct {
+	sync.Mutex
+
+	w       io.Writer
+	partial []byte // Incomplete trailing sequence held from the previous write.
+}
+
+// newUTF8Writer returns a writer that wraps writer w and
+// replaces invalid UTF-8 sequences.
+func newUTF8Writer(w io.Writer) *utf8Writer {
+	return &utf8Writer{w: w}
+}
+
+// Write writes p to the underlying writer, replacing invalid
+// UTF-8 sequences. An incomplete trailing sequence is held
+// until the next write, since a multi-byte character may be
+// split across writes.
+func (w *utf8Writer) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	data := append(w.partial, p...)
+	buf := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			break
+		}
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, string(utf8.RuneError)...)
+		} else {
+			buf = append(buf, data[:size]...)
+		}
+		data = data[size:]
+	}
+	w.partial = append([]byte(nil), data...)
+	if _, err := w.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the incomplete sequence held from the previous
+// write, if any, to the underlying writer as a replacement
+// character.
+func (w *utf8Writer) Flush() error {
+	w.Lock()
+	defer w.Unlock()
+	if len(w.partial) == 0 {
+		return nil
+	}
+	w.partial = nil
+	_, err := io.WriteString(w.w, string(utf8.RuneError))
+	return err
+}
+
+// flusher is implemented by writers that buffer output and
+// return an error if the buffered output cannot be flushed.
+type flusher interface {
+	Flush() error
+}
+
+// httpFlusher is implemented by writers that buffer output,
+// such as the http.Flusher interface.
+type httpFlusher interface {
+	Flush()
+}
+
+// flushWriter is an io.Writer that flushes the underlying
+// writer after every write, so that step output is visible in
+// the live log as soon as it is written.
+type flushWriter struct {
+	sync.Mutex
+
+	w     io.Writer
+	flush func() error
+}
+
+// newFlushWriter returns a writer that wraps writer w and
+// flushes w after every write. If w does not buffer output,
+// w is returned unchanged.
+func newFlushWriter(w io.Writer) io.Writer {
+	switch f := w.(type) {
+	case flusher:
+		return &flushWriter{w: w, flush: f.Flush}
+	case httpFlusher:
+		return &flushWriter{w: w, flush: func() error {
+			f.Flush()
+			return nil
+		}}
+	default:
+		return w
+	}
+}
+
+// Write writes p to the underlying writer and then flushes
+// the underlying writer.
+func (w *flushWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	n, err := w.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.flush()
+}
+
+// defaultFlushInterval is the default interval at which the
+// buffered step output is flushed.
+const defaultFlushInterval = time.Second
+
+// bufferWriter is an io.Writer that buffers the step output to
+// reduce the number of small writes to the underlying writer.
+// The buffered output is flushed on an interval, so that the
+// step output remains reasonably live, and when the writer is
+// stopped.
+type bufferWriter struct {
+	sync.Mutex
+
+	w    *bufio.Writer
+	err  error
+	done chan struct{}
+	once sync.Once
+}
+
+// newBufferWriter returns a writer that buffers up to size
+// bytes of output written to w, and flushes the buffered
+// output on the interval. The writer must be stopped to flush
+// the remaining output.
+func newBufferWriter(w io.Writer, size int, interval time.Duration) *bufferWriter {
+	if interval <= 0 {
+		interval = defaultFlushInterval
+	}
+	b := &bufferWriter{
+		w:    bufio.NewWriterSize(w, size),
+		done: make(chan struct{}),
+	}
+	go b.flushEvery(interval)
+	return b
+}
+
+// Write writes p to the buffer. If the buffer is full, the
+// buffered output is written to the underlying writer.
+func (b *bufferWriter) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.w.Write(p)
+}
+
+// Flush writes the buffered output to the underlying writer.
+func (b *bufferWriter) Flush() error {
+	b.Lock()
+	defer b.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	b.err = b.w.Flush()
+	return b.err
+}
+
+// Stop stops the flush interval and flushes the remaining
+// buffered output.
+func (b *bufferWriter) Stop() error {
+	b.once.Do(func() {
+		close(b.done)
+	})
+	return b.Flush()
+}
+
+// helper function flushes the buffered output on the interval
+// until the writer is stopped.
+func (b *bufferWriter) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.Flush()
+		}
+	}
+}
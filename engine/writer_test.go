@@ -0,0 +1,278 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLimitWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := newLimitWriter(buf, 10)
+
+	for i := 0; i < 1000; i++ {
+		if _, err := w.Write([]byte("hello\n")); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	want := "hello\nhell" + truncatedMarker
+	if got := buf.String(); got != want {
+		t.Errorf("Want truncated output %q, got %q", want, got)
+	}
+	if !w.Truncated() {
+		t.Errorf("Expect output truncated")
+	}
+}
+
+func TestLimitWriter_UnderLimit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := newLimitWriter(buf, 10)
+	w.Write([]byte("hello"))
+	w.Write([]byte("world"))
+
+	if got, want := buf.String(), "helloworld"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+	if w.Truncated() {
+		t.Errorf("Expect output not truncated")
+	}
+	if strings.Contains(buf.String(), truncatedMarker) {
+		t.Errorf("Expect no truncated marker")
+	}
+}
+
+func TestTailWriter(t *testing.T) {
+	w := newTailWriter(3)
+	io.WriteString(w, "line 1\nline 2\nli")
+	io.WriteString(w, "ne 3\nline 4\nline 5\n")
+
+	want := []string{"line 3", "line 4", "line 5"}
+	if diff := cmp.Diff(w.Lines(), want); diff != "" {
+		t.Errorf("Unexpected tail lines")
+		t.Log(diff)
+	}
+
+	// an unterminated trailing line is included.
+	io.WriteString(w, "line 6")
+	want = []string{"line 4", "line 5", "line 6"}
+	if diff := cmp.Diff(w.Lines(), want); diff != "" {
+		t.Errorf("Unexpected tail lines")
+		t.Log(diff)
+	}
+}
+
+func TestTailWriter_NotFull(t *testing.T) {
+	w := newTailWriter(3)
+	io.WriteString(w, "line 1\n")
+
+	want := []string{"line 1"}
+	if diff := cmp.Diff(w.Lines(), want); diff != "" {
+		t.Errorf("Unexpected tail lines")
+		t.Log(diff)
+	}
+}
+
+func TestCRLFWriter(t *testing.T) {
+	tests := []struct {
+		writes []string
+		want   string
+	}{
+		{[]string{"hello\r\nworld\r\n"}, "hello\nworld\n"},
+		{[]string{"hello\r", "\nworld\r", "\n"}, "hello\nworld\n"},
+		{[]string{"hello\r", "world"}, "hello\rworld"},
+		{[]string{"progress 1\rprogress 2\r\n"}, "progress 1\rprogress 2\n"},
+		{[]string{"\r", "\r", "\n"}, "\r\n"},
+		{[]string{"\x00\r\xff\r"}, "\x00\r\xff\r"},
+	}
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		w := newCRLFWriter(buf)
+		for _, s := range test.writes {
+			if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+				t.Errorf("Want %d bytes written, got %d, %v", len(s), n, err)
+			}
+		}
+		w.Flush()
+		if got := buf.String(); got != test.want {
+			t.Errorf("Want output %q, got %q", test.want, got)
+		}
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	tests := []struct {
+		writes []string
+		want   string
+	}{
+		{[]string{"hello\nworld\n"}, "[build] hello\n[build] world\n"},
+		{[]string{"hel", "lo\nwor", "ld\n"}, "[build] hello\n[build] world\n"},
+		{[]string{"hello\n", "\n", "world"}, "[build] hello\n[build] \n[build] world"},
+		{[]string{"", "hello"}, "[build] hello"},
+	}
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		w := newPrefixWriter(buf, "[build] ")
+		for _, s := range test.writes {
+			if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+				t.Errorf("Want %d bytes written, got %d, %v", len(s), n, err)
+			}
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("Want output %q, got %q", test.want, got)
+		}
+	}
+}
+
+func TestTrailerWriter(t *testing.T) {
+	tests := []struct {
+		writes []string
+		want   string
+	}{
+		{[]string{"hello\n"}, "hello\n[build exit=1]\n"},
+		{[]string{"hello"}, "hello\n[build exit=1]\n"},
+		{nil, "[build exit=1]\n"},
+	}
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		w := newTrailerWriter(buf)
+		for _, s := range test.writes {
+			w.Write([]byte(s))
+		}
+		if err := w.Trailer("[{step} exit={exit}]", "build", 1); err != nil {
+			t.Error(err)
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("Want output %q, got %q", test.want, got)
+		}
+	}
+}
+
+func TestUTF8Writer(t *testing.T) {
+	tests := []struct {
+		writes []string
+		want   string
+	}{
+		{[]string{"hello world\n"}, "hello world\n"},
+		{[]string{"caf\xc3\xa9 \xe2\x82\xac\n"}, "caf\u00e9 \u20ac\n"},
+		{[]string{"caf\xc3", "\xa9"}, "caf\u00e9"},
+		{[]string{"\xe2", "\x82", "\xac"}, "\u20ac"},
+		{[]string{"\xff\xfehello"}, "\ufffd\ufffdhello"},
+		{[]string{"caf\xe9\n"}, "caf\ufffd\n"},
+		{[]string{"\xe2\x82", "A"}, "\ufffd\ufffdA"},
+		{[]string{"hello\xe2\x82"}, "hello\ufffd"},
+	}
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		w := newUTF8Writer(buf)
+		for _, s := range test.writes {
+			if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+				t.Errorf("Want %d bytes written, got %d, %v", len(s), n, err)
+			}
+		}
+		w.Flush()
+		if got := buf.String(); got != test.want {
+			t.Errorf("Want output %q, got %q", test.want, got)
+		}
+	}
+}
+
+// flushBuffer is a buffer that records the length of the
+// buffered output each time it is flushed.
+type flushBuffer struct {
+	syncBuffer
+	flushed []int
+}
+
+func (b *flushBuffer) Flush() error {
+	b.mu.Lock()
+	b.flushed = append(b.flushed, b.buf.Len())
+	b.mu.Unlock()
+	return nil
+}
+
+func TestFlushWriter(t *testing.T) {
+	buf := new(flushBuffer)
+	w := newFlushWriter(buf)
+	w.Write([]byte("hello\n"))
+	w.Write([]byte("world\n"))
+	if diff := cmp.Diff(buf.flushed, []int{6, 12}); diff != "" {
+		t.Errorf("Expect output flushed after every write")
+		t.Log(diff)
+	}
+}
+
+func TestFlushWriter_NotBuffered(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if w := newFlushWriter(buf); w != io.Writer(buf) {
+		t.Errorf("Expect unbuffered writer returned unchanged")
+	}
+}
+
+func TestBufferWriter(t *testing.T) {
+	buf := new(syncBuffer)
+	w := newBufferWriter(buf, 1024, time.Millisecond*50)
+	defer w.Stop()
+
+	// small writes are buffered until the flush interval.
+	io.WriteString(w, "hello ")
+	io.WriteString(w, "world\n")
+	if got := buf.String(); got != "" {
+		t.Errorf("Want output buffered, got %q", got)
+	}
+	time.Sleep(time.Millisecond * 150)
+	if got, want := buf.String(), "hello world\n"; got != want {
+		t.Errorf("Want output flushed on interval %q, got %q", want, got)
+	}
+
+	// the remaining output is flushed when the writer is
+	// stopped.
+	io.WriteString(w, "goodbye\n")
+	w.Stop()
+	if got, want := buf.String(), "hello world\ngoodbye\n"; got != want {
+		t.Errorf("Want output flushed when stopped %q, got %q", want, got)
+	}
+}
+
+func TestBufferWriter_Full(t *testing.T) {
+	buf := new(syncBuffer)
+	w := newBufferWriter(buf, 4, time.Hour)
+	defer w.Stop()
+
+	// output that exceeds the buffer size is written to the
+	// underlying writer without waiting for the interval.
+	io.WriteString(w, "hello\n")
+	if got, want := buf.String(), "hello\n"; got != want {
+		t.Errorf("Want output written %q, got %q", want, got)
+	}
+}
+
+func TestRun_OutputBuffer(t *testing.T) {
+	engine, spec, closer := mockEngine(t, Opts{
+		OutputBufferSize:    4096,
+		OutputFlushInterval: time.Hour,
+	})
+	defer closer()
+
+	// the buffered output is flushed when the step completes,
+	// before the flush interval elapses.
+	step := &Step{Name: "build", Command: "echo", Args: []string{"hello"}}
+	buf := new(syncBuffer)
+	if _, err := engine.Run(context.Background(), spec, step, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := buf.String(), "hello\n"; got != want {
+		t.Errorf("Want output %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/drone/runner-go/logger"
+
+	"github.com/digitalocean/godo"
+)
+
+// the maximum time to wait between polling the digitalocean
+// api for action status updates. The polling interval is
+// doubled after every poll, starting at actionInterval.
+var actionMaxInterval = time.Minute
+
+// the time to wait for an action to complete.
+var actionTimeout = time.Minute * 30
+
+// ErrActionTimeout is returned when an action does not
+// complete before the timeout.
+var ErrActionTimeout = errors.New("timeout waiting for action")
+
+// ActionError is returned when an action does not complete
+// successfully.
+type ActionError struct {
+	ID     int
+	Type   string
+	Status string
+}
+
+func (e *ActionError) Error() string {
+	return fmt.Sprintf("%s action %d %s", e.Type, e.ID, e.Status)
+}
+
+// WaitForAction blocks until the action is complete, or
+// returns an error if the action errored or does not complete
+// before the timeout.
+func WaitForAction(ctx context.Context, id int, token string) error {
+	client := newClient(ctx, token)
+	action, _, err := client.Actions.Get(ctx, id)
+	if err != nil {
+		logger.FromContext(ctx).
+			WithError(err).
+			WithField("action", id).
+			Error("cannot find action")
+		return err
+	}
+	return waitForAction(ctx, client, action)
+}
+
+// helper function polls the digitalocean api for action status
+// updates, with backoff, until the action is no longer in
+// progress.
+func waitForAction(ctx context.Context, client *godo.Client, action *godo.Action) error {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, actionTimeout)
+	defer cancel()
+
+	logger := logger.FromContext(ctx).
+		WithField("action", action.ID).
+		WithField("type", action.Type)
+
+	var err error
+	interval := actionInterval
+	for action.Status == godo.ActionInProgress {
+		logger.Trace("waiting for action")
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > actionMaxInterval {
+			interval = actionMaxInterval
+		}
+		if ctx.Err() == nil {
+			action, _, err = client.Actions.Get(ctx, action.ID)
+		}
+		// the request may fail because the context is done,
+		// in which case the context error takes precedence.
+		switch {
+		case parent.Err() != nil:
+			return parent.Err()
+		case ctx.Err() != nil:
+			logger.Error("timeout waiting for action")
+			return ErrActionTimeout
+		case err != nil:
+			logger.WithError(err).Error("cannot find action")
+			return err
+		}
+	}
+	if action.Status != godo.ActionCompleted {
+		logger.WithField("status", action.Status).
+			Error("action failed")
+		return &ActionError{
+			ID:     action.ID,
+			Type:   action.Type,
+			Status: action.Status,
+		}
+	}
+	return nil
+}
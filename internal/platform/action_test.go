@@ -0,0 +1,99 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitForAction(t *testing.T) {
+	defer mockActionInterval()()
+
+	var polls int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/actions/2", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&polls, 1) < 3 {
+			io.WriteString(w, `{"action":{"id":2,"status":"in-progress","type":"snapshot"}}`)
+			return
+		}
+		io.WriteString(w, `{"action":{"id":2,"status":"completed","type":"snapshot"}}`)
+	})
+	defer mockServer(mux)()
+
+	if err := WaitForAction(context.Background(), 2, "token"); err != nil {
+		t.Error(err)
+	}
+	if got, want := atomic.LoadInt32(&polls), int32(3); got != want {
+		t.Errorf("Want action polled %d times, got %d", want, got)
+	}
+}
+
+func TestWaitForAction_Errored(t *testing.T) {
+	defer mockActionInterval()()
+
+	var polls int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/actions/2", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&polls, 1) < 2 {
+			io.WriteString(w, `{"action":{"id":2,"status":"in-progress","type":"power_off"}}`)
+			return
+		}
+		io.WriteString(w, `{"action":{"id":2,"status":"errored","type":"power_off"}}`)
+	})
+	defer mockServer(mux)()
+
+	err := WaitForAction(context.Background(), 2, "token")
+	actionerr, ok := err.(*ActionError)
+	if !ok {
+		t.Errorf("Want action error, got %v", err)
+		return
+	}
+	if actionerr.Type != "power_off" || actionerr.Status != "errored" {
+		t.Errorf("Unexpected action error %v", actionerr)
+	}
+	if got, want := err.Error(), "power_off action 2 errored"; got != want {
+		t.Errorf("Want error message %q, got %q", want, got)
+	}
+}
+
+func TestWaitForAction_Timeout(t *testing.T) {
+	defer mockActionInterval()()
+	restore := actionTimeout
+	actionTimeout = time.Millisecond * 20
+	defer func() {
+		actionTimeout = restore
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/actions/2", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"action":{"id":2,"status":"in-progress","type":"resize"}}`)
+	})
+	defer mockServer(mux)()
+
+	if err := WaitForAction(context.Background(), 2, "token"); err != ErrActionTimeout {
+		t.Errorf("Want error %v, got %v", ErrActionTimeout, err)
+	}
+}
+
+func TestWaitForAction_Canceled(t *testing.T) {
+	defer mockActionInterval()()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/actions/2", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"action":{"id":2,"status":"in-progress","type":"resize"}}`)
+	})
+	defer mockServer(mux)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if err := WaitForAction(ctx, 2, "token"); err != context.DeadlineExceeded {
+		t.Errorf("Want error %v, got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/drone/runner-go/logger"
+
+	"github.com/digitalocean/godo"
+)
+
+// DefaultCatalogTTL is the default time the catalog is cached
+// before it is refreshed.
+const DefaultCatalogTTL = time.Hour
+
+// Catalog caches the digitalocean regions, sizes and images,
+// which rarely change, to avoid querying the digitalocean api
+// for every build. The catalog is fetched on first use, and is
+// refreshed when the cached catalog is older than the ttl. The
+// catalog is safe for concurrent use.
+type Catalog struct {
+	sync.Mutex
+
+	token   string
+	ttl     time.Duration
+	fetched time.Time
+
+	regions []godo.Region
+	sizes   []godo.Size
+	images  []godo.Image
+}
+
+// NewCatalog returns a new catalog. If the ttl is zero, the
+// default ttl is used.
+func NewCatalog(token string, ttl time.Duration) *Catalog {
+	if ttl == 0 {
+		ttl = DefaultCatalogTTL
+	}
+	return &Catalog{token: token, ttl: ttl}
+}
+
+// Regions returns the cached regions.
+func (c *Catalog) Regions(ctx context.Context) ([]godo.Region, error) {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.load(ctx); err != nil {
+		return nil, err
+	}
+	return c.regions, nil
+}
+
+// Sizes returns the cached sizes.
+func (c *Catalog) Sizes(ctx context.Context) ([]godo.Size, error) {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.load(ctx); err != nil {
+		return nil, err
+	}
+	return c.sizes, nil
+}
+
+// Images returns the cached images.
+func (c *Catalog) Images(ctx context.Context) ([]godo.Image, error) {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.load(ctx); err != nil {
+		return nil, err
+	}
+	return c.images, nil
+}
+
+// Refresh fetches the catalog, regardless of the ttl.
+func (c *Catalog) Refresh(ctx context.Context) error {
+	c.Lock()
+	defer c.Unlock()
+	return c.fetch(ctx)
+}
+
+// helper function fetches the catalog if the catalog was not
+// fetched or the cached catalog is older than the ttl. The
+// caller must hold the lock.
+func (c *Catalog) load(ctx context.Context) error {
+	if !c.fetched.IsZero() && now().Sub(c.fetched) < c.ttl {
+		return nil
+	}
+	return c.fetch(ctx)
+}
+
+// helper function fetches the regions, sizes and images. The
+// cached catalog is only replaced if every list succeeds. The
+// caller must hold the lock.
+func (c *Catalog) fetch(ctx context.Context) error {
+	logger := logger.FromContext(ctx)
+	client := newClient(ctx, c.token)
+
+	var regions []godo.Region
+	err := paginate(func(opts *godo.ListOptions) (*godo.Response, error) {
+		page, res, err := client.Regions.List(ctx, opts)
+		regions = append(regions, page...)
+		return res, err
+	})
+	if err != nil {
+		logger.WithError(err).Error("cannot list regions")
+		return err
+	}
+
+	var sizes []godo.Size
+	err = paginate(func(opts *godo.ListOptions) (*godo.Response, error) {
+		page, res, err := client.Sizes.List(ctx, opts)
+		sizes = append(sizes, page...)
+		return res, err
+	})
+	if err != nil {
+		logger.WithError(err).Error("cannot list instance sizes")
+		return err
+	}
+
+	var images []godo.Image
+	err = paginate(func(opts *godo.ListOptions) (*godo.Response, error) {
+		page, res, err := client.Images.List(ctx, opts)
+		images = append(images, page...)
+		return res, err
+	})
+	if err != nil {
+		logger.WithError(err).Error("cannot list images")
+		return err
+	}
+
+	c.regions = regions
+	c.sizes = sizes
+	c.images = images
+	c.fetched = now()
+
+	logger.WithField("regions", len(regions)).
+		WithField("sizes", len(sizes)).
+		WithField("images", len(images)).
+		Debug("catalog fetched")
+	return nil
+}
+
+// helper function invokes the list function for every page
+// of results.
+func paginate(list func(*godo.ListOptions) (*godo.Response, error)) error {
+	opts := &godo.ListOptions{PerPage: 200}
+	for {
+		res, err := list(opts)
+		if err != nil {
+			return err
+		}
+		if res.Links == nil || res.Links.IsLastPage() {
+			return nil
+		}
+		page, err := res.Links.CurrentPage()
+		if err != nil {
+			return err
+		}
+		opts.Page = page + 1
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCatalog(t *testing.T) {
+	handler, calls := mockCatalogHandler()
+	defer mockServer(handler)()
+
+	// the catalog is fetched once, and is shared by
+	// concurrent callers.
+	catalog := NewCatalog("token", time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := catalog.Sizes(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	regions, err := catalog.Regions(context.Background())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(regions) != 2 || regions[0].Slug != "nyc1" {
+		t.Errorf("Unexpected regions %v", regions)
+	}
+	sizes, err := catalog.Sizes(context.Background())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(sizes) != 1 || sizes[0].Slug != "s-1vcpu-1gb" {
+		t.Errorf("Unexpected sizes %v", sizes)
+	}
+	images, err := catalog.Images(context.Background())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(images) != 1 || images[0].Slug != "docker-18-04" {
+		t.Errorf("Unexpected images %v", images)
+	}
+	if got := calls("/v2/sizes"); got != 1 {
+		t.Errorf("Want catalog fetched once, got %d", got)
+	}
+}
+
+func TestCatalog_Refresh(t *testing.T) {
+	defer func() {
+		now = time.Now
+	}()
+	current := time.Now()
+	now = func() time.Time {
+		return current
+	}
+
+	handler, calls := mockCatalogHandler()
+	defer mockServer(handler)()
+
+	catalog := NewCatalog("token", time.Minute)
+	if _, err := catalog.Sizes(context.Background()); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the cached catalog is used until the ttl expires.
+	current = current.Add(time.Second * 30)
+	catalog.Sizes(context.Background())
+	if got := calls("/v2/sizes"); got != 1 {
+		t.Errorf("Want cached catalog used, got %d requests", got)
+	}
+
+	// the catalog is refreshed when the ttl expires.
+	current = current.Add(time.Minute)
+	catalog.Sizes(context.Background())
+	if got := calls("/v2/sizes"); got != 2 {
+		t.Errorf("Want catalog refreshed, got %d requests", got)
+	}
+
+	// the catalog is refreshed on demand.
+	if err := catalog.Refresh(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if got := calls("/v2/sizes"); got != 3 {
+		t.Errorf("Want catalog refreshed, got %d requests", got)
+	}
+}
+
+func TestCatalog_Error(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/regions", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		io.WriteString(w, `{"id":"server_error","message":"Server error"}`)
+	})
+	defer mockServer(mux)()
+
+	catalog := NewCatalog("token", 0)
+	if _, err := catalog.Sizes(context.Background()); err == nil {
+		t.Errorf("Expect error fetching the catalog")
+	}
+	if !catalog.fetched.IsZero() {
+		t.Errorf("Expect catalog not cached on error")
+	}
+}
+
+func TestResize_Catalog(t *testing.T) {
+	handler, calls := mockCatalogHandler()
+	defer mockServer(handler)()
+
+	catalog := NewCatalog("token", time.Hour)
+	if err := catalog.Refresh(context.Background()); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the resize is validated using the cached sizes. The
+	// size is not in the catalog, and the resize is rejected
+	// without listing the sizes.
+	err := Resize(context.Background(), ResizeArgs{
+		ID:      1,
+		Size:    "s-2vcpu-2gb",
+		Catalog: catalog,
+	})
+	if err == nil {
+		t.Errorf("Expect error when the size is not in the catalog")
+	}
+	if got := calls("/v2/sizes"); got != 1 {
+		t.Errorf("Want cached sizes used, got %d requests", got)
+	}
+}
+
+// helper function returns a mock api handler that serves the
+// regions, sizes and images. The returned function returns the
+// number of requests to the path.
+func mockCatalogHandler() (http.Handler, func(string) int) {
+	var mu sync.Mutex
+	counts := map[string]int{}
+	count := func(path string, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			counts[path]++
+			mu.Unlock()
+			io.WriteString(w, body)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/regions", count("/v2/regions", `{"regions":[{"slug":"nyc1"},{"slug":"sfo2"}]}`))
+	mux.HandleFunc("/v2/sizes", count("/v2/sizes", `{"sizes":[{"slug":"s-1vcpu-1gb","disk":25}]}`))
+	mux.HandleFunc("/v2/images", count("/v2/images", `{"images":[{"id":1,"slug":"docker-18-04"}]}`))
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":1,"disk":25,"size_slug":"s-1vcpu-1gb"}}`)
+	})
+	return mux, func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return counts[path]
+	}
+}
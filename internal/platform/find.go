@@ -0,0 +1,69 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"errors"
+
+	"github.com/drone/runner-go/logger"
+
+	"github.com/digitalocean/godo"
+)
+
+// ErrDuplicateName is returned when more than one server
+// instance in the account matches the name.
+var ErrDuplicateName = errors.New("multiple instances found with name")
+
+// FindByName returns the server instance with the matching
+// name. If the server instance does not exist, ErrNotFound is
+// returned. If more than one server instance matches the name,
+// ErrDuplicateName is returned. The Owned field reports whether
+// the server instance carries the runner tag.
+func FindByName(ctx context.Context, name, token string) (*Instance, error) {
+	client := newClient(ctx, token)
+	opts := &godo.ListOptions{PerPage: 200}
+
+	var found *Instance
+	for {
+		page, res, err := client.Droplets.List(ctx, opts)
+		if err != nil {
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("name", name).
+				Error("cannot list instances")
+			return nil, err
+		}
+		for _, droplet := range page {
+			if droplet.Name != name {
+				continue
+			}
+			if found != nil {
+				logger.FromContext(ctx).
+					WithField("name", name).
+					WithField("id", found.ID).
+					WithField("duplicate", droplet.ID).
+					Warn("multiple instances found with name")
+				return nil, ErrDuplicateName
+			}
+			found = &Instance{ID: droplet.ID}
+			found.IP, _ = droplet.PublicIPv4()
+			found.PrivateIP, _ = droplet.PrivateIPv4()
+			found.Owned = hasTag(droplet.Tags, runnerTag)
+		}
+		if res.Links == nil || res.Links.IsLastPage() {
+			break
+		}
+		current, err := res.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opts.Page = current + 1
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// helper function returns a mock handler that lists the
+// droplets in the account across two pages.
+func mockDroplets() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("page") == "2" {
+			io.WriteString(w, `{"droplets":[{"id":3,"name":"drone-temp-baz","tags":["drone"],"networks":{"v4":[{"ip_address":"10.0.0.3","type":"private"},{"ip_address":"1.2.3.6","type":"public"}]}},{"id":4,"name":"drone-temp-bar"}],"links":{"pages":{"prev":"https://api.digitalocean.com/v2/droplets?page=1"}}}`)
+			return
+		}
+		io.WriteString(w, `{"droplets":[{"id":1,"name":"drone-temp-foo","networks":{"v4":[{"ip_address":"1.2.3.4","type":"public"}]}},{"id":2,"name":"drone-temp-bar"}],"links":{"pages":{"next":"https://api.digitalocean.com/v2/droplets?page=2","last":"https://api.digitalocean.com/v2/droplets?page=2"}}}`)
+	})
+	return mux
+}
+
+func TestFindByName(t *testing.T) {
+	defer mockServer(mockDroplets())()
+
+	instance, err := FindByName(context.Background(), "drone-temp-baz", "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	want := &Instance{ID: 3, IP: "1.2.3.6", PrivateIP: "10.0.0.3", Owned: true}
+	if diff := cmp.Diff(instance, want); diff != "" {
+		t.Errorf("Unexpected instance")
+		t.Log(diff)
+	}
+}
+
+func TestFindByName_NotOwned(t *testing.T) {
+	defer mockServer(mockDroplets())()
+
+	instance, err := FindByName(context.Background(), "drone-temp-foo", "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if instance.Owned {
+		t.Errorf("Want instance without the runner tag not owned")
+	}
+}
+
+func TestFindByName_NotFound(t *testing.T) {
+	defer mockServer(mockDroplets())()
+
+	_, err := FindByName(context.Background(), "drone-temp-qux", "")
+	if err != ErrNotFound {
+		t.Errorf("Want not found error, got %v", err)
+	}
+}
+
+func TestFindByName_Duplicate(t *testing.T) {
+	defer mockServer(mockDroplets())()
+
+	_, err := FindByName(context.Background(), "drone-temp-bar", "")
+	if err != ErrDuplicateName {
+		t.Errorf("Want duplicate name error, got %v", err)
+	}
+}
+
+func TestFindByName_Error(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer mockServer(mux)()
+
+	_, err := FindByName(context.Background(), "drone-temp-foo", "")
+	if err == nil {
+		t.Errorf("Expect error returned from the api")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+// The registered runner key name can optionally embed the name
+// of the runner that registered the key, and the time the key
+// was registered, so that operators can trace a registered key
+// back to its origin. The key is only registered if it is not
+// already registered, which means the metadata identifies the
+// runner that first registered the key.
+
+// keyNamePrefix is the prefix of the runner key name.
+const keyNamePrefix = "drone_runner_key"
+
+// buildKeyPrefix is the prefix of the build key name. The
+// build key name includes the server instance name, so that
+// the build key can be removed with the server instance.
+const buildKeyPrefix = "drone_build_key_"
+
+// keyNameSeparator separates the metadata in the key name.
+const keyNameSeparator = ":"
+
+// maxKeyNameLength is the maximum length of an ssh key name
+// accepted by the digitalocean api.
+const maxKeyNameLength = 255
+
+// ErrKeyNotFound is returned when the ssh key is not
+// registered with the account.
+var ErrKeyNotFound = errors.New("ssh key not found")
+
+// KeyOrigin is the metadata embedded in the runner key name.
+type KeyOrigin struct {
+	Runner  string
+	Created time.Time
+}
+
+// KeyName returns the runner key name that embeds the key
+// origin. Characters in the runner name that are not valid in
+// the key name are replaced with dashes.
+func KeyName(origin KeyOrigin) (string, error) {
+	runner := sanitizeKeyRunner(origin.Runner)
+	if runner == "" {
+		return "", errors.New("runner name is required in the key name")
+	}
+	name := strings.Join([]string{
+		keyNamePrefix,
+		runner,
+		strconv.FormatInt(origin.Created.Unix(), 10),
+	}, keyNameSeparator)
+	if err := validateKeyName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// ParseKeyName returns the key origin embedded in the runner
+// key name, or false if the key name does not embed the key
+// origin.
+func ParseKeyName(name string) (KeyOrigin, bool) {
+	parts := strings.Split(name, keyNameSeparator)
+	if len(parts) != 3 || parts[0] != keyNamePrefix || parts[1] == "" {
+		return KeyOrigin{}, false
+	}
+	created, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return KeyOrigin{}, false
+	}
+	return KeyOrigin{
+		Runner:  parts[1],
+		Created: time.Unix(created, 0).UTC(),
+	}, true
+}
+
+// LookupKeyOrigin returns the origin of the ssh key registered
+// with the account with the matching fingerprint. If the key
+// is not registered, ErrKeyNotFound is returned. If the key
+// name does not embed the key origin, false is returned.
+func LookupKeyOrigin(ctx context.Context, fingerprint, token string) (KeyOrigin, bool, error) {
+	keys, err := ListKeys(ctx, token)
+	if err != nil {
+		return KeyOrigin{}, false, err
+	}
+	for _, key := range keys {
+		if key.Fingerprint == fingerprint {
+			origin, ok := ParseKeyName(key.Name)
+			return origin, ok, nil
+		}
+	}
+	return KeyOrigin{}, false, ErrKeyNotFound
+}
+
+// BuildKeyName returns the name of the build key registered
+// for the named server instance.
+func BuildKeyName(name string) string {
+	return buildKeyPrefix + name
+}
+
+// helper function removes the build key registered for the
+// named server instance, if any.
+func deleteBuildKey(ctx context.Context, client *godo.Client, name string) error {
+	opts := &godo.ListOptions{PerPage: 200}
+	for {
+		keys, res, err := client.Keys.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if key.Name == BuildKeyName(name) {
+				_, err := client.Keys.DeleteByID(ctx, key.ID)
+				return err
+			}
+		}
+		if res.Links == nil || res.Links.IsLastPage() {
+			return nil
+		}
+		page, err := res.Links.CurrentPage()
+		if err != nil {
+			return err
+		}
+		opts.Page = page + 1
+	}
+}
+
+// helper function returns an error if the key name is not
+// accepted by the digitalocean api.
+func validateKeyName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("key name is empty")
+	case len(name) > maxKeyNameLength:
+		return errors.New("key name exceeds 255 characters")
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return errors.New("key name contains control characters")
+		}
+	}
+	return nil
+}
+
+// helper function replaces characters in the runner name that
+// are not valid in the key name with dashes. The separator is
+// not valid in the runner name.
+func sanitizeKeyRunner(runner string) string {
+	var b strings.Builder
+	for _, r := range runner {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
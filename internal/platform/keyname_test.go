@@ -0,0 +1,101 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyName(t *testing.T) {
+	created := time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+	name, err := KeyName(KeyOrigin{Runner: "runner-1.example.com", Created: created})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if want := "drone_runner_key:runner-1.example.com:1571054400"; name != want {
+		t.Errorf("Want key name %q, got %q", want, name)
+	}
+	origin, ok := ParseKeyName(name)
+	if !ok {
+		t.Errorf("Want key origin parsed from %q", name)
+		return
+	}
+	if origin.Runner != "runner-1.example.com" || !origin.Created.Equal(created) {
+		t.Errorf("Unexpected key origin %v", origin)
+	}
+}
+
+func TestKeyName_Sanitize(t *testing.T) {
+	name, err := KeyName(KeyOrigin{Runner: "runner 1:prod\n", Created: time.Unix(0, 0)})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if want := "drone_runner_key:runner-1-prod:0"; name != want {
+		t.Errorf("Want key name %q, got %q", want, name)
+	}
+}
+
+func TestKeyName_Invalid(t *testing.T) {
+	if _, err := KeyName(KeyOrigin{Runner: "::"}); err == nil {
+		t.Errorf("Expect error when the runner name is empty")
+	}
+	if _, err := KeyName(KeyOrigin{Runner: strings.Repeat("a", 256)}); err == nil {
+		t.Errorf("Expect error when the key name is too long")
+	}
+}
+
+func TestParseKeyName(t *testing.T) {
+	tests := []string{
+		"drone_runner_key",
+		"drone_build_key_drone-temp-random",
+		"drone_runner_key:runner-1",
+		"drone_runner_key::1571054400",
+		"drone_runner_key:runner-1:yesterday",
+		"other_key:runner-1:1571054400",
+	}
+	for _, name := range tests {
+		if _, ok := ParseKeyName(name); ok {
+			t.Errorf("Want key origin not parsed from %q", name)
+		}
+	}
+}
+
+func TestLookupKeyOrigin(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/account/keys", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ssh_keys":[
+			{"id":1,"name":"drone_runner_key","fingerprint":"aa:aa"},
+			{"id":2,"name":"drone_runner_key:runner-1:1571054400","fingerprint":"bb:bb"}
+		]}`)
+	})
+	defer mockServer(mux)()
+
+	origin, ok, err := LookupKeyOrigin(context.Background(), "bb:bb", "token")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !ok || origin.Runner != "runner-1" {
+		t.Errorf("Unexpected key origin %v", origin)
+	}
+
+	// the key name does not embed the key origin.
+	_, ok, err = LookupKeyOrigin(context.Background(), "aa:aa", "token")
+	if err != nil || ok {
+		t.Errorf("Want key origin not found, got %v", err)
+	}
+
+	_, _, err = LookupKeyOrigin(context.Background(), "cc:cc", "token")
+	if err != ErrKeyNotFound {
+		t.Errorf("Want ErrKeyNotFound, got %v", err)
+	}
+}
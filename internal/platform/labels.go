@@ -0,0 +1,105 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxTags is the maximum number of tags that can be
+	// applied to a server instance.
+	maxTags = 50
+
+	// maxTagLength is the maximum length of a tag.
+	maxTagLength = 255
+)
+
+// EncodeLabels encodes the labels as tags in key:value format.
+// Tags are flat strings limited to letters, numbers, colons,
+// dashes and underscores. An error is returned if a label
+// cannot be encoded as a valid tag.
+func EncodeLabels(labels map[string]string) ([]string, error) {
+	if len(labels) > maxTags {
+		return nil, fmt.Errorf("too many labels: %d exceeds the %d tag limit", len(labels), maxTags)
+	}
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var tags []string
+	for _, k := range keys {
+		if k == "" || strings.Contains(k, ":") {
+			return nil, fmt.Errorf("invalid label key %q", k)
+		}
+		tag := k + ":" + labels[k]
+		if err := validateTag(tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// DecodeLabels decodes labels from tags in key:value format.
+// Tags that are not in key:value format are ignored.
+func DecodeLabels(tags []string) map[string]string {
+	labels := map[string]string{}
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels
+}
+
+// helper function merges the tags, removing duplicates. An
+// error is returned if a tag is invalid or the number of tags
+// exceeds the limit.
+func mergeTags(tags, other []string) ([]string, error) {
+	var merged []string
+	seen := map[string]struct{}{}
+	for _, list := range [][]string{tags, other} {
+		for _, tag := range list {
+			if _, ok := seen[tag]; ok {
+				continue
+			}
+			if err := validateTag(tag); err != nil {
+				return nil, err
+			}
+			seen[tag] = struct{}{}
+			merged = append(merged, tag)
+		}
+	}
+	if len(merged) > maxTags {
+		return nil, fmt.Errorf("too many tags: %d exceeds the %d tag limit", len(merged), maxTags)
+	}
+	return merged, nil
+}
+
+// helper function returns an error if the tag exceeds the
+// maximum length or contains invalid characters.
+func validateTag(tag string) error {
+	if len(tag) > maxTagLength {
+		return fmt.Errorf("tag %q exceeds %d characters", tag, maxTagLength)
+	}
+	for _, r := range tag {
+		switch {
+		case r >= 'a' && r <= 'z':
+		case r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9':
+		case r == ':', r == '-', r == '_':
+		default:
+			return fmt.Errorf("tag %q contains invalid character %q", tag, r)
+		}
+	}
+	return nil
+}
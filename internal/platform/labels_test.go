@@ -0,0 +1,96 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEncodeLabels(t *testing.T) {
+	labels := map[string]string{
+		"repo":      "hello-world",
+		"pipeline":  "default",
+		"requester": "octocat",
+	}
+	tags, err := EncodeLabels(labels)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	want := []string{
+		"pipeline:default",
+		"repo:hello-world",
+		"requester:octocat",
+	}
+	if diff := cmp.Diff(tags, want); diff != "" {
+		t.Errorf("Unexpected tags")
+		t.Log(diff)
+	}
+	if diff := cmp.Diff(DecodeLabels(tags), labels); diff != "" {
+		t.Errorf("Want labels decoded from tags")
+		t.Log(diff)
+	}
+}
+
+func TestEncodeLabels_Invalid(t *testing.T) {
+	tests := []map[string]string{
+		{"repo": "octocat/hello-world"},
+		{"repo": "hello world"},
+		{"": "hello-world"},
+		{"repo:name": "hello-world"},
+		{"repo": strings.Repeat("a", 255)},
+	}
+	for _, labels := range tests {
+		if _, err := EncodeLabels(labels); err == nil {
+			t.Errorf("Expect error encoding labels %v", labels)
+		}
+	}
+}
+
+func TestEncodeLabels_Limit(t *testing.T) {
+	labels := map[string]string{}
+	for i := 0; i <= maxTags; i++ {
+		labels[fmt.Sprintf("key%d", i)] = "value"
+	}
+	if _, err := EncodeLabels(labels); err == nil {
+		t.Errorf("Expect error when label count exceeds the tag limit")
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	tags, err := mergeTags(
+		[]string{"drone", "alert-high-cpu", "drone"},
+		[]string{"repo:hello-world", "alert-high-cpu"},
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	want := []string{"drone", "alert-high-cpu", "repo:hello-world"}
+	if diff := cmp.Diff(tags, want); diff != "" {
+		t.Errorf("Unexpected tags")
+		t.Log(diff)
+	}
+
+	if _, err := mergeTags([]string{"alert high cpu"}, nil); err == nil {
+		t.Errorf("Expect error when tag is invalid")
+	}
+}
+
+func TestDecodeLabels(t *testing.T) {
+	tags := []string{"drone", "repo:hello-world", ":empty", "url:https://github.com"}
+	want := map[string]string{
+		"repo": "hello-world",
+		"url":  "https://github.com",
+	}
+	if diff := cmp.Diff(DecodeLabels(tags), want); diff != "" {
+		t.Errorf("Unexpected labels")
+		t.Log(diff)
+	}
+}
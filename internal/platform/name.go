@@ -0,0 +1,48 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"strings"
+)
+
+// maxNameLength is the maximum length of a server instance
+// name. The name is used to configure the server hostname,
+// which is limited to 63 characters.
+const maxNameLength = 63
+
+// SanitizeName returns a valid server instance name. The name
+// is lowercased, invalid characters are replaced with dashes,
+// and repeated dashes are collapsed. If the name exceeds the
+// maximum length it is truncated, preserving the characters
+// after the final dash, which are assumed to be a unique
+// suffix.
+func SanitizeName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.':
+			b.WriteRune(r)
+		case strings.HasSuffix(b.String(), "-"):
+			// collapse repeated dashes
+		default:
+			b.WriteRune('-')
+		}
+	}
+	name = strings.Trim(b.String(), "-.")
+	if len(name) <= maxNameLength {
+		return name
+	}
+
+	prefix, suffix := name, ""
+	if i := strings.LastIndex(name, "-"); i != -1 {
+		prefix, suffix = name[:i], name[i:]
+	}
+	if len(suffix) >= maxNameLength {
+		return strings.Trim(name[:maxNameLength], "-.")
+	}
+	prefix = prefix[:maxNameLength-len(suffix)]
+	return strings.TrimLeft(strings.Trim(prefix, "-.")+suffix, "-.")
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{
+			name: "drone-temp-k6pmqwy2dy1d4ftl",
+			want: "drone-temp-k6pmqwy2dy1d4ftl",
+		},
+		{
+			name: "Octocat/Hello_World-k6pmqwy2dy1d4ftl",
+			want: "octocat-hello-world-k6pmqwy2dy1d4ftl",
+		},
+		{
+			name: "feature//branch  name--k6pmqwy2dy1d4ftl",
+			want: "feature-branch-name-k6pmqwy2dy1d4ftl",
+		},
+		{
+			name: "-leading-and-trailing-",
+			want: "leading-and-trailing",
+		},
+		{
+			name: strings.Repeat("a", 100) + "-k6pmqwy2dy1d4ftl",
+			want: strings.Repeat("a", 46) + "-k6pmqwy2dy1d4ftl",
+		},
+		{
+			name: strings.Repeat("a", 40) + "-" + strings.Repeat("b", 40) + "-k6pmqwy2dy1d4ftl",
+			want: strings.Repeat("a", 40) + "-" + strings.Repeat("b", 5) + "-k6pmqwy2dy1d4ftl",
+		},
+		{
+			name: strings.Repeat("a", 100),
+			want: strings.Repeat("a", 63),
+		},
+	}
+	for _, test := range tests {
+		got := SanitizeName(test.name)
+		if got != test.want {
+			t.Errorf("Want name %q, got %q", test.want, got)
+		}
+		if len(got) > maxNameLength {
+			t.Errorf("Want name length <= %d, got %d", maxNameLength, len(got))
+		}
+	}
+}
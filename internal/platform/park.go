@@ -0,0 +1,285 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drone/runner-go/logger"
+
+	"github.com/digitalocean/godo"
+)
+
+const (
+	// cacheTag is the tag prefix applied to a parked server
+	// instance, followed by the cache key.
+	cacheTag = "drone-cache:"
+
+	// parkedTag is the tag prefix applied to a parked server
+	// instance, followed by the unix time the server instance
+	// was parked.
+	parkedTag = "drone-parked:"
+)
+
+type (
+	// ParkArgs provides arguments to park the server instance
+	// for reuse by pipelines with the same cache key.
+	ParkArgs struct {
+		ID    int
+		Key   string
+		Token string
+	}
+
+	// UnparkArgs provides arguments to claim a parked server
+	// instance.
+	UnparkArgs struct {
+		ID     int
+		Key    string
+		Parked time.Time
+		Token  string
+		Tags   []string // Tags applied once the instance is claimed.
+	}
+
+	// ListParkedArgs provides arguments to list the parked
+	// server instances. If the key is empty, the server
+	// instances parked with any cache key are listed.
+	ListParkedArgs struct {
+		Key   string
+		Token string
+	}
+
+	// Parked represents a parked server instance.
+	Parked struct {
+		Instance
+		Key    string    // Cache key, as encoded in the tag.
+		Parked time.Time // Time the instance was parked.
+	}
+)
+
+// Park tags the server instance with the cache key and the
+// current time, and returns the time the server instance was
+// parked. The expiry tags are removed from the server instance,
+// since a parked server instance expires with the park ttl.
+func Park(ctx context.Context, args ParkArgs) (time.Time, error) {
+	client := newClient(ctx, args.Token)
+	if err := untagExpiry(ctx, client, args.ID); err != nil {
+		return time.Time{}, err
+	}
+	parked := now().Truncate(time.Second)
+	for _, tag := range []string{
+		cacheTag + EncodeKey(args.Key),
+		parkedTag + strconv.FormatInt(parked.Unix(), 10),
+	} {
+		if err := tagInstance(ctx, client, args.ID, tag); err != nil {
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("id", args.ID).
+				WithField("tag", tag).
+				Error("cannot tag parked instance")
+			return time.Time{}, err
+		}
+	}
+	return parked, nil
+}
+
+// Unpark removes the cache key and parked time tags from the
+// server instance, so that the server instance is not claimed
+// by another pipeline, and applies the tags of the claiming
+// pipeline. The parked time tag is deleted from the account. If the server instance was already claimed or does
+// not exist, ErrNotFound is returned.
+func Unpark(ctx context.Context, args UnparkArgs) error {
+	client := newClient(ctx, args.Token)
+	droplet, res, err := client.Droplets.Get(ctx, args.ID)
+	if res != nil && res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	key := cacheTag + EncodeKey(args.Key)
+	if !hasTag(droplet.Tags, key) {
+		return ErrNotFound
+	}
+	parked := parkedTag + strconv.FormatInt(args.Parked.Unix(), 10)
+	req := &godo.UntagResourcesRequest{
+		Resources: []godo.Resource{{
+			ID:   strconv.Itoa(args.ID),
+			Type: godo.DropletResourceType,
+		}},
+	}
+	for _, tag := range []string{key, parked} {
+		res, err := client.Tags.UntagResources(ctx, tag, req)
+		if res != nil && res.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("id", args.ID).
+				WithField("tag", tag).
+				Error("cannot untag parked instance")
+			return err
+		}
+	}
+	// the parked time tag is unique to the server instance,
+	// and is removed to avoid accumulating tags. This is a
+	// best effort, and errors are ignored.
+	client.Tags.Delete(ctx, parked)
+
+	for _, tag := range args.Tags {
+		if err := tagInstance(ctx, client, args.ID, tag); err != nil {
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("id", args.ID).
+				WithField("tag", tag).
+				Error("cannot tag claimed instance")
+			return err
+		}
+	}
+	return nil
+}
+
+// helper function removes the expiry tags from the server
+// instance, so that a parked server instance is not deleted by
+// the reaper once the lifetime of the previous pipeline
+// elapses. If the server instance does not exist, ErrNotFound
+// is returned.
+func untagExpiry(ctx context.Context, client *godo.Client, id int) error {
+	droplet, res, err := client.Droplets.Get(ctx, id)
+	if res != nil && res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	req := &godo.UntagResourcesRequest{
+		Resources: []godo.Resource{{
+			ID:   strconv.Itoa(id),
+			Type: godo.DropletResourceType,
+		}},
+	}
+	for _, tag := range droplet.Tags {
+		if !strings.HasPrefix(tag, expiryTagPrefix) {
+			continue
+		}
+		if _, err := client.Tags.UntagResources(ctx, tag, req); err != nil {
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("id", id).
+				WithField("tag", tag).
+				Error("cannot remove expiry tag from parked instance")
+			return err
+		}
+	}
+	return nil
+}
+
+// ListParked returns the active server instances parked by the
+// runner, most recently parked first.
+func ListParked(ctx context.Context, args ListParkedArgs) ([]Parked, error) {
+	client := newClient(ctx, args.Token)
+	opts := &godo.ListOptions{PerPage: 200}
+
+	tag := runnerTag
+	if args.Key != "" {
+		tag = cacheTag + EncodeKey(args.Key)
+	}
+
+	var list []Parked
+	for {
+		page, res, err := client.Droplets.ListByTag(ctx, tag, opts)
+		if err != nil {
+			logger.FromContext(ctx).
+				WithError(err).
+				WithField("tag", tag).
+				Error("cannot list parked instances")
+			return nil, err
+		}
+		for _, droplet := range page {
+			if parked, ok := newParked(droplet); ok && droplet.Status == "active" {
+				list = append(list, parked)
+			}
+		}
+		if res.Links == nil || res.Links.IsLastPage() {
+			break
+		}
+		current, err := res.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opts.Page = current + 1
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Parked.After(list[j].Parked)
+	})
+	return list, nil
+}
+
+// EncodeKey encodes the cache key as a valid tag value. The key
+// is lowercased, and characters that are not valid in a tag are
+// replaced with dashes.
+func EncodeKey(key string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(key) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	key = b.String()
+	if max := maxTagLength - len(cacheTag); len(key) > max {
+		key = key[:max]
+	}
+	return key
+}
+
+// helper function returns the parked server instance for the
+// droplet, or false if the droplet is not parked.
+func newParked(droplet godo.Droplet) (Parked, bool) {
+	parked := Parked{Instance: Instance{ID: droplet.ID}}
+	if droplet.Size != nil {
+		parked.Size = droplet.Size.Slug
+	}
+	parked.IP, _ = droplet.PublicIPv4()
+	parked.PrivateIP, _ = droplet.PrivateIPv4()
+	for _, tag := range droplet.Tags {
+		switch {
+		case strings.HasPrefix(tag, cacheTag):
+			parked.Key = strings.TrimPrefix(tag, cacheTag)
+		case strings.HasPrefix(tag, parkedTag):
+			unix, err := strconv.ParseInt(strings.TrimPrefix(tag, parkedTag), 10, 64)
+			if err == nil {
+				parked.Parked = time.Unix(unix, 0)
+			}
+		}
+	}
+	return parked, parked.Key != "" && !parked.Parked.IsZero()
+}
+
+// helper function creates the tag, if it does not exist, and
+// applies the tag to the server instance.
+func tagInstance(ctx context.Context, client *godo.Client, id int, tag string) error {
+	if err := validateTag(tag); err != nil {
+		return err
+	}
+	_, res, err := client.Tags.Create(ctx, &godo.TagCreateRequest{Name: tag})
+	if err != nil && (res == nil || res.StatusCode != http.StatusUnprocessableEntity) {
+		return err
+	}
+	_, err = client.Tags.TagResources(ctx, tag, &godo.TagResourcesRequest{
+		Resources: []godo.Resource{{
+			ID:   strconv.Itoa(id),
+			Type: godo.DropletResourceType,
+		}},
+	})
+	return err
+}
@@ -0,0 +1,174 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPark(t *testing.T) {
+	defer mockNow()()
+
+	var tagged, untagged []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":1,"tags":["drone","drone-expires:1569934800"]}}`)
+	})
+	mux.HandleFunc("/v2/tags", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"tag":{}}`)
+	})
+	mux.HandleFunc("/v2/tags/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			untagged = append(untagged, r.URL.Path)
+		} else {
+			tagged = append(tagged, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer mockServer(mux)()
+
+	parked, err := Park(context.Background(), ParkArgs{ID: 1, Key: "octocat/hello.world"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := parked.Unix(), int64(1569931200); got != want {
+		t.Errorf("Want parked time %d, got %d", want, got)
+	}
+	want := []string{
+		"/v2/tags/drone-cache:octocat-hello-world/resources",
+		"/v2/tags/drone-parked:1569931200/resources",
+	}
+	if diff := cmp.Diff(tagged, want); diff != "" {
+		t.Errorf("Unexpected tags applied")
+		t.Log(diff)
+	}
+	// the expiry tag is removed, so that the reaper does not
+	// delete the parked server instance.
+	if diff := cmp.Diff(untagged, []string{"/v2/tags/drone-expires:1569934800/resources"}); diff != "" {
+		t.Errorf("Unexpected tags removed")
+		t.Log(diff)
+	}
+}
+
+func TestUnpark(t *testing.T) {
+	var untagged, deleted, tagged []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":1,"tags":["drone","drone-cache:octocat","drone-parked:1569931200"]}}`)
+	})
+	mux.HandleFunc("/v2/tags", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"tag":{}}`)
+	})
+	mux.HandleFunc("/v2/tags/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			tagged = append(tagged, r.URL.Path)
+		case r.URL.Path == "/v2/tags/drone-parked:1569931200":
+			deleted = append(deleted, r.URL.Path)
+		default:
+			untagged = append(untagged, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer mockServer(mux)()
+
+	err := Unpark(context.Background(), UnparkArgs{
+		ID:     1,
+		Key:    "octocat",
+		Parked: time.Unix(1569931200, 0),
+		Tags:   []string{"drone-expires:1569934800"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	want := []string{
+		"/v2/tags/drone-cache:octocat/resources",
+		"/v2/tags/drone-parked:1569931200/resources",
+	}
+	if diff := cmp.Diff(untagged, want); diff != "" {
+		t.Errorf("Unexpected tags removed")
+		t.Log(diff)
+	}
+	if len(deleted) != 1 {
+		t.Errorf("Want parked time tag deleted")
+	}
+	// the tags of the claiming pipeline are applied.
+	if diff := cmp.Diff(tagged, []string{"/v2/tags/drone-expires:1569934800/resources"}); diff != "" {
+		t.Errorf("Unexpected tags applied")
+		t.Log(diff)
+	}
+}
+
+func TestUnpark_Claimed(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":1,"tags":["drone"]}}`)
+	})
+	defer mockServer(mux)()
+
+	// the server instance was claimed by another pipeline,
+	// which removed the cache key tag.
+	err := Unpark(context.Background(), UnparkArgs{ID: 1, Key: "octocat"})
+	if err != ErrNotFound {
+		t.Errorf("Want not found error, got %v", err)
+	}
+}
+
+func TestListParked(t *testing.T) {
+	var tag string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		tag = r.URL.Query().Get("tag_name")
+		io.WriteString(w, `{"droplets":[
+			{"id":1,"status":"active","tags":["drone","drone-cache:octocat","drone-parked:1569927600"],"size":{"slug":"s-1vcpu-1gb"},"networks":{"v4":[{"ip_address":"1.2.3.4","type":"public"}]}},
+			{"id":2,"status":"active","tags":["drone","drone-cache:octocat","drone-parked:1569931200"]},
+			{"id":3,"status":"off","tags":["drone","drone-cache:octocat","drone-parked:1569931200"]},
+			{"id":4,"status":"active","tags":["drone"]}
+		]}`)
+	})
+	defer mockServer(mux)()
+
+	list, err := ListParked(context.Background(), ListParkedArgs{Key: "octocat"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := tag, "drone-cache:octocat"; got != want {
+		t.Errorf("Want instances listed by tag %s, got %s", want, got)
+	}
+	want := []Parked{
+		{Instance: Instance{ID: 2}, Key: "octocat", Parked: time.Unix(1569931200, 0)},
+		{Instance: Instance{ID: 1, IP: "1.2.3.4", Size: "s-1vcpu-1gb"}, Key: "octocat", Parked: time.Unix(1569927600, 0)},
+	}
+	if diff := cmp.Diff(list, want); diff != "" {
+		t.Errorf("Unexpected parked instances")
+		t.Log(diff)
+	}
+}
+
+func TestEncodeKey(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"octocat", "octocat"},
+		{"Octocat/Hello.World", "octocat-hello-world"},
+		{"octocat/hello_world:main", "octocat-hello_world-main"},
+	}
+	for _, test := range tests {
+		if got := EncodeKey(test.in); got != test.want {
+			t.Errorf("Want key %q encoded as %q, got %q", test.in, test.want, got)
+		}
+	}
+}
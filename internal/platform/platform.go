@@ -8,6 +8,13 @@ package platform
 
 import (
 	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/drone/runner-go/logger"
@@ -16,6 +23,24 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// endpoint is the digitalocean api address. It is declared as
+// a variable so that it can be overridden in unit tests.
+var endpoint = "https://api.digitalocean.com/"
+
+// runnerTag is the tag applied to all server instances
+// provisioned by the runner.
+const runnerTag = "drone"
+
+// ErrNotOwned is returned when the server instance does not
+// match the server instance provisioned by the runner, and is
+// not deleted.
+var ErrNotOwned = errors.New("instance not provisioned by the runner")
+
+// destroyTimeout is the default time to wait for in-flight
+// actions to complete when the server instance is force
+// destroyed.
+var destroyTimeout = time.Minute * 10
+
 type (
 	// RegisterArgs provides arguments to register the SSH
 	// public key with the account.
@@ -24,6 +49,18 @@ type (
 		Name        string
 		Data        string
 		Token       string
+
+		// Lookup resolves the key from the list of keys
+		// registered with the account before attempting to
+		// register the key.
+		Lookup bool
+	}
+
+	// DeregisterArgs provides arguments to remove the SSH
+	// public key from the account.
+	DeregisterArgs struct {
+		Fingerprint string
+		Token       string
 	}
 
 	// DestroyArgs provides arguments to destroy the server
@@ -32,59 +69,148 @@ type (
 		ID    int
 		IP    string
 		Token string
+
+		// Force retries the delete request while the server
+		// instance is locked by an in-flight action, until
+		// the action completes or the timeout is reached.
+		Force   bool
+		Timeout time.Duration
+
+		// Confirm verifies the server instance bears the
+		// runner tag, and the name if not empty, before it
+		// is deleted.
+		Confirm bool
+		Name    string
+
+		// DryRun logs the server instance that would be
+		// deleted, without deleting the server instance.
+		DryRun bool
+
+		// Resources destroys the volumes and volume snapshots
+		// associated with the server instance that bear the
+		// runner tag, together with the server instance.
+		Resources bool
 	}
 
 	// ProvisionArgs provides arguments to provision instances.
 	ProvisionArgs struct {
 		Key    string
-		Image  string
+		KeyID  int      // Key ID, takes precedence over Key.
+		Keys   []string // Additional key fingerprints.
+		Image  string   // Image slug, or snapshot image ID.
 		Name   string
 		Region string
 		Size   string
+		Sizes  []string // Fallback sizes, in order of preference.
 		Token  string
+		Labels map[string]string // Labels encoded as tags.
+		Tags   []string          // Additional tags.
+		IPv6   bool              // Enable the public IPv6 address.
 	}
 
 	// Instance represents a provisioned server instance.
 	Instance struct {
-		ID int
-		IP string
+		ID        int
+		IP        string
+		PrivateIP string
+		IPv6      string // Public IPv6 address, if enabled.
+		Size      string // Size of the provisioned instance.
+		Owned     bool   // Instance is tagged as provisioned by the runner.
+	}
+
+	// Key represents an ssh key registered with the account.
+	Key struct {
+		ID          int
+		Name        string
+		Fingerprint string
 	}
 )
 
 // Provision provisions the server instance.
 func Provision(ctx context.Context, args ProvisionArgs) (Instance, error) {
 	res := Instance{}
+	tags, err := EncodeLabels(args.Labels)
+	if err != nil {
+		return res, err
+	}
+	tags, err = mergeTags(append([]string{runnerTag}, args.Tags...), tags)
+	if err != nil {
+		return res, err
+	}
 	req := &godo.DropletCreateRequest{
 		Name:   args.Name,
 		Region: args.Region,
 		Size:   args.Size,
-		Tags:   []string{"drone"},
-		IPv6:   false,
-		SSHKeys: []godo.DropletCreateSSHKey{
-			{Fingerprint: args.Key},
-		},
+		Tags:   tags,
+		IPv6:   args.IPv6,
 		Image: godo.DropletCreateImage{
 			Slug: args.Image,
 		},
 	}
+	// the image may be a snapshot image ID, for example, a
+	// snapshot taken earlier in the build.
+	if id, err := strconv.Atoi(args.Image); err == nil {
+		req.Image = godo.DropletCreateImage{ID: id}
+	}
+	// the runner key is optional, for example, if the public
+	// key is baked into the image.
+	if args.KeyID != 0 {
+		req.SSHKeys = append(req.SSHKeys, godo.DropletCreateSSHKey{
+			ID: args.KeyID,
+		})
+	} else if args.Key != "" {
+		req.SSHKeys = append(req.SSHKeys, godo.DropletCreateSSHKey{
+			Fingerprint: args.Key,
+		})
+	}
+	for _, key := range args.Keys {
+		req.SSHKeys = append(req.SSHKeys, godo.DropletCreateSSHKey{
+			Fingerprint: key,
+		})
+	}
 
 	logger := logger.FromContext(ctx).
 		WithField("region", req.Region).
-		WithField("image", req.Image.Slug).
+		WithField("image", args.Image).
 		WithField("size", req.Size).
 		WithField("name", req.Name)
 
+	client := newClient(ctx, args.Token)
+
+	// a snapshot image is only available in the regions it
+	// was created in or transferred to.
+	if req.Image.ID != 0 {
+		err = checkImageRegion(ctx, client, req.Image.ID, req.Region)
+		if err != nil {
+			logger.WithError(err).Error("cannot create instance")
+			return res, err
+		}
+	}
+
 	logger.Debug("instance create")
 
-	client := newClient(ctx, args.Token)
-	droplet, _, err := client.Droplets.Create(ctx, req)
+	// the fallback sizes are tried, in order, if the preferred
+	// size is out of capacity in the region.
+	var droplet *godo.Droplet
+	for i, size := range append([]string{args.Size}, args.Sizes...) {
+		req.Size = size
+		droplet, _, err = client.Droplets.Create(ctx, req)
+		if err == nil || !isCapacityError(err) || i == len(args.Sizes) {
+			break
+		}
+		logger.WithError(err).
+			WithField("size", size).
+			Warn("instance size unavailable, trying the next size")
+	}
 	if err != nil {
 		logger.WithError(err).Error("cannot create instance")
 		return res, err
 	}
 
-	// record the droplet ID
+	// record the droplet ID and size
 	res.ID = droplet.ID
+	res.Size = req.Size
+	logger = logger.WithField("size", req.Size)
 
 	logger.WithField("name", req.Name).
 		Info("instance created")
@@ -114,12 +240,24 @@ poller:
 			}
 
 			for _, network := range droplet.Networks.V4 {
-				if network.Type == "public" {
+				switch network.Type {
+				case "public":
 					res.IP = network.IPAddress
+				case "private":
+					res.PrivateIP = network.IPAddress
 				}
 			}
 
-			if res.IP != "" {
+			for _, network := range droplet.Networks.V6 {
+				if network.Type == "public" {
+					res.IPv6 = network.IPAddress
+				}
+			}
+
+			// the ipv6 address is allocated with the ipv4
+			// address, however, the network is polled until
+			// both addresses are allocated.
+			if res.IP != "" && (!args.IPv6 || res.IPv6 != "") {
 				break poller
 			}
 		}
@@ -133,10 +271,58 @@ poller:
 	return res, nil
 }
 
-// Destroy destroys the server instance.
+// Destroy destroys the server instance. If the server instance
+// does not exist, ErrNotFound is returned. If confirmation is
+// enabled and the server instance was not provisioned by the
+// runner, ErrNotOwned is returned.
 func Destroy(ctx context.Context, args DestroyArgs) error {
 	client := newClient(ctx, args.Token)
-	_, err := client.Droplets.Delete(ctx, args.ID)
+	if args.Confirm {
+		if err := confirm(ctx, client, args); err != nil {
+			return err
+		}
+	}
+	if args.DryRun {
+		return dryRun(ctx, client, args.ID)
+	}
+	remove := func(ctx context.Context) (*godo.Response, error) {
+		if args.Resources {
+			return deleteWithResources(ctx, client, args.ID)
+		}
+		return client.Droplets.Delete(ctx, args.ID)
+	}
+	res, err := remove(ctx)
+
+	// the server instance cannot be deleted while an action,
+	// such as a resize or snapshot, is in progress. In force
+	// mode the delete is retried until the action completes.
+	if args.Force && isLocked(res) {
+		timeout := args.Timeout
+		if timeout == 0 {
+			timeout = destroyTimeout
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+	retry:
+		for isLocked(res) {
+			logger.FromContext(ctx).
+				WithField("id", args.ID).
+				WithField("ip", args.IP).
+				Debug("server locked by an in-flight action, retrying")
+
+			select {
+			case <-ctx.Done():
+				break retry
+			case <-time.After(actionInterval):
+			}
+			res, err = remove(ctx)
+		}
+	}
+
+	if res != nil && res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
 	if err != nil {
 		logger.FromContext(ctx).
 			WithError(err).
@@ -147,31 +333,203 @@ func Destroy(ctx context.Context, args DestroyArgs) error {
 	return err
 }
 
+// helper function verifies the server instance bears the
+// runner tag and matches the name before it is deleted, to
+// prevent a stale server instance ID from deleting the wrong
+// server instance.
+func confirm(ctx context.Context, client *godo.Client, args DestroyArgs) error {
+	droplet, res, err := client.Droplets.Get(ctx, args.ID)
+	if res != nil && res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !hasTag(droplet.Tags, runnerTag) || (args.Name != "" && droplet.Name != args.Name) {
+		logger.FromContext(ctx).
+			WithField("id", args.ID).
+			WithField("name", droplet.Name).
+			WithField("tags", droplet.Tags).
+			Warn("refusing to delete server not provisioned by the runner")
+		return ErrNotOwned
+	}
+	return nil
+}
+
+// helper function returns true if the tag is in the list.
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAPIError returns true if the error is an error response
+// from the digitalocean api, as opposed to, for example, a
+// network error or a cancelled request.
+func IsAPIError(err error) bool {
+	_, ok := err.(*godo.ErrorResponse)
+	return ok
+}
+
+// IsTransient returns true if the error is transient and the
+// request may succeed if retried, for example, a rate limit or
+// server error response, or a network error.
+func IsTransient(err error) bool {
+	switch err := err.(type) {
+	case *godo.ErrorResponse:
+		if err.Response == nil {
+			return false
+		}
+		code := err.Response.StatusCode
+		return code == http.StatusTooManyRequests || code >= 500
+	case net.Error:
+		return true
+	}
+	return err == ErrActionTimeout
+}
+
+// helper function returns true if the error indicates the
+// instance size is out of capacity or not available in the
+// region.
+func isCapacityError(err error) bool {
+	res, ok := err.(*godo.ErrorResponse)
+	if !ok || res.Response == nil || res.Response.StatusCode != http.StatusUnprocessableEntity {
+		return false
+	}
+	message := strings.ToLower(res.Message)
+	return strings.Contains(message, "size") &&
+		(strings.Contains(message, "not available") ||
+			strings.Contains(message, "unavailable") ||
+			strings.Contains(message, "capacity"))
+}
+
+// IsKeyError returns true if the error indicates that an ssh
+// key authorized on the server instance is not registered with
+// the account, for example, because the key was removed.
+func IsKeyError(err error) bool {
+	res, ok := err.(*godo.ErrorResponse)
+	if !ok || res.Response == nil {
+		return false
+	}
+	return res.Response.StatusCode == http.StatusUnprocessableEntity &&
+		strings.Contains(strings.ToLower(res.Message), "ssh")
+}
+
+// helper function returns true if the response indicates the
+// server instance is locked by an in-flight action.
+func isLocked(res *godo.Response) bool {
+	return res != nil && res.StatusCode == http.StatusUnprocessableEntity
+}
+
 // RegisterKey registers the ssh public key with the account if
-// it is not already registered.
-func RegisterKey(ctx context.Context, args RegisterArgs) error {
+// it is not already registered, and returns the key ID.
+func RegisterKey(ctx context.Context, args RegisterArgs) (int, error) {
 	client := newClient(ctx, args.Token)
-	_, _, err := client.Keys.GetByFingerprint(ctx, args.Fingerprint)
-	if err == nil {
-		return nil
+	if args.Lookup {
+		keys, err := ListKeys(ctx, args.Token)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			if key.Fingerprint == args.Fingerprint {
+				return key.ID, nil
+			}
+		}
+	} else {
+		key, _, err := client.Keys.GetByFingerprint(ctx, args.Fingerprint)
+		if err == nil {
+			return key.ID, nil
+		}
 	}
 
 	// if the ssh key does not exists we attempt to register
 	// with the digital ocean account.
-	_, _, err = client.Keys.Create(ctx, &godo.KeyCreateRequest{
+	key, res, err := client.Keys.Create(ctx, &godo.KeyCreateRequest{
 		Name:      args.Name,
 		PublicKey: args.Data,
 	})
+	if err == nil {
+		return key.ID, nil
+	}
+
+	// the key may have been registered concurrently by another
+	// runner sharing the same key, in which case the create
+	// request is rejected and the existing key is returned.
+	if res != nil && res.StatusCode == http.StatusUnprocessableEntity {
+		key, _, lookuperr := client.Keys.GetByFingerprint(ctx, args.Fingerprint)
+		if lookuperr == nil {
+			return key.ID, nil
+		}
+	}
+	return 0, err
+}
+
+// ListKeys returns the ssh keys registered with the account.
+func ListKeys(ctx context.Context, token string) ([]Key, error) {
+	client := newClient(ctx, token)
+	opts := &godo.ListOptions{PerPage: 200}
+
+	var keys []Key
+	for {
+		page, res, err := client.Keys.List(ctx, opts)
+		if err != nil {
+			logger.FromContext(ctx).
+				WithError(err).
+				Error("cannot list ssh keys")
+			return nil, err
+		}
+		for _, key := range page {
+			keys = append(keys, Key{
+				ID:          key.ID,
+				Name:        key.Name,
+				Fingerprint: key.Fingerprint,
+			})
+		}
+		if res.Links == nil || res.Links.IsLastPage() {
+			return keys, nil
+		}
+		current, err := res.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opts.Page = current + 1
+	}
+}
+
+// DeregisterKey removes the ssh public key from the account.
+func DeregisterKey(ctx context.Context, args DeregisterArgs) error {
+	client := newClient(ctx, args.Token)
+	_, err := client.Keys.DeleteByFingerprint(ctx, args.Fingerprint)
+	if err != nil {
+		logger.FromContext(ctx).
+			WithError(err).
+			WithField("fingerprint", args.Fingerprint).
+			Error("cannot remove ssh key")
+	}
 	return err
 }
 
-// helper function returns a new digitalocean client.
+// tokenEnv is the environment variable from which the api token
+// is read if the token is empty, consistent with doctl and the
+// terraform provider. The token is never logged.
+const tokenEnv = "DIGITALOCEAN_ACCESS_TOKEN"
+
+// helper function returns a new digitalocean client. If the
+// token is empty, the token is read from the environment.
 func newClient(ctx context.Context, token string) *godo.Client {
-	return godo.NewClient(
+	if token == "" {
+		token = os.Getenv(tokenEnv)
+	}
+	client := godo.NewClient(
 		oauth2.NewClient(ctx, oauth2.StaticTokenSource(
 			&oauth2.Token{
 				AccessToken: token,
 			},
 		)),
 	)
+	client.BaseURL, _ = url.Parse(endpoint)
+	return client
 }
@@ -3,3 +3,685 @@
 // that can be found in the LICENSE file.
 
 package platform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// helper function starts a mock digitalocean api server and
+// configures the package to send requests to the mock server.
+// The returned function stops the server and restores the
+// default endpoint.
+func mockServer(handler http.Handler) func() {
+	server := httptest.NewServer(handler)
+	restore := endpoint
+	endpoint = server.URL + "/"
+	return func() {
+		server.Close()
+		endpoint = restore
+	}
+}
+
+func TestProvision_Keys(t *testing.T) {
+	var got struct {
+		SSHKeys []interface{} `json:"ssh_keys"`
+		Tags    []string      `json:"tags"`
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		io.WriteString(w, `{"droplet":{"id":1}}`)
+	})
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":1,"networks":{"v4":[{"ip_address":"10.0.0.1","type":"private"},{"ip_address":"1.2.3.4","type":"public"}]}}}`)
+	})
+	defer mockServer(mux)()
+
+	instance, err := Provision(context.Background(), ProvisionArgs{
+		Key:  "runner-fingerprint",
+		Keys: []string{"build-fingerprint"},
+		Name: "drone-temp-random",
+		Labels: map[string]string{
+			"repo": "hello-world",
+		},
+		Tags: []string{"drone-alerts"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if instance.ID != 1 || instance.IP != "1.2.3.4" || instance.PrivateIP != "10.0.0.1" {
+		t.Errorf("Unexpected instance %v", instance)
+	}
+
+	want := []interface{}{
+		"runner-fingerprint",
+		"build-fingerprint",
+	}
+	if diff := cmp.Diff(got.SSHKeys, want); diff != "" {
+		t.Errorf("Unexpected ssh keys")
+		t.Log(diff)
+	}
+	if diff := cmp.Diff(got.Tags, []string{"drone", "drone-alerts", "repo:hello-world"}); diff != "" {
+		t.Errorf("Unexpected tags")
+		t.Log(diff)
+	}
+}
+
+func TestProvision_Sizes(t *testing.T) {
+	var sizes []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Size string `json:"size"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		sizes = append(sizes, req.Size)
+		if req.Size == "s-4vcpu-8gb" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			io.WriteString(w, `{"id":"unprocessable_entity","message":"Size is not available in this region."}`)
+			return
+		}
+		io.WriteString(w, `{"droplet":{"id":1}}`)
+	})
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":1,"networks":{"v4":[{"ip_address":"1.2.3.4","type":"public"}]}}}`)
+	})
+	defer mockServer(mux)()
+
+	instance, err := Provision(context.Background(), ProvisionArgs{
+		Name:  "drone-temp-random",
+		Size:  "s-4vcpu-8gb",
+		Sizes: []string{"s-2vcpu-4gb", "s-1vcpu-2gb"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := instance.Size, "s-2vcpu-4gb"; got != want {
+		t.Errorf("Want instance size %s, got %s", want, got)
+	}
+	if diff := cmp.Diff(sizes, []string{"s-4vcpu-8gb", "s-2vcpu-4gb"}); diff != "" {
+		t.Errorf("Unexpected sizes requested")
+		t.Log(diff)
+	}
+}
+
+func TestProvision_Marketplace(t *testing.T) {
+	var image interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Image interface{} `json:"image"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		image = req.Image
+		io.WriteString(w, `{"droplet":{"id":1}}`)
+	})
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":1,"networks":{"v4":[{"ip_address":"1.2.3.4","type":"public"}]}}}`)
+	})
+	defer mockServer(mux)()
+
+	// marketplace images are created from the image slug.
+	_, err := Provision(context.Background(), ProvisionArgs{
+		Name:  "drone-temp-random",
+		Image: "docker-20-04",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := image, "docker-20-04"; got != want {
+		t.Errorf("Want image slug %v, got %v", want, got)
+	}
+}
+
+func TestProvision_SizesError(t *testing.T) {
+	var calls int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		io.WriteString(w, `{"id":"unprocessable_entity","message":"Size is not available in this region."}`)
+	})
+	defer mockServer(mux)()
+
+	// the error is returned once all sizes are exhausted.
+	_, err := Provision(context.Background(), ProvisionArgs{
+		Name:  "drone-temp-random",
+		Size:  "s-4vcpu-8gb",
+		Sizes: []string{"s-2vcpu-4gb"},
+	})
+	if !isCapacityError(err) {
+		t.Errorf("Want capacity error, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Want 2 create requests, got %d", calls)
+	}
+}
+
+func TestProvision_NoKey(t *testing.T) {
+	var got struct {
+		SSHKeys []interface{} `json:"ssh_keys"`
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		io.WriteString(w, `{"droplet":{"id":1}}`)
+	})
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":1,"networks":{"v4":[{"ip_address":"1.2.3.4","type":"public"}]}}}`)
+	})
+	defer mockServer(mux)()
+
+	_, err := Provision(context.Background(), ProvisionArgs{
+		Name: "drone-temp-random",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(got.SSHKeys) != 0 {
+		t.Errorf("Expect no ssh keys when runner key is empty, got %v", got.SSHKeys)
+	}
+}
+
+func TestProvision_IPv6(t *testing.T) {
+	var got struct {
+		IPv6 bool `json:"ipv6"`
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		io.WriteString(w, `{"droplet":{"id":1}}`)
+	})
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":1,"networks":{`+
+			`"v4":[{"ip_address":"1.2.3.4","type":"public"}],`+
+			`"v6":[{"ip_address":"2001:db8::1","type":"public"}]}}}`)
+	})
+	defer mockServer(mux)()
+
+	instance, err := Provision(context.Background(), ProvisionArgs{
+		Name: "drone-temp-random",
+		IPv6: true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !got.IPv6 {
+		t.Errorf("Expect ipv6 enabled")
+	}
+	if instance.IP != "1.2.3.4" || instance.IPv6 != "2001:db8::1" {
+		t.Errorf("Unexpected addresses %+v", instance)
+	}
+}
+
+func TestProvision_KeyID(t *testing.T) {
+	var got struct {
+		SSHKeys []interface{} `json:"ssh_keys"`
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		io.WriteString(w, `{"droplet":{"id":1}}`)
+	})
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":1,"networks":{"v4":[{"ip_address":"1.2.3.4","type":"public"}]}}}`)
+	})
+	defer mockServer(mux)()
+
+	_, err := Provision(context.Background(), ProvisionArgs{
+		Key:   "runner-fingerprint",
+		KeyID: 512189,
+		Keys:  []string{"build-fingerprint"},
+		Name:  "drone-temp-random",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the key id takes precedence over the fingerprint.
+	want := []interface{}{
+		float64(512189),
+		"build-fingerprint",
+	}
+	if diff := cmp.Diff(got.SSHKeys, want); diff != "" {
+		t.Errorf("Unexpected ssh keys")
+		t.Log(diff)
+	}
+}
+
+func TestProvision_KeyError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		io.WriteString(w, `{"id":"unprocessable_entity","message":"ssh_keys invalid key identifiers for Droplet creation"}`)
+	})
+	defer mockServer(mux)()
+
+	_, err := Provision(context.Background(), ProvisionArgs{
+		Key:  "runner-fingerprint",
+		Name: "drone-temp-random",
+	})
+	if err == nil {
+		t.Errorf("Expect error when ssh key is not registered")
+		return
+	}
+	if !IsKeyError(err) {
+		t.Errorf("Expect key error, got %s", err)
+	}
+}
+
+func TestIsAPIError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		io.WriteString(w, `{"id":"unprocessable_entity","message":"invalid size"}`)
+	})
+	defer mockServer(mux)()
+
+	_, err := Provision(context.Background(), ProvisionArgs{Name: "drone-temp-random"})
+	if !IsAPIError(err) {
+		t.Errorf("Expect api error, got %v", err)
+	}
+	if IsAPIError(context.Canceled) {
+		t.Errorf("Expect context error is not an api error")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		code      int
+		transient bool
+	}{
+		{code: http.StatusTooManyRequests, transient: true},
+		{code: http.StatusInternalServerError, transient: true},
+		{code: http.StatusServiceUnavailable, transient: true},
+		{code: http.StatusUnprocessableEntity, transient: false},
+		{code: http.StatusUnauthorized, transient: false},
+	}
+	for _, test := range tests {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.code)
+			io.WriteString(w, `{"id":"error","message":"error"}`)
+		})
+		closer := mockServer(mux)
+		_, err := Provision(context.Background(), ProvisionArgs{Name: "drone-temp-random"})
+		closer()
+		if got := IsTransient(err); got != test.transient {
+			t.Errorf("Want transient %v for status %d, got %v", test.transient, test.code, got)
+		}
+	}
+
+	// network errors are transient, for example, when the
+	// api endpoint cannot be reached.
+	err := &url.Error{Op: "Post", URL: "https://api.digitalocean.com", Err: errors.New("connection refused")}
+	if !IsTransient(err) {
+		t.Errorf("Expect network error is transient, got %v", err)
+	}
+	if IsTransient(errors.New("invalid")) {
+		t.Errorf("Expect unknown error is not transient")
+	}
+}
+
+func TestIsKeyError(t *testing.T) {
+	if IsKeyError(errors.New("ssh_keys invalid")) {
+		t.Errorf("Expect key error requires an api error response")
+	}
+	if IsKeyError(nil) {
+		t.Errorf("Expect nil error is not a key error")
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	var deleted bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		deleted = r.Method == "DELETE"
+		w.WriteHeader(204)
+	})
+	defer mockServer(mux)()
+
+	err := Destroy(context.Background(), DestroyArgs{ID: 1})
+	if err != nil {
+		t.Error(err)
+	}
+	if !deleted {
+		t.Errorf("Expect server instance deleted")
+	}
+}
+
+func TestDestroy_Confirm(t *testing.T) {
+	tests := []struct {
+		droplet string
+		err     error
+	}{
+		{`{"droplet":{"id":1,"name":"drone-temp-foo","tags":["drone","repo:hello-world"]}}`, nil},
+		{`{"droplet":{"id":1,"name":"drone-temp-foo","tags":["repo:hello-world"]}}`, ErrNotOwned},
+		{`{"droplet":{"id":1,"name":"production-db","tags":["drone"]}}`, ErrNotOwned},
+	}
+	for _, test := range tests {
+		var deleted bool
+		mux := http.NewServeMux()
+		mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "DELETE" {
+				deleted = true
+				w.WriteHeader(204)
+				return
+			}
+			io.WriteString(w, test.droplet)
+		})
+		closer := mockServer(mux)
+
+		err := Destroy(context.Background(), DestroyArgs{
+			ID:      1,
+			Name:    "drone-temp-foo",
+			Confirm: true,
+		})
+		closer()
+		if err != test.err {
+			t.Errorf("Want error %v, got %v", test.err, err)
+		}
+		if got, want := deleted, test.err == nil; got != want {
+			t.Errorf("Want server instance deleted %v, got %v", want, got)
+		}
+	}
+}
+
+func TestDestroy_ConfirmNotFound(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			t.Errorf("Expect server instance not deleted")
+		}
+		w.WriteHeader(404)
+		io.WriteString(w, `{"id":"not_found","message":"The resource you were accessing could not be found."}`)
+	})
+	defer mockServer(mux)()
+
+	err := Destroy(context.Background(), DestroyArgs{ID: 1, Confirm: true})
+	if err != ErrNotFound {
+		t.Errorf("Want ErrNotFound, got %v", err)
+	}
+}
+
+func TestDestroy_NotFound(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		io.WriteString(w, `{"id":"not_found","message":"The resource you were accessing could not be found."}`)
+	})
+	defer mockServer(mux)()
+
+	err := Destroy(context.Background(), DestroyArgs{ID: 1})
+	if err != ErrNotFound {
+		t.Errorf("Want ErrNotFound, got %v", err)
+	}
+}
+
+func TestDestroy_Error(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		io.WriteString(w, `{"id":"server_error","message":"Unexpected server-side error"}`)
+	})
+	defer mockServer(mux)()
+
+	err := Destroy(context.Background(), DestroyArgs{ID: 1})
+	if err == nil || err == ErrNotFound {
+		t.Errorf("Want api error, got %v", err)
+	}
+}
+
+func TestDestroy_Force(t *testing.T) {
+	defer mockActionInterval()()
+
+	var attempts int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		// the server is locked by a resize action that
+		// completes before the third attempt.
+		if attempts < 3 {
+			w.WriteHeader(422)
+			io.WriteString(w, `{"id":"unprocessable_entity","message":"Droplet already has a pending event."}`)
+			return
+		}
+		w.WriteHeader(204)
+	})
+	defer mockServer(mux)()
+
+	err := Destroy(context.Background(), DestroyArgs{ID: 1})
+	if err == nil {
+		t.Errorf("Expect error when server locked and not forced")
+	}
+
+	attempts = 0
+	err = Destroy(context.Background(), DestroyArgs{ID: 1, Force: true})
+	if err != nil {
+		t.Error(err)
+	}
+	if got, want := attempts, 3; got != want {
+		t.Errorf("Want %d delete attempts, got %d", want, got)
+	}
+}
+
+func TestDestroy_ForceTimeout(t *testing.T) {
+	defer mockActionInterval()()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(422)
+		io.WriteString(w, `{"id":"unprocessable_entity","message":"Droplet already has a pending event."}`)
+	})
+	defer mockServer(mux)()
+
+	err := Destroy(context.Background(), DestroyArgs{
+		ID:      1,
+		Force:   true,
+		Timeout: time.Millisecond * 50,
+	})
+	if err == nil {
+		t.Errorf("Expect error when server remains locked")
+	}
+}
+
+func TestRegisterKey_Lookup(t *testing.T) {
+	var created bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/account/keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			created = true
+		}
+		io.WriteString(w, `{"ssh_keys":[{"id":1,"name":"other","fingerprint":"aa:bb"},{"id":2,"name":"drone_runner_key","fingerprint":"cc:dd"}]}`)
+	})
+	defer mockServer(mux)()
+
+	id, err := RegisterKey(context.Background(), RegisterArgs{
+		Fingerprint: "cc:dd",
+		Name:        "drone_runner_key",
+		Lookup:      true,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if got, want := id, 2; got != want {
+		t.Errorf("Want key id %d, got %d", want, got)
+	}
+	if created {
+		t.Errorf("Expect registration skipped when the key exists")
+	}
+}
+
+func TestRegisterKey_LookupNotFound(t *testing.T) {
+	var created bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/account/keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			created = true
+			io.WriteString(w, `{"ssh_key":{"id":3,"fingerprint":"ee:ff"}}`)
+			return
+		}
+		io.WriteString(w, `{"ssh_keys":[{"id":1,"name":"other","fingerprint":"aa:bb"}]}`)
+	})
+	defer mockServer(mux)()
+
+	id, err := RegisterKey(context.Background(), RegisterArgs{
+		Fingerprint: "ee:ff",
+		Name:        "drone_runner_key",
+		Lookup:      true,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if got, want := id, 3; got != want {
+		t.Errorf("Want key id %d, got %d", want, got)
+	}
+	if !created {
+		t.Errorf("Expect key registered when not found")
+	}
+}
+
+func TestRegisterKey_Concurrent(t *testing.T) {
+	var mu sync.Mutex
+	var created int
+	var lookups int
+
+	const runners = 5
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/account/keys", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if created > 0 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			io.WriteString(w, `{"id":"unprocessable_entity","message":"SSH Key is already in use on your account"}`)
+			return
+		}
+		created++
+		io.WriteString(w, `{"ssh_key":{"id":3,"fingerprint":"ee:ff"}}`)
+	})
+	mux.HandleFunc("/v2/account/keys/ee:ff", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups++
+		// simulate every runner checking for the key before
+		// any runner creates the key.
+		if lookups <= runners {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"id":"not_found","message":"The resource you were accessing could not be found."}`)
+			return
+		}
+		io.WriteString(w, `{"ssh_key":{"id":3,"fingerprint":"ee:ff"}}`)
+	})
+	defer mockServer(mux)()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, runners)
+	ids := make(chan int, runners)
+	for i := 0; i < runners; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := RegisterKey(context.Background(), RegisterArgs{
+				Fingerprint: "ee:ff",
+				Name:        "drone_runner_key",
+			})
+			errs <- err
+			ids <- id
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	close(ids)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Expect concurrent registration succeeds, got %s", err)
+		}
+	}
+	for id := range ids {
+		if id != 3 {
+			t.Errorf("Want key id 3, got %d", id)
+		}
+	}
+	if created != 1 {
+		t.Errorf("Want key created once, got %d", created)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/account/keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("page") == "2" {
+			io.WriteString(w, `{"ssh_keys":[{"id":2,"fingerprint":"cc:dd"}],"links":{"pages":{"prev":"https://api.digitalocean.com/v2/account/keys?page=1"}}}`)
+			return
+		}
+		io.WriteString(w, `{"ssh_keys":[{"id":1,"fingerprint":"aa:bb"}],"links":{"pages":{"next":"https://api.digitalocean.com/v2/account/keys?page=2","last":"https://api.digitalocean.com/v2/account/keys?page=2"}}}`)
+	})
+	defer mockServer(mux)()
+
+	keys, err := ListKeys(context.Background(), "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	want := []Key{
+		{ID: 1, Fingerprint: "aa:bb"},
+		{ID: 2, Fingerprint: "cc:dd"},
+	}
+	if diff := cmp.Diff(keys, want); diff != "" {
+		t.Errorf("Unexpected keys")
+		t.Log(diff)
+	}
+}
+
+func TestNewClient_TokenEnv(t *testing.T) {
+	var got string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/account/keys", func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+		io.WriteString(w, `{"ssh_keys":[]}`)
+	})
+	defer mockServer(mux)()
+
+	restore := os.Getenv(tokenEnv)
+	os.Setenv(tokenEnv, "env-token")
+	defer os.Setenv(tokenEnv, restore)
+
+	// the token is read from the environment if the token
+	// is empty.
+	if _, err := ListKeys(context.Background(), ""); err != nil {
+		t.Error(err)
+		return
+	}
+	if want := "Bearer env-token"; got != want {
+		t.Errorf("Want authorization header %q, got %q", want, got)
+	}
+
+	// the token takes precedence over the environment.
+	if _, err := ListKeys(context.Background(), "spec-token"); err != nil {
+		t.Error(err)
+		return
+	}
+	if want := "Bearer spec-token"; got != want {
+		t.Errorf("Want authorization header %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drone/runner-go/logger"
+
+	"github.com/digitalocean/godo"
+)
+
+// now returns the current time. It is declared as a variable
+// so that it can be replaced in unit tests.
+var now = time.Now
+
+// expiryTagPrefix is the prefix of the tag that records the
+// time at which the server instance expires.
+const expiryTagPrefix = "drone-expires:"
+
+// ExpiryTag returns the tag that records the time at which the
+// server instance expires. A server instance with an expiry tag
+// is deleted by the reaper once it expires, regardless of its
+// age, and is not deleted before it expires.
+func ExpiryTag(expires time.Time) string {
+	return expiryTagPrefix + strconv.FormatInt(expires.Unix(), 10)
+}
+
+// helper function returns true if the server instance is
+// deleted by the reaper. A server instance with an expiry tag
+// is judged by the expiry tag, and a parked server instance is
+// evicted once the park ttl elapses, instead of by age.
+func reapable(target Target, olderThan time.Duration) bool {
+	switch {
+	case hasTagPrefix(target.Tags, expiryTagPrefix):
+		return expired(target.Tags)
+	case hasTagPrefix(target.Tags, parkedTag):
+		return false
+	default:
+		return olderThan > 0 && target.Age >= olderThan
+	}
+}
+
+// helper function returns true if the tags include a tag with
+// the prefix.
+func hasTagPrefix(tags []string, prefix string) bool {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function returns true if the tags include an expiry
+// tag, and the expiry time has elapsed.
+func expired(tags []string) bool {
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, expiryTagPrefix) {
+			continue
+		}
+		unix, err := strconv.ParseInt(strings.TrimPrefix(tag, expiryTagPrefix), 10, 64)
+		if err == nil && !now().Before(time.Unix(unix, 0)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReapArgs provides arguments to remove server instances
+// provisioned by the runner that are older than the age. If the
+// age is zero, only expired server instances are removed.
+type ReapArgs struct {
+	OlderThan time.Duration
+	Token     string
+
+	// DryRun logs and returns the server instances that would
+	// be deleted, without deleting the server instances.
+	DryRun bool
+}
+
+// Target represents a server instance targeted for deletion.
+type Target struct {
+	ID   int
+	Name string
+	Tags []string
+	Age  time.Duration
+}
+
+// ReapOlderThan deletes the server instances provisioned by
+// the runner that are older than the age, or that are expired,
+// and returns the targeted server instances. Server instances
+// with an expiry tag, and parked server instances, are not
+// deleted because of their age. In dry-run mode the server
+// instances are not deleted.
+func ReapOlderThan(ctx context.Context, args ReapArgs) ([]Target, error) {
+	client := newClient(ctx, args.Token)
+	opts := &godo.ListOptions{PerPage: 200}
+
+	var targets []Target
+	for {
+		page, res, err := client.Droplets.ListByTag(ctx, runnerTag, opts)
+		if err != nil {
+			logger.FromContext(ctx).
+				WithError(err).
+				Error("cannot list instances")
+			return nil, err
+		}
+		for _, droplet := range page {
+			target := newTarget(droplet)
+			if !reapable(target, args.OlderThan) {
+				continue
+			}
+			targets = append(targets, target)
+		}
+		if res.Links == nil || res.Links.IsLastPage() {
+			break
+		}
+		current, err := res.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opts.Page = current + 1
+	}
+
+	for _, target := range targets {
+		log := logger.FromContext(ctx).
+			WithField("id", target.ID).
+			WithField("name", target.Name).
+			WithField("tags", target.Tags).
+			WithField("age", target.Age)
+		if args.DryRun {
+			log.Info("dry run: instance would be deleted")
+			continue
+		}
+		res, err := client.Droplets.Delete(ctx, target.ID)
+		if res != nil && res.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			log.WithError(err).Error("cannot terminate server")
+			return targets, err
+		}
+		log.Info("instance deleted")
+
+		// the build key is registered with the account, and
+		// is removed with the server instance.
+		if err := deleteBuildKey(ctx, client, target.Name); err != nil {
+			log.WithError(err).Warn("cannot remove build key")
+		}
+	}
+	return targets, nil
+}
+
+// helper function logs the server instance that would be
+// deleted in dry-run mode.
+func dryRun(ctx context.Context, client *godo.Client, id int) error {
+	droplet, res, err := client.Droplets.Get(ctx, id)
+	if res != nil && res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	target := newTarget(*droplet)
+	logger.FromContext(ctx).
+		WithField("id", target.ID).
+		WithField("name", target.Name).
+		WithField("tags", target.Tags).
+		WithField("age", target.Age).
+		Info("dry run: instance would be deleted")
+	return nil
+}
+
+// helper function returns the deletion target for the droplet.
+// The age is zero if the creation time cannot be parsed.
+func newTarget(droplet godo.Droplet) Target {
+	target := Target{
+		ID:   droplet.ID,
+		Name: droplet.Name,
+		Tags: droplet.Tags,
+	}
+	if created, err := time.Parse(time.RFC3339, droplet.Created); err == nil {
+		target.Age = now().Sub(created)
+	}
+	return target
+}
@@ -0,0 +1,224 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReapOlderThan(t *testing.T) {
+	defer mockNow()()
+
+	var deleted []string
+	defer mockServer(mockReapHandler(&deleted))()
+
+	targets, err := ReapOlderThan(context.Background(), ReapArgs{OlderThan: time.Hour})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(targets) != 1 || targets[0].ID != 1 || targets[0].Age != time.Hour*2 {
+		t.Errorf("Unexpected targets %v", targets)
+	}
+	if len(deleted) != 1 || deleted[0] != "/v2/droplets/1" {
+		t.Errorf("Want instance 1 deleted, got %v", deleted)
+	}
+}
+
+func TestReapOlderThan_DryRun(t *testing.T) {
+	defer mockNow()()
+
+	var deleted []string
+	defer mockServer(mockReapHandler(&deleted))()
+
+	targets, err := ReapOlderThan(context.Background(), ReapArgs{OlderThan: time.Hour, DryRun: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(targets) != 1 || targets[0].Name != "drone-temp-old" {
+		t.Errorf("Unexpected targets %v", targets)
+	}
+	if len(targets[0].Tags) != 2 {
+		t.Errorf("Want target tags, got %v", targets[0].Tags)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("Want no delete requests in dry-run mode, got %v", deleted)
+	}
+}
+
+func TestReapOlderThan_Expired(t *testing.T) {
+	defer mockNow()()
+
+	var deleted []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplets":[`+
+			`{"id":1,"name":"drone-temp-expired","tags":["drone","drone-expires:1569931140"],"created_at":"2019-10-01T11:50:00Z"},`+
+			`{"id":2,"name":"drone-temp-new","tags":["drone","drone-expires:1569931260"],"created_at":"2019-10-01T11:50:00Z"}]}`)
+	})
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		deleted = append(deleted, r.URL.Path)
+		w.WriteHeader(204)
+	})
+	mux.HandleFunc("/v2/account/keys", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ssh_keys":[`+
+			`{"id":7,"name":"drone_runner_key"},`+
+			`{"id":8,"name":"drone_build_key_drone-temp-expired"},`+
+			`{"id":9,"name":"drone_build_key_drone-temp-new"}]}`)
+	})
+	mux.HandleFunc("/v2/account/keys/", func(w http.ResponseWriter, r *http.Request) {
+		deleted = append(deleted, r.URL.Path)
+		w.WriteHeader(204)
+	})
+	defer mockServer(mux)()
+
+	// the expired server instance and its build key are
+	// deleted even though the
+	// server instance is not older than the age.
+	targets, err := ReapOlderThan(context.Background(), ReapArgs{OlderThan: time.Hour})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(targets) != 1 || targets[0].ID != 1 {
+		t.Errorf("Unexpected targets %v", targets)
+	}
+	if len(deleted) != 2 || deleted[0] != "/v2/droplets/1" || deleted[1] != "/v2/account/keys/8" {
+		t.Errorf("Want instance 1 and build key 8 deleted, got %v", deleted)
+	}
+}
+
+func TestReapOlderThan_ExpiredOnly(t *testing.T) {
+	defer mockNow()()
+
+	var deleted []string
+	defer mockServer(mockReapHandler(&deleted))()
+
+	// if the age is zero, server instances that are not
+	// expired are not deleted, regardless of the age.
+	targets, err := ReapOlderThan(context.Background(), ReapArgs{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(targets) != 0 || len(deleted) != 0 {
+		t.Errorf("Want no server instances deleted, got %v", targets)
+	}
+}
+
+func TestReapOlderThan_TaggedNotAged(t *testing.T) {
+	defer mockNow()()
+
+	var deleted []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplets":[`+
+			`{"id":1,"name":"drone-temp-setup","tags":["drone","drone-expires:1569934800"],"created_at":"2019-10-01T10:00:00Z"},`+
+			`{"id":2,"name":"drone-temp-parked","tags":["drone","drone-cache:octocat","drone-parked:1569924000"],"created_at":"2019-10-01T10:00:00Z"}]}`)
+	})
+	mux.HandleFunc("/v2/droplets/", func(w http.ResponseWriter, r *http.Request) {
+		deleted = append(deleted, r.URL.Path)
+		w.WriteHeader(204)
+	})
+	defer mockServer(mux)()
+
+	// server instances with an expiry tag that has not elapsed,
+	// and parked server instances, are not deleted even though
+	// they are older than the age.
+	targets, err := ReapOlderThan(context.Background(), ReapArgs{OlderThan: time.Hour})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(targets) != 0 || len(deleted) != 0 {
+		t.Errorf("Want no server instances deleted, got %v", targets)
+	}
+}
+
+func TestExpiryTag(t *testing.T) {
+	defer mockNow()()
+	expires := now().Add(time.Minute)
+	tag := ExpiryTag(expires)
+	if got, want := tag, "drone-expires:1569931260"; got != want {
+		t.Errorf("Want tag %q, got %q", want, got)
+	}
+	if err := validateTag(tag); err != nil {
+		t.Error(err)
+	}
+	if expired([]string{tag}) {
+		t.Errorf("Expect tag not expired")
+	}
+	if !expired([]string{ExpiryTag(now())}) {
+		t.Errorf("Expect tag expired")
+	}
+	if expired([]string{"drone-expires:invalid"}) {
+		t.Errorf("Expect invalid tag ignored")
+	}
+}
+
+func TestDestroy_DryRun(t *testing.T) {
+	var deleted []string
+	defer mockServer(mockReapHandler(&deleted))()
+
+	err := Destroy(context.Background(), DestroyArgs{ID: 1, DryRun: true})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("Want no delete requests in dry-run mode, got %v", deleted)
+	}
+
+	err = Destroy(context.Background(), DestroyArgs{ID: 3, DryRun: true})
+	if err != ErrNotFound {
+		t.Errorf("Want not found error, got %v", err)
+	}
+}
+
+// helper function returns a mock api handler that serves two
+// runner instances, created two hours and ten minutes before
+// the mock time. Delete requests are appended to the slice.
+func mockReapHandler(deleted *[]string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("tag_name") != "drone" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, `{"droplets":[`+
+			`{"id":1,"name":"drone-temp-old","tags":["drone","repo:hello-world"],"created_at":"2019-10-01T10:00:00Z"},`+
+			`{"id":2,"name":"drone-temp-new","tags":["drone"],"created_at":"2019-10-01T11:50:00Z"}]}`)
+	})
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			*deleted = append(*deleted, r.URL.Path)
+			w.WriteHeader(204)
+			return
+		}
+		io.WriteString(w, `{"droplet":{"id":1,"name":"drone-temp-old","tags":["drone"],"created_at":"2019-10-01T10:00:00Z"}}`)
+	}
+	mux.HandleFunc("/v2/droplets/1", handler)
+	mux.HandleFunc("/v2/droplets/2", handler)
+	mux.HandleFunc("/v2/droplets/3", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"id":"not_found","message":"not found"}`)
+	})
+	return mux
+}
+
+// helper function replaces the current time for unit tests.
+// The returned function restores the current time.
+func mockNow() func() {
+	now = func() time.Time {
+		return time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	}
+	return func() {
+		now = time.Now
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/drone/runner-go/logger"
+
+	"github.com/digitalocean/godo"
+)
+
+// the time to wait between polling the digitalocean api for
+// action status updates.
+var actionInterval = time.Second * 10
+
+// ResizeType defines the droplet resize type.
+type ResizeType int
+
+// ResizeType enumeration.
+const (
+	// ResizeCPU resizes the cpu and memory only. The disk is
+	// not modified, which means the resize is reversible.
+	ResizeCPU ResizeType = iota
+
+	// ResizeDisk resizes the cpu, memory and disk. The resize
+	// is permanent because a disk cannot be shrunk.
+	ResizeDisk
+)
+
+// ResizeArgs provides arguments to resize the server instance.
+// The server instance must be powered off before it can be
+// resized.
+type ResizeArgs struct {
+	ID    int
+	Size  string
+	Type  ResizeType
+	Token string
+
+	// Catalog optionally provides the cached instance sizes
+	// used to validate the resize.
+	Catalog *Catalog
+}
+
+// Resize resizes the server instance and blocks until the
+// resize action is complete.
+func Resize(ctx context.Context, args ResizeArgs) error {
+	logger := logger.FromContext(ctx).
+		WithField("id", args.ID).
+		WithField("size", args.Size).
+		WithField("disk", args.Type == ResizeDisk)
+
+	client := newClient(ctx, args.Token)
+	droplet, _, err := client.Droplets.Get(ctx, args.ID)
+	if err != nil {
+		logger.WithError(err).Error("cannot find instance")
+		return err
+	}
+	sizes, err := listSizes(ctx, client, args.Catalog)
+	if err != nil {
+		logger.WithError(err).Error("cannot list instance sizes")
+		return err
+	}
+	err = checkResize(droplet, sizes, args.Size, args.Type)
+	if err != nil {
+		logger.WithError(err).Error("cannot resize instance")
+		return err
+	}
+
+	logger.Debug("instance resize")
+
+	action, _, err := client.DropletActions.Resize(ctx, args.ID, args.Size, args.Type == ResizeDisk)
+	if err != nil {
+		logger.WithError(err).Error("cannot resize instance")
+		return err
+	}
+
+	err = waitForAction(ctx, client, action)
+	if err != nil {
+		logger.WithError(err).Error("cannot resize instance")
+		return err
+	}
+
+	logger.Info("instance resized")
+	return nil
+}
+
+// helper function returns the instance sizes from the catalog,
+// if provided, or from the digitalocean api.
+func listSizes(ctx context.Context, client *godo.Client, catalog *Catalog) ([]godo.Size, error) {
+	if catalog != nil {
+		return catalog.Sizes(ctx)
+	}
+	sizes, _, err := client.Sizes.List(ctx, &godo.ListOptions{PerPage: 200})
+	return sizes, err
+}
+
+// helper function returns an error if the droplet cannot be
+// resized to the named size using the resize type.
+func checkResize(droplet *godo.Droplet, sizes []godo.Size, size string, typ ResizeType) error {
+	var target *godo.Size
+	for i := range sizes {
+		if sizes[i].Slug == size {
+			target = &sizes[i]
+		}
+	}
+	if target == nil {
+		return errors.New("invalid or unknown instance size")
+	}
+	if target.Disk < droplet.Disk {
+		if typ == ResizeDisk {
+			return errors.New("cannot shrink the instance disk")
+		}
+		return errors.New("instance size disk is smaller than the current disk")
+	}
+	return nil
+}
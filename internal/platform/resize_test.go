@@ -0,0 +1,147 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		typ  ResizeType
+		disk bool
+	}{
+		{typ: ResizeCPU, disk: false},
+		{typ: ResizeDisk, disk: true},
+	}
+	for _, test := range tests {
+		testResize(t, test.typ, test.disk)
+	}
+}
+
+// helper function resizes the mock droplet using the resize
+// type, and verifies the resize action request. The mocks are
+// restored before the next test case runs.
+func testResize(t *testing.T, typ ResizeType, disk bool) {
+	var got *godo.ActionRequest
+	handler := mockResizeHandler(func(req *godo.ActionRequest) {
+		got = req
+	})
+	defer mockServer(handler)()
+	defer mockActionInterval()()
+
+	err := Resize(context.Background(), ResizeArgs{
+		ID:   1,
+		Size: "s-2vcpu-2gb",
+		Type: typ,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got == nil {
+		t.Errorf("Expect resize action request")
+		return
+	}
+	if (*got)["type"] != "resize" {
+		t.Errorf("Want resize action, got %v", (*got)["type"])
+	}
+	if (*got)["size"] != "s-2vcpu-2gb" {
+		t.Errorf("Want resize to s-2vcpu-2gb, got %v", (*got)["size"])
+	}
+	if (*got)["disk"] != disk {
+		t.Errorf("Want resize disk %v, got %v", disk, (*got)["disk"])
+	}
+}
+
+func TestResize_Invalid(t *testing.T) {
+	var called bool
+	handler := mockResizeHandler(func(*godo.ActionRequest) {
+		called = true
+	})
+	defer mockServer(handler)()
+
+	err := Resize(context.Background(), ResizeArgs{
+		ID:   1,
+		Size: "s-1vcpu-512mb",
+		Type: ResizeDisk,
+	})
+	if err == nil {
+		t.Errorf("Expect error when the target disk is smaller")
+	}
+	if called {
+		t.Errorf("Expect resize action not requested")
+	}
+}
+
+func TestCheckResize(t *testing.T) {
+	droplet := &godo.Droplet{Disk: 25}
+	sizes := []godo.Size{
+		{Slug: "s-1vcpu-512mb", Disk: 20},
+		{Slug: "s-1vcpu-1gb", Disk: 25},
+		{Slug: "s-2vcpu-2gb", Disk: 60},
+	}
+	tests := []struct {
+		size string
+		typ  ResizeType
+		ok   bool
+	}{
+		{size: "s-2vcpu-2gb", typ: ResizeCPU, ok: true},
+		{size: "s-2vcpu-2gb", typ: ResizeDisk, ok: true},
+		{size: "s-1vcpu-1gb", typ: ResizeCPU, ok: true},
+		{size: "s-1vcpu-512mb", typ: ResizeCPU, ok: false},
+		{size: "s-1vcpu-512mb", typ: ResizeDisk, ok: false},
+		{size: "s-unknown", typ: ResizeCPU, ok: false},
+	}
+	for _, test := range tests {
+		err := checkResize(droplet, sizes, test.size, test.typ)
+		if test.ok && err != nil {
+			t.Errorf("Want resize to %s ok, got error %s", test.size, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("Want resize to %s error", test.size)
+		}
+	}
+}
+
+// helper function returns a mock api handler that serves a
+// droplet, the size catalog and the resize action. The callback
+// function is invoked with the resize action request.
+func mockResizeHandler(fn func(*godo.ActionRequest)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":1,"disk":25,"size_slug":"s-1vcpu-1gb"}}`)
+	})
+	mux.HandleFunc("/v2/sizes", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"sizes":[{"slug":"s-1vcpu-512mb","disk":20},{"slug":"s-1vcpu-1gb","disk":25},{"slug":"s-2vcpu-2gb","disk":60}]}`)
+	})
+	mux.HandleFunc("/v2/droplets/1/actions", func(w http.ResponseWriter, r *http.Request) {
+		req := new(godo.ActionRequest)
+		json.NewDecoder(r.Body).Decode(req)
+		fn(req)
+		io.WriteString(w, `{"action":{"id":2,"status":"in-progress","type":"resize"}}`)
+	})
+	mux.HandleFunc("/v2/actions/2", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"action":{"id":2,"status":"completed","type":"resize"}}`)
+	})
+	return mux
+}
+
+// helper function shortens the action polling interval for
+// unit tests. The returned function restores the interval.
+func mockActionInterval() func() {
+	restore := actionInterval
+	actionInterval = time.Millisecond
+	return func() {
+		actionInterval = restore
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/drone/runner-go/logger"
+
+	"github.com/digitalocean/godo"
+)
+
+// The server instance can be destroyed together with the
+// volumes and volume snapshots associated with the server
+// instance, in a single request, so that resources created by
+// the pipeline do not leak. Only resources that bear the runner
+// tag are destroyed, since resources associated with the server
+// instance may be shared with other services. Droplet snapshots
+// are never destroyed, since the snapshot image may be used by
+// a subsequent pipeline, and reserved ips are never destroyed,
+// since reserved ips cannot be tagged.
+
+type (
+	// associatedResources represents the resources associated
+	// with the server instance.
+	associatedResources struct {
+		Volumes         []associatedResource `json:"volumes,omitempty"`
+		VolumeSnapshots []associatedResource `json:"volume_snapshots,omitempty"`
+	}
+
+	// associatedResource represents a resource associated
+	// with the server instance.
+	associatedResource struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+
+	// selectiveDestroyRequest provides the resources that are
+	// destroyed together with the server instance.
+	selectiveDestroyRequest struct {
+		Volumes         []string `json:"volumes,omitempty"`
+		VolumeSnapshots []string `json:"volume_snapshots,omitempty"`
+	}
+)
+
+// helper function deletes the server instance together with
+// the associated resources that bear the runner tag. If no
+// associated resource bears the runner tag, the server
+// instance is deleted.
+func deleteWithResources(ctx context.Context, client *godo.Client, id int) (*godo.Response, error) {
+	path := fmt.Sprintf("v2/droplets/%d/destroy_with_associated_resources", id)
+	req, err := client.NewRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	associated := new(associatedResources)
+	res, err := client.Do(ctx, req, associated)
+	if err != nil {
+		return res, err
+	}
+
+	selected := new(selectiveDestroyRequest)
+	for _, volume := range associated.Volumes {
+		v, _, err := client.Storage.GetVolume(ctx, volume.ID)
+		if err != nil {
+			return nil, err
+		}
+		if hasTag(v.Tags, runnerTag) {
+			selected.Volumes = append(selected.Volumes, volume.ID)
+		}
+	}
+	for _, snapshot := range associated.VolumeSnapshots {
+		s, _, err := client.Snapshots.Get(ctx, snapshot.ID)
+		if err != nil {
+			return nil, err
+		}
+		if hasTag(s.Tags, runnerTag) {
+			selected.VolumeSnapshots = append(selected.VolumeSnapshots, snapshot.ID)
+		}
+	}
+	if len(selected.Volumes) == 0 && len(selected.VolumeSnapshots) == 0 {
+		return client.Droplets.Delete(ctx, id)
+	}
+
+	logger.FromContext(ctx).
+		WithField("id", id).
+		WithField("volumes", selected.Volumes).
+		WithField("volume_snapshots", selected.VolumeSnapshots).
+		Debug("destroying server with associated resources")
+
+	req, err = client.NewRequest(ctx, http.MethodDelete, path+"/selective", selected)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(ctx, req, nil)
+}
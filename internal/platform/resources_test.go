@@ -0,0 +1,113 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDestroy_Resources(t *testing.T) {
+	var selected *selectiveDestroyRequest
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expect server instance deleted with associated resources")
+		w.WriteHeader(204)
+	})
+	mux.HandleFunc("/v2/droplets/1/destroy_with_associated_resources", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{
+			"volumes":[{"id":"vol-1","name":"cache"},{"id":"vol-2","name":"shared"}],
+			"volume_snapshots":[{"id":"snap-1","name":"cache-snapshot"}],
+			"snapshots":[{"id":"100","name":"golden-image"}],
+			"reserved_ips":[{"id":"1.2.3.4","name":"1.2.3.4"}]
+		}`)
+	})
+	mux.HandleFunc("/v2/droplets/1/destroy_with_associated_resources/selective", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("Want DELETE request, got %s", r.Method)
+		}
+		selected = new(selectiveDestroyRequest)
+		json.NewDecoder(r.Body).Decode(selected)
+		w.WriteHeader(202)
+	})
+	mux.HandleFunc("/v2/volumes/vol-1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"volume":{"id":"vol-1","tags":["drone"]}}`)
+	})
+	mux.HandleFunc("/v2/volumes/vol-2", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"volume":{"id":"vol-2","tags":["production"]}}`)
+	})
+	mux.HandleFunc("/v2/snapshots/snap-1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"snapshot":{"id":"snap-1","tags":["drone"]}}`)
+	})
+	defer mockServer(mux)()
+
+	err := Destroy(context.Background(), DestroyArgs{ID: 1, Resources: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if selected == nil {
+		t.Errorf("Expect server instance deleted with associated resources")
+		return
+	}
+
+	// the shared volume, droplet snapshot and reserved ip
+	// are not destroyed.
+	want := &selectiveDestroyRequest{
+		Volumes:         []string{"vol-1"},
+		VolumeSnapshots: []string{"snap-1"},
+	}
+	if diff := cmp.Diff(selected, want); diff != "" {
+		t.Errorf("Unexpected resources destroyed")
+		t.Log(diff)
+	}
+}
+
+func TestDestroy_ResourcesNotOwned(t *testing.T) {
+	var deleted bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		deleted = r.Method == http.MethodDelete
+		w.WriteHeader(204)
+	})
+	mux.HandleFunc("/v2/droplets/1/destroy_with_associated_resources", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"volumes":[{"id":"vol-2","name":"shared"}]}`)
+	})
+	mux.HandleFunc("/v2/droplets/1/destroy_with_associated_resources/selective", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expect associated resources not destroyed")
+		w.WriteHeader(202)
+	})
+	mux.HandleFunc("/v2/volumes/vol-2", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"volume":{"id":"vol-2","tags":["production"]}}`)
+	})
+	defer mockServer(mux)()
+
+	err := Destroy(context.Background(), DestroyArgs{ID: 1, Resources: true})
+	if err != nil {
+		t.Error(err)
+	}
+	if !deleted {
+		t.Errorf("Expect server instance deleted")
+	}
+}
+
+func TestDestroy_ResourcesNotFound(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1/destroy_with_associated_resources", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		io.WriteString(w, `{"id":"not_found","message":"The resource you were accessing could not be found."}`)
+	})
+	defer mockServer(mux)()
+
+	err := Destroy(context.Background(), DestroyArgs{ID: 1, Resources: true})
+	if err != ErrNotFound {
+		t.Errorf("Want ErrNotFound, got %v", err)
+	}
+}
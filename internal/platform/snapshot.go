@@ -0,0 +1,153 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/drone/runner-go/logger"
+
+	"github.com/digitalocean/godo"
+)
+
+// ErrSnapshotNotFound is returned when the snapshot image
+// cannot be found after the snapshot action is complete.
+var ErrSnapshotNotFound = errors.New("cannot find snapshot image")
+
+// ErrImageRegion is returned when the snapshot image is not
+// available in the region of the server instance.
+var ErrImageRegion = errors.New("snapshot image is not available in the region")
+
+// SnapshotArgs provides arguments to snapshot the server
+// instance. The server instance should be powered off before
+// the snapshot is taken to ensure the disk is consistent.
+type SnapshotArgs struct {
+	ID      int
+	Name    string
+	Regions []string // Additional regions the image is transferred to.
+	Token   string
+}
+
+// Image represents a snapshot image.
+type Image struct {
+	// ID is the image identifier, which can be used as the
+	// image when provisioning a server instance.
+	ID      string
+	Name    string
+	Regions []string
+}
+
+// Snapshot snapshots the server instance and blocks until the
+// snapshot image is available. A snapshot image is only
+// available in the region of the server instance, and is
+// optionally transferred to additional regions.
+func Snapshot(ctx context.Context, args SnapshotArgs) (Image, error) {
+	logger := logger.FromContext(ctx).
+		WithField("id", args.ID).
+		WithField("snapshot", args.Name)
+
+	logger.Debug("instance snapshot")
+
+	client := newClient(ctx, args.Token)
+	action, _, err := client.DropletActions.Snapshot(ctx, args.ID, args.Name)
+	if err != nil {
+		logger.WithError(err).Error("cannot snapshot instance")
+		return Image{}, err
+	}
+	err = waitForAction(ctx, client, action)
+	if err != nil {
+		logger.WithError(err).Error("cannot snapshot instance")
+		return Image{}, err
+	}
+
+	image, err := findSnapshot(ctx, client, args.ID, args.Name)
+	if err != nil {
+		logger.WithError(err).Error("cannot find snapshot image")
+		return Image{}, err
+	}
+
+	for _, region := range args.Regions {
+		if hasRegion(image.Regions, region) {
+			continue
+		}
+		logger.WithField("region", region).
+			Debug("transfer snapshot image")
+
+		action, _, err := client.ImageActions.Transfer(ctx, image.ID, &godo.ActionRequest{
+			"type":   "transfer",
+			"region": region,
+		})
+		if err != nil {
+			logger.WithError(err).Error("cannot transfer snapshot image")
+			return Image{}, err
+		}
+		err = waitForAction(ctx, client, action)
+		if err != nil {
+			logger.WithError(err).Error("cannot transfer snapshot image")
+			return Image{}, err
+		}
+		image.Regions = append(image.Regions, region)
+	}
+
+	logger.WithField("image", image.ID).
+		Info("instance snapshot created")
+
+	return Image{
+		ID:      strconv.Itoa(image.ID),
+		Name:    image.Name,
+		Regions: image.Regions,
+	}, nil
+}
+
+// helper function returns the named snapshot image of the
+// droplet. The snapshot action does not return the image,
+// therefore the droplet snapshots are listed by name.
+func findSnapshot(ctx context.Context, client *godo.Client, id int, name string) (*godo.Image, error) {
+	opts := &godo.ListOptions{PerPage: 200}
+	for {
+		images, res, err := client.Droplets.Snapshots(ctx, id, opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range images {
+			if images[i].Name == name {
+				return &images[i], nil
+			}
+		}
+		if res.Links == nil || res.Links.IsLastPage() {
+			return nil, ErrSnapshotNotFound
+		}
+		page, err := res.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opts.Page = page + 1
+	}
+}
+
+// helper function returns an error if the image is not
+// available in the region.
+func checkImageRegion(ctx context.Context, client *godo.Client, id int, region string) error {
+	image, _, err := client.Images.GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !hasRegion(image.Regions, region) {
+		return ErrImageRegion
+	}
+	return nil
+}
+
+// helper function returns true if the region is in the list.
+func hasRegion(regions []string, region string) bool {
+	for _, r := range regions {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/digitalocean/godo"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSnapshot(t *testing.T) {
+	var transfers []string
+	defer mockServer(mockSnapshotHandler(&transfers))()
+	defer mockActionInterval()()
+
+	image, err := Snapshot(context.Background(), SnapshotArgs{
+		ID:      1,
+		Name:    "drone-snapshot",
+		Regions: []string{"nyc1", "sfo2"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	want := Image{
+		ID:      "3",
+		Name:    "drone-snapshot",
+		Regions: []string{"nyc1", "sfo2"},
+	}
+	if diff := cmp.Diff(image, want); diff != "" {
+		t.Errorf("Unexpected snapshot image")
+		t.Log(diff)
+	}
+	// the snapshot is already available in the region of the
+	// server instance and is only transferred to sfo2.
+	if diff := cmp.Diff(transfers, []string{"sfo2"}); diff != "" {
+		t.Errorf("Unexpected image transfers")
+		t.Log(diff)
+	}
+}
+
+func TestSnapshot_NotFound(t *testing.T) {
+	defer mockServer(mockSnapshotHandler(nil))()
+	defer mockActionInterval()()
+
+	_, err := Snapshot(context.Background(), SnapshotArgs{
+		ID:   1,
+		Name: "drone-unknown",
+	})
+	if err != ErrSnapshotNotFound {
+		t.Errorf("Want snapshot not found error, got %v", err)
+	}
+}
+
+func TestProvision_Snapshot(t *testing.T) {
+	var transfers []string
+	var got struct {
+		Image interface{} `json:"image"`
+	}
+	mux := mockSnapshotHandler(&transfers)
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		io.WriteString(w, `{"droplet":{"id":4}}`)
+	})
+	mux.HandleFunc("/v2/droplets/4", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":4,"networks":{"v4":[{"ip_address":"1.2.3.4","type":"public"}]}}}`)
+	})
+	defer mockServer(mux)()
+	defer mockActionInterval()()
+
+	image, err := Snapshot(context.Background(), SnapshotArgs{
+		ID:      1,
+		Name:    "drone-snapshot",
+		Regions: []string{"sfo2"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = Provision(context.Background(), ProvisionArgs{
+		Image:  image.ID,
+		Name:   "drone-temp-random",
+		Region: "sfo2",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the snapshot image is referenced by id instead of slug.
+	if got.Image != float64(3) {
+		t.Errorf("Want image id 3, got %v", got.Image)
+	}
+}
+
+func TestProvision_SnapshotRegion(t *testing.T) {
+	var called bool
+	mux := mockSnapshotHandler(nil)
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		io.WriteString(w, `{"droplet":{"id":4}}`)
+	})
+	defer mockServer(mux)()
+
+	_, err := Provision(context.Background(), ProvisionArgs{
+		Image:  "3",
+		Name:   "drone-temp-random",
+		Region: "sfo2",
+	})
+	if err != ErrImageRegion {
+		t.Errorf("Want image region error, got %v", err)
+	}
+	if called {
+		t.Errorf("Expect instance not created")
+	}
+}
+
+// helper function returns a mock api handler that serves the
+// snapshot action, the droplet snapshots and the image transfer
+// action. The snapshot image is created in the nyc1 region, and
+// transferred regions are appended to the slice.
+func mockSnapshotHandler(transfers *[]string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1/actions", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"action":{"id":2,"status":"in-progress","type":"snapshot"}}`)
+	})
+	mux.HandleFunc("/v2/actions/2", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"action":{"id":2,"status":"completed","type":"snapshot"}}`)
+	})
+	mux.HandleFunc("/v2/droplets/1/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"snapshots":[{"id":3,"name":"drone-snapshot","regions":["nyc1"]}]}`)
+	})
+	mux.HandleFunc("/v2/images/3/actions", func(w http.ResponseWriter, r *http.Request) {
+		req := new(godo.ActionRequest)
+		json.NewDecoder(r.Body).Decode(req)
+		*transfers = append(*transfers, (*req)["region"].(string))
+		io.WriteString(w, `{"action":{"id":5,"status":"in-progress","type":"transfer"}}`)
+	})
+	mux.HandleFunc("/v2/actions/5", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"action":{"id":5,"status":"completed","type":"transfer"}}`)
+	})
+	mux.HandleFunc("/v2/images/3", func(w http.ResponseWriter, r *http.Request) {
+		regions := `["nyc1"]`
+		if transfers != nil && len(*transfers) > 0 {
+			regions = `["nyc1","sfo2"]`
+		}
+		io.WriteString(w, `{"image":{"id":3,"name":"drone-snapshot","regions":`+regions+`}}`)
+	})
+	return mux
+}
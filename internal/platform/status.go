@@ -0,0 +1,30 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrNotFound is returned when the server instance does not
+// exist in the account.
+var ErrNotFound = errors.New("instance not found")
+
+// Status returns the status of the server instance (new,
+// active, off or archive). If the server instance does not
+// exist, ErrNotFound is returned.
+func Status(ctx context.Context, id int, token string) (string, error) {
+	client := newClient(ctx, token)
+	droplet, res, err := client.Droplets.Get(ctx, id)
+	if res != nil && res.StatusCode == http.StatusNotFound {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return droplet.Status, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":1,"status":"active"}}`)
+	})
+	defer mockServer(mux)()
+
+	status, err := Status(context.Background(), 1, "")
+	if err != nil {
+		t.Error(err)
+	}
+	if got, want := status, "active"; got != want {
+		t.Errorf("Want status %q, got %q", want, got)
+	}
+}
+
+func TestStatus_NotFound(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets/1", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		io.WriteString(w, `{"id":"not_found","message":"The resource you were accessing could not be found."}`)
+	})
+	defer mockServer(mux)()
+
+	_, err := Status(context.Background(), 1, "")
+	if err != ErrNotFound {
+		t.Errorf("Want ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Polyform License
+// that can be found in the LICENSE file.
+
+package platform
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"droplet":{"id":1,"status":"active"}}`)
+	}))
+	defer server.Close()
+
+	restore := endpoint
+	endpoint = server.URL + "/"
+	defer func() {
+		endpoint = restore
+	}()
+
+	// the request fails when the certificate authority of
+	// the server is not trusted.
+	if _, err := Status(context.Background(), 1, ""); err == nil {
+		t.Errorf("Expect error when certificate authority is unknown")
+	}
+
+	bundle := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	})
+	client, err := NewHTTPClient(bundle)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx := WithHTTPClient(context.Background(), client)
+	status, err := Status(ctx, 1, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got, want := status, "active"; got != want {
+		t.Errorf("Want status %q, got %q", want, got)
+	}
+}
+
+func TestNewHTTPClient_Invalid(t *testing.T) {
+	_, err := NewHTTPClient([]byte("not a certificate"))
+	if err != ErrNoCertificates {
+		t.Errorf("Want ErrNoCertificates, got %v", err)
+	}
+}
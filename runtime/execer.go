@@ -191,6 +191,15 @@ func (e *execer) exec(ctx context.Context, state *pipeline.State, spec *engine.S
 		multierror.Append(result, err)
 	}
 
+	// the engine returns the state of a step that is killed
+	// when the context is cancelled, however, the step is
+	// cancelled rather than finished with the exit code.
+	switch err {
+	case context.Canceled, context.DeadlineExceeded:
+		state.Cancel()
+		return nil
+	}
+
 	if exited != nil {
 		state.Finish(step.Name, exited.ExitCode)
 		err := e.reporter.ReportStep(noContext, state, step.Name)
@@ -205,12 +214,6 @@ func (e *execer) exec(ctx context.Context, state *pipeline.State, spec *engine.S
 		return result
 	}
 
-	switch err {
-	case context.Canceled, context.DeadlineExceeded:
-		state.Cancel()
-		return nil
-	}
-
 	// if the step failed with an internal error (as oppsed to a
 	// runtime error) the step is failed.
 	state.Fail(step.Name, err)
@@ -57,6 +57,10 @@ type Runner struct {
 
 	// Secret provides the compiler with secrets.
 	Secret secret.Provider
+
+	// Users provides the compiler with the default ssh user
+	// for server images, keyed by image slug.
+	Users map[string]string
 }
 
 // Run runs the pipeline stage.
@@ -198,6 +202,7 @@ func (s *Runner) Run(ctx context.Context, stage *drone.Stage) error {
 		System:   data.System,
 		Netrc:    data.Netrc,
 		Secret:   secrets,
+		Users:    s.Users,
 	}
 
 	spec := comp.Compile(ctx)